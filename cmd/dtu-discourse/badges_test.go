@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/lightcap/dtu-discourse/internal/store"
+)
+
+// userBadge is a grant as /user-badges lists it.
+type userBadge struct {
+	badgeID, postID int
+}
+
+func badgesOf(t *testing.T, ts *httptest.Server, username string) []userBadge {
+	t.Helper()
+	_, body := apiGet(ts, "/user-badges/"+username+".json")
+	list, _ := parseJSON(t, body)["user_badges"].([]interface{})
+	var out []userBadge
+	for _, item := range list {
+		ub := item.(map[string]interface{})
+		b := userBadge{badgeID: int(ub["badge_id"].(float64))}
+		if id, ok := ub["post_id"].(float64); ok {
+			b.postID = int(id)
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+func badgeIDs(list []userBadge) []int {
+	ids := make([]int, len(list))
+	for i, b := range list {
+		ids[i] = b.badgeID
+	}
+	return ids
+}
+
+func TestBadges_GrantedOnTheirTriggers(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	// The seeded users have the badges for their trust levels; reaching
+	// a new one grants the rest and tells the user.
+	if got := badgeIDs(badgesOf(t, ts, "alice")); !slices.Equal(got, []int{1, 2}) {
+		t.Errorf("expected alice to start with Basic and Member, got %v", got)
+	}
+	apiRequest(ts, "PUT", "/admin/users/3/trust_level", map[string]interface{}{"level": float64(3)})
+	if got := badgeIDs(badgesOf(t, ts, "bob")); !slices.Equal(got, []int{1, 2, 3}) {
+		t.Errorf("expected bob to have Basic, Member and Regular, got %v", got)
+	}
+	var granted []interface{}
+	for _, n := range notificationsFor(t, ts, "bob") {
+		if n["notification_type"] == float64(12) {
+			granted = append(granted, n["data"].(map[string]interface{})["badge_name"])
+		}
+	}
+	if len(granted) != 2 || !slices.Contains(granted, "Member") || !slices.Contains(granted, "Regular") {
+		t.Errorf("expected granted_badge for Member and Regular, got %v", granted)
+	}
+
+	// A like earns the liker First Like and the author Welcome, for the
+	// post liked.
+	apiRequestAs(ts, "POST", "/post_actions.json", "bob", map[string]interface{}{"id": float64(2), "post_action_type_id": float64(2)})
+	if got := badgesOf(t, ts, "bob"); !slices.Contains(got, userBadge{11, 2}) {
+		t.Errorf("expected bob to get First Like for post 2, got %v", got)
+	}
+	if got := badgesOf(t, ts, "alice"); !slices.Contains(got, userBadge{5, 2}) {
+		t.Errorf("expected alice to get Welcome for post 2, got %v", got)
+	}
+
+	// Editor is for editing your own post.
+	apiRequest(ts, "PUT", "/posts/2", map[string]interface{}{"post": map[string]interface{}{"raw": "Edited by staff, which earns nobody Editor."}})
+	if slices.Contains(badgeIDs(badgesOf(t, ts, "alice")), 10) || slices.Contains(badgeIDs(badgesOf(t, ts, "admin")), 10) {
+		t.Error("expected no Editor for someone else's edit")
+	}
+	apiRequestAs(ts, "PUT", "/posts/2", "alice", map[string]interface{}{"post": map[string]interface{}{"raw": "Edited by alice herself this time."}})
+	if got := badgesOf(t, ts, "alice"); !slices.Contains(got, userBadge{10, 2}) {
+		t.Errorf("expected alice to get Editor, got %v", got)
+	}
+
+	// A disabled badge isn't granted, automatically or by hand.
+	apiRequest(ts, "PUT", "/admin/badges/13.json", map[string]interface{}{"enabled": false})
+	flagPost(t, ts, "bob", 1, 4)
+	if slices.Contains(badgeIDs(badgesOf(t, ts, "bob")), 13) {
+		t.Error("expected no First Flag while it is disabled")
+	}
+	if resp, _ := apiRequest(ts, "POST", "/user_badges", map[string]interface{}{"username": "bob", "badge_id": float64(13)}); resp.StatusCode != 422 {
+		t.Errorf("expected granting a disabled badge to be refused, got %d", resp.StatusCode)
+	}
+	apiRequest(ts, "PUT", "/admin/badges/13.json", map[string]interface{}{"enabled": "true"})
+	flagPost(t, ts, "alice", 1, 4)
+	if got := badgesOf(t, ts, "alice"); !slices.Contains(got, userBadge{13, 1}) {
+		t.Errorf("expected alice to get First Flag, got %v", got)
+	}
+
+	// Autobiographer needs both an about me and an uploaded avatar.
+	apiRequestAs(ts, "PUT", "/u/alice", "alice", map[string]interface{}{"bio_raw": "I fell down a rabbit hole."})
+	if slices.Contains(badgeIDs(badgesOf(t, ts, "alice")), 9) {
+		t.Error("expected no Autobiographer without an avatar")
+	}
+	_, body := apiRequestAs(ts, "POST", "/uploads.json", "alice", url.Values{"type": {"avatar"}, "url": {"https://example.com/alice.png"}})
+	uploadID := parseJSON(t, body)["id"].(float64)
+	if resp, _ := apiRequestAs(ts, "PUT", "/u/alice/preferences/avatar/pick", "bob", map[string]interface{}{"type": "uploaded", "upload_id": uploadID}); resp.StatusCode != 403 {
+		t.Errorf("expected bob not to pick alice's avatar, got %d", resp.StatusCode)
+	}
+	if resp, body := apiRequestAs(ts, "PUT", "/u/alice/preferences/avatar/pick", "alice", map[string]interface{}{"type": "uploaded", "upload_id": uploadID}); resp.StatusCode != 200 {
+		t.Fatalf("pick avatar: %d: %s", resp.StatusCode, body)
+	}
+	if !slices.Contains(badgeIDs(badgesOf(t, ts, "alice")), 9) {
+		t.Error("expected alice to get Autobiographer")
+	}
+
+	// Following a share link earns the sharer First Share, unless they
+	// followed it themselves or it was fetched as system.
+	apiGetAs(ts, "/t/welcome-to-discourse/1/2.json?u=alice", "alice")
+	apiGet(ts, "/t/welcome-to-discourse/1/2.json?u=alice")
+	if slices.Contains(badgeIDs(badgesOf(t, ts, "alice")), 12) {
+		t.Error("expected no First Share for following your own link or fetching it as system")
+	}
+	apiGetAs(ts, "/t/welcome-to-discourse/1/2.json?u=alice", "bob")
+	if got := badgesOf(t, ts, "alice"); !slices.Contains(got, userBadge{12, 2}) {
+		t.Errorf("expected alice to get First Share for post 2, got %v", got)
+	}
+
+	// Certified stands for the new user tutorial.
+	if resp, _ := apiRequest(ts, "PUT", "/__dtu/users/bob/complete_tutorial", nil); resp.StatusCode != 200 {
+		t.Fatalf("complete tutorial: %d", resp.StatusCode)
+	}
+	if !slices.Contains(badgeIDs(badgesOf(t, ts, "bob")), 100) {
+		t.Error("expected bob to get Certified")
+	}
+
+	// Badges granted once are only granted once, by hand too.
+	before := len(badgesOf(t, ts, "alice"))
+	if resp, _ := apiRequest(ts, "POST", "/user_badges", map[string]interface{}{"username": "alice", "badge_id": float64(1)}); resp.StatusCode != 200 {
+		t.Errorf("expected granting a held badge to succeed, got %d", resp.StatusCode)
+	}
+	if after := len(badgesOf(t, ts, "alice")); after != before {
+		t.Errorf("expected Basic not to be granted twice, went from %d to %d grants", before, after)
+	}
+}
+
+func TestBadges_LikeCountsAndAnniversary(t *testing.T) {
+	s := store.New()
+	s.RateLimitsDisabled = true
+	s.Users[2].CreatedAt = time.Now().AddDate(-2, 0, 0)
+	ts, _ := serveStore(t, s)
+
+	// Nice Post may be granted again, once for each reply that earns it;
+	// a topic's first post earns Nice Topic instead.
+	resp, body := apiRequestAs(ts, "POST", "/posts", "alice", map[string]interface{}{"topic_id": float64(1), "raw": "A second post worth ten likes."})
+	if resp.StatusCode != 200 {
+		t.Fatalf("reply: %d: %s", resp.StatusCode, body)
+	}
+	second := int(parseJSON(t, body)["id"].(float64))
+	for i := 0; i < 10; i++ {
+		username := fmt.Sprintf("fan%d", i)
+		apiRequest(ts, "POST", "/users", map[string]interface{}{
+			"name": username, "username": username, "email": username + "@example.com", "password": "supersecret123", "active": true,
+		})
+		for _, id := range []int{1, 2, second} {
+			if resp, body := apiRequestAs(ts, "POST", "/post_actions.json", username, map[string]interface{}{"id": float64(id), "post_action_type_id": float64(2)}); resp.StatusCode != 200 {
+				t.Fatalf("like by %s: %d: %s", username, resp.StatusCode, body)
+			}
+		}
+	}
+	got := badgesOf(t, ts, "alice")
+	if !slices.Contains(got, userBadge{6, 2}) || !slices.Contains(got, userBadge{6, second}) {
+		t.Errorf("expected Nice Post for both posts, got %v", got)
+	}
+	if slices.Contains(badgeIDs(got), 7) {
+		t.Errorf("expected no Good Post for ten likes, got %v", got)
+	}
+	if admin := badgesOf(t, ts, "admin"); !slices.Contains(admin, userBadge{18, 1}) || slices.Contains(badgeIDs(admin), 6) {
+		t.Errorf("expected Nice Topic and no Nice Post for the first post, got %v", admin)
+	}
+	welcomes := 0
+	for _, b := range got {
+		if b.badgeID == 5 {
+			welcomes++
+		}
+	}
+	if welcomes != 1 {
+		t.Errorf("expected Welcome once, got %d", welcomes)
+	}
+
+	// Anniversary is for posting after a year, once a year.
+	anniversaries := 0
+	for _, b := range got {
+		if b.badgeID == 24 {
+			anniversaries++
+		}
+	}
+	apiRequestAs(ts, "POST", "/posts", "alice", map[string]interface{}{"topic_id": float64(1), "raw": "And one more post this year."})
+	apiRequestAs(ts, "POST", "/posts", "bob", map[string]interface{}{"topic_id": float64(1), "raw": "Too new for an anniversary."})
+	if n := len(badgesOf(t, ts, "alice")) - len(got); anniversaries != 1 || n != 0 {
+		t.Errorf("expected one Anniversary for alice, got %d and %d more", anniversaries, n)
+	}
+	if slices.Contains(badgeIDs(badgesOf(t, ts, "bob")), 24) {
+		t.Error("expected no Anniversary for bob")
+	}
+}
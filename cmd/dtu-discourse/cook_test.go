@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/lightcap/dtu-discourse/internal/store"
+)
+
+// cookedFor creates a reply in topic 1 and returns its cooked HTML.
+func cookedFor(t *testing.T, ts *httptest.Server, raw string) string {
+	t.Helper()
+	resp, body := apiRequest(ts, "POST", "/posts", map[string]interface{}{
+		"topic_id": float64(1), "raw": raw,
+	})
+	if resp.StatusCode != 200 {
+		t.Fatalf("create post: %d: %s", resp.StatusCode, body)
+	}
+	cooked, _ := parseJSON(t, body)["cooked"].(string)
+	return cooked
+}
+
+func TestCook_Markdown(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+	cases := []struct{ raw, want string }{
+		{"Plain text here.", "<p>Plain text here.</p>"},
+		{"Some **bold** and *italic* text.\nSecond line.",
+			"<p>Some <strong>bold</strong> and <em>italic</em> text.<br>\nSecond line.</p>"},
+		{"## Getting started\n\nRead the docs.",
+			"<h2><a name=\"getting-started-1\" class=\"anchor\" href=\"#getting-started-1\"></a>Getting started</h2>\n<p>Read the docs.</p>"},
+		{"- first item\n- second item", "<ul>\n<li>first item</li>\n<li>second item</li>\n</ul>"},
+		{"```go\nfmt.Println(\"<hi>\")\n```",
+			"<pre><code class=\"lang-go\">fmt.Println(&quot;&lt;hi&gt;&quot;)\n</code></pre>"},
+		{"| Name | Count |\n| --- | ---: |\n| apples | 3 |",
+			"<div class=\"md-table\">\n<table>\n<thead>\n<tr>\n<th>Name</th>\n<th style=\"text-align:right\">Count</th>\n</tr>\n</thead>\n<tbody>\n<tr>\n<td>apples</td>\n<td style=\"text-align:right\">3</td>\n</tr>\n</tbody>\n</table>\n</div>"},
+		{"See [the docs](https://example.com/docs) please.",
+			"<p>See <a href=\"https://example.com/docs\" rel=\"noopener nofollow ugc\">the docs</a> please.</p>"},
+	}
+	for _, tc := range cases {
+		if got := cookedFor(t, ts, tc.raw); got != tc.want {
+			t.Errorf("cook(%q)\n got: %q\nwant: %q", tc.raw, got, tc.want)
+		}
+	}
+}
+
+func TestCook_SanitizesHTML(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+	got := cookedFor(t, ts, `Hello <script>alert("x")</script><b onclick="evil()">there</b> <a href="javascript:alert(1)">click</a>`)
+	want := `<p>Hello <b>there</b> <a>click</a></p>`
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCook_RejectsDisguisedJavascriptURLs(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+	for _, raw := range []string{
+		"<javascript:alert(1)>",
+		"<a href=\"jav\nascript:alert(1)\">click</a>",
+		"<a href=\"jav&#x09;ascript:alert(1)\">click</a>",
+		"<a href=\"jav&Tab;ascript:alert(1)\">click</a>",
+		"<a href=\"\x01javascript:alert(1)\">click</a>",
+		"[click](jav&#x09;ascript:alert(1))",
+		"[click](\x01javascript:alert(1))",
+		"![pic](jav&Tab;ascript:alert(1))",
+	} {
+		got := cookedFor(t, ts, raw)
+		if strings.Contains(got, "href=") || strings.Contains(got, "src=") {
+			t.Errorf("cook(%q) kept the link: %q", raw, got)
+		}
+	}
+	if got, want := cookedFor(t, ts, "<javascript:alert(1)>"), "<p>&lt;javascript:alert(1)&gt;</p>"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := cookedFor(t, ts, "<https://example.com/ok>"); !strings.Contains(got, `href="https://example.com/ok"`) {
+		t.Errorf("expected a safe autolink to stay a link, got %q", got)
+	}
+}
+
+func TestCook_MentionsHashtagsEmoji(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+	got := cookedFor(t, ts, "Thanks @alice and @ghost, see #support and #api :tada:")
+	for _, want := range []string{
+		`<a class="mention" href="/u/alice">@alice</a>`,
+		`<span class="mention">@ghost</span>`,
+		`<a class="hashtag-cooked" href="/c/support/2" data-type="category" data-slug="support" data-id="2">`,
+		`<a class="hashtag-cooked" href="/tag/api" data-type="tag" data-slug="api">`,
+		`<img src="/images/emoji/twitter/tada.png?v=12" title=":tada:" class="emoji" alt=":tada:"`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("cooked missing %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestCook_QuoteUploadAndOnebox(t *testing.T) {
+	s := store.New()
+	ts, _ := serveStore(t, s)
+	s.Outbox.BaseURL = ts.URL
+
+	got := cookedFor(t, ts, "[quote=\"alice, post:2, topic:1\"]\nThanks for the warm welcome!\n[/quote]\n\nYou're welcome.")
+	want := "<aside class=\"quote no-group\" data-username=\"alice\" data-post=\"2\" data-topic=\"1\">"
+	if !strings.HasPrefix(got, want) ||
+		!strings.HasSuffix(got, "<blockquote>\n<p>Thanks for the warm welcome!</p>\n</blockquote>\n</aside>\n<p>You're welcome.</p>") {
+		t.Errorf("unexpected quote cooking:\n%s", got)
+	}
+
+	resp, body := apiRequest(ts, "POST", "/uploads.json", url.Values{
+		"type": {"composer"}, "url": {"https://example.com/diagram.png"},
+	})
+	if resp.StatusCode != 200 {
+		t.Fatalf("upload: %d: %s", resp.StatusCode, body)
+	}
+	upload := parseJSON(t, body)
+	shortURL, _ := upload["short_url"].(string)
+	src, _ := upload["url"].(string)
+	got = cookedFor(t, ts, "![diagram|690x388]("+shortURL+")")
+	if !strings.Contains(got, `<img src="`+src+`" alt="diagram"`) || !strings.Contains(got, `width="690" height="388"`) {
+		t.Errorf("upload not resolved:\n%s", got)
+	}
+
+	got = cookedFor(t, ts, ts.URL+"/t/how-to-use-the-api/2")
+	if !strings.HasPrefix(got, `<aside class="onebox discoursetopic"`) ||
+		!strings.Contains(got, "How to use the API") ||
+		!strings.Contains(got, "Here is a guide on using the Discourse API.") {
+		t.Errorf("expected internal onebox:\n%s", got)
+	}
+
+	// Another forum's topic 2 is not this one's.
+	got = cookedFor(t, ts, "https://forum.example.org/t/how-to-use-the-api/2")
+	if !strings.HasPrefix(got, `<p><a href="https://forum.example.org/t/how-to-use-the-api/2" class="onebox"`) || strings.Contains(got, "How to use the API") {
+		t.Errorf("expected a plain onebox link for another host:\n%s", got)
+	}
+}
+
+func TestCook_UpdateRecooks(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+	resp, body := apiRequest(ts, "PUT", "/posts/1", map[string]interface{}{
+		"post": map[string]interface{}{"raw": "Now with **emphasis**."},
+	})
+	if resp.StatusCode != 200 {
+		t.Fatalf("update: %d: %s", resp.StatusCode, body)
+	}
+	post, _ := parseJSON(t, body)["post"].(map[string]interface{})
+	if post["cooked"] != "<p>Now with <strong>emphasis</strong>.</p>" {
+		t.Errorf("unexpected cooked: %v", post["cooked"])
+	}
+
+	resp, body = apiGet(ts, "/posts/1/cooked")
+	if resp.StatusCode != 200 || !strings.Contains(string(body), "emphasis") {
+		t.Errorf("cooked endpoint not updated: %d %s", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lightcap/dtu-discourse/internal/mailer"
+	"github.com/lightcap/dtu-discourse/internal/store"
+)
+
+// mailTo lists the outbox messages sent to address, oldest first.
+func mailTo(t *testing.T, ts *httptest.Server, address string) []map[string]interface{} {
+	t.Helper()
+	resp, body := apiGet(ts, "/__dtu/mail?to="+url.QueryEscape(address))
+	if resp.StatusCode != 200 {
+		t.Fatalf("mail to %s: %d: %s", address, resp.StatusCode, body)
+	}
+	var list []map[string]interface{}
+	for _, m := range parseJSON(t, body)["messages"].([]interface{}) {
+		list = append(list, m.(map[string]interface{}))
+	}
+	return list
+}
+
+func mailToken(m map[string]interface{}, name string) string {
+	token, _ := m["tokens"].(map[string]interface{})[name].(string)
+	return token
+}
+
+func TestEmail_SignupActivation(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	resp, body := apiRequest(ts, "POST", "/users", map[string]interface{}{
+		"name": "Newbie", "username": "newbie", "email": "newbie@example.com", "password": "correct horse battery",
+	})
+	if resp.StatusCode != 200 {
+		t.Fatalf("create user: %d: %s", resp.StatusCode, body)
+	}
+	if data := parseJSON(t, body); data["active"] != false || !strings.Contains(data["message"].(string), "activation mail") {
+		t.Errorf("expected an inactive account awaiting activation: %s", body)
+	}
+	mail := mailTo(t, ts, "newbie@example.com")
+	if len(mail) != 1 || mail[0]["email_type"] != "signup" {
+		t.Fatalf("expected a signup email: %v", mail)
+	}
+	token := mailToken(mail[0], "activation")
+	if token == "" || !strings.Contains(mail[0]["text"].(string), "/u/activate-account/"+token) {
+		t.Fatalf("expected an activation link: %v", mail[0])
+	}
+	if raw := mail[0]["raw"].(string); !strings.Contains(raw, "To: newbie@example.com") ||
+		!strings.Contains(raw, "Content-Type: multipart/alternative") || !strings.Contains(raw, "Content-Type: text/html") {
+		t.Errorf("unexpected MIME message:\n%s", raw)
+	}
+
+	// The link works without an API key, once.
+	resp, err := http.Get(ts.URL + "/u/activate-account/" + token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("follow activation link: %d", resp.StatusCode)
+	}
+	_, body = apiGet(ts, "/u/newbie.json")
+	if parseJSON(t, body)["user"].(map[string]interface{})["active"] != true {
+		t.Errorf("expected newbie to be active: %s", body)
+	}
+	if resp, _ := apiRequest(ts, "PUT", "/u/activate-account/"+token, nil); resp.StatusCode != 422 {
+		t.Errorf("expected a used token to be refused, got %d", resp.StatusCode)
+	}
+	if resp, _ := apiRequest(ts, "POST", "/u/action/send_activation_email", map[string]interface{}{"username": "newbie"}); resp.StatusCode != 422 {
+		t.Errorf("expected no new link for an active account, got %d", resp.StatusCode)
+	}
+
+	// Accounts created active by an admin get no email.
+	apiRequest(ts, "POST", "/users", map[string]interface{}{
+		"name": "Ready", "username": "ready", "email": "ready@example.com", "password": "correct horse battery", "active": true,
+	})
+	if mail := mailTo(t, ts, "ready@example.com"); len(mail) != 0 {
+		t.Errorf("expected no email for an active account: %v", mail)
+	}
+}
+
+func TestEmail_ForgotPassword(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	resp, body := apiRequest(ts, "POST", "/session/forgot_password", map[string]interface{}{"login": "alice"})
+	if data := parseJSON(t, body); resp.StatusCode != 200 || data["user_found"] != true {
+		t.Fatalf("forgot password: %d: %s", resp.StatusCode, body)
+	}
+	_, body = apiRequest(ts, "POST", "/session/forgot_password", map[string]interface{}{"login": "nobody@example.com"})
+	if parseJSON(t, body)["user_found"] != false {
+		t.Errorf("expected no user for an unknown login: %s", body)
+	}
+	mail := mailTo(t, ts, "alice@example.com")
+	if len(mail) != 1 || mail[0]["email_type"] != "forgot_password" {
+		t.Fatalf("expected a password reset email: %v", mail)
+	}
+	token := mailToken(mail[0], "password_reset")
+
+	if resp, _ := apiRequest(ts, "PUT", "/u/password-reset/"+token, map[string]interface{}{"password": "short"}); resp.StatusCode != 422 {
+		t.Errorf("expected a short password to be refused, got %d", resp.StatusCode)
+	}
+	resp, body = apiRequest(ts, "PUT", "/u/password-reset/"+token, map[string]interface{}{"password": "a much longer password"})
+	if resp.StatusCode != 200 || parseJSON(t, body)["success"] != true {
+		t.Fatalf("reset password: %d: %s", resp.StatusCode, body)
+	}
+	if resp, _ := apiRequest(ts, "PUT", "/u/password-reset/"+token, map[string]interface{}{"password": "a much longer password"}); resp.StatusCode != 422 {
+		t.Errorf("expected a used token to be refused, got %d", resp.StatusCode)
+	}
+}
+
+func TestEmail_Invites(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	resp, body := apiRequest(ts, "POST", "/invites.json", map[string]interface{}{"email": "friend@example.com", "topic_id": 1})
+	if resp.StatusCode != 200 {
+		t.Fatalf("invite: %d: %s", resp.StatusCode, body)
+	}
+	mail := mailTo(t, ts, "friend@example.com")
+	if len(mail) != 1 || mail[0]["email_type"] != "invite" || !strings.Contains(mail[0]["subject"].(string), "Welcome to Discourse") {
+		t.Fatalf("expected a topic invite email: %v", mail)
+	}
+	if mailToken(mail[0], "invite") == "" {
+		t.Errorf("expected an invite link: %v", mail[0]["links"])
+	}
+
+	apiRequest(ts, "POST", "/invites.json", map[string]interface{}{"email": "quiet@example.com", "skip_email": true})
+	if mail := mailTo(t, ts, "quiet@example.com"); len(mail) != 0 {
+		t.Errorf("skip_email should not send: %v", mail)
+	}
+}
+
+func TestEmail_Notifications(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	post := staffReply(t, ts, map[string]interface{}{"topic_id": float64(2), "raw": "@alice could you check this?"})
+	mail := mailTo(t, ts, "alice@example.com")
+	if len(mail) != 1 || mail[0]["email_type"] != "user_mentioned" || mail[0]["post_id"] != post["id"] || mail[0]["reply_key"] == "" {
+		t.Fatalf("expected a mention email: %v", mail)
+	}
+	if raw := mail[0]["raw"].(string); !strings.Contains(raw, "X-Discourse-Post-Id: ") || !strings.Contains(raw, "could you check this?") {
+		t.Errorf("unexpected MIME message:\n%s", raw)
+	}
+
+	resp, body := apiRequest(ts, "POST", "/posts", map[string]interface{}{
+		"title": "A private word about billing", "raw": "Let's talk about the invoices.",
+		"archetype": "private_message", "target_recipients": "bob",
+	})
+	if resp.StatusCode != 200 {
+		t.Fatalf("create message: %d: %s", resp.StatusCode, body)
+	}
+	mail = mailTo(t, ts, "bob@example.com")
+	if len(mail) != 1 || mail[0]["email_type"] != "user_private_message" || !strings.Contains(mail[0]["subject"].(string), "[PM] A private word about billing") {
+		t.Fatalf("expected a private message email: %v", mail)
+	}
+
+	_, body = apiGet(ts, "/admin/email/sent.json?type=user_mentioned")
+	if !strings.Contains(string(body), `"post_url":"/t/`) || strings.Contains(string(body), "user_private_message") {
+		t.Errorf("expected only the mention in the filtered sent list: %s", body)
+	}
+}
+
+func TestEmail_TestEmailAndSkipped(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	_, body := apiRequest(ts, "POST", "/admin/email/test", map[string]interface{}{"email_address": "ops@example.com"})
+	if parseJSON(t, body)["sent_test_email_message"] != "sent" {
+		t.Fatalf("expected the test email to be sent: %s", body)
+	}
+	apiRequest(ts, "PUT", "/admin/site_settings/disable_emails", map[string]interface{}{"disable_emails": "yes"})
+	apiRequest(ts, "POST", "/admin/email/test", map[string]interface{}{"email_address": "ops@example.com"})
+
+	_, body = apiGet(ts, "/admin/email/sent.json")
+	if strings.Count(string(body), `"email_type":"test_message"`) != 1 {
+		t.Errorf("expected one sent test email: %s", body)
+	}
+	_, body = apiGet(ts, "/admin/email/skipped.json")
+	if !strings.Contains(string(body), `"skipped_reason":"Outgoing email is disabled`) {
+		t.Errorf("expected the second test email to be skipped: %s", body)
+	}
+	for _, path := range []string{"/admin/email/sent.json?offset=-1", "/admin/email/skipped.json?offset=-1"} {
+		if resp, body := apiGet(ts, path); resp.StatusCode != 200 || !strings.Contains(string(body), "test_message") {
+			t.Errorf("expected a negative offset to give the first page of %s, got %d: %s", path, resp.StatusCode, body)
+		}
+	}
+
+	if resp, _ := apiRequest(ts, "DELETE", "/__dtu/mail", nil); resp.StatusCode != 200 {
+		t.Fatalf("clear outbox: %d", resp.StatusCode)
+	}
+	if mail := mailTo(t, ts, "ops@example.com"); len(mail) != 0 {
+		t.Errorf("expected an empty outbox: %v", mail)
+	}
+}
+
+func TestEmail_DigestAndTemplates(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	resp, body := apiGet(ts, "/admin/email/preview-digest.json?username=bob&last_seen_at=2000-01-01")
+	if resp.StatusCode != 200 || !strings.Contains(parseJSON(t, body)["html_content"].(string), "Welcome to Discourse") {
+		t.Fatalf("preview digest: %d: %s", resp.StatusCode, body)
+	}
+	apiRequest(ts, "POST", "/admin/email/send-digest.json", map[string]interface{}{
+		"username": "bob", "email": "digest@example.com", "last_seen_at": "2000-01-01",
+	})
+	if mail := mailTo(t, ts, "digest@example.com"); len(mail) != 1 || mail[0]["email_type"] != "digest" {
+		t.Errorf("expected a digest email: %v", mail)
+	}
+
+	resp, body = apiRequest(ts, "PUT", "/admin/customize/email_templates/test_mailer", map[string]interface{}{
+		"email_template": map[string]interface{}{"subject": "Hello from %{site_name}"},
+	})
+	if resp.StatusCode != 200 || parseJSON(t, body)["email_template"].(map[string]interface{})["can_revert"] != true {
+		t.Fatalf("override template: %d: %s", resp.StatusCode, body)
+	}
+	apiRequest(ts, "POST", "/admin/email/test", map[string]interface{}{"email_address": "ops@example.com"})
+	if mail := mailTo(t, ts, "ops@example.com"); len(mail) != 1 || !strings.HasPrefix(mail[0]["subject"].(string), "Hello from ") {
+		t.Errorf("expected the overridden subject: %v", mail)
+	}
+	_, body = apiRequest(ts, "DELETE", "/admin/customize/email_templates/test_mailer", nil)
+	if tmpl := parseJSON(t, body)["email_template"].(map[string]interface{}); tmpl["can_revert"] != false || !strings.Contains(tmpl["subject"].(string), "Deliverability") {
+		t.Errorf("expected the default template back: %v", tmpl)
+	}
+}
+
+// smtpSink is a minimal SMTP server that refuses recipients containing
+// "bounce" and passes every accepted message's data to received.
+func smtpSink(t *testing.T) (addr string, received chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	received = make(chan string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				tp := textproto.NewConn(conn)
+				tp.PrintfLine("220 sink ready")
+				for {
+					line, err := tp.ReadLine()
+					if err != nil {
+						return
+					}
+					switch cmd := strings.ToUpper(line); {
+					case strings.HasPrefix(cmd, "RCPT") && strings.Contains(cmd, "BOUNCE"):
+						tp.PrintfLine("550 5.1.1 mailbox unavailable")
+					case strings.HasPrefix(cmd, "DATA"):
+						tp.PrintfLine("354 go ahead")
+						data, _ := tp.ReadDotBytes()
+						tp.PrintfLine("250 queued")
+						received <- string(data)
+					case strings.HasPrefix(cmd, "QUIT"):
+						tp.PrintfLine("221 bye")
+						return
+					default:
+						tp.PrintfLine("250 ok")
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), received
+}
+
+func TestEmail_SMTPDelivery(t *testing.T) {
+	addr, received := smtpSink(t)
+	s := store.New()
+	s.Outbox.DeliverVia(mailer.SMTPSender{Addr: addr})
+	ts, _ := serveStore(t, s)
+
+	_, body := apiGet(ts, "/admin/email/server-settings")
+	settings := parseJSON(t, body)
+	if settings["delivery_method"] != "smtp" || settings["settings"].(map[string]interface{})["address"] != "127.0.0.1" {
+		t.Errorf("expected the SMTP server in the settings: %s", body)
+	}
+
+	apiRequest(ts, "POST", "/admin/email/test", map[string]interface{}{"email_address": "ops@example.com"})
+	select {
+	case data := <-received:
+		if !strings.Contains(data, "To: ops@example.com") || !strings.Contains(data, "Email Deliverability Test") {
+			t.Errorf("unexpected message delivered:\n%s", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the test email was not delivered")
+	}
+
+	apiRequest(ts, "POST", "/admin/email/test", map[string]interface{}{"email_address": "bounce@example.com"})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, body = apiGet(ts, "/admin/email/bounced.json")
+		if strings.Contains(string(body), "bounce@example.com") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the refused email to bounce: %s", body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, body = apiGet(ts, "/admin/email/skipped.json")
+	if !strings.Contains(string(body), `"skipped_reason":"The email bounced: 550 5.1.1 mailbox unavailable"`) {
+		t.Errorf("expected the bounce among the skipped emails: %s", body)
+	}
+	_, body = apiGet(ts, "/admin/email/sent.json")
+	if strings.Contains(string(body), "bounce@example.com") || !strings.Contains(string(body), "ops@example.com") {
+		t.Errorf("expected only the delivered email in the sent list: %s", body)
+	}
+}
+
+func TestEmail_SMTPFailure(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	s := store.New()
+	s.Outbox.DeliverVia(mailer.SMTPSender{Addr: addr})
+	ts, _ := serveStore(t, s)
+
+	apiRequest(ts, "POST", "/admin/email/test", map[string]interface{}{"email_address": "ops@example.com"})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mail := mailTo(t, ts, "ops@example.com")
+		if reason, _ := mail[0]["skipped_reason"].(string); strings.HasPrefix(reason, "Delivering the email failed: ") {
+			if mail[0]["bounced"] != false {
+				t.Errorf("a failed connection is not a bounce: %v", mail[0])
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the delivery failure to be recorded: %v", mail)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -763,7 +763,8 @@ func TestExtended_Misc_PresenceUpdate(t *testing.T) {
 	ts := testServer(t)
 	defer ts.Close()
 	resp, _ := apiRequest(ts, "POST", "/presence/update", map[string]interface{}{
-		"present": true,
+		"client_id":        "abc",
+		"present_channels": []string{"/discourse-presence/reply/1"},
 	})
 	if resp.StatusCode != 200 {
 		t.Fatalf("expected 200, got %d", resp.StatusCode)
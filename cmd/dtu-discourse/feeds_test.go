@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type testRSS struct {
+	Version string `xml:"version,attr"`
+	Channel struct {
+		Title string `xml:"title"`
+		Link  string `xml:"link"`
+		Items []struct {
+			Title       string `xml:"title"`
+			Creator     string `xml:"creator"`
+			Category    string `xml:"category"`
+			Description string `xml:"description"`
+			Link        string `xml:"link"`
+			PubDate     string `xml:"pubDate"`
+			TopicPinned string `xml:"topicPinned"`
+			GUID        string `xml:"guid"`
+		} `xml:"item"`
+	} `xml:"channel"`
+}
+
+// rssGet fetches a feed without credentials, the way feed readers do.
+func rssGet(t *testing.T, path string) (*http.Response, testRSS) {
+	t.Helper()
+	ts := testServer(t)
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	var feed testRSS
+	if resp.StatusCode == 200 {
+		if err := xml.Unmarshal(body, &feed); err != nil {
+			t.Fatalf("invalid RSS: %v\n%s", err, body)
+		}
+		if !strings.Contains(string(body), `xmlns:discourse="http://www.discourse.org/"`) {
+			t.Errorf("missing discourse namespace: %s", body)
+		}
+	}
+	return resp, feed
+}
+
+func TestFeeds_Latest(t *testing.T) {
+	resp, feed := rssGet(t, "/latest.rss")
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/rss+xml") {
+		t.Errorf("expected rss content type, got %q", ct)
+	}
+	if feed.Version != "2.0" {
+		t.Errorf("expected version 2.0, got %q", feed.Version)
+	}
+	if len(feed.Channel.Items) != 3 {
+		t.Fatalf("expected 3 items, got %d", len(feed.Channel.Items))
+	}
+	first := feed.Channel.Items[0]
+	if first.Title != "Need help with plugins" {
+		t.Errorf("expected most recently bumped topic first, got %q", first.Title)
+	}
+	if first.Creator != "@bob" || first.Category != "Support" || first.TopicPinned != "No" {
+		t.Errorf("unexpected item fields: %+v", first)
+	}
+	if !strings.HasSuffix(first.Link, "/t/need-help-with-plugins/3") {
+		t.Errorf("unexpected link %q", first.Link)
+	}
+	if !strings.Contains(first.Description, "install a plugin") {
+		t.Errorf("expected cooked body in description, got %q", first.Description)
+	}
+}
+
+func TestFeeds_Category(t *testing.T) {
+	resp, feed := rssGet(t, "/c/general/1.rss")
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if len(feed.Channel.Items) != 2 {
+		t.Errorf("expected 2 items, got %d", len(feed.Channel.Items))
+	}
+	resp, _ = rssGet(t, "/c/nope/999.rss")
+	if resp.StatusCode != 404 {
+		t.Errorf("expected 404 for unknown category, got %d", resp.StatusCode)
+	}
+}
+
+func TestFeeds_Tag(t *testing.T) {
+	resp, feed := rssGet(t, "/tag/api.rss")
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if len(feed.Channel.Items) != 1 || feed.Channel.Items[0].Title != "How to use the API" {
+		t.Errorf("unexpected items: %+v", feed.Channel.Items)
+	}
+}
+
+func TestFeeds_Topic(t *testing.T) {
+	resp, feed := rssGet(t, "/t/welcome-to-discourse/1.rss")
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if len(feed.Channel.Items) != 2 {
+		t.Fatalf("expected 2 posts, got %d", len(feed.Channel.Items))
+	}
+	if !strings.HasSuffix(feed.Channel.Items[0].Link, "/t/welcome-to-discourse/1/2") {
+		t.Errorf("expected newest post first, got %q", feed.Channel.Items[0].Link)
+	}
+}
+
+func TestFeeds_PostsAndUserActivity(t *testing.T) {
+	resp, feed := rssGet(t, "/posts.rss")
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if len(feed.Channel.Items) != 4 {
+		t.Errorf("expected 4 posts, got %d", len(feed.Channel.Items))
+	}
+
+	resp, feed = rssGet(t, "/u/admin/activity.rss")
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if len(feed.Channel.Items) != 2 {
+		t.Errorf("expected 2 posts by admin, got %d", len(feed.Channel.Items))
+	}
+	for _, item := range feed.Channel.Items {
+		if item.Creator != "@admin" {
+			t.Errorf("unexpected creator %q", item.Creator)
+		}
+	}
+}
+
+func TestFeeds_ExcludePrivateMessages(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+	resp, body := apiRequest(ts, "POST", "/posts", map[string]interface{}{
+		"title": "Secret conversation", "raw": "This is between us.",
+		"archetype": "private_message", "target_usernames": "alice",
+	})
+	if resp.StatusCode != 200 {
+		t.Fatalf("create pm: %d: %s", resp.StatusCode, body)
+	}
+	topicID := parseJSON(t, body)["topic_id"].(float64)
+
+	for _, path := range []string{"/latest.rss", "/posts.rss"} {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if strings.Contains(string(b), "Secret conversation") {
+			t.Errorf("%s leaked a private message", path)
+		}
+	}
+	resp, err := http.Get(ts.URL + "/t/" + strconv.Itoa(int(topicID)) + ".rss")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 404 {
+		t.Errorf("expected 404 for private message feed, got %d", resp.StatusCode)
+	}
+}
+
+func TestFeeds_ExcludeReadRestrictedCategories(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+	apiRequest(ts, "PUT", "/categories/2", map[string]interface{}{
+		"permissions": map[string]interface{}{"staff": float64(1)},
+	})
+
+	for _, path := range []string{"/latest.rss", "/posts.rss", "/tag/plugins.rss", "/u/bob/activity.rss"} {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if strings.Contains(string(b), "Need help with plugins") {
+			t.Errorf("%s leaked a read-restricted topic", path)
+		}
+	}
+	for _, path := range []string{"/c/support/2.rss", "/t/need-help-with-plugins/3.rss"} {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 404 {
+			t.Errorf("expected 404 for %s, got %d", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestFeeds_SkipHiddenFirstPost(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+	apiRequest(ts, "PUT", "/admin/site_settings/score_to_hide_post", map[string]interface{}{
+		"score_to_hide_post": float64(1),
+	})
+	flagPost(t, ts, "alice", 1, 4)
+
+	resp, err := http.Get(ts.URL + "/latest.rss")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if strings.Contains(string(b), "This is your first topic") {
+		t.Errorf("latest.rss showed a hidden first post: %s", b)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func flagPost(t *testing.T, ts *httptest.Server, username string, postID, flagType int) {
+	t.Helper()
+	resp, body := apiRequestAs(ts, "POST", "/post_actions.json", username, map[string]interface{}{
+		"id": float64(postID), "post_action_type_id": float64(flagType), "message": "please take a look",
+	})
+	if resp.StatusCode != 200 {
+		t.Fatalf("flag by %s: %d: %s", username, resp.StatusCode, body)
+	}
+}
+
+func pendingReviewable(t *testing.T, ts *httptest.Server) map[string]interface{} {
+	t.Helper()
+	_, body := apiGet(ts, "/review.json")
+	list, _ := parseJSON(t, body)["reviewables"].([]interface{})
+	if len(list) != 1 {
+		t.Fatalf("expected one pending reviewable: %s", body)
+	}
+	return list[0].(map[string]interface{})
+}
+
+func postHidden(t *testing.T, ts *httptest.Server, id int) bool {
+	t.Helper()
+	_, body := apiGet(ts, "/posts/"+strconv.Itoa(id)+".json")
+	return parseJSON(t, body)["hidden"] == true
+}
+
+func TestFlags_AggregateAndAutoHide(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+	apiRequest(ts, "PUT", "/admin/site_settings/score_to_hide_post", map[string]interface{}{
+		"score_to_hide_post": float64(3),
+	})
+
+	flagPost(t, ts, "alice", 3, 8)
+	rv := pendingReviewable(t, ts)
+	if rv["type"] != "ReviewableFlaggedPost" || rv["target_id"] != float64(3) || rv["score"] != float64(2) {
+		t.Errorf("unexpected reviewable: %v", rv)
+	}
+	if postHidden(t, ts, 3) {
+		t.Fatal("post hidden before reaching the threshold")
+	}
+
+	resp, _ := apiRequestAs(ts, "POST", "/post_actions.json", "alice", map[string]interface{}{
+		"id": float64(3), "post_action_type_id": float64(4),
+	})
+	if resp.StatusCode != 403 {
+		t.Errorf("expected 403 for a second flag by the same user, got %d", resp.StatusCode)
+	}
+	resp, _ = apiRequestAs(ts, "POST", "/post_actions.json", "bob", map[string]interface{}{
+		"id": float64(4), "post_action_type_id": float64(3),
+	})
+	if resp.StatusCode != 403 {
+		t.Errorf("expected 403 when flagging your own post, got %d", resp.StatusCode)
+	}
+
+	flagPost(t, ts, "bob", 3, 3)
+	rv = pendingReviewable(t, ts)
+	scores, _ := rv["reviewable_scores"].([]interface{})
+	if len(scores) != 2 || rv["score"] != float64(3.5) {
+		t.Errorf("flags not aggregated: %v", rv)
+	}
+	if !postHidden(t, ts, 3) {
+		t.Error("post not hidden after reaching the threshold")
+	}
+	_, body := apiGet(ts, "/t/2.json")
+	if parseJSON(t, body)["visible"] != false {
+		t.Error("hiding the first post should hide the topic")
+	}
+}
+
+func TestFlags_PerformActions(t *testing.T) {
+	cases := []struct {
+		action     string
+		hidden     bool
+		transition string
+	}{
+		{"agree_and_keep", false, "approved"},
+		{"agree_and_hide", true, "approved"},
+		{"disagree", false, "rejected"},
+		{"ignore", true, "ignored"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.action, func(t *testing.T) {
+			ts := testServer(t)
+			defer ts.Close()
+			apiRequest(ts, "PUT", "/admin/site_settings/score_to_hide_post", map[string]interface{}{
+				"score_to_hide_post": float64(1),
+			})
+			flagPost(t, ts, "alice", 4, 4)
+			if !postHidden(t, ts, 4) {
+				t.Fatal("expected the flag to hide the post")
+			}
+			id := strconv.Itoa(int(pendingReviewable(t, ts)["id"].(float64)))
+
+			resp, body := apiRequest(ts, "PUT", "/review/"+id+"/perform/"+tc.action, nil)
+			if resp.StatusCode != 200 {
+				t.Fatalf("perform: %d: %s", resp.StatusCode, body)
+			}
+			result, _ := parseJSON(t, body)["reviewable_perform_result"].(map[string]interface{})
+			if result["transition_to"] != tc.transition || result["reviewable_count"] != float64(0) {
+				t.Errorf("unexpected result: %v", result)
+			}
+			if got := postHidden(t, ts, 4); got != tc.hidden {
+				t.Errorf("hidden = %v, want %v", got, tc.hidden)
+			}
+
+			_, body = apiGet(ts, "/review/"+id+".json")
+			rv, _ := parseJSON(t, body)["reviewable"].(map[string]interface{})
+			score := rv["reviewable_scores"].([]interface{})[0].(map[string]interface{})
+			if score["status"] == float64(0) || score["reviewed_by_id"] != float64(1) {
+				t.Errorf("flagger's score not resolved: %v", score)
+			}
+
+			if resp, _ := apiRequest(ts, "PUT", "/review/"+id+"/perform/"+tc.action, nil); resp.StatusCode != 403 {
+				t.Errorf("expected 403 performing on a resolved reviewable, got %d", resp.StatusCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lightcap/dtu-discourse/internal/middleware"
+	"github.com/lightcap/dtu-discourse/internal/store"
+	"github.com/lightcap/dtu-discourse/internal/webhook"
+)
+
+// gamificationReceiver records the payloads posted to it, answering each
+// request with the next of statuses and 200 once they run out.
+type gamificationReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	received []webhook.GamificationPayload
+	secrets  []string
+}
+
+func newGamificationReceiver(t *testing.T, statuses ...int) *gamificationReceiver {
+	t.Helper()
+	rec := &gamificationReceiver{statuses: statuses}
+	rec.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p webhook.GamificationPayload
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &p)
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		rec.received = append(rec.received, p)
+		rec.secrets = append(rec.secrets, r.Header.Get("x-webhook-secret"))
+		if len(rec.statuses) > 0 {
+			w.WriteHeader(rec.statuses[0])
+			rec.statuses = rec.statuses[1:]
+		}
+	}))
+	t.Cleanup(rec.Close)
+	return rec
+}
+
+func (rec *gamificationReceiver) actions() []string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	var out []string
+	for _, p := range rec.received {
+		out = append(out, p.Action)
+	}
+	return out
+}
+
+// expect fails t unless every one of actions has been received.
+func (rec *gamificationReceiver) expect(t *testing.T, actions ...string) {
+	t.Helper()
+	got := rec.actions()
+	for _, action := range actions {
+		if !slices.Contains(got, action) {
+			t.Errorf("expected a %s event, got %v", action, got)
+		}
+	}
+}
+
+// syncServer starts a DTU sending gamification events to d that delivers
+// webhooks before it responds, so tests can check them straight away.
+func syncServer(t *testing.T, d *webhook.Dispatcher) *httptest.Server {
+	t.Helper()
+	s := store.New()
+	s.WebhooksSync = true
+	ts := httptest.NewServer(middleware.SyncWebhooks(s)(middleware.RateLimit(s)(middleware.Auth(s)(BuildRouter(s, d)))))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestGamification_RetriesInOrderToEveryURL(t *testing.T) {
+	flaky := newGamificationReceiver(t, 503, 503)
+	steady := newGamificationReceiver(t)
+	d := webhook.New(flaky.URL+", "+steady.URL, "eve-secret")
+	d.SetRetryPolicy(5, 5*time.Millisecond)
+	ts := syncServer(t, d)
+
+	resp, body := apiRequestAs(ts, "POST", "/posts", "alice", map[string]interface{}{
+		"title": "Points for this topic please", "raw": "Eve should hear about this topic.", "category": float64(1),
+	})
+	if resp.StatusCode != 200 {
+		t.Fatalf("create topic: %d: %s", resp.StatusCode, body)
+	}
+	topicID := parseJSON(t, body)["topic_id"].(float64)
+	apiRequestAs(ts, "POST", "/posts", "alice", map[string]interface{}{"topic_id": topicID, "raw": "And about this reply to it."})
+
+	// The flaky receiver fails alice's first event twice; the rest wait
+	// their turn.
+	want := []string{"daily_visit", "daily_visit", "daily_visit", "topic_created", "post_created"}
+	if got := flaky.actions(); !slices.Equal(got, want) {
+		t.Errorf("expected %v at the flaky receiver, got %v", want, got)
+	}
+	if got := steady.actions(); !slices.Equal(got, want[2:]) {
+		t.Errorf("expected each payload once at the steady receiver, got %v", got)
+	}
+	for _, secret := range append(flaky.secrets, steady.secrets...) {
+		if secret != "eve-secret" {
+			t.Errorf("expected every request to carry the secret, got %q", secret)
+		}
+	}
+	if dead := d.DeadLetters(); len(dead) != 0 {
+		t.Errorf("expected nothing dead-lettered, got %v", dead)
+	}
+}
+
+func TestGamification_DeadLettersAndShutdown(t *testing.T) {
+	rejecting := newGamificationReceiver(t, 400)
+	down := newGamificationReceiver(t)
+	down.Close()
+	d := webhook.New(rejecting.URL+","+down.URL, "")
+	d.SetRetryPolicy(3, time.Hour)
+	s := store.New()
+	ts := httptest.NewServer(middleware.RateLimit(s)(middleware.Auth(s)(BuildRouter(s, d))))
+	defer ts.Close()
+
+	apiRequestAs(ts, "POST", "/posts", "bob", map[string]interface{}{"topic_id": float64(1), "raw": "Nobody gets points for this reply."})
+	deadline := time.Now().Add(5 * time.Second)
+	for len(d.DeadLetters()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// A 400 is not retried. Closing skips the hour-long backoff but still
+	// gives the unreachable receiver its remaining tries.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := d.Close(ctx); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	// bob's visit, his reply and admin's reply_received each went to
+	// both receivers; the rejecting one refused whichever came first.
+	dead := d.DeadLetters()
+	perURL := map[string]int{}
+	for _, dl := range dead {
+		perURL[dl.URL]++
+		switch dl.URL {
+		case rejecting.URL:
+			if dl.Attempts != 1 {
+				t.Errorf("expected the rejected payload to be tried once: %+v", dl)
+			}
+		case down.URL:
+			if dl.Attempts != 3 {
+				t.Errorf("expected the unreachable receiver to be tried three times: %+v", dl)
+			}
+		}
+	}
+	if perURL[rejecting.URL] != 1 || perURL[down.URL] != 3 {
+		t.Fatalf("expected one dead letter for the rejecting receiver and three for the unreachable one, got %v", dead)
+	}
+	delivered := len(rejecting.actions())
+
+	// Once closed, payloads are no longer taken.
+	apiRequestAs(ts, "POST", "/posts", "bob", map[string]interface{}{"topic_id": float64(1), "raw": "Sent after the dispatcher shut down."})
+	if got := rejecting.actions(); len(got) != delivered {
+		t.Errorf("expected nothing after shutdown, got %v", got)
+	}
+}
+
+func TestGamification_EventsCarryStableIDsAndReversals(t *testing.T) {
+	rec := newGamificationReceiver(t)
+	d := webhook.New(rec.URL, "")
+	ts := syncServer(t, d)
+
+	// alice answers bob's question; bob likes and accepts the answer, then
+	// changes his mind about both.
+	resp, body := apiRequestAs(ts, "POST", "/posts", "alice", map[string]interface{}{"topic_id": float64(3), "raw": "Try turning it off and on again."})
+	if resp.StatusCode != 200 {
+		t.Fatalf("reply: %d: %s", resp.StatusCode, body)
+	}
+	replyID := int(parseJSON(t, body)["id"].(float64))
+	reply := fmt.Sprint(replyID)
+	apiRequestAs(ts, "POST", "/post_actions", "bob", map[string]interface{}{"id": float64(replyID), "post_action_type_id": float64(2)})
+	apiRequestAs(ts, "DELETE", "/post_actions/"+reply+"?post_action_type_id=2", "bob", nil)
+	apiRequestAs(ts, "POST", "/solution/accept", "bob", map[string]interface{}{"id": float64(replyID)})
+	apiRequestAs(ts, "POST", "/solution/unaccept", "bob", map[string]interface{}{"id": float64(replyID)})
+	apiRequest(ts, "PUT", "/posts/"+reply, map[string]interface{}{"post": map[string]interface{}{"raw": "Try turning it off and on again, slowly."}})
+	apiRequest(ts, "POST", "/user_badges", map[string]interface{}{"username": "alice", "badge_id": float64(3)})
+
+	resp, body = apiRequestAs(ts, "POST", "/bookmarks", "bob", map[string]interface{}{"bookmarkable_id": float64(replyID)})
+	if resp.StatusCode != 200 {
+		t.Fatalf("bookmark: %d: %s", resp.StatusCode, body)
+	}
+	bookmarkID := parseJSON(t, body)["id"].(float64)
+	apiRequestAs(ts, "DELETE", fmt.Sprintf("/bookmarks/%v", bookmarkID), "bob", nil)
+	apiRequestAs(ts, "PUT", "/polls/vote", "alice", map[string]interface{}{"post_id": float64(1), "poll_name": "poll", "options": []string{"a"}})
+	apiRequestAs(ts, "DELETE", "/polls/vote?post_id=1&poll_name=poll", "alice", nil)
+
+	resp, body = apiRequest(ts, "POST", "/invites", map[string]interface{}{"email": "carol@example.com", "skip_email": true})
+	if resp.StatusCode != 200 {
+		t.Fatalf("invite: %d: %s", resp.StatusCode, body)
+	}
+	inviteID := parseJSON(t, body)["id"].(float64)
+	resp, body = apiRequestAs(ts, "PUT", fmt.Sprintf("/invites/show/%v", inviteID), "system", map[string]interface{}{
+		"username": "carol", "email": "carol@example.com", "name": "Carol",
+	})
+	if resp.StatusCode != 200 {
+		t.Fatalf("accept invite: %d: %s", resp.StatusCode, body)
+	}
+	carolID := int(parseJSON(t, body)["user_id"].(float64))
+
+	apiRequest(ts, "DELETE", "/posts/"+reply, nil)
+	resp, body = apiRequestAs(ts, "POST", "/posts", "alice", map[string]interface{}{"title": "A topic that will not last", "raw": "Delete me when you get a chance.", "category": float64(1)})
+	if resp.StatusCode != 200 {
+		t.Fatalf("create topic: %d: %s", resp.StatusCode, body)
+	}
+	topicID := int(parseJSON(t, body)["topic_id"].(float64))
+	apiRequest(ts, "DELETE", fmt.Sprintf("/t/%d.json", topicID), nil)
+
+	type event struct {
+		user         int
+		action       string
+		id, reverses string
+		counterparty int
+	}
+	var got []event
+	seen := map[string]bool{}
+	rec.mu.Lock()
+	for _, p := range rec.received {
+		if seen[p.EventID] {
+			t.Errorf("event id %q sent twice", p.EventID)
+		}
+		seen[p.EventID] = true
+		if p.Action == "first_visit" || p.Action == "daily_visit" {
+			continue
+		}
+		e := event{user: p.DiscourseUserID, action: p.Action, id: p.EventID, reverses: p.ReversesEventID}
+		if p.CounterpartyDiscourseUserID != nil {
+			e.counterparty = *p.CounterpartyDiscourseUserID
+		}
+		got = append(got, e)
+	}
+	rec.mu.Unlock()
+
+	// The seeded users have visited before, on other days.
+	today := time.Now().UTC().Format("2006-01-02")
+	for _, id := range []string{"daily_visit:2:" + today, "daily_visit:3:" + today} {
+		if !seen[id] {
+			t.Errorf("expected visit event %s", id)
+		}
+	}
+	if seen["first_visit:2"] || seen["first_visit:3"] {
+		t.Errorf("expected no first_visit for the seeded users")
+	}
+	if seen["first_visit:"+fmt.Sprint(carolID)] {
+		t.Errorf("expected no visit for carol, who never made a request")
+	}
+
+	want := []event{
+		{2, "post_created", "post_created:" + reply, "", 0},
+		{3, "reply_received", "reply_received:" + reply, "", 2},
+		{2, "reaction_received", "reaction_received:" + reply + ":3", "", 3},
+		{2, "badge_granted", "badge_granted:8", "", 0},
+		{3, "reaction_given", "reaction_given:" + reply + ":3", "", 0},
+		{3, "badge_granted", "badge_granted:7", "", 0},
+		{2, "reaction_received_reversed", "reaction_received_reversed:" + reply + ":3", "reaction_received:" + reply + ":3", 3},
+		{3, "reaction_given_reversed", "reaction_given_reversed:" + reply + ":3", "reaction_given:" + reply + ":3", 0},
+		{2, "solution_accepted", "solution_accepted:" + reply, "", 3},
+		{2, "solution_accepted_reversed", "solution_accepted_reversed:" + reply, "solution_accepted:" + reply, 3},
+		{2, "post_edited", "post_edited:" + reply + ":2", "", 1},
+		{2, "badge_granted", "badge_granted:9", "", 0},
+		{3, "bookmark_created", fmt.Sprintf("bookmark_created:%v", bookmarkID), "", 0},
+		{3, "bookmark_created_reversed", fmt.Sprintf("bookmark_created_reversed:%v", bookmarkID), fmt.Sprintf("bookmark_created:%v", bookmarkID), 0},
+		{2, "poll_voted", "poll_voted:1:poll:2", "", 0},
+		{2, "poll_voted_reversed", "poll_voted_reversed:1:poll:2", "poll_voted:1:poll:2", 0},
+		{carolID, "user_created", fmt.Sprintf("user_created:%d", carolID), "", 0},
+		{1, "invite_redeemed", fmt.Sprintf("invite_redeemed:%v:%d", inviteID, carolID), "", carolID},
+		{2, "post_deleted", "post_deleted:" + reply, "post_created:" + reply, 0},
+		{3, "reply_received_reversed", "reply_received_reversed:" + reply, "reply_received:" + reply, 2},
+		{2, "topic_created", fmt.Sprintf("topic_created:%d", topicID), "", 0},
+		{2, "topic_deleted", fmt.Sprintf("topic_deleted:%d", topicID), fmt.Sprintf("topic_created:%d", topicID), 0},
+	}
+	// Each user's events arrive in order; different users' may interleave.
+	byUser := func(events []event) map[int][]event {
+		out := map[int][]event{}
+		for _, e := range events {
+			out[e.user] = append(out[e.user], e)
+		}
+		return out
+	}
+	gotByUser := byUser(got)
+	for user, events := range byUser(want) {
+		if len(gotByUser[user]) != len(events) {
+			t.Errorf("expected user %d to get %+v, got %+v", user, events, gotByUser[user])
+			continue
+		}
+		for i, w := range events {
+			if g := gotByUser[user][i]; g != w {
+				t.Errorf("user %d event %d: expected %+v, got %+v", user, i, w, g)
+			}
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("expected %d events, got %d: %+v", len(want), len(got), got)
+	}
+}
+
+func TestGamification_FirstVisitOnlyForNewUsers(t *testing.T) {
+	rec := newGamificationReceiver(t)
+	ts := syncServer(t, webhook.New(rec.URL, ""))
+
+	resp, body := apiRequest(ts, "POST", "/users", map[string]interface{}{
+		"name": "Dave", "username": "dave", "email": "dave@example.com", "password": "supersecret123", "active": true,
+	})
+	if resp.StatusCode != 200 {
+		t.Fatalf("create user: %d: %s", resp.StatusCode, body)
+	}
+	daveID := int(parseJSON(t, body)["user_id"].(float64))
+	apiGetAs(ts, "/latest.json", "dave")
+	apiGetAs(ts, "/latest.json", "dave")
+	apiGetAs(ts, "/latest.json", "alice")
+
+	visits := map[int][]string{}
+	rec.mu.Lock()
+	for _, p := range rec.received {
+		if p.Action == "first_visit" || p.Action == "daily_visit" {
+			visits[p.DiscourseUserID] = append(visits[p.DiscourseUserID], p.Action)
+		}
+	}
+	rec.mu.Unlock()
+	if got := visits[daveID]; !slices.Equal(got, []string{"first_visit", "daily_visit"}) {
+		t.Errorf("expected first_visit and one daily_visit for dave, got %v", got)
+	}
+	if got := visits[2]; !slices.Equal(got, []string{"daily_visit"}) {
+		t.Errorf("expected only daily_visit for alice, who was seen before, got %v", got)
+	}
+}
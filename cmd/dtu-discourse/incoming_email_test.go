@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// handleMail hands raw to the forum as an incoming email and returns the
+// newest received email.
+func handleMail(t *testing.T, ts *httptest.Server, raw string) map[string]interface{} {
+	t.Helper()
+	resp, body := apiRequest(ts, "POST", "/admin/email/handle_mail", map[string]interface{}{"email": raw})
+	if resp.StatusCode != 200 || string(body) != "email has been received and is queued for processing" {
+		t.Fatalf("handle_mail: %d: %s", resp.StatusCode, body)
+	}
+	_, body = apiGet(ts, "/admin/email/received.json")
+	var list []map[string]interface{}
+	if err := json.Unmarshal(body, &list); err != nil || len(list) == 0 {
+		t.Fatalf("received: %s", body)
+	}
+	return list[0]
+}
+
+func lastPostRaw(t *testing.T, ts *httptest.Server, topicID int) (string, string) {
+	t.Helper()
+	_, body := apiGet(ts, "/t/"+strconv.Itoa(topicID)+".json")
+	posts := parseJSON(t, body)["post_stream"].(map[string]interface{})["posts"].([]interface{})
+	last := posts[len(posts)-1].(map[string]interface{})
+	return last["username"].(string), last["cooked"].(string)
+}
+
+func TestIncomingEmail_ReplyByEmail(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+	apiRequest(ts, "PUT", "/admin/site_settings/reply_by_email_enabled", map[string]interface{}{"reply_by_email_enabled": true})
+	apiRequest(ts, "PUT", "/admin/site_settings/reply_by_email_address", map[string]interface{}{"reply_by_email_address": "replies+%{reply_key}@example.com"})
+
+	staffReply(t, ts, map[string]interface{}{"topic_id": float64(2), "raw": "@alice @bob could you check this?"})
+	alice := mailTo(t, ts, "alice@example.com")[0]
+	replyTo := alice["reply_to"].(string)
+	if !strings.HasPrefix(replyTo, "replies+") {
+		t.Fatalf("expected a reply-by-email address: %v", alice)
+	}
+
+	got := handleMail(t, ts, "From: Alice <alice@example.com>\r\nTo: "+replyTo+"\r\nSubject: Re: "+alice["subject"].(string)+
+		"\r\nMessage-ID: <reply-1@mail.example.com>\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n"+
+		"Sure, I'll check it today.\r\n\r\nOn Mon, Jan 1, 2024 at 10:00 AM admin <noreply@example.com> wrote:\r\n"+
+		"> @alice @bob could you check this?\r\n\r\n-- \r\nAlice\r\n")
+	if got["error"] != "" || !strings.HasPrefix(got["post_url"].(string), "/t/") || got["user"].(map[string]interface{})["username"] != "alice" {
+		t.Fatalf("expected alice's reply to be posted: %v", got)
+	}
+	if user, cooked := lastPostRaw(t, ts, 2); user != "alice" || !strings.Contains(cooked, "check it today") || strings.Contains(cooked, "could you") || strings.Contains(cooked, "Alice") {
+		t.Errorf("expected the trimmed reply as alice's post, got %s: %s", user, cooked)
+	}
+
+	// bob answers his email by threading on its Message-ID, with a
+	// base64 plain part next to an HTML one.
+	bob := mailTo(t, ts, "bob@example.com")[0]
+	text := base64.StdEncoding.EncodeToString([]byte("Looks good to me.\n"))
+	got = handleMail(t, ts, "From: bob@example.com\nTo: forum@example.com\nSubject: Re: topic\n"+
+		"In-Reply-To: <"+bob["message_id"].(string)+">\nMIME-Version: 1.0\nContent-Type: multipart/alternative; boundary=\"b1\"\n\n"+
+		"--b1\nContent-Type: text/plain; charset=UTF-8\nContent-Transfer-Encoding: base64\n\n"+text+"\n"+
+		"--b1\nContent-Type: text/html; charset=UTF-8\n\n<p>Looks good to me.</p>\n--b1--\n")
+	if got["error"] != "" {
+		t.Fatalf("expected bob's reply to be posted: %v", got)
+	}
+	if user, cooked := lastPostRaw(t, ts, 2); user != "bob" || !strings.Contains(cooked, "Looks good to me.") {
+		t.Errorf("expected bob's reply, got %s: %s", user, cooked)
+	}
+
+	// A reply key only works for the user it was sent to.
+	got = handleMail(t, ts, "From: bob@example.com\nTo: "+replyTo+"\nSubject: Re: hi\n\nNot mine to answer.\n")
+	if got["error"] != "Email::Receiver::ReplyUserNotMatchingError" {
+		t.Errorf("expected a mismatched sender to be rejected: %v", got)
+	}
+	_, body := apiGet(ts, "/admin/email/rejected.json")
+	if strings.Count(string(body), `"from_address"`) != 1 {
+		t.Errorf("expected one rejected email: %s", body)
+	}
+	for _, path := range []string{"/admin/email/received.json?offset=-1", "/admin/email/rejected.json?offset=-1"} {
+		if resp, body := apiGet(ts, path); resp.StatusCode != 200 || !strings.Contains(string(body), "ReplyUserNotMatchingError") {
+			t.Errorf("expected a negative offset to give the first page of %s, got %d: %s", path, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestIncomingEmail_CategoryEmailIn(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+	apiRequest(ts, "PUT", "/admin/site_settings/email_in", map[string]interface{}{"email_in": true})
+	apiRequest(ts, "PUT", "/categories/2", map[string]interface{}{"email_in": "support@example.com", "email_in_allow_strangers": true})
+	apiRequest(ts, "PUT", "/categories/3", map[string]interface{}{"email_in": "meta@example.com|feedback@example.com"})
+
+	got := handleMail(t, ts, "From: \"Carol Jones\" <Carol@Example.org>\nTo: support@example.com\nSubject: Printer is on fire again\n\n"+
+		"The printer on floor two is on fire again.\n\nSent from my iPhone\n")
+	if got["error"] != "" || got["user"].(map[string]interface{})["username"] != "carol" {
+		t.Fatalf("expected a topic from a staged user: %v", got)
+	}
+	_, body := apiGet(ts, "/u/carol.json")
+	if user := parseJSON(t, body)["user"].(map[string]interface{}); user["staged"] != true || user["name"] != "Carol Jones" {
+		t.Errorf("expected carol to be staged: %s", body)
+	}
+	topicID, _ := strconv.Atoi(strings.Split(got["post_url"].(string), "/")[3])
+	_, body = apiGet(ts, "/t/"+strconv.Itoa(topicID)+".json")
+	if topic := parseJSON(t, body); topic["title"] != "Printer is on fire again" || topic["category_id"] != float64(2) {
+		t.Errorf("expected the topic in Support: %s", body)
+	}
+	_, body = apiGet(ts, "/admin/email/incoming/"+strconv.Itoa(int(got["id"].(float64)))+".json")
+	if details := parseJSON(t, body); details["body"] != "The printer on floor two is on fire again." || !strings.Contains(details["headers"].(string), "Subject: Printer") {
+		t.Errorf("unexpected details: %s", body)
+	}
+
+	for _, c := range []struct{ from, to, headers, want string }{
+		{"dave@example.org", "feedback@example.com", "", "Email::Receiver::StrangersNotAllowedError"},
+		{"bob@example.com", "meta@example.com", "", "Email::Receiver::InsufficientTrustLevelError"},
+		{"bob@example.com", "nowhere@example.com", "", "Email::Receiver::BadDestinationAddress"},
+		{"bob@example.com", "support@example.com", "Auto-Submitted: auto-replied\n", "Email::Receiver::AutoGeneratedEmailError"},
+	} {
+		got := handleMail(t, ts, "From: "+c.from+"\nTo: "+c.to+"\n"+c.headers+"Subject: A question about the forum\n\nHello there, a question.\n")
+		if got["error"] != c.want {
+			t.Errorf("%s to %s: expected %s, got %v", c.from, c.to, c.want, got["error"])
+		}
+	}
+	_, body = apiGet(ts, "/admin/email/rejected.json?error=Strangers")
+	if strings.Count(string(body), `"from_address"`) != 1 {
+		t.Errorf("expected the error filter to find one email: %s", body)
+	}
+}
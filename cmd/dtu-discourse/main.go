@@ -12,12 +12,19 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/lightcap/dtu-discourse/internal/handler"
+	"github.com/lightcap/dtu-discourse/internal/mailer"
 	"github.com/lightcap/dtu-discourse/internal/middleware"
 	"github.com/lightcap/dtu-discourse/internal/store"
 	"github.com/lightcap/dtu-discourse/internal/webhook"
@@ -31,18 +38,50 @@ func main() {
 
 	s := store.New()
 
+	// Links in outgoing email, and the instance web hooks name, point at
+	// the DTU itself unless it is reached under another address
+	s.Outbox.BaseURL = os.Getenv("DTU_BASE_URL")
+	if s.Outbox.BaseURL == "" {
+		s.Outbox.BaseURL = "http://localhost:" + port
+	}
+	s.Hooks.Instance = s.Outbox.BaseURL
+	// SMTP delivery (optional): mail is also sent to a local sink such as
+	// MailHog
+	smtpAddr := os.Getenv("DTU_SMTP_ADDR")
+	if smtpAddr != "" {
+		s.Outbox.DeliverVia(mailer.SMTPSender{Addr: smtpAddr})
+	}
+
 	// SSO configuration (optional)
 	s.SSOSecret = os.Getenv("DISCOURSE_CONNECT_SECRET")
 	s.SSOCallbackURL = os.Getenv("SSO_CALLBACK_URL")
 
-	// Webhook dispatcher (optional)
+	// Webhook dispatcher (optional): WEBHOOK_URL may list several URLs
+	// separated by commas
 	webhookURL := os.Getenv("WEBHOOK_URL")
 	webhookSecret := os.Getenv("WEBHOOK_SECRET")
 	dispatcher := webhook.New(webhookURL, webhookSecret)
+	// DTU_WEBHOOKS=sync delivers webhooks before the response that set
+	// them off is sent
+	s.WebhooksSync = os.Getenv("DTU_WEBHOOKS") == "sync"
+
+	// Rate limits (optional): the global request limits are read from the
+	// same variables Discourse uses and are off unless set. DTU_RATE_LIMITS=off
+	// also lifts the per-user action limits.
+	for env, setting := range map[string]string{
+		"DISCOURSE_MAX_REQS_PER_IP_PER_MINUTE":     "max_reqs_per_ip_per_minute",
+		"DISCOURSE_MAX_REQS_PER_IP_PER_10_SECONDS": "max_reqs_per_ip_per_10_seconds",
+		"DISCOURSE_MAX_ADMIN_API_REQS_PER_MINUTE":  "max_admin_api_reqs_per_minute",
+	} {
+		if n, err := strconv.Atoi(os.Getenv(env)); err == nil {
+			s.UpdateSiteSetting(setting, n)
+		}
+	}
+	s.RateLimitsDisabled = os.Getenv("DTU_RATE_LIMITS") == "off"
 
 	mux := BuildRouter(s, dispatcher)
 
-	wrapped := middleware.Auth(s)(mux)
+	wrapped := middleware.SyncWebhooks(s)(middleware.RateLimit(s)(middleware.Auth(s)(mux)))
 
 	log.Printf("DTU Discourse listening on :%s", port)
 	log.Printf("Default API key: test_api_key (user: system)")
@@ -53,23 +92,53 @@ func main() {
 	if webhookURL != "" {
 		log.Printf("Webhooks enabled → %s", webhookURL)
 	}
-	if err := http.ListenAndServe(":"+port, wrapped); err != nil {
+	if smtpAddr != "" {
+		log.Printf("Email delivered over SMTP → %s", smtpAddr)
+	}
+	if s.RateLimitsDisabled {
+		log.Printf("Rate limits disabled")
+	}
+	if s.WebhooksSync {
+		log.Printf("Webhooks delivered before responding")
+	}
+
+	// On SIGINT or SIGTERM, finish the requests in flight and deliver the
+	// queued gamification webhooks before exiting.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	srv := &http.Server{Addr: ":" + port, Handler: wrapped}
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdown)
+	}()
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		fmt.Fprintf(os.Stderr, "server error: %v\n", err)
 		os.Exit(1)
 	}
+	<-drained
+	flush, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dispatcher.Close(flush)
 }
 
 // BuildRouter creates the HTTP mux with all Discourse-compatible routes.
 // Wildcard path segments (e.g. {username}) will match values with or without
 // a .json suffix; handlers strip the suffix when extracting the value.
+// Gamification events go to dispatcher, which may be nil.
 func BuildRouter(s *store.Store, dispatcher *webhook.Dispatcher) *http.ServeMux {
 	mux := http.NewServeMux()
+	ext := store.NewExtStore(s)
+	s.Gamification = dispatcher
 
 	// ---- Core handlers ----
-	users := &handler.UsersHandler{Store: s}
+	users := &handler.UsersHandler{Store: s, Ext: ext}
 	cats := &handler.CategoriesHandler{Store: s}
-	topics := &handler.TopicsHandler{Store: s}
-	posts := &handler.PostsHandler{Store: s, Webhook: dispatcher}
+	topics := &handler.TopicsHandler{Store: s, Ext: ext}
+	posts := &handler.PostsHandler{Store: s, Ext: ext}
 	groups := &handler.GroupsHandler{Store: s}
 	search := &handler.SearchHandler{Store: s}
 	tags := &handler.TagsHandler{Store: s}
@@ -83,9 +152,9 @@ func BuildRouter(s *store.Store, dispatcher *webhook.Dispatcher) *http.ServeMux
 
 	// ---- Extended handlers ----
 	extTopics := &handler.ExtendedTopicsHandler{Store: s}
-	extPosts := &handler.ExtendedPostsHandler{Store: s}
-	extAdmin := &handler.ExtendedAdminHandler{Store: s}
-	misc := &handler.MiscHandler{Store: s}
+	extPosts := &handler.ExtendedPostsHandler{Store: s, Ext: ext}
+	extAdmin := &handler.ExtendedAdminHandler{Store: s, Ext: ext}
+	misc := &handler.MiscHandler{Store: s, Ext: ext}
 	extUsers := &handler.ExtendedUsersHandler{Store: s}
 	session := &handler.SessionHandler{Store: s}
 	extPM := &handler.ExtendedPMHandler{Store: s}
@@ -96,11 +165,15 @@ func BuildRouter(s *store.Store, dispatcher *webhook.Dispatcher) *http.ServeMux
 	extTags := &handler.ExtendedTagsHandler{Store: s}
 	extUploads := &handler.ExtendedUploadsHandler{Store: s}
 	extBackups := &handler.ExtendedBackupsHandler{Store: s}
-	polls := &handler.PollsHandler{Store: s}
+	polls := &handler.PollsHandler{Store: s, Ext: ext}
+	reactions := &handler.ReactionsHandler{Store: s, Ext: ext}
+	solved := &handler.SolvedHandler{Store: s}
 	apiKeys := &handler.APIKeysHandler{Store: s}
-	email := &handler.EmailHandler{Store: s}
+	email := &handler.EmailHandler{Store: s, Ext: ext}
 	userActions := &handler.UserActionsHandler{Store: s}
 	topicTimings := &handler.TopicTimingsHandler{Store: s}
+	feeds := &handler.FeedsHandler{Store: s}
+	messageBus := &handler.MessageBusHandler{Store: s}
 
 	// ==================================================================
 	// Users (core)
@@ -171,6 +244,7 @@ func BuildRouter(s *store.Store, dispatcher *webhook.Dispatcher) *http.ServeMux
 	mux.HandleFunc("GET /u/{username}/card.json", extUsers.Card)
 	mux.HandleFunc("GET /u/{username}", users.GetUser)
 	mux.HandleFunc("POST /u/password-reset/{token}", extUsers.PasswordReset)
+	mux.HandleFunc("POST /u/action/send_activation_email", extUsers.SendActivationEmail)
 	mux.HandleFunc("POST /u/confirm-email/{token}", extUsers.ConfirmEmail)
 	mux.HandleFunc("POST /u/second_factors", extUsers.SecondFactors)
 	mux.HandleFunc("PUT /u/second_factor", extUsers.UpdateSecondFactor)
@@ -359,12 +433,18 @@ func BuildRouter(s *store.Store, dispatcher *webhook.Dispatcher) *http.ServeMux
 	mux.HandleFunc("PUT /notifications/{id}", extNotifs.Update)
 	mux.HandleFunc("DELETE /notifications/{id}", extNotifs.Delete)
 
+	// ==================================================================
+	// MessageBus
+	// ==================================================================
+	mux.HandleFunc("POST /message-bus/{client_id}/poll", messageBus.Poll)
+
 	// ==================================================================
 	// Invites
 	// ==================================================================
 	mux.HandleFunc("POST /invites", invites.Create)
 	mux.HandleFunc("POST /invites.json", invites.Create)
 	mux.HandleFunc("GET /invites/retrieve.json", invites.Retrieve)
+	mux.HandleFunc("PUT /invites/show/{id}", invites.Accept)
 	mux.HandleFunc("PUT /invites/{invite_id}", invites.Update)
 	mux.HandleFunc("DELETE /invites", invites.Destroy)
 	mux.HandleFunc("POST /invites/destroy-all-expired", invites.DestroyAllExpired)
@@ -413,12 +493,16 @@ func BuildRouter(s *store.Store, dispatcher *webhook.Dispatcher) *http.ServeMux
 	// Admin Extended
 	// ==================================================================
 	// Webhooks
+	mux.HandleFunc("GET /admin/api/web_hooks", extAdmin.ListWebhooks)
 	mux.HandleFunc("GET /admin/api/web_hooks.json", extAdmin.ListWebhooks)
+	mux.HandleFunc("POST /admin/api/web_hooks", extAdmin.CreateWebhook)
 	mux.HandleFunc("POST /admin/api/web_hooks.json", extAdmin.CreateWebhook)
 	mux.HandleFunc("GET /admin/api/web_hooks/{id}", extAdmin.ShowWebhook)
 	mux.HandleFunc("PUT /admin/api/web_hooks/{id}", extAdmin.UpdateWebhook)
 	mux.HandleFunc("DELETE /admin/api/web_hooks/{id}", extAdmin.DeleteWebhook)
 	mux.HandleFunc("GET /admin/api/web_hooks/{id}/events", extAdmin.WebhookEvents)
+	mux.HandleFunc("GET /admin/api/web_hooks/{id}/events.json", extAdmin.WebhookEvents)
+	mux.HandleFunc("POST /admin/api/web_hooks/{id}/events/{event_id}/redeliver", extAdmin.RedeliverWebhookEvent)
 	mux.HandleFunc("POST /admin/api/web_hooks/{id}/ping", extAdmin.PingWebhook)
 
 	// Themes
@@ -595,16 +679,48 @@ func BuildRouter(s *store.Store, dispatcher *webhook.Dispatcher) *http.ServeMux
 	mux.HandleFunc("GET /admin/email.json", email.Settings)
 	mux.HandleFunc("GET /admin/email/server-settings", email.ServerSettings)
 	mux.HandleFunc("GET /admin/email/preview-digest", email.PreviewDigest)
+	mux.HandleFunc("GET /admin/email/preview-digest.json", email.PreviewDigest)
+	mux.HandleFunc("POST /admin/email/send-digest.json", email.SendDigest)
 	mux.HandleFunc("POST /admin/email/test", email.Test)
+	mux.HandleFunc("POST /admin/email/handle_mail", email.HandleMail)
+	mux.HandleFunc("POST /admin/email/handle_mail.json", email.HandleMail)
+	mux.HandleFunc("GET /admin/email/incoming/{id}", email.Incoming)
 	mux.HandleFunc("GET /admin/email/{filter}", email.List)
 
+	// DTU outbox: every email the forum sent or skipped, with the links
+	// and tokens they carry
+	mux.HandleFunc("GET /__dtu/mail", email.Outbox)
+	mux.HandleFunc("GET /__dtu/mail/{id}", email.OutboxMessage)
+	mux.HandleFunc("DELETE /__dtu/mail", email.ClearOutbox)
+
+	// DTU webhooks: wait for queued deliveries and see how they went
+	mux.HandleFunc("POST /__dtu/webhooks/flush", extAdmin.FlushWebhooks)
+	mux.HandleFunc("GET /__dtu/webhooks/deliveries", extAdmin.WebhookDeliveries)
+
+	// DTU tutorial: what finishing the new user tutorial would do
+	mux.HandleFunc("PUT /__dtu/users/{username}/complete_tutorial", extUsers.CompleteTutorial)
+
 	// ==================================================================
 	// Polls
 	// ==================================================================
 	mux.HandleFunc("PUT /polls/vote", polls.Vote)
+	mux.HandleFunc("DELETE /polls/vote", polls.RemoveVote)
 	mux.HandleFunc("PUT /polls/toggle_status", polls.ToggleStatus)
 	mux.HandleFunc("GET /polls/voters.json", polls.Voters)
 
+	// ==================================================================
+	// Reactions (discourse-reactions plugin)
+	// ==================================================================
+	mux.HandleFunc("PUT /discourse-reactions/posts/{id}/custom-reactions/{reaction}/toggle.json", reactions.Toggle)
+	mux.HandleFunc("GET /discourse-reactions/posts/{id}/reactions-users.json", reactions.ReactionUsers)
+	mux.HandleFunc("GET /discourse-reactions/posts/reactions.json", reactions.UserReactions)
+
+	// ==================================================================
+	// Solutions (discourse-solved plugin)
+	// ==================================================================
+	mux.HandleFunc("POST /solution/accept", solved.Accept)
+	mux.HandleFunc("POST /solution/unaccept", solved.Unaccept)
+
 	// ==================================================================
 	// User Actions
 	// ==================================================================
@@ -706,8 +822,8 @@ func BuildRouter(s *store.Store, dispatcher *webhook.Dispatcher) *http.ServeMux
 	mux.HandleFunc("GET /embed/info", misc.EmbedInfo)
 
 	// Presence
-	mux.HandleFunc("POST /presence/update", misc.PresenceUpdate)
-	mux.HandleFunc("GET /presence/get", misc.PresenceGet)
+	mux.HandleFunc("POST /presence/update", messageBus.UpdatePresence)
+	mux.HandleFunc("GET /presence/get", messageBus.GetPresence)
 
 	// User Status / DND
 	mux.HandleFunc("GET /user-status", misc.GetUserStatus)
@@ -742,5 +858,25 @@ func BuildRouter(s *store.Store, dispatcher *webhook.Dispatcher) *http.ServeMux
 	// Pageview
 	mux.HandleFunc("POST /pageview", misc.Pageview)
 
-	return mux
+	// ==================================================================
+	// RSS feeds
+	// ==================================================================
+	// /c/{slug}/{id}.rss, /tag/{tag}.rss and /t/{slug}/{id}.rss are
+	// dispatched by the category, tag and topic handlers above.
+	mux.HandleFunc("GET /latest.rss", feeds.Latest)
+	mux.HandleFunc("GET /posts.rss", feeds.Posts)
+	mux.HandleFunc("GET /u/{username}/activity.rss", feeds.UserActivity)
+
+	// ==================================================================
+	// Email links
+	// ==================================================================
+	// These overlap the /u/{username}/... patterns, which ServeMux
+	// refuses to register side by side, so they sit in front of mux.
+	root := http.NewServeMux()
+	root.Handle("/", mux)
+	root.HandleFunc("GET /u/activate-account/{token}", extUsers.ActivateAccountPage)
+	root.HandleFunc("PUT /u/activate-account/{token}", extUsers.ActivateAccount)
+	root.HandleFunc("PUT /u/password-reset/{token}", extUsers.PasswordReset)
+
+	return root
 }
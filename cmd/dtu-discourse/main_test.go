@@ -18,14 +18,27 @@ import (
 
 	"github.com/lightcap/dtu-discourse/internal/middleware"
 	"github.com/lightcap/dtu-discourse/internal/store"
+	"github.com/lightcap/dtu-discourse/internal/webhook"
 )
 
 func testServer(t *testing.T) *httptest.Server {
 	t.Helper()
-	s := store.New()
-	mux := BuildRouter(s, nil)
-	wrapped := middleware.Auth(s)(mux)
-	return httptest.NewServer(wrapped)
+	ts, _ := serveStore(t, store.New())
+	return ts
+}
+
+// serveStore starts a DTU on s behind the full middleware chain. Its
+// gamification events go to the returned receiver, and each response
+// waits until the events it set off have been delivered there.
+func serveStore(t *testing.T, s *store.Store) (*httptest.Server, *gamificationReceiver) {
+	t.Helper()
+	rec := newGamificationReceiver(t)
+	s.WebhooksSync = true
+	mux := BuildRouter(s, webhook.New(rec.URL, ""))
+	wrapped := middleware.SyncWebhooks(s)(middleware.RateLimit(s)(middleware.Auth(s)(mux)))
+	ts := httptest.NewServer(wrapped)
+	t.Cleanup(ts.Close)
+	return ts, rec
 }
 
 func apiGet(ts *httptest.Server, path string) (*http.Response, []byte) {
@@ -41,7 +54,26 @@ func apiGet(ts *httptest.Server, path string) (*http.Response, []byte) {
 	return resp, body
 }
 
+// apiGetAs issues a GET with the system key acting as username.
+func apiGetAs(ts *httptest.Server, path, username string) (*http.Response, []byte) {
+	req, _ := http.NewRequest("GET", ts.URL+path, nil)
+	req.Header.Set("Api-Key", "test_api_key")
+	req.Header.Set("Api-Username", username)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		panic(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, body
+}
+
 func apiRequest(ts *httptest.Server, method, path string, body interface{}) (*http.Response, []byte) {
+	return apiRequestAs(ts, method, path, "admin", body)
+}
+
+// apiRequestAs is apiRequest acting as username.
+func apiRequestAs(ts *httptest.Server, method, path, username string, body interface{}) (*http.Response, []byte) {
 	var bodyReader io.Reader
 	ct := "application/json"
 	switch v := body.(type) {
@@ -57,7 +89,7 @@ func apiRequest(ts *httptest.Server, method, path string, body interface{}) (*ht
 
 	req, _ := http.NewRequest(method, ts.URL+path, bodyReader)
 	req.Header.Set("Api-Key", "admin_api_key")
-	req.Header.Set("Api-Username", "admin")
+	req.Header.Set("Api-Username", username)
 	req.Header.Set("Content-Type", ct)
 
 	resp, err := http.DefaultClient.Do(req)
@@ -427,8 +459,7 @@ func TestRuby_GetTopic(t *testing.T) {
 }
 
 func TestRuby_CreateTopic(t *testing.T) {
-	ts := testServer(t)
-	defer ts.Close()
+	ts, rec := serveStore(t, store.New())
 	resp, body := apiRequest(ts, "POST", "/posts", map[string]interface{}{
 		"title": "New Test Topic", "raw": "Body of the test topic.", "category": float64(1),
 	})
@@ -439,6 +470,7 @@ func TestRuby_CreateTopic(t *testing.T) {
 	if data["topic_id"] == nil {
 		t.Error("expected topic_id")
 	}
+	rec.expect(t, "topic_created")
 }
 
 func TestRuby_RenameTopic(t *testing.T) {
@@ -570,14 +602,14 @@ func TestRuby_InviteToTopic(t *testing.T) {
 // ============================================================
 
 func TestRuby_CreatePost(t *testing.T) {
-	ts := testServer(t)
-	defer ts.Close()
+	ts, rec := serveStore(t, store.New())
 	resp, body := apiRequest(ts, "POST", "/posts", map[string]interface{}{
-		"topic_id": float64(1), "raw": "A reply.",
+		"topic_id": float64(1), "raw": "A short reply.",
 	})
 	if resp.StatusCode != 200 {
 		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
 	}
+	rec.expect(t, "post_created")
 }
 
 func TestRuby_GetPost(t *testing.T) {
@@ -636,14 +668,14 @@ func TestRuby_WikifyPost(t *testing.T) {
 }
 
 func TestRuby_CreatePostAction(t *testing.T) {
-	ts := testServer(t)
-	defer ts.Close()
+	ts, rec := serveStore(t, store.New())
 	resp, _ := apiRequest(ts, "POST", "/post_actions", map[string]interface{}{
-		"id": float64(1), "post_action_type_id": float64(2),
+		"id": float64(2), "post_action_type_id": float64(2),
 	})
 	if resp.StatusCode != 200 {
 		t.Fatalf("expected 200, got %d", resp.StatusCode)
 	}
+	rec.expect(t, "reaction_given", "reaction_received")
 }
 
 func TestRuby_PostActionUsers(t *testing.T) {
@@ -958,7 +990,7 @@ func TestRuby_CreatePM(t *testing.T) {
 	ts := testServer(t)
 	defer ts.Close()
 	resp, body := apiRequest(ts, "POST", "/posts", map[string]interface{}{
-		"title": "DM Test", "raw": "pm body",
+		"title": "DM Test", "raw": "pm body text",
 		"target_usernames": "alice", "archetype": "private_message",
 	})
 	if resp.StatusCode != 200 {
@@ -1253,7 +1285,7 @@ func TestLifecycle_TopicCreateReplyEditDelete(t *testing.T) {
 
 	// 1. Create topic
 	resp, body := apiRequest(ts, "POST", "/posts", map[string]interface{}{
-		"title": "Lifecycle", "raw": "Original.", "category": float64(1),
+		"title": "Lifecycle", "raw": "Original body.", "category": float64(1),
 	})
 	if resp.StatusCode != 200 {
 		t.Fatalf("create topic: %d: %s", resp.StatusCode, body)
@@ -1264,7 +1296,7 @@ func TestLifecycle_TopicCreateReplyEditDelete(t *testing.T) {
 
 	// 2. Reply
 	resp, body = apiRequest(ts, "POST", "/posts", map[string]interface{}{
-		"topic_id": topicID, "raw": "Reply.",
+		"topic_id": topicID, "raw": "Reply to the topic.",
 	})
 	if resp.StatusCode != 200 {
 		t.Fatalf("reply: %d: %s", resp.StatusCode, body)
@@ -1369,10 +1401,7 @@ func TestSSO_RoundTrip(t *testing.T) {
 	// SSOCallbackURL will be set to the test server's own URL below (we use a placeholder for redirect)
 	s.SSOCallbackURL = "http://eve.local/api/discourse/sso"
 
-	mux := BuildRouter(s, nil)
-	wrapped := middleware.Auth(s)(mux)
-	ts := httptest.NewServer(wrapped)
-	defer ts.Close()
+	ts, _ := serveStore(t, s)
 
 	// Update callback URL to point to our test server's sso_login for a full round trip
 	s.SSOCallbackURL = ts.URL + "/session/sso_login"
@@ -1469,10 +1498,7 @@ func TestSSO_InvalidSignatureRejected(t *testing.T) {
 	s.SSOSecret = "real_secret"
 	s.SSOCallbackURL = "http://localhost/callback"
 
-	mux := BuildRouter(s, nil)
-	wrapped := middleware.Auth(s)(mux)
-	ts := httptest.NewServer(wrapped)
-	defer ts.Close()
+	ts, _ := serveStore(t, s)
 
 	// Build a payload with wrong secret
 	payload := base64.StdEncoding.EncodeToString([]byte("nonce=fake&email=x@y.com&external_id=1&username=x"))
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lightcap/dtu-discourse/internal/store"
+)
+
+// pollAs polls the message bus as username (anonymously when empty) with
+// subs, short polling unless header asks otherwise.
+func pollAs(t *testing.T, ts *httptest.Server, username string, subs map[string]int, header http.Header) (*http.Response, []byte) {
+	t.Helper()
+	form := url.Values{"__seq": {"1"}}
+	for channel, id := range subs {
+		form.Set(channel, strconv.Itoa(id))
+	}
+	path := "/message-bus/test-client/poll"
+	if header == nil {
+		path += "?dlp=t"
+	}
+	req, _ := http.NewRequest("POST", ts.URL+path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if username != "" {
+		req.Header.Set("Api-Key", "admin_api_key")
+		req.Header.Set("Api-Username", username)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	return resp, b
+}
+
+// busMessages short polls as username and returns the messages.
+func busMessages(t *testing.T, ts *httptest.Server, username string, subs map[string]int) []map[string]interface{} {
+	t.Helper()
+	resp, body := pollAs(t, ts, username, subs, nil)
+	if resp.StatusCode != 200 {
+		t.Fatalf("poll: %d: %s", resp.StatusCode, body)
+	}
+	var msgs []map[string]interface{}
+	if err := json.Unmarshal(body, &msgs); err != nil {
+		t.Fatalf("poll: %v: %s", err, body)
+	}
+	return msgs
+}
+
+func TestMessageBus_ShortPollBacklog(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	msgs := busMessages(t, ts, "alice", map[string]int{"/latest": -1, "/topic/1": -1})
+	if len(msgs) != 1 || msgs[0]["channel"] != "/__status" {
+		t.Fatalf("expected a status message: %v", msgs)
+	}
+	if status := msgs[0]["data"].(map[string]interface{}); status["/latest"] != float64(0) || status["/topic/1"] != float64(0) {
+		t.Errorf("unexpected status: %v", status)
+	}
+
+	post := staffReply(t, ts, map[string]interface{}{"topic_id": float64(1), "raw": "A reply everyone should hear about."})
+	msgs = busMessages(t, ts, "alice", map[string]int{"/latest": 0, "/topic/1": 0, "/unread": 0})
+	if len(msgs) != 3 {
+		t.Fatalf("expected three messages: %v", msgs)
+	}
+	created := msgs[0]["data"].(map[string]interface{})
+	if msgs[0]["channel"] != "/topic/1" || created["type"] != "created" || created["id"] != post["id"] || created["post_number"] != float64(3) {
+		t.Errorf("unexpected topic message: %v", msgs[0])
+	}
+	if msgs[1]["channel"] != "/latest" || msgs[1]["data"].(map[string]interface{})["message_type"] != "latest" {
+		t.Errorf("unexpected latest message: %v", msgs[1])
+	}
+	unread := msgs[2]["data"].(map[string]interface{})
+	if msgs[2]["channel"] != "/unread" || unread["payload"].(map[string]interface{})["notification_level"] != float64(2) {
+		t.Errorf("unexpected unread message: %v", msgs[2])
+	}
+	if msgs[0]["global_id"].(float64) >= msgs[1]["global_id"].(float64) {
+		t.Errorf("messages should be in global order: %v", msgs)
+	}
+	if got := busMessages(t, ts, "bob", map[string]int{"/unread": 0}); len(got) != 0 {
+		t.Errorf("bob doesn't track topic 1: %v", got)
+	}
+	if got := busMessages(t, ts, "alice", map[string]int{"/topic/1": 1}); len(got) != 0 {
+		t.Errorf("nothing is newer than the last id: %v", got)
+	}
+	if got := busMessages(t, ts, "alice", map[string]int{"/latest": -2}); len(got) != 1 || got[0]["channel"] != "/latest" {
+		t.Errorf("-2 should return the last message: %v", got)
+	}
+	if got := busMessages(t, ts, "", map[string]int{"/latest": 5}); len(got) != 1 || got[0]["channel"] != "/__status" {
+		t.Errorf("a last id past the end should get a status message: %v", got)
+	}
+
+	apiRequest(ts, "PUT", "/posts/"+strconv.Itoa(int(post["id"].(float64))), map[string]interface{}{"post": map[string]interface{}{"raw": "A reply everyone should hear about, edited."}})
+	apiRequest(ts, "DELETE", "/posts/"+strconv.Itoa(int(post["id"].(float64))), nil)
+	msgs = busMessages(t, ts, "", map[string]int{"/topic/1": 1})
+	if len(msgs) != 2 || msgs[0]["data"].(map[string]interface{})["type"] != "revised" || msgs[1]["data"].(map[string]interface{})["type"] != "deleted" {
+		t.Errorf("expected revised and deleted: %v", msgs)
+	}
+}
+
+func TestMessageBus_LongPoll(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	type result struct {
+		resp *http.Response
+		body []byte
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, body := pollAs(t, ts, "alice", map[string]int{"/topic/1": 0}, http.Header{"Dont-Chunk": {"true"}})
+		done <- result{resp, body}
+	}()
+	select {
+	case <-done:
+		t.Fatal("the poll should wait for a message")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	staffReply(t, ts, map[string]interface{}{"topic_id": float64(1), "raw": "Waking up the waiting poll."})
+	select {
+	case r := <-done:
+		if r.resp.Header.Get("Cache-Control") != "must-revalidate, private, max-age=0" {
+			t.Errorf("unexpected Cache-Control: %q", r.resp.Header.Get("Cache-Control"))
+		}
+		var msgs []map[string]interface{}
+		json.Unmarshal(r.body, &msgs)
+		if len(msgs) != 1 || msgs[0]["channel"] != "/topic/1" {
+			t.Errorf("expected the new post: %s", r.body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the poll wasn't woken by the post")
+	}
+}
+
+func TestMessageBus_LongPollTimeoutAndChunks(t *testing.T) {
+	s := store.New()
+	s.Bus.LongPollInterval = 100 * time.Millisecond
+	ts, _ := serveStore(t, s)
+
+	resp, body := pollAs(t, ts, "alice", map[string]int{"/latest": 0}, http.Header{"Dont-Chunk": {"true"}})
+	if resp.StatusCode != 200 || strings.TrimSpace(string(body)) != "[]" {
+		t.Fatalf("expected an empty response at the timeout: %d: %s", resp.StatusCode, body)
+	}
+
+	staffReply(t, ts, map[string]interface{}{"topic_id": float64(1), "raw": "Something for the chunked poll."})
+	resp, body = pollAs(t, ts, "alice", map[string]int{"/latest": 0}, http.Header{})
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Errorf("chunked polls are text/plain, got %q", resp.Header.Get("Content-Type"))
+	}
+	chunks := strings.Split(string(body), "\r\n|\r\n")
+	if len(chunks) != 2 || chunks[1] != "" {
+		t.Fatalf("expected one chunk: %q", body)
+	}
+	var msgs []map[string]interface{}
+	if err := json.Unmarshal([]byte(chunks[0]), &msgs); err != nil || len(msgs) != 1 || msgs[0]["channel"] != "/latest" {
+		t.Errorf("unexpected chunk: %q", chunks[0])
+	}
+}
+
+func TestMessageBus_NotificationChannel(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	staffReply(t, ts, map[string]interface{}{"topic_id": float64(1), "raw": "@bob please take a look."})
+	msgs := busMessages(t, ts, "bob", map[string]int{"/notification/3": 0})
+	if len(msgs) != 1 {
+		t.Fatalf("expected bob's notification state: %v", msgs)
+	}
+	data := msgs[0]["data"].(map[string]interface{})
+	if data["unread_notifications"] != float64(1) || data["all_unread_notifications_count"] != float64(1) {
+		t.Errorf("unexpected counts: %v", data)
+	}
+	last := data["last_notification"].(map[string]interface{})["notification"].(map[string]interface{})
+	if last["notification_type"] != float64(1) || last["user_id"] != float64(3) {
+		t.Errorf("unexpected last notification: %v", last)
+	}
+	if got := busMessages(t, ts, "alice", map[string]int{"/notification/3": 0}); len(got) != 0 {
+		t.Errorf("alice must not see bob's notifications: %v", got)
+	}
+	if got := busMessages(t, ts, "", map[string]int{"/notification/3": 0}); len(got) != 0 {
+		t.Errorf("anonymous clients must not see bob's notifications: %v", got)
+	}
+
+	apiRequestAs(ts, "PUT", "/notifications/mark-read", "bob", nil)
+	msgs = busMessages(t, ts, "bob", map[string]int{"/notification/3": 1})
+	if len(msgs) != 1 || msgs[0]["data"].(map[string]interface{})["unread_notifications"] != float64(0) {
+		t.Errorf("marking read should publish the new state: %v", msgs)
+	}
+}
+
+func TestMessageBus_PrivateMessageScoping(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	resp, body := apiRequest(ts, "POST", "/posts", map[string]interface{}{
+		"title": "Just between the two of us", "raw": "This message is for alice only.",
+		"archetype": "private_message", "target_recipients": "alice",
+	})
+	if resp.StatusCode != 200 {
+		t.Fatalf("create message: %d: %s", resp.StatusCode, body)
+	}
+	channel := "/topic/" + strconv.Itoa(int(parseJSON(t, body)["topic_id"].(float64)))
+	if got := busMessages(t, ts, "alice", map[string]int{channel: 0}); len(got) != 1 {
+		t.Errorf("alice should see the message's post: %v", got)
+	}
+	if got := busMessages(t, ts, "bob", map[string]int{channel: 0}); len(got) != 0 {
+		t.Errorf("bob must not see the message's post: %v", got)
+	}
+	if got := busMessages(t, ts, "bob", map[string]int{"/latest": 0, "/new": 0}); len(got) != 0 {
+		t.Errorf("messages stay out of the topic lists: %v", got)
+	}
+}
+
+func TestMessageBus_Presence(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	resp, body := apiRequestAs(ts, "POST", "/presence/update", "alice", url.Values{
+		"client_id":          {"alice-tab"},
+		"present_channels[]": {"/discourse-presence/reply/1", "/discourse-presence/whisper/1"},
+	})
+	if resp.StatusCode != 200 {
+		t.Fatalf("update: %d: %s", resp.StatusCode, body)
+	}
+	if res := parseJSON(t, body); res["/discourse-presence/reply/1"] != true || res["/discourse-presence/whisper/1"] != false {
+		t.Errorf("only staff may whisper: %v", res)
+	}
+
+	_, body = apiGetAs(ts, "/presence/get?channels[]=/discourse-presence/reply/1&channels[]=/discourse-presence/whisper/1", "bob")
+	res := parseJSON(t, body)
+	reply := res["/discourse-presence/reply/1"].(map[string]interface{})
+	users := reply["users"].([]interface{})
+	if reply["count"] != float64(1) || len(users) != 1 || users[0].(map[string]interface{})["username"] != "alice" {
+		t.Errorf("alice should be replying: %v", reply)
+	}
+	if res["/discourse-presence/whisper/1"] != nil {
+		t.Errorf("bob must not see the whisper channel: %v", res)
+	}
+	msgs := busMessages(t, ts, "bob", map[string]int{"/presence/discourse-presence/reply/1": 0})
+	if len(msgs) != 1 || msgs[0]["data"].(map[string]interface{})["entering_users"] == nil {
+		t.Fatalf("expected alice entering: %v", msgs)
+	}
+
+	apiRequestAs(ts, "POST", "/presence/update", "alice", url.Values{
+		"client_id": {"alice-tab"}, "leave_channels[]": {"/discourse-presence/reply/1"},
+	})
+	msgs = busMessages(t, ts, "bob", map[string]int{"/presence/discourse-presence/reply/1": 1})
+	if len(msgs) != 1 || msgs[0]["data"].(map[string]interface{})["leaving_user_ids"].([]interface{})[0] != float64(2) {
+		t.Errorf("expected alice leaving: %v", msgs)
+	}
+	_, body = apiGetAs(ts, "/presence/get?channels[]=/discourse-presence/reply/1", "bob")
+	if reply := parseJSON(t, body)["/discourse-presence/reply/1"].(map[string]interface{}); reply["count"] != float64(0) || reply["last_message_id"] != float64(2) {
+		t.Errorf("nobody should be replying: %v", reply)
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// notificationsFor lists username's notifications, newest first.
+func notificationsFor(t *testing.T, ts *httptest.Server, username string) []map[string]interface{} {
+	t.Helper()
+	resp, body := apiGetAs(ts, "/notifications.json", username)
+	if resp.StatusCode != 200 {
+		t.Fatalf("notifications for %s: %d: %s", username, resp.StatusCode, body)
+	}
+	var list []map[string]interface{}
+	for _, n := range parseJSON(t, body)["notifications"].([]interface{}) {
+		list = append(list, n.(map[string]interface{}))
+	}
+	return list
+}
+
+func notificationTypes(list []map[string]interface{}) []int {
+	types := make([]int, len(list))
+	for i, n := range list {
+		types[i] = int(n["notification_type"].(float64))
+	}
+	return types
+}
+
+func staffReply(t *testing.T, ts *httptest.Server, body map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	resp, raw := apiRequest(ts, "POST", "/posts", body)
+	if resp.StatusCode != 200 {
+		t.Fatalf("reply: %d: %s", resp.StatusCode, raw)
+	}
+	return parseJSON(t, raw)
+}
+
+func TestNotifications_MentionReplyAndQuote(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	post := staffReply(t, ts, map[string]interface{}{
+		"topic_id": float64(1), "raw": "@bob have a look at this.", "reply_to_post_number": float64(2),
+	})
+	staffReply(t, ts, map[string]interface{}{
+		"topic_id": float64(1), "raw": "[quote=\"bob, post:1, topic:3\"]\nCan someone help me install a plugin?\n[/quote]\nSure thing.",
+	})
+
+	bob := notificationsFor(t, ts, "bob")
+	if got := notificationTypes(bob); len(got) != 2 || got[0] != 3 || got[1] != 1 {
+		t.Fatalf("expected quoted then mentioned, got %v", got)
+	}
+	mention := bob[1]
+	data := mention["data"].(map[string]interface{})
+	if mention["topic_id"] != float64(1) || mention["post_number"] != float64(3) || mention["slug"] != "welcome-to-discourse" ||
+		data["topic_title"] != "Welcome to Discourse" || data["original_post_id"] != post["id"] ||
+		data["original_post_type"] != float64(1) || data["original_username"] != "admin" || data["display_username"] != "admin" {
+		t.Errorf("unexpected mention: %v", mention)
+	}
+
+	alice := notificationsFor(t, ts, "alice")
+	if got := notificationTypes(alice); len(got) != 1 || got[0] != 2 || alice[0]["post_number"] != float64(3) {
+		t.Errorf("expected alice to be notified of the reply: %v", alice)
+	}
+	// Mentions inside a quote don't notify, nor does mentioning yourself.
+	staffReply(t, ts, map[string]interface{}{
+		"topic_id": float64(1), "raw": "[quote=\"admin\"]\n@alice said hello\n[/quote]\nThanks @admin.",
+	})
+	if got := notificationsFor(t, ts, "alice"); len(got) != 1 {
+		t.Errorf("alice should not be notified of a quoted mention: %v", got)
+	}
+}
+
+func TestNotifications_GroupMention(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	resp, body := apiRequest(ts, "POST", "/admin/groups", map[string]interface{}{
+		"group": map[string]interface{}{"name": "designers", "mentionable_level": float64(99)},
+	})
+	if resp.StatusCode != 200 {
+		t.Fatalf("create group: %d: %s", resp.StatusCode, body)
+	}
+	id := strconv.Itoa(int(parseJSON(t, body)["basic_group"].(map[string]interface{})["id"].(float64)))
+	apiRequest(ts, "PUT", "/admin/groups/"+id+"/members.json", map[string]interface{}{"usernames": "alice,bob"})
+
+	staffReply(t, ts, map[string]interface{}{"topic_id": float64(2), "raw": "@designers please review, and @bob too."})
+	bob := notificationsFor(t, ts, "bob")
+	if got := notificationTypes(bob); len(got) != 1 || got[0] != 1 {
+		t.Errorf("bob should only be notified once, as mentioned: %v", got)
+	}
+	alice := notificationsFor(t, ts, "alice")
+	if len(alice) != 1 || alice[0]["notification_type"] != float64(15) {
+		t.Fatalf("expected a group mention for alice: %v", alice)
+	}
+	if data := alice[0]["data"].(map[string]interface{}); data["group_name"] != "designers" || data["group_id"] == nil {
+		t.Errorf("unexpected group mention data: %v", data)
+	}
+
+	// A group nobody may mention notifies no one.
+	apiRequest(ts, "PUT", "/groups/"+id, map[string]interface{}{"mentionable_level": float64(0)})
+	staffReply(t, ts, map[string]interface{}{"topic_id": float64(2), "raw": "@designers one more time."})
+	if got := notificationsFor(t, ts, "alice"); len(got) != 1 {
+		t.Errorf("unmentionable group should not notify: %v", got)
+	}
+}
+
+func TestNotifications_WatchingAndMuting(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	// bob created topic 3, so he watches it.
+	resp, body := apiRequestAs(ts, "POST", "/posts", "alice", map[string]interface{}{"topic_id": float64(3), "raw": "Try reinstalling it."})
+	if resp.StatusCode != 200 {
+		t.Fatalf("reply: %d: %s", resp.StatusCode, body)
+	}
+	bob := notificationsFor(t, ts, "bob")
+	if len(bob) != 1 || bob[0]["notification_type"] != float64(9) || bob[0]["topic_id"] != float64(3) {
+		t.Fatalf("expected bob to be notified as a watcher: %v", bob)
+	}
+
+	apiRequestAs(ts, "POST", "/t/3/notifications", "bob", map[string]interface{}{"notification_level": "muted"})
+	staffReply(t, ts, map[string]interface{}{"topic_id": float64(3), "raw": "@bob are you still there?"})
+	if got := notificationsFor(t, ts, "bob"); len(got) != 1 {
+		t.Errorf("muted topic should not notify: %v", got)
+	}
+
+	// Watching a category's first posts notifies of new topics only.
+	apiRequestAs(ts, "POST", "/category/1/notifications", "bob", map[string]interface{}{"notification_level": float64(4)})
+	resp, body = apiRequest(ts, "POST", "/posts", map[string]interface{}{
+		"title": "Announcing the new release", "raw": "It is out now, go get it.", "category": float64(1),
+	})
+	if resp.StatusCode != 200 {
+		t.Fatalf("create topic: %d: %s", resp.StatusCode, body)
+	}
+	topicID := parseJSON(t, body)["topic_id"]
+	staffReply(t, ts, map[string]interface{}{"topic_id": topicID, "raw": "A follow up to the release."})
+	bob = notificationsFor(t, ts, "bob")
+	if got := notificationTypes(bob); len(got) != 2 || got[0] != 17 || bob[0]["topic_id"] != topicID || bob[0]["post_number"] != float64(1) {
+		t.Errorf("expected one watching_first_post notification: %v", bob)
+	}
+}
+
+func TestNotifications_EditMentions(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	post := replyAs(t, ts, "alice", "Thanks for the help.")
+	id := strconv.Itoa(int(post["id"].(float64)))
+	resp, body := apiRequest(ts, "PUT", "/posts/"+id, map[string]interface{}{
+		"post": map[string]interface{}{"raw": "Thanks for the help, @bob.", "edit_reason": "credit"},
+	})
+	if resp.StatusCode != 200 {
+		t.Fatalf("edit: %d: %s", resp.StatusCode, body)
+	}
+	if bob := notificationsFor(t, ts, "bob"); len(bob) != 1 || bob[0]["notification_type"] != float64(1) {
+		t.Errorf("expected bob to be notified of the new mention: %v", bob)
+	}
+	alice := notificationsFor(t, ts, "alice")
+	if len(alice) != 1 || alice[0]["notification_type"] != float64(4) {
+		t.Fatalf("expected alice to be told her post was edited: %v", alice)
+	}
+	if data := alice[0]["data"].(map[string]interface{}); data["display_username"] != "admin" || data["revision_number"] != float64(2) {
+		t.Errorf("unexpected edited data: %v", data)
+	}
+}
+
+func TestNotifications_LikesConsolidate(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	like := func(username string, postID float64) {
+		t.Helper()
+		if resp, body := apiRequestAs(ts, "POST", "/post_actions.json", username, map[string]interface{}{
+			"id": postID, "post_action_type_id": float64(2),
+		}); resp.StatusCode != 200 {
+			t.Fatalf("like by %s: %d: %s", username, resp.StatusCode, body)
+		}
+	}
+	// The badges for first likes would be notified as well.
+	for _, badge := range []string{"5", "11"} {
+		apiRequest(ts, "PUT", "/admin/badges/"+badge+".json", map[string]interface{}{"enabled": false})
+	}
+	like("bob", 2)
+	like("admin", 2)
+	alice := notificationsFor(t, ts, "alice")
+	if len(alice) != 1 || alice[0]["notification_type"] != float64(5) {
+		t.Fatalf("expected one liked notification: %v", alice)
+	}
+	if data := alice[0]["data"].(map[string]interface{}); data["username"] != "admin" || data["username2"] != "bob" || data["count"] != float64(2) {
+		t.Errorf("unexpected liked data: %v", data)
+	}
+
+	// bob liking more than three of admin's posts consolidates his likes.
+	for _, p := range []float64{1, 3} {
+		like("bob", p)
+	}
+	post := staffReply(t, ts, map[string]interface{}{"topic_id": float64(2), "raw": "Another useful answer."})
+	like("bob", post["id"].(float64))
+	if got := notificationTypes(notificationsFor(t, ts, "admin")); len(got) != 3 {
+		t.Fatalf("expected three liked notifications, got %v", got)
+	}
+	post = staffReply(t, ts, map[string]interface{}{"topic_id": float64(2), "raw": "And one more answer."})
+	like("bob", post["id"].(float64))
+	admin := notificationsFor(t, ts, "admin")
+	if got := notificationTypes(admin); len(got) != 1 || got[0] != 19 {
+		t.Fatalf("expected a liked_consolidated notification, got %v", got)
+	}
+	if data := admin[0]["data"].(map[string]interface{}); data["username"] != "bob" || data["count"] != float64(4) {
+		t.Errorf("unexpected consolidated data: %v", data)
+	}
+}
+
+func TestNotifications_PrivateMessagesAndInvites(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	resp, body := apiRequestAs(ts, "POST", "/posts", "alice", map[string]interface{}{
+		"title": "A private question for you", "raw": "Could you take a look at this?",
+		"archetype": "private_message", "target_recipients": "bob",
+	})
+	if resp.StatusCode != 200 {
+		t.Fatalf("create message: %d: %s", resp.StatusCode, body)
+	}
+	topicID := parseJSON(t, body)["topic_id"].(float64)
+	bob := notificationsFor(t, ts, "bob")
+	if len(bob) != 1 || bob[0]["notification_type"] != float64(6) || bob[0]["high_priority"] != true {
+		t.Fatalf("expected a private_message notification: %v", bob)
+	}
+	_, body = apiGetAs(ts, "/topics/private-messages/bob.json", "bob")
+	if topics := parseJSON(t, body)["topic_list"].(map[string]interface{})["topics"].([]interface{}); len(topics) != 1 {
+		t.Errorf("bob should see the message: %s", body)
+	}
+
+	tid := strconv.Itoa(int(topicID))
+	if resp, _ := apiRequestAs(ts, "POST", "/t/"+tid+"/invite", "admin", map[string]interface{}{"user": "bob"}); resp.StatusCode != 200 {
+		t.Errorf("staff should be able to invite: %d", resp.StatusCode)
+	}
+	if resp, _ := apiRequest(ts, "POST", "/t/"+tid+"/invite", map[string]interface{}{"user": "nobody"}); resp.StatusCode != 422 {
+		t.Errorf("expected 422 for an unknown user, got %d", resp.StatusCode)
+	}
+	if got := notificationsFor(t, ts, "bob"); len(got) != 2 || got[0]["notification_type"] != float64(7) {
+		t.Errorf("expected invited_to_private_message: %v", got)
+	}
+
+	if resp, body := apiRequestAs(ts, "POST", "/t/1/invite", "bob", map[string]interface{}{"user": "alice"}); resp.StatusCode != 200 {
+		t.Fatalf("invite: %d: %s", resp.StatusCode, body)
+	}
+	alice := notificationsFor(t, ts, "alice")
+	if alice[0]["notification_type"] != float64(13) || alice[0]["topic_id"] != float64(1) {
+		t.Fatalf("expected invited_to_topic: %v", alice[0])
+	}
+	if data := alice[0]["data"].(map[string]interface{}); data["display_username"] != "bob" || data["topic_title"] != "Welcome to Discourse" {
+		t.Errorf("unexpected invite data: %v", data)
+	}
+}
+
+func TestNotifications_GrantedBadge(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	if resp, body := apiRequest(ts, "POST", "/user_badges", map[string]interface{}{"username": "bob", "badge_id": float64(2)}); resp.StatusCode != 200 {
+		t.Fatalf("grant: %d: %s", resp.StatusCode, body)
+	}
+	bob := notificationsFor(t, ts, "bob")
+	if len(bob) != 1 || bob[0]["notification_type"] != float64(12) {
+		t.Fatalf("expected a granted_badge notification: %v", bob)
+	}
+	data := bob[0]["data"].(map[string]interface{})
+	if data["badge_id"] != float64(2) || data["badge_name"] != "Member" || data["badge_slug"] != "member" ||
+		data["badge_title"] != false || data["username"] != "bob" {
+		t.Errorf("unexpected badge data: %v", data)
+	}
+}
+
+func notificationTotals(t *testing.T, ts *httptest.Server, username string) map[string]interface{} {
+	t.Helper()
+	resp, body := apiGetAs(ts, "/notifications/totals", username)
+	if resp.StatusCode != 200 {
+		t.Fatalf("totals for %s: %d: %s", username, resp.StatusCode, body)
+	}
+	return parseJSON(t, body)
+}
+
+func TestNotifications_ReadStateAndTotals(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	if resp, body := apiRequestAs(ts, "POST", "/posts", "alice", map[string]interface{}{
+		"title": "Quick private question here", "raw": "Do you have a minute to chat?", "target_usernames": "bob",
+	}); resp.StatusCode != 200 {
+		t.Fatalf("create message: %d: %s", resp.StatusCode, body)
+	}
+	for _, raw := range []string{"First ping for @bob.", "Second ping for @bob.", "Third ping for @bob."} {
+		staffReply(t, ts, map[string]interface{}{"topic_id": float64(2), "raw": raw})
+	}
+
+	totals := notificationTotals(t, ts, "bob")
+	if totals["total_notifications"] != float64(4) || totals["unread_notifications"] != float64(3) || totals["unread_high_priority"] != float64(1) {
+		t.Errorf("unexpected totals: %v", totals)
+	}
+	_, body := apiGetAs(ts, "/session/current.json", "bob")
+	if cu := parseJSON(t, body)["current_user"].(map[string]interface{}); cu["username"] != "bob" || cu["unread_notifications"] != float64(3) || cu["unread_high_priority_notifications"] != float64(1) {
+		t.Errorf("unexpected current user: %v", cu)
+	}
+
+	// Paging.
+	_, body = apiGetAs(ts, "/notifications.json?limit=3", "bob")
+	page := parseJSON(t, body)
+	if len(page["notifications"].([]interface{})) != 3 || page["total_rows_notifications"] != float64(4) ||
+		page["load_more_notifications"] != "/notifications?offset=3&username=bob" {
+		t.Errorf("unexpected first page: %s", body)
+	}
+	_, body = apiGetAs(ts, "/notifications.json?limit=3&offset=3", "bob")
+	if rest := parseJSON(t, body)["notifications"].([]interface{}); len(rest) != 1 || rest[0].(map[string]interface{})["notification_type"] != float64(6) {
+		t.Errorf("unexpected second page: %s", body)
+	}
+
+	// The notifications menu lists the unread message first and marks
+	// everything seen, which clears the low priority badge.
+	_, body = apiGetAs(ts, "/notifications.json?recent=true&limit=2", "bob")
+	recent := parseJSON(t, body)
+	list := recent["notifications"].([]interface{})
+	if len(list) != 2 || list[0].(map[string]interface{})["notification_type"] != float64(6) || recent["seen_notification_id"] == float64(0) {
+		t.Errorf("unexpected recent list: %s", body)
+	}
+	if totals := notificationTotals(t, ts, "bob"); totals["unread_notifications"] != float64(0) || totals["unread_high_priority"] != float64(1) {
+		t.Errorf("unexpected totals after seeing: %v", totals)
+	}
+
+	// Mark one read by id, then the message by type, then the rest.
+	id := list[1].(map[string]interface{})["id"]
+	if resp, body := apiRequestAs(ts, "PUT", "/notifications/mark-read", "bob", map[string]interface{}{"id": id}); resp.StatusCode != 200 {
+		t.Fatalf("mark read: %d: %s", resp.StatusCode, body)
+	}
+	if read := notificationsFor(t, ts, "bob"); len(read) != 4 {
+		t.Fatalf("marking read should keep the notification: %v", read)
+	}
+	_, body = apiGetAs(ts, "/notifications.json?filter=read", "bob")
+	if read := parseJSON(t, body)["notifications"].([]interface{}); len(read) != 1 || read[0].(map[string]interface{})["id"] != id {
+		t.Errorf("unexpected read notifications: %s", body)
+	}
+	apiRequestAs(ts, "PUT", "/notifications/mark-read", "bob", map[string]interface{}{"dismiss_types": "private_message"})
+	if totals := notificationTotals(t, ts, "bob"); totals["unread_high_priority"] != float64(0) {
+		t.Errorf("message should be read: %v", totals)
+	}
+	apiRequestAs(ts, "PUT", "/notifications/mark-read", "bob", nil)
+	_, body = apiGetAs(ts, "/notifications.json?filter=unread", "bob")
+	if unread := parseJSON(t, body)["notifications"].([]interface{}); len(unread) != 0 {
+		t.Errorf("expected everything read: %s", body)
+	}
+}
+
+func TestNotifications_AccessAndAdmin(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+	staffReply(t, ts, map[string]interface{}{"topic_id": float64(2), "raw": "Ping for @bob."})
+	id := strconv.Itoa(int(notificationsFor(t, ts, "bob")[0]["id"].(float64)))
+
+	if resp, _ := apiGetAs(ts, "/notifications.json?username=bob", "alice"); resp.StatusCode != 403 {
+		t.Errorf("expected 403 listing another user's notifications, got %d", resp.StatusCode)
+	}
+	if resp, body := apiGetAs(ts, "/notifications.json?username=bob", "admin"); resp.StatusCode != 200 || len(parseJSON(t, body)["notifications"].([]interface{})) != 1 {
+		t.Errorf("staff should see bob's notifications: %d: %s", resp.StatusCode, body)
+	}
+	if resp, _ := apiGetAs(ts, "/notifications/"+id, "alice"); resp.StatusCode != 404 {
+		t.Errorf("expected 404 for another user's notification, got %d", resp.StatusCode)
+	}
+	if resp, body := apiGetAs(ts, "/notifications/"+id, "bob"); resp.StatusCode != 200 || parseJSON(t, body)["notification"] == nil {
+		t.Errorf("bob should see his notification: %d: %s", resp.StatusCode, body)
+	}
+	if resp, _ := apiRequestAs(ts, "DELETE", "/notifications/"+id, "bob", nil); resp.StatusCode != 403 {
+		t.Errorf("only admins may delete notifications, got %d", resp.StatusCode)
+	}
+
+	resp, body := apiRequest(ts, "PUT", "/notifications/"+id, map[string]interface{}{"notification": map[string]interface{}{"read": true}})
+	if resp.StatusCode != 200 || parseJSON(t, body)["read"] != true {
+		t.Errorf("update: %d: %s", resp.StatusCode, body)
+	}
+	if resp, _ := apiRequest(ts, "DELETE", "/notifications/"+id, nil); resp.StatusCode != 200 {
+		t.Errorf("delete: %d", resp.StatusCode)
+	}
+	if got := notificationsFor(t, ts, "bob"); len(got) != 0 {
+		t.Errorf("expected the notification to be deleted: %v", got)
+	}
+}
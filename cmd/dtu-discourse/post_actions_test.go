@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func likeSummary(t *testing.T, post map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	summary, _ := post["actions_summary"].([]interface{})
+	for _, s := range summary {
+		if entry, _ := s.(map[string]interface{}); entry["id"] == float64(2) {
+			return entry
+		}
+	}
+	t.Fatalf("no like entry in actions_summary: %v", post["actions_summary"])
+	return nil
+}
+
+func topicLikeCount(t *testing.T, ts *httptest.Server, id string) float64 {
+	t.Helper()
+	_, body := apiGet(ts, "/t/"+id+".json")
+	n, _ := parseJSON(t, body)["like_count"].(float64)
+	return n
+}
+
+func TestPostActions_LikeDedupeAndUndo(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+	before := topicLikeCount(t, ts, "3")
+
+	like := map[string]interface{}{"id": float64(4), "post_action_type_id": float64(2)}
+	resp, body := apiRequest(ts, "POST", "/post_actions.json", like)
+	if resp.StatusCode != 200 {
+		t.Fatalf("like: %d: %s", resp.StatusCode, body)
+	}
+	entry := likeSummary(t, parseJSON(t, body))
+	if entry["count"] != float64(1) || entry["acted"] != true || entry["can_undo"] != true {
+		t.Errorf("unexpected like summary: %v", entry)
+	}
+
+	resp, body = apiRequest(ts, "POST", "/post_actions.json", like)
+	if resp.StatusCode != 403 {
+		t.Fatalf("expected 403 for a repeated like, got %d: %s", resp.StatusCode, body)
+	}
+	if got := topicLikeCount(t, ts, "3"); got != before+1 {
+		t.Errorf("expected topic like_count %v, got %v", before+1, got)
+	}
+
+	resp, body = apiGet(ts, "/post_action_users.json?id=4&post_action_type_id=2")
+	users, _ := parseJSON(t, body)["post_action_users"].([]interface{})
+	if resp.StatusCode != 200 || len(users) != 1 || users[0].(map[string]interface{})["username"] != "admin" {
+		t.Errorf("unexpected post_action_users: %d %s", resp.StatusCode, body)
+	}
+
+	resp, body = apiRequest(ts, "DELETE", "/post_actions/4.json?post_action_type_id=2", nil)
+	if resp.StatusCode != 200 {
+		t.Fatalf("undo like: %d: %s", resp.StatusCode, body)
+	}
+	if entry := likeSummary(t, parseJSON(t, body)); entry["count"] != float64(0) || entry["acted"] != nil {
+		t.Errorf("unexpected summary after undo: %v", entry)
+	}
+	if got := topicLikeCount(t, ts, "3"); got != before {
+		t.Errorf("expected topic like_count back to %v, got %v", before, got)
+	}
+}
+
+func TestPostActions_UndoWindow(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	resp, body := apiRequest(ts, "POST", "/post_actions.json", map[string]interface{}{
+		"id": float64(4), "post_action_type_id": float64(2),
+	})
+	if resp.StatusCode != 200 {
+		t.Fatalf("like: %d: %s", resp.StatusCode, body)
+	}
+	apiRequest(ts, "PUT", "/admin/site_settings/post_undo_action_window_mins", map[string]interface{}{
+		"post_undo_action_window_mins": float64(0),
+	})
+	resp, body = apiRequest(ts, "DELETE", "/post_actions/4.json?post_action_type_id=2", nil)
+	if resp.StatusCode != 403 {
+		t.Fatalf("expected 403 outside the undo window, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestPostActions_DeletedPost(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+	before := topicLikeCount(t, ts, "1")
+	resp, body := apiRequestAs(ts, "POST", "/posts", "alice", map[string]interface{}{"topic_id": float64(1), "raw": "A reply that won't last long."})
+	if resp.StatusCode != 200 {
+		t.Fatalf("reply: %d: %s", resp.StatusCode, body)
+	}
+	postID := parseJSON(t, body)["id"].(float64)
+	id := strconv.Itoa(int(postID))
+	if resp, body := apiRequest(ts, "POST", "/post_actions.json", map[string]interface{}{"id": postID, "post_action_type_id": float64(2)}); resp.StatusCode != 200 {
+		t.Fatalf("like: %d: %s", resp.StatusCode, body)
+	}
+
+	// Deleting the post takes its likes with it.
+	if resp, body := apiRequest(ts, "DELETE", "/posts/"+id, nil); resp.StatusCode != 200 {
+		t.Fatalf("delete post: %d: %s", resp.StatusCode, body)
+	}
+	if got := topicLikeCount(t, ts, "1"); got != before {
+		t.Errorf("expected topic like_count back to %v, got %v", before, got)
+	}
+	if resp, body := apiRequest(ts, "DELETE", "/post_actions/"+id+".json?post_action_type_id=2", nil); resp.StatusCode != 404 {
+		t.Errorf("expected 404 undoing a like on a deleted post, got %d: %s", resp.StatusCode, body)
+	}
+	if resp, body := apiRequest(ts, "POST", "/post_actions.json", map[string]interface{}{"id": postID, "post_action_type_id": float64(2)}); resp.StatusCode != 404 {
+		t.Errorf("expected 404 liking a deleted post, got %d: %s", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func submitQueued(t *testing.T, ts *httptest.Server, username string, body map[string]interface{}, reason string) map[string]interface{} {
+	t.Helper()
+	resp, raw := apiRequestAs(ts, "POST", "/posts", username, body)
+	if resp.StatusCode != 200 {
+		t.Fatalf("submit by %s: %d: %s", username, resp.StatusCode, raw)
+	}
+	res := parseJSON(t, raw)
+	if res["action"] != "enqueued" || res["reason"] != reason {
+		t.Fatalf("expected the post to be enqueued for %s: %s", reason, raw)
+	}
+	return res["pending_post"].(map[string]interface{})
+}
+
+func pendingPosts(t *testing.T, ts *httptest.Server, username string) []interface{} {
+	t.Helper()
+	resp, body := apiGetAs(ts, "/posts/"+username+"/pending.json", username)
+	if resp.StatusCode != 200 {
+		t.Fatalf("pending posts: %d: %s", resp.StatusCode, body)
+	}
+	return parseJSON(t, body)["pending_posts"].([]interface{})
+}
+
+func TestQueuedPosts_ApproveReply(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+	apiRequest(ts, "PUT", "/admin/site_settings/approve_unless_trust_level", map[string]interface{}{
+		"approve_unless_trust_level": float64(3),
+	})
+
+	pp := submitQueued(t, ts, "alice", map[string]interface{}{
+		"topic_id": float64(1), "raw": "Held until a moderator looks at it.",
+	}, "trust_level")
+	if pp["raw_text"] != "Held until a moderator looks at it." || pp["topic_id"] != float64(1) || pp["username"] != "alice" {
+		t.Errorf("unexpected pending post: %v", pp)
+	}
+	if list := pendingPosts(t, ts, "alice"); len(list) != 1 {
+		t.Fatalf("expected one pending post, got %v", list)
+	}
+	if resp, _ := apiGetAs(ts, "/posts/alice/pending.json", "bob"); resp.StatusCode != 403 {
+		t.Errorf("expected 403 for another user's pending posts, got %d", resp.StatusCode)
+	}
+
+	id := strconv.Itoa(int(pp["id"].(float64)))
+	resp, body := apiRequest(ts, "PUT", "/review/"+id+"/perform/approve_post", nil)
+	if resp.StatusCode != 200 {
+		t.Fatalf("approve: %d: %s", resp.StatusCode, body)
+	}
+	if len(pendingPosts(t, ts, "alice")) != 0 {
+		t.Error("approved post should no longer be pending")
+	}
+	_, body = apiGet(ts, "/review/"+id)
+	rv := parseJSON(t, body)["reviewable"].(map[string]interface{})
+	if rv["status"] != float64(1) || rv["target_type"] != "Post" {
+		t.Fatalf("unexpected reviewable after approval: %v", rv)
+	}
+	_, body = apiGet(ts, "/posts/"+strconv.Itoa(int(rv["target_id"].(float64)))+".json")
+	if post := parseJSON(t, body); post["username"] != "alice" || post["topic_id"] != float64(1) || post["post_number"] != float64(3) {
+		t.Errorf("unexpected approved post: %v", post)
+	}
+}
+
+func TestQueuedPosts_RejectNewTopic(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+	apiRequest(ts, "PUT", "/admin/site_settings/approve_post_count", map[string]interface{}{
+		"approve_post_count": float64(5),
+	})
+
+	pp := submitQueued(t, ts, "bob", map[string]interface{}{
+		"title": "My very first topic here", "raw": "Hello everyone, glad to join.",
+	}, "post_count")
+	if pp["title"] != "My very first topic here" {
+		t.Errorf("unexpected pending post: %v", pp)
+	}
+	id := strconv.Itoa(int(pp["id"].(float64)))
+	if resp, body := apiRequest(ts, "PUT", "/review/"+id+"/perform/reject_post", nil); resp.StatusCode != 200 {
+		t.Fatalf("reject: %d: %s", resp.StatusCode, body)
+	}
+	if resp, _ := apiRequest(ts, "PUT", "/review/"+id+"/perform/approve_post", nil); resp.StatusCode != 403 {
+		t.Errorf("expected 403 approving a rejected post, got %d", resp.StatusCode)
+	}
+	if resp, _ := apiGet(ts, "/t/4.json"); resp.StatusCode != 404 {
+		t.Errorf("rejected topic should not exist, got %d", resp.StatusCode)
+	}
+
+	// alice is above trust level 1, so her post count doesn't matter.
+	if resp, body := apiRequestAs(ts, "POST", "/posts", "alice", map[string]interface{}{
+		"title": "Another topic for everyone", "raw": "Published without approval.",
+	}); resp.StatusCode != 200 || parseJSON(t, body)["action"] == "enqueued" {
+		t.Errorf("expected alice's topic to be published: %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestQueuedPosts_CategoryRequiresApproval(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+	apiRequest(ts, "PUT", "/categories/2", map[string]interface{}{
+		"custom_fields": map[string]interface{}{"require_reply_approval": "true"},
+	})
+
+	submitQueued(t, ts, "alice", map[string]interface{}{
+		"topic_id": float64(3), "raw": "Have you tried turning it off and on?",
+	}, "category")
+	if resp, body := apiRequest(ts, "POST", "/posts", map[string]interface{}{
+		"topic_id": float64(3), "raw": "Staff replies skip the queue.",
+	}); resp.StatusCode != 200 || parseJSON(t, body)["action"] == "enqueued" {
+		t.Errorf("expected the staff reply to be published: %d: %s", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/lightcap/dtu-discourse/internal/store"
+)
+
+func expectRateLimited(t *testing.T, resp *http.Response, body []byte, code string) map[string]interface{} {
+	t.Helper()
+	if resp.StatusCode != 429 {
+		t.Fatalf("expected 429, got %d: %s", resp.StatusCode, body)
+	}
+	res := parseJSON(t, body)
+	extras, _ := res["extras"].(map[string]interface{})
+	if res["error_type"] != "rate_limit" || extras == nil || extras["wait_seconds"] == nil {
+		t.Errorf("unexpected rate limit body: %s", body)
+	}
+	if resp.Header.Get("Retry-After") == "" || resp.Header.Get("Discourse-Rate-Limit-Error-Code") != code {
+		t.Errorf("unexpected headers: %v", resp.Header)
+	}
+	return res
+}
+
+func TestRateLimits_Replies(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	replyAs(t, ts, "alice", "The first of two quick replies.")
+	resp, body := apiRequestAs(ts, "POST", "/posts", "alice", map[string]interface{}{
+		"topic_id": float64(1), "raw": "The second of two quick replies.",
+	})
+	res := expectRateLimited(t, resp, body, "create_post")
+	if msg := res["errors"].([]interface{})[0]; msg != "You’re replying too quickly. Please wait 5 seconds before trying again." {
+		t.Errorf("unexpected message: %v", msg)
+	}
+	if resp.Header.Get("Retry-After") != "5" {
+		t.Errorf("Retry-After = %q", resp.Header.Get("Retry-After"))
+	}
+
+	// Staff are never limited.
+	for i, raw := range []string{"Staff reply number one.", "Staff reply number two."} {
+		if resp, body := apiRequest(ts, "POST", "/posts", map[string]interface{}{"topic_id": float64(1), "raw": raw}); resp.StatusCode != 200 {
+			t.Errorf("staff reply %d: %d: %s", i, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestRateLimits_LikesAndMessagesPerDay(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+	apiRequest(ts, "PUT", "/admin/site_settings/max_likes_per_day", map[string]interface{}{"max_likes_per_day": float64(1)})
+	apiRequest(ts, "PUT", "/admin/site_settings/max_personal_messages_per_day", map[string]interface{}{"max_personal_messages_per_day": float64(1)})
+	apiRequest(ts, "PUT", "/admin/site_settings/rate_limit_create_topic", map[string]interface{}{"rate_limit_create_topic": float64(0)})
+
+	like := func(postID float64) (*http.Response, []byte) {
+		return apiRequestAs(ts, "POST", "/post_actions.json", "bob", map[string]interface{}{"id": postID, "post_action_type_id": float64(2)})
+	}
+	if resp, body := like(1); resp.StatusCode != 200 {
+		t.Fatalf("first like: %d: %s", resp.StatusCode, body)
+	}
+	resp, body := like(2)
+	expectRateLimited(t, resp, body, "create_like")
+
+	pm := func(title, raw string) (*http.Response, []byte) {
+		return apiRequestAs(ts, "POST", "/posts", "alice", map[string]interface{}{
+			"title": title, "raw": raw, "archetype": "private_message", "target_usernames": "bob",
+		})
+	}
+	if resp, body := pm("A quick question for you", "Just checking in with you."); resp.StatusCode != 200 {
+		t.Fatalf("first message: %d: %s", resp.StatusCode, body)
+	}
+	resp, body = pm("Another quick question", "One more thing I forgot.")
+	expectRateLimited(t, resp, body, "pms_per_day")
+}
+
+func TestRateLimits_GlobalRequestLimits(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	apiRequest(ts, "PUT", "/admin/site_settings/max_admin_api_reqs_per_minute", map[string]interface{}{
+		"max_admin_api_reqs_per_minute": float64(2),
+	})
+	apiGet(ts, "/latest.json")
+	apiGet(ts, "/latest.json")
+	resp, body := apiGet(ts, "/latest.json")
+	expectRateLimited(t, resp, body, "admin_api_key_rate_limit")
+	// The limit is per key, so the admin key still works.
+	if resp, body := apiRequest(ts, "PUT", "/admin/site_settings/max_admin_api_reqs_per_minute", map[string]interface{}{
+		"max_admin_api_reqs_per_minute": float64(0),
+	}); resp.StatusCode != 200 {
+		t.Errorf("admin key should not be limited: %d: %s", resp.StatusCode, body)
+	}
+
+	apiRequest(ts, "PUT", "/admin/site_settings/max_reqs_per_ip_per_10_seconds", map[string]interface{}{
+		"max_reqs_per_ip_per_10_seconds": float64(2),
+	})
+	apiGet(ts, "/latest.json")
+	apiGet(ts, "/latest.json")
+	resp, body = apiGet(ts, "/latest.json")
+	expectRateLimited(t, resp, body, "ip_10_secs_limit")
+}
+
+func TestRateLimits_Disabled(t *testing.T) {
+	s := store.New()
+	s.RateLimitsDisabled = true
+	ts, _ := serveStore(t, s)
+
+	replyAs(t, ts, "alice", "The first of two quick replies.")
+	replyAs(t, ts, "alice", "The second of two quick replies.")
+}
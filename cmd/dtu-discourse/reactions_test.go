@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func toggleReaction(t *testing.T, ts *httptest.Server, username, reaction string) map[string]interface{} {
+	t.Helper()
+	resp, body := apiRequestAs(ts, "PUT", "/discourse-reactions/posts/4/custom-reactions/"+reaction+"/toggle.json", username, nil)
+	if resp.StatusCode != 200 {
+		t.Fatalf("toggle %s by %s: %d: %s", reaction, username, resp.StatusCode, body)
+	}
+	return parseJSON(t, body)
+}
+
+func reactionCount(post map[string]interface{}, id string) float64 {
+	list, _ := post["reactions"].([]interface{})
+	for _, r := range list {
+		if entry, _ := r.(map[string]interface{}); entry["id"] == id {
+			return entry["count"].(float64)
+		}
+	}
+	return 0
+}
+
+func TestReactions_Toggle(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	resp, _ := apiRequest(ts, "PUT", "/discourse-reactions/posts/4/custom-reactions/clap/toggle.json", nil)
+	if resp.StatusCode != 422 {
+		t.Errorf("expected 422 for a reaction that isn't enabled, got %d", resp.StatusCode)
+	}
+
+	post := toggleReaction(t, ts, "admin", "laughing")
+	cur, _ := post["current_user_reaction"].(map[string]interface{})
+	if reactionCount(post, "laughing") != 1 || cur["id"] != "laughing" || cur["can_undo"] != true {
+		t.Errorf("unexpected post after reacting: %v", post)
+	}
+	toggleReaction(t, ts, "alice", "laughing")
+
+	// Switching to the main reaction replaces laughing with a like.
+	post = toggleReaction(t, ts, "admin", "heart")
+	if reactionCount(post, "laughing") != 1 || reactionCount(post, "heart") != 1 ||
+		post["current_user_used_main_reaction"] != true || post["reaction_users_count"] != float64(2) {
+		t.Errorf("unexpected post after switching to heart: %v", post)
+	}
+	if entry := likeSummary(t, post); entry["count"] != float64(1) || entry["acted"] != true {
+		t.Errorf("heart should count as a like: %v", entry)
+	}
+
+	post = toggleReaction(t, ts, "admin", "heart")
+	if reactionCount(post, "heart") != 0 || post["current_user_reaction"] != nil {
+		t.Errorf("unexpected post after removing heart: %v", post)
+	}
+}
+
+func TestReactions_Lists(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+	toggleReaction(t, ts, "admin", "hugs")
+	toggleReaction(t, ts, "alice", "hugs")
+	toggleReaction(t, ts, "bob", "heart")
+
+	resp, body := apiGet(ts, "/discourse-reactions/posts/4/reactions-users.json")
+	groups, _ := parseJSON(t, body)["reaction_users"].([]interface{})
+	if resp.StatusCode != 200 || len(groups) != 2 {
+		t.Fatalf("unexpected reactions-users: %d %s", resp.StatusCode, body)
+	}
+	first := groups[0].(map[string]interface{})
+	if first["id"] != "hugs" || first["count"] != float64(2) || len(first["users"].([]interface{})) != 2 {
+		t.Errorf("unexpected first group: %v", first)
+	}
+
+	_, body = apiGet(ts, "/discourse-reactions/posts/4/reactions-users.json?reaction_value=heart")
+	groups, _ = parseJSON(t, body)["reaction_users"].([]interface{})
+	if len(groups) != 1 || groups[0].(map[string]interface{})["id"] != "heart" {
+		t.Errorf("reaction_value filter not applied: %s", body)
+	}
+
+	resp, body = apiGet(ts, "/discourse-reactions/posts/reactions.json?username=bob")
+	given := parseArray(t, body)
+	if resp.StatusCode != 200 || len(given) != 1 || given[0]["post_id"] != float64(4) {
+		t.Fatalf("unexpected reactions.json: %d %s", resp.StatusCode, body)
+	}
+	if reaction, _ := given[0]["reaction"].(map[string]interface{}); reaction["reaction_value"] != "heart" {
+		t.Errorf("bob's like should be listed as heart: %v", given[0])
+	}
+
+	_, body = apiGet(ts, "/t/3.json")
+	posts := parseJSON(t, body)["post_stream"].(map[string]interface{})["posts"].([]interface{})
+	for _, p := range posts {
+		if p := p.(map[string]interface{}); p["id"] == float64(4) && reactionCount(p, "hugs") != 2 {
+			t.Errorf("topic view missing reactions: %v", p["reactions"])
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// replyTo posts a reply in topic 1 to the given post number and returns
+// the new post's id.
+func replyTo(t *testing.T, ts *httptest.Server, postNumber int, raw string) int {
+	t.Helper()
+	resp, body := apiRequest(ts, "POST", "/posts", map[string]interface{}{
+		"topic_id": float64(1), "raw": raw, "reply_to_post_number": float64(postNumber),
+	})
+	if resp.StatusCode != 200 {
+		t.Fatalf("create reply: %d: %s", resp.StatusCode, body)
+	}
+	post := parseJSON(t, body)
+	if postNumber > 0 {
+		if user, _ := post["reply_to_user"].(map[string]interface{}); user["username"] == nil {
+			t.Errorf("reply_to_user missing: %v", post)
+		}
+	}
+	return int(post["id"].(float64))
+}
+
+func parseArray(t *testing.T, data []byte) []map[string]interface{} {
+	t.Helper()
+	var out []map[string]interface{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatalf("decode %s: %v", data, err)
+	}
+	return out
+}
+
+func TestReplies_Graph(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	// Post 2 (alice) already replies to post 1. Build 1 <- 2 <- 3 <- 4.
+	third := replyTo(t, ts, 2, "Replying to alice's thank-you note.")
+	fourth := replyTo(t, ts, 3, "And a reply to that reply.")
+	replyTo(t, ts, 0, "A plain reply to the topic.")
+
+	resp, body := apiGet(ts, "/posts/2/replies.json")
+	replies := parseArray(t, body)
+	if resp.StatusCode != 200 || len(replies) != 1 || replies[0]["id"] != float64(third) {
+		t.Errorf("unexpected replies: %d %s", resp.StatusCode, body)
+	}
+
+	resp, body = apiGet(ts, "/posts/"+strconv.Itoa(fourth)+"/reply-history.json")
+	history := parseArray(t, body)
+	if resp.StatusCode != 200 || len(history) != 3 ||
+		history[0]["post_number"] != float64(1) || history[2]["post_number"] != float64(3) {
+		t.Errorf("unexpected reply history: %d %s", resp.StatusCode, body)
+	}
+
+	resp, body = apiGet(ts, "/posts/1/reply-ids.json")
+	ids := parseArray(t, body)
+	if resp.StatusCode != 200 || len(ids) != 3 || ids[0]["id"] != float64(2) || ids[2]["level"] != float64(3) {
+		t.Errorf("unexpected reply ids: %d %s", resp.StatusCode, body)
+	}
+
+	resp, body = apiGet(ts, "/posts/2.json")
+	if post := parseJSON(t, body); post["reply_count"] != float64(1) {
+		t.Errorf("expected post 2 reply_count 1, got %v", post["reply_count"])
+	}
+	resp, body = apiGet(ts, "/t/1.json")
+	if topic := parseJSON(t, body); topic["reply_count"] != float64(3) {
+		t.Errorf("expected topic reply_count 3, got %v", topic["reply_count"])
+	}
+
+	if resp, body := apiRequest(ts, "DELETE", "/posts/"+strconv.Itoa(fourth)+".json", nil); resp.StatusCode != 200 {
+		t.Fatalf("delete: %d: %s", resp.StatusCode, body)
+	}
+	resp, body = apiGet(ts, "/posts/"+strconv.Itoa(third)+".json")
+	if post := parseJSON(t, body); post["reply_count"] != float64(0) {
+		t.Errorf("expected reply_count 0 after delete, got %v", post["reply_count"])
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRevisions_EditRecordsRevision(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	resp, body := apiRequest(ts, "PUT", "/posts/3.json", map[string]interface{}{
+		"post": map[string]interface{}{"raw": "Here is a short guide on using the Discourse API.", "edit_reason": "tighten wording"},
+	})
+	if resp.StatusCode != 200 {
+		t.Fatalf("update: %d: %s", resp.StatusCode, body)
+	}
+
+	resp, body = apiGet(ts, "/posts/3/revisions/latest.json")
+	if resp.StatusCode != 200 {
+		t.Fatalf("latest: %d: %s", resp.StatusCode, body)
+	}
+	rev := parseJSON(t, body)
+	if rev["current_revision"] != float64(2) || rev["previous_revision"] != float64(1) || rev["next_revision"] != nil {
+		t.Errorf("unexpected navigation: %v", rev)
+	}
+	if rev["version_count"] != float64(2) || rev["username"] != "admin" || rev["edit_reason"] != "tighten wording" {
+		t.Errorf("unexpected revision metadata: %v", rev)
+	}
+	changes, _ := rev["body_changes"].(map[string]interface{})
+	inline, _ := changes["inline"].(string)
+	if !strings.HasPrefix(inline, `<div class="inline-diff">`) || !strings.Contains(inline, "<ins>short") {
+		t.Errorf("unexpected inline diff: %s", inline)
+	}
+	side, _ := changes["side_by_side"].(string)
+	if strings.Count(side, `<div class="revision-content">`) != 2 || !strings.Contains(side, "<ins>short") {
+		t.Errorf("unexpected side-by-side diff: %s", side)
+	}
+	if md, _ := changes["side_by_side_markdown"].(string); !strings.Contains(md, `<td class="diff-ins">`) {
+		t.Errorf("unexpected markdown diff: %s", md)
+	}
+
+	resp, body = apiGet(ts, "/posts/3/revisions/2.json")
+	if resp.StatusCode != 200 || parseJSON(t, body)["current_revision"] != float64(2) {
+		t.Errorf("revision 2: %d: %s", resp.StatusCode, body)
+	}
+	if resp, _ := apiGet(ts, "/posts/3/revisions/3.json"); resp.StatusCode != 404 {
+		t.Errorf("expected 404 for missing revision, got %d", resp.StatusCode)
+	}
+}
+
+func TestRevisions_TopicChanges(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	resp, body := apiRequest(ts, "PUT", "/t/-/2.json", map[string]interface{}{
+		"topic": map[string]interface{}{
+			"title": "How to use the REST API", "category_id": float64(3), "tags": []interface{}{"api"},
+		},
+	})
+	if resp.StatusCode != 200 {
+		t.Fatalf("update topic: %d: %s", resp.StatusCode, body)
+	}
+
+	resp, body = apiGet(ts, "/posts/3/revisions/latest.json")
+	if resp.StatusCode != 200 {
+		t.Fatalf("latest: %d: %s", resp.StatusCode, body)
+	}
+	rev := parseJSON(t, body)
+	title, _ := rev["title_changes"].(map[string]interface{})
+	if inline, _ := title["inline"].(string); !strings.Contains(inline, "<ins>REST") {
+		t.Errorf("unexpected title diff: %v", title)
+	}
+	cat, _ := rev["category_id_changes"].(map[string]interface{})
+	if cat["previous"] != float64(1) || cat["current"] != float64(3) {
+		t.Errorf("unexpected category changes: %v", cat)
+	}
+	tags, _ := rev["tags_changes"].(map[string]interface{})
+	if prev, _ := tags["previous"].([]interface{}); len(prev) != 2 {
+		t.Errorf("unexpected tag changes: %v", tags)
+	}
+}
+
+func TestRevisions_RevertHideAndDelete(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	original := "Here is a guide on using the Discourse API."
+	resp, body := apiRequest(ts, "PUT", "/posts/3.json", map[string]interface{}{
+		"post": map[string]interface{}{"raw": "Vandalised."},
+	})
+	if resp.StatusCode != 200 {
+		t.Fatalf("update: %d: %s", resp.StatusCode, body)
+	}
+
+	resp, body = apiRequest(ts, "PUT", "/posts/3/revisions/2/revert", nil)
+	if resp.StatusCode != 200 {
+		t.Fatalf("revert: %d: %s", resp.StatusCode, body)
+	}
+	post := parseJSON(t, body)
+	if post["raw"] != original || post["version"] != float64(3) {
+		t.Errorf("revert did not restore raw: %v", post)
+	}
+	resp, body = apiGet(ts, "/posts/3/revisions/latest.json")
+	if rev := parseJSON(t, body); resp.StatusCode != 200 || rev["edit_reason"] != "reverted to version #1" {
+		t.Errorf("unexpected revert revision: %d %v", resp.StatusCode, rev)
+	}
+
+	if resp, body := apiRequest(ts, "PUT", "/posts/3/revisions/2/hide", nil); resp.StatusCode != 200 {
+		t.Fatalf("hide: %d: %s", resp.StatusCode, body)
+	}
+	if resp, _ := apiGetAs(ts, "/posts/3/revisions/2.json", "alice"); resp.StatusCode != 403 {
+		t.Errorf("expected hidden revision to be forbidden, got %d", resp.StatusCode)
+	}
+	if resp, _ := apiRequest(ts, "PUT", "/posts/3/revisions/2/show", nil); resp.StatusCode != 200 {
+		t.Fatalf("show: %d", resp.StatusCode)
+	}
+	if resp, _ := apiGetAs(ts, "/posts/3/revisions/2.json", "alice"); resp.StatusCode != 200 {
+		t.Errorf("expected shown revision, got %d", resp.StatusCode)
+	}
+
+	if resp, _ := apiRequest(ts, "DELETE", "/posts/3/revisions/permanently_delete", nil); resp.StatusCode != 200 {
+		t.Fatalf("permanently delete: %d", resp.StatusCode)
+	}
+	resp, body = apiGet(ts, "/posts/3/revisions/latest.json")
+	if rev := parseJSON(t, body); resp.StatusCode != 200 || rev["current_revision"] != float64(1) {
+		t.Errorf("expected only the original version after delete: %v", rev)
+	}
+}
+
+func TestRevisions_EditConflict(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	resp, body := apiRequest(ts, "PUT", "/posts/3.json", map[string]interface{}{
+		"post": map[string]interface{}{
+			"raw":           "Here is a guide on using the Discourse API, updated.",
+			"original_text": "Here is a guide on using the Discourse API.",
+		},
+	})
+	if resp.StatusCode != 200 {
+		t.Fatalf("update with matching original_text: %d: %s", resp.StatusCode, body)
+	}
+
+	resp, body = apiRequest(ts, "PUT", "/posts/3.json", map[string]interface{}{
+		"post": map[string]interface{}{
+			"raw":           "A stale edit.",
+			"original_text": "Here is a guide on using the Discourse API.",
+		},
+	})
+	if resp.StatusCode != 409 {
+		t.Fatalf("expected 409, got %d: %s", resp.StatusCode, body)
+	}
+	errs, _ := parseJSON(t, body)["errors"].([]interface{})
+	if len(errs) != 1 || errs[0] != "someone else edited this post" {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+	resp, body = apiGet(ts, "/posts/3.json")
+	if post := parseJSON(t, body); post["raw"] != "Here is a guide on using the Discourse API, updated." {
+		t.Errorf("conflicting edit was applied: %v", post["raw"])
+	}
+}
+
+func TestRevisions_GracePeriod(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	resp, body := apiRequest(ts, "POST", "/posts", map[string]interface{}{
+		"topic_id": float64(1), "raw": "A reply with a typpo in it.",
+	})
+	if resp.StatusCode != 200 {
+		t.Fatalf("create post: %d: %s", resp.StatusCode, body)
+	}
+	id := strconv.Itoa(int(parseJSON(t, body)["id"].(float64)))
+	edit := func(raw, reason string) map[string]interface{} {
+		t.Helper()
+		resp, body := apiRequest(ts, "PUT", "/posts/"+id+".json", map[string]interface{}{
+			"post": map[string]interface{}{"raw": raw, "edit_reason": reason},
+		})
+		if resp.StatusCode != 200 {
+			t.Fatalf("update: %d: %s", resp.StatusCode, body)
+		}
+		post, _ := parseJSON(t, body)["post"].(map[string]interface{})
+		return post
+	}
+
+	if post := edit("A reply with a typo in it.", ""); post["version"] != float64(1) {
+		t.Errorf("grace-period edit created a version: %v", post["version"])
+	}
+	if post := edit("A reply with a typo in it, explained.", "add context"); post["version"] != float64(2) {
+		t.Errorf("edit with a reason should create a version: %v", post["version"])
+	}
+	if post := edit("A reply with a typo in it, explained better.", ""); post["version"] != float64(2) {
+		t.Errorf("grace-period edit created a version: %v", post["version"])
+	}
+
+	resp, body = apiGet(ts, "/posts/"+id+"/revisions/latest.json")
+	rev := parseJSON(t, body)
+	if resp.StatusCode != 200 || rev["current_revision"] != float64(2) {
+		t.Fatalf("latest: %d: %s", resp.StatusCode, body)
+	}
+	changes, _ := rev["body_changes"].(map[string]interface{})
+	if inline, _ := changes["inline"].(string); !strings.Contains(inline, "better") {
+		t.Errorf("grace-period edit not folded into revision 2: %s", inline)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestSolved_AcceptAndUnaccept(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	// Topic 3 is bob's question in Support, which has solutions enabled.
+	resp, body := apiRequestAs(ts, "POST", "/posts", "alice", map[string]interface{}{
+		"topic_id": float64(3), "raw": "Copy it into the plugins directory and rebuild.",
+	})
+	if resp.StatusCode != 200 {
+		t.Fatalf("reply: %d: %s", resp.StatusCode, body)
+	}
+	answerID := parseJSON(t, body)["id"].(float64)
+	answer := map[string]interface{}{"id": answerID}
+
+	_, body = apiGetAs(ts, "/posts/"+strconv.Itoa(int(answerID))+".json", "bob")
+	if post := parseJSON(t, body); post["can_accept_answer"] != true {
+		t.Errorf("topic author should be able to accept: %v", post)
+	}
+	if resp, _ := apiRequestAs(ts, "POST", "/solution/accept", "alice", answer); resp.StatusCode != 403 {
+		t.Errorf("expected 403 for a non-owner below the trust level, got %d", resp.StatusCode)
+	}
+
+	resp, body = apiRequestAs(ts, "POST", "/solution/accept", "bob", answer)
+	if resp.StatusCode != 200 {
+		t.Fatalf("accept: %d: %s", resp.StatusCode, body)
+	}
+	if accepted := parseJSON(t, body); accepted["post_number"] != float64(2) || accepted["accepter_username"] != "bob" {
+		t.Errorf("unexpected accepted answer: %v", accepted)
+	}
+
+	_, body = apiGetAs(ts, "/t/3.json", "bob")
+	topic := parseJSON(t, body)
+	if topic["has_accepted_answer"] != true || topic["accepted_answer"] == nil {
+		t.Errorf("topic not marked solved: %v", topic)
+	}
+	posts := topic["post_stream"].(map[string]interface{})["posts"].([]interface{})
+	reply := posts[1].(map[string]interface{})
+	if reply["accepted_answer"] != true || reply["can_unaccept_answer"] != true || reply["can_accept_answer"] != false {
+		t.Errorf("unexpected answer post: %v", reply)
+	}
+
+	_, body = apiGet(ts, "/search?q=status:solved")
+	topics, _ := parseJSON(t, body)["topics"].([]interface{})
+	if len(topics) != 1 || topics[0].(map[string]interface{})["id"] != float64(3) {
+		t.Errorf("unexpected status:solved results: %s", body)
+	}
+
+	resp, body = apiRequestAs(ts, "POST", "/solution/unaccept", "bob", answer)
+	if resp.StatusCode != 200 {
+		t.Fatalf("unaccept: %d: %s", resp.StatusCode, body)
+	}
+	_, body = apiGet(ts, "/search?q=plugins+status:unsolved")
+	topics, _ = parseJSON(t, body)["topics"].([]interface{})
+	if len(topics) != 1 {
+		t.Errorf("expected topic 3 to be unsolved again: %s", body)
+	}
+}
+
+func TestSolved_CategoryMustAllowSolutions(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	// Post 2 replies in General, where solutions are off.
+	answer := map[string]interface{}{"id": float64(2)}
+	if resp, _ := apiRequest(ts, "POST", "/solution/accept", answer); resp.StatusCode != 403 {
+		t.Errorf("expected 403 outside a solved category, got %d", resp.StatusCode)
+	}
+	apiRequest(ts, "PUT", "/categories/1", map[string]interface{}{
+		"custom_fields": map[string]interface{}{"enable_accepted_answers": "true"},
+	})
+	if resp, body := apiRequest(ts, "POST", "/solution/accept", answer); resp.StatusCode != 200 {
+		t.Errorf("expected staff to accept once enabled, got %d: %s", resp.StatusCode, body)
+	}
+}
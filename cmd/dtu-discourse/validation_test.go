@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func expectErrors(t *testing.T, ts *httptest.Server, username string, body map[string]interface{}, want ...string) {
+	t.Helper()
+	resp, raw := apiRequestAs(ts, "POST", "/posts", username, body)
+	if resp.StatusCode != 422 {
+		t.Fatalf("expected 422, got %d: %s", resp.StatusCode, raw)
+	}
+	var got []string
+	for _, e := range parseJSON(t, raw)["errors"].([]interface{}) {
+		got = append(got, e.(string))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("errors = %q, want %q", got, want)
+	}
+}
+
+func TestValidation_TitleAndBody(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	expectErrors(t, ts, "alice", map[string]interface{}{"title": "Hi", "raw": "Too short"},
+		"Title is too short (minimum is 5 characters)",
+		"Body is too short (minimum is 10 characters)")
+	expectErrors(t, ts, "alice", map[string]interface{}{"title": "aaaa aaaa aaaa", "raw": "A perfectly fine body."},
+		"Title seems unclear, is it a complete sentence?")
+	expectErrors(t, ts, "alice", map[string]interface{}{"title": "PLEASE HELP ME NOW", "raw": "A perfectly fine body."},
+		"Title seems unclear, is it a complete sentence?")
+
+	apiRequest(ts, "PUT", "/admin/site_settings/max_post_length", map[string]interface{}{"max_post_length": float64(20)})
+	expectErrors(t, ts, "alice", map[string]interface{}{"topic_id": float64(1), "raw": "This reply runs past the limit."},
+		"Body is too long (maximum is 20 characters)")
+}
+
+func TestValidation_DuplicatesAndMentions(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	reply := map[string]interface{}{"topic_id": float64(1), "raw": "Same words, posted twice."}
+	if resp, body := apiRequestAs(ts, "POST", "/posts", "alice", reply); resp.StatusCode != 200 {
+		t.Fatalf("first reply: %d: %s", resp.StatusCode, body)
+	}
+	expectErrors(t, ts, "alice", reply, "Body is too similar to what you recently posted")
+	if resp, _ := apiRequest(ts, "POST", "/posts", reply); resp.StatusCode != 200 {
+		t.Error("staff should be exempt from the duplicate check")
+	}
+
+	apiRequest(ts, "PUT", "/admin/site_settings/max_mentions_per_post", map[string]interface{}{"max_mentions_per_post": float64(1)})
+	expectErrors(t, ts, "alice", map[string]interface{}{"topic_id": float64(1), "raw": "Paging @admin and @bob about this."},
+		"Sorry, you can only mention 1 users in a post.")
+}
+
+func TestValidation_NewUserLimits(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+	apiRequest(ts, "PUT", "/admin/users/3/trust_level", map[string]interface{}{"level": float64(0)})
+
+	expectErrors(t, ts, "bob", map[string]interface{}{
+		"topic_id": float64(1),
+		"raw":      "See https://a.example, https://b.example and https://c.example.\n\n![one](https://a.example/1.png) ![two](https://a.example/2.png)",
+	},
+		"Sorry, new users can only put 2 links in a post.",
+		"Sorry, new users can only put one embedded media item in a post.")
+}
+
+func TestValidation_ReadOnlyCategory(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+	apiRequest(ts, "PUT", "/categories/2", map[string]interface{}{
+		"permissions": map[string]interface{}{"everyone": float64(3)},
+	})
+
+	topic := map[string]interface{}{"title": "Question about plugins", "raw": "How do I install one?", "category": float64(2)}
+	expectErrors(t, ts, "alice", topic, "You are not permitted to create topics in this category.")
+	if resp, body := apiRequest(ts, "POST", "/posts", topic); resp.StatusCode != 200 {
+		t.Errorf("staff should still create topics: %d: %s", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func watchWord(t *testing.T, ts *httptest.Server, word, action, replacement string) {
+	t.Helper()
+	resp, body := apiRequest(ts, "POST", "/admin/customize/watched_words.json", map[string]interface{}{
+		"word": word, "action_key": action, "replacement": replacement,
+	})
+	if resp.StatusCode != 200 {
+		t.Fatalf("watch %q: %d: %s", word, resp.StatusCode, body)
+	}
+}
+
+func replyAs(t *testing.T, ts *httptest.Server, username, raw string) map[string]interface{} {
+	t.Helper()
+	resp, body := apiRequestAs(ts, "POST", "/posts", username, map[string]interface{}{"topic_id": float64(1), "raw": raw})
+	if resp.StatusCode != 200 {
+		t.Fatalf("reply by %s: %d: %s", username, resp.StatusCode, body)
+	}
+	return parseJSON(t, body)
+}
+
+func TestWatchedWords_Block(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+	watchWord(t, ts, "darn", "block", "")
+	watchWord(t, ts, "heck*", "block", "")
+
+	expectErrors(t, ts, "alice", map[string]interface{}{"topic_id": float64(1), "raw": "Well, DARN it all to pieces."},
+		"Your post contains a word that's not allowed: DARN")
+	expectErrors(t, ts, "alice", map[string]interface{}{"title": "What the hecking darn thing", "raw": "A perfectly fine body."},
+		"Your post contains multiple words that aren't allowed: darn, hecking")
+	replyAs(t, ts, "alice", "A darnell is not a blocked word.")
+
+	resp, body := apiRequest(ts, "PUT", "/u/bob/preferences/username", map[string]interface{}{"new_username": "darn"})
+	if resp.StatusCode != 422 || !strings.Contains(string(body), "not allowed: darn") {
+		t.Errorf("expected the username to be blocked, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestWatchedWords_CensorReplaceAndLink(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+	watchWord(t, ts, "rude", "censor", "")
+	watchWord(t, ts, "colour", "replace", "color")
+	watchWord(t, ts, "docs", "link", "https://example.com/docs")
+
+	post := replyAs(t, ts, "alice", "That rude colour is covered in the docs.")
+	cooked := post["cooked"].(string)
+	for _, want := range []string{"■■■■", "color", `<a href="https://example.com/docs" rel="noopener nofollow ugc">docs</a>`} {
+		if !strings.Contains(cooked, want) {
+			t.Errorf("cooked %q missing %q", cooked, want)
+		}
+	}
+	if strings.Contains(cooked, "rude") || strings.Contains(cooked, "colour") {
+		t.Errorf("cooked still has the original words: %q", cooked)
+	}
+	if post["raw"] != "That rude colour is covered in the docs." {
+		t.Errorf("raw should be untouched: %v", post["raw"])
+	}
+}
+
+func TestWatchedWords_TagAndCaseSensitive(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+	watchWord(t, ts, "plugin*", "tag", "plugins,help")
+	apiRequest(ts, "POST", "/admin/customize/watched_words.json", map[string]interface{}{
+		"word": "API", "action_key": "tag", "replacement": "api", "case_sensitive": true,
+	})
+
+	resp, body := apiRequestAs(ts, "POST", "/posts", "alice", map[string]interface{}{
+		"title": "Installing plugins on a new site", "raw": "Which api should I call first?",
+	})
+	if resp.StatusCode != 200 {
+		t.Fatalf("create topic: %d: %s", resp.StatusCode, body)
+	}
+	topicID := int(parseJSON(t, body)["topic_id"].(float64))
+	_, body = apiGet(ts, "/t/"+strconv.Itoa(topicID)+".json")
+	tags, _ := parseJSON(t, body)["tags"].([]interface{})
+	if len(tags) != 2 || tags[0] != "plugins" || tags[1] != "help" {
+		t.Errorf("unexpected tags: %v", tags)
+	}
+}
+
+func TestWatchedWords_RequireApproval(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+	watchWord(t, ts, "casino", "require_approval", "")
+
+	resp, body := apiRequestAs(ts, "POST", "/posts", "alice", map[string]interface{}{
+		"topic_id": float64(1), "raw": "Try my casino, it is great.",
+	})
+	if resp.StatusCode != 200 {
+		t.Fatalf("reply: %d: %s", resp.StatusCode, body)
+	}
+	res := parseJSON(t, body)
+	if res["action"] != "enqueued" || res["pending_count"] != float64(1) {
+		t.Errorf("unexpected enqueue response: %v", res)
+	}
+	rv := pendingReviewable(t, ts)
+	if rv["type"] != "ReviewableQueuedPost" || rv["payload"].(map[string]interface{})["raw"] != "Try my casino, it is great." {
+		t.Errorf("unexpected reviewable: %v", rv)
+	}
+
+	// Staff posts go straight through.
+	if resp, body := apiRequest(ts, "POST", "/posts", map[string]interface{}{
+		"topic_id": float64(1), "raw": "Staff talking about the casino.",
+	}); resp.StatusCode != 200 || parseJSON(t, body)["id"] == nil {
+		t.Errorf("staff post should be created: %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestWatchedWords_FlagAndSilence(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+	watchWord(t, ts, "scam", "flag", "")
+	watchWord(t, ts, "spamlink", "silence", "")
+
+	post := replyAs(t, ts, "alice", "This looks like a scam to me.")
+	rv := pendingReviewable(t, ts)
+	if rv["type"] != "ReviewableFlaggedPost" || rv["target_id"] != post["id"] {
+		t.Errorf("unexpected reviewable: %v", rv)
+	}
+
+	replyAs(t, ts, "bob", "Visit my spamlink today please.")
+	_, body := apiGet(ts, "/u/bob.json")
+	if user := parseJSON(t, body)["user"].(map[string]interface{}); user["silenced"] != true {
+		t.Errorf("bob should be silenced: %v", user)
+	}
+}
+
+func TestWatchedWords_AdminListUploadAndClear(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+
+	upload := func(csv string) (*http.Response, []byte) {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		mw.WriteField("action_key", "replace")
+		fw, _ := mw.CreateFormFile("file", "words.csv")
+		fw.Write([]byte(csv))
+		mw.Close()
+		req, _ := http.NewRequest("POST", ts.URL+"/admin/customize/watched_words/upload", &buf)
+		req.Header.Set("Api-Key", "test_api_key")
+		req.Header.Set("Api-Username", "system")
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, body
+	}
+	if resp, body := upload("colour,color\nfavourite,favorite,true\n"); resp.StatusCode != 200 {
+		t.Fatalf("upload: %d: %s", resp.StatusCode, body)
+	}
+	// A bad row rejects the whole file.
+	if resp, body := upload("grey,gray\ncentre\n"); resp.StatusCode != 422 || !strings.Contains(string(body), "Row 2: Replacement can't be blank") {
+		t.Errorf("expected 422 naming the bad row, got %d: %s", resp.StatusCode, body)
+	}
+
+	_, body := apiGet(ts, "/admin/customize/watched_words.json")
+	// The seed data already watches one blocked word.
+	words := parseJSON(t, body)["words"].([]interface{})
+	if len(words) != 3 {
+		t.Fatalf("expected 3 words: %s", body)
+	}
+	fav := words[2].(map[string]interface{})
+	if fav["word"] != "favourite" || fav["action"] != "replace" || fav["replacement"] != "favorite" || fav["case_sensitive"] != true {
+		t.Errorf("unexpected word: %v", fav)
+	}
+
+	if resp, body := apiRequest(ts, "POST", "/admin/customize/watched_words.json", map[string]interface{}{
+		"word": "grey", "action_key": "replace",
+	}); resp.StatusCode != 422 || !strings.Contains(string(body), "Replacement can't be blank") {
+		t.Errorf("expected 422 without a replacement, got %d: %s", resp.StatusCode, body)
+	}
+
+	apiRequest(ts, "DELETE", "/admin/customize/watched_words/action/replace.json", nil)
+	_, body = apiGet(ts, "/admin/customize/watched_words.json")
+	if words := parseJSON(t, body)["words"].([]interface{}); len(words) != 1 {
+		t.Errorf("expected the replace words to be cleared: %s", body)
+	}
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lightcap/dtu-discourse/internal/middleware"
+	"github.com/lightcap/dtu-discourse/internal/store"
+	"github.com/lightcap/dtu-discourse/internal/webhook"
+)
+
+// hookDelivery is a request received by hookReceiver.
+type hookDelivery struct {
+	Header http.Header
+	Body   []byte
+}
+
+// hookReceiver starts a web hook endpoint that passes on what it is sent.
+func hookReceiver(t *testing.T) (*httptest.Server, chan hookDelivery) {
+	t.Helper()
+	received := make(chan hookDelivery, 20)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- hookDelivery{Header: r.Header.Clone(), Body: body}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, received
+}
+
+func nextDelivery(t *testing.T, received chan hookDelivery) hookDelivery {
+	t.Helper()
+	select {
+	case d := <-received:
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("no web hook delivery arrived")
+	}
+	return hookDelivery{}
+}
+
+func createWebHook(t *testing.T, ts *httptest.Server, attrs map[string]interface{}) int {
+	t.Helper()
+	resp, body := apiRequest(ts, "POST", "/admin/api/web_hooks.json", map[string]interface{}{"web_hook": attrs})
+	if resp.StatusCode != 200 {
+		t.Fatalf("create web hook: %d: %s", resp.StatusCode, body)
+	}
+	return int(parseJSON(t, body)["web_hook"].(map[string]interface{})["id"].(float64))
+}
+
+func signed(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestWebHooks_SignedTopicAndPostEvents(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+	receiver, received := hookReceiver(t)
+	id := createWebHook(t, ts, map[string]interface{}{
+		"payload_url": receiver.URL, "secret": "very-secret-key", "content_type": float64(1),
+		"web_hook_event_type_ids": []interface{}{float64(101), float64(201)},
+	})
+
+	_, body := apiGet(ts, "/admin/api/web_hooks/"+strconv.Itoa(id)+".json")
+	hook := parseJSON(t, body)["web_hook"].(map[string]interface{})
+	if types := hook["web_hook_event_types"].([]interface{}); len(types) != 2 || hook["active"] != true {
+		t.Fatalf("unexpected web hook: %s", body)
+	}
+
+	staffReply(t, ts, map[string]interface{}{"title": "Web hooks are now delivered", "raw": "Every active hook is told about this topic.", "category": float64(2)})
+	topic := nextDelivery(t, received)
+	post := nextDelivery(t, received)
+	for _, c := range []struct {
+		d           hookDelivery
+		event, kind string
+	}{{topic, "topic_created", "topic"}, {post, "post_created", "post"}} {
+		h := c.d.Header
+		if h.Get("X-Discourse-Event") != c.event || h.Get("X-Discourse-Event-Type") != c.kind {
+			t.Errorf("expected %s, got %s %s", c.event, h.Get("X-Discourse-Event"), h.Get("X-Discourse-Event-Type"))
+		}
+		if h.Get("X-Discourse-Instance") == "" || h.Get("X-Discourse-Event-Id") == "" || h.Get("Content-Type") != "application/json" {
+			t.Errorf("missing headers: %v", h)
+		}
+		if got := h.Get("X-Discourse-Event-Signature"); got != signed("very-secret-key", c.d.Body) {
+			t.Errorf("%s: signature %q does not match the body", c.event, got)
+		}
+	}
+	if topic.Header.Get("X-Discourse-Event-Id") == post.Header.Get("X-Discourse-Event-Id") {
+		t.Error("expected each delivery to have its own event id")
+	}
+	var payload map[string]map[string]interface{}
+	json.Unmarshal(topic.Body, &payload)
+	if payload["topic"]["title"] != "Web hooks are now delivered" || payload["topic"]["created_by"].(map[string]interface{})["username"] != "admin" {
+		t.Errorf("unexpected topic payload: %s", topic.Body)
+	}
+	json.Unmarshal(post.Body, &payload)
+	if payload["post"]["raw"] != "Every active hook is told about this topic." || payload["post"]["category_slug"] != "support" {
+		t.Errorf("unexpected post payload: %s", post.Body)
+	}
+
+	// Replies still match post_created; likes aren't subscribed to, and
+	// an inactive hook hears nothing.
+	staffReply(t, ts, map[string]interface{}{"topic_id": float64(1), "raw": "A reply the hook hears about."})
+	apiRequestAs(ts, "POST", "/post_actions", "bob", map[string]interface{}{"id": float64(1), "post_action_type_id": float64(2)})
+	staffReply(t, ts, map[string]interface{}{"topic_id": float64(1), "raw": "A second reply the hook hears about."})
+	for _, want := range []string{"A reply the hook hears about.", "A second reply the hook hears about."} {
+		d := nextDelivery(t, received)
+		json.Unmarshal(d.Body, &payload)
+		if d.Header.Get("X-Discourse-Event") != "post_created" || payload["post"]["raw"] != want {
+			t.Errorf("expected post_created for %q, got %s: %s", want, d.Header.Get("X-Discourse-Event"), d.Body)
+		}
+	}
+	apiRequest(ts, "PUT", "/admin/api/web_hooks/"+strconv.Itoa(id), map[string]interface{}{"web_hook": map[string]interface{}{"active": false}})
+	staffReply(t, ts, map[string]interface{}{"topic_id": float64(1), "raw": "Nobody hears about this reply."})
+	select {
+	case d := <-received:
+		t.Errorf("expected no delivery for an inactive hook, got %s", d.Body)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestWebHooks_FiltersAndURLEncoded(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+	receiver, received := hookReceiver(t)
+	createWebHook(t, ts, map[string]interface{}{
+		"payload_url": receiver.URL, "secret": "form-secret-key", "content_type": float64(2),
+		"wildcard_web_hook": true, "category_ids": []interface{}{float64(3)}, "tag_names": []interface{}{"api"},
+	})
+	if resp, _ := apiRequest(ts, "POST", "/admin/api/web_hooks.json", map[string]interface{}{"web_hook": map[string]interface{}{"payload_url": "not a url"}}); resp.StatusCode != 422 {
+		t.Errorf("expected an invalid payload URL to be refused, got %d", resp.StatusCode)
+	}
+
+	// Only the topic in Meta tagged api passes both filters.
+	staffReply(t, ts, map[string]interface{}{"title": "Tagged api but in Support", "raw": "This topic is in the wrong category.", "category": float64(2), "tags": []interface{}{"api"}})
+	staffReply(t, ts, map[string]interface{}{"title": "In Meta but not tagged api", "raw": "This topic has the wrong tags on it.", "category": float64(3), "tags": []interface{}{"howto"}})
+	staffReply(t, ts, map[string]interface{}{"title": "In Meta and tagged api", "raw": "This topic is what the hook wants.", "category": float64(3), "tags": []interface{}{"api"}})
+
+	d := nextDelivery(t, received)
+	if d.Header.Get("Content-Type") != "application/x-www-form-urlencoded" || d.Header.Get("X-Discourse-Event") != "topic_created" {
+		t.Fatalf("expected a url-encoded topic_created, got %v", d.Header)
+	}
+	if got := d.Header.Get("X-Discourse-Event-Signature"); got != signed("form-secret-key", d.Body) {
+		t.Errorf("signature %q does not match the body", got)
+	}
+	form, err := url.ParseQuery(string(d.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payload map[string]map[string]interface{}
+	if err := json.Unmarshal([]byte(form.Get("payload")), &payload); err != nil || payload["topic"]["title"] != "In Meta and tagged api" {
+		t.Errorf("unexpected payload: %s", d.Body)
+	}
+	if d = nextDelivery(t, received); d.Header.Get("X-Discourse-Event") != "post_created" {
+		t.Errorf("expected the topic's first post next, got %s", d.Header.Get("X-Discourse-Event"))
+	}
+}
+
+func TestWebHooks_UserGroupAndLikeEvents(t *testing.T) {
+	ts := testServer(t)
+	defer ts.Close()
+	receiver, received := hookReceiver(t)
+	createWebHook(t, ts, map[string]interface{}{
+		"payload_url": receiver.URL, "web_hook_event_type_ids": []interface{}{float64(308), float64(401), float64(1001), float64(1401)},
+	})
+
+	apiRequest(ts, "PUT", "/admin/users/3/suspend", map[string]interface{}{"suspend_until": "2099-01-01", "reason": "spam"})
+	d := nextDelivery(t, received)
+	var payload map[string]map[string]interface{}
+	json.Unmarshal(d.Body, &payload)
+	if d.Header.Get("X-Discourse-Event") != "user_suspended" || payload["user"]["username"] != "bob" {
+		t.Errorf("expected user_suspended for bob, got %s: %s", d.Header.Get("X-Discourse-Event"), d.Body)
+	}
+	if d.Header.Get("X-Discourse-Event-Signature") != "" {
+		t.Error("expected no signature without a secret")
+	}
+
+	apiRequest(ts, "POST", "/admin/groups", map[string]interface{}{"group": map[string]interface{}{"name": "hooked"}})
+	if d = nextDelivery(t, received); d.Header.Get("X-Discourse-Event") != "group_created" || d.Header.Get("X-Discourse-Event-Type") != "group" {
+		t.Errorf("expected group_created, got %v", d.Header)
+	}
+
+	apiRequestAs(ts, "POST", "/post_actions", "alice", map[string]interface{}{"id": float64(1), "post_action_type_id": float64(2)})
+	like := nextDelivery(t, received)
+	var likePayload map[string]map[string]map[string]interface{}
+	json.Unmarshal(like.Body, &likePayload)
+	if like.Header.Get("X-Discourse-Event") != "post_liked" || likePayload["like"]["user"]["username"] != "alice" || likePayload["like"]["post"]["id"] != float64(1) {
+		t.Errorf("expected alice's like, got %s", like.Body)
+	}
+	if n := nextDelivery(t, received); n.Header.Get("X-Discourse-Event") != "notification_created" {
+		t.Errorf("expected the liked notification, got %s", n.Header.Get("X-Discourse-Event"))
+	}
+}
+
+// webHookEvents polls a web hook's event log until ready accepts it.
+func webHookEvents(t *testing.T, ts *httptest.Server, path string, ready func([]interface{}) bool) []interface{} {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, body := apiGet(ts, path)
+		events := parseJSON(t, body)["web_hook_events"].([]interface{})
+		if ready(events) {
+			return events
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("web hook events never settled: %s", body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebHooks_EventLogRetriesRedeliveryAndPing(t *testing.T) {
+	s := store.New()
+	s.Hooks.SetRetryPolicy(2, 10*time.Millisecond)
+	ts, _ := serveStore(t, s)
+
+	// The receiver fails the first request and accepts the rest.
+	var calls atomic.Int32
+	received := make(chan hookDelivery, 20)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- hookDelivery{Header: r.Header.Clone(), Body: body}
+		if calls.Add(1) == 1 {
+			w.Header().Set("X-Receiver", "down")
+			http.Error(w, "receiver is down", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("thanks"))
+	}))
+	defer receiver.Close()
+	id := createWebHook(t, ts, map[string]interface{}{
+		"payload_url": receiver.URL, "web_hook_event_type_ids": []interface{}{float64(201)},
+	})
+	eventsPath := "/admin/api/web_hooks/" + strconv.Itoa(id) + "/events.json"
+
+	staffReply(t, ts, map[string]interface{}{"topic_id": float64(1), "raw": "A reply the receiver fails to take."})
+	first, retried := nextDelivery(t, received), nextDelivery(t, received)
+	if first.Header.Get("X-Discourse-Event-Id") == retried.Header.Get("X-Discourse-Event-Id") || string(first.Body) != string(retried.Body) {
+		t.Errorf("expected the retry to resend the body as a new event, got %v and %v", first.Header, retried.Header)
+	}
+	events := webHookEvents(t, ts, eventsPath, func(events []interface{}) bool {
+		return len(events) == 2 && events[0].(map[string]interface{})["status"] != float64(0)
+	})
+	ok, failed := events[0].(map[string]interface{}), events[1].(map[string]interface{})
+	if ok["status"] != float64(200) || ok["response_body"] != "thanks" || failed["status"] != float64(500) {
+		t.Fatalf("expected a failure then a success, newest first: %v", events)
+	}
+	if !strings.Contains(failed["response_body"].(string), "receiver is down") || !strings.Contains(failed["response_headers"].(string), "down") {
+		t.Errorf("expected the failed response to be recorded: %v", failed)
+	}
+	if !strings.Contains(failed["headers"].(string), "post_created") || !strings.Contains(failed["payload"].(string), "A reply the receiver fails to take.") {
+		t.Errorf("expected the request to be recorded: %v", failed)
+	}
+	if _, body := apiGet(ts, "/admin/api/web_hooks/"+strconv.Itoa(id)+".json"); parseJSON(t, body)["web_hook"].(map[string]interface{})["last_delivery_status"] != float64(3) {
+		t.Errorf("expected the last delivery to count as successful: %s", body)
+	}
+	_, body := apiGet(ts, eventsPath+"?status=failed")
+	if page := parseJSON(t, body); page["total_rows_web_hook_events"] != float64(1) || page["load_more_web_hook_events"] == "" {
+		t.Errorf("expected one failed event: %s", body)
+	}
+	resp, body := apiGet(ts, eventsPath+"?offset=-1")
+	if page := parseJSON(t, body); resp.StatusCode != 200 || len(page["web_hook_events"].([]interface{})) != 2 || !strings.Contains(page["load_more_web_hook_events"].(string), "offset=50") {
+		t.Errorf("expected a negative offset to give the first page: %d: %s", resp.StatusCode, body)
+	}
+
+	// Redelivering keeps the event's id and records the new result.
+	failedID := int(failed["id"].(float64))
+	redeliver := eventsPath[:len(eventsPath)-len(".json")] + "/" + strconv.Itoa(failedID) + "/redeliver"
+	if resp, body := apiRequest(ts, "POST", redeliver, nil); resp.StatusCode != 200 {
+		t.Fatalf("redeliver: %d: %s", resp.StatusCode, body)
+	}
+	if d := nextDelivery(t, received); d.Header.Get("X-Discourse-Event-Id") != strconv.Itoa(failedID) {
+		t.Errorf("expected the redelivery to keep id %d, got %s", failedID, d.Header.Get("X-Discourse-Event-Id"))
+	}
+	webHookEvents(t, ts, eventsPath, func(events []interface{}) bool {
+		last := events[1].(map[string]interface{})
+		return len(events) == 2 && last["status"] == float64(200) && last["redelivering"] == false
+	})
+	if resp, _ := apiRequest(ts, "POST", "/admin/api/web_hooks/"+strconv.Itoa(id)+"/events/999/redeliver", nil); resp.StatusCode != 404 {
+		t.Errorf("expected an unknown event to be 404, got %d", resp.StatusCode)
+	}
+
+	// A ping goes out whatever the hook subscribes to.
+	if resp, body := apiRequest(ts, "POST", "/admin/api/web_hooks/"+strconv.Itoa(id)+"/ping", nil); resp.StatusCode != 200 {
+		t.Fatalf("ping: %d: %s", resp.StatusCode, body)
+	}
+	ping := nextDelivery(t, received)
+	if ping.Header.Get("X-Discourse-Event") != "ping" || ping.Header.Get("X-Discourse-Event-Type") != "ping" || string(ping.Body) != `{"ping":"OK"}` {
+		t.Errorf("unexpected ping: %v %s", ping.Header, ping.Body)
+	}
+}
+
+func TestWebHooks_SyncDeliveryFlushAndDeliveryLog(t *testing.T) {
+	// In sync mode the response waits for both kinds of webhook.
+	rec := newGamificationReceiver(t)
+	ts := syncServer(t, webhook.New(rec.URL, ""))
+	receiver, received := hookReceiver(t)
+	createWebHook(t, ts, map[string]interface{}{"payload_url": receiver.URL, "web_hook_event_type_ids": []interface{}{float64(101)}})
+	apiRequestAs(ts, "POST", "/posts", "alice", map[string]interface{}{"title": "Delivered before the response", "raw": "No sleeping in tests any more.", "category": float64(1)})
+	if len(received) != 1 {
+		t.Errorf("expected the topic_created web hook before the response, got %d deliveries", len(received))
+	}
+	if got := rec.actions(); !slices.Contains(got, "topic_created") {
+		t.Errorf("expected topic_created before the response, got %v", got)
+	}
+
+	// Otherwise the flush endpoint waits for deliveries, retries included.
+	rec = newGamificationReceiver(t, 503)
+	d := webhook.New(rec.URL, "")
+	d.SetRetryPolicy(3, 20*time.Millisecond)
+	s := store.New()
+	ts = httptest.NewServer(middleware.RateLimit(s)(middleware.Auth(s)(BuildRouter(s, d))))
+	defer ts.Close()
+	createWebHook(t, ts, map[string]interface{}{"payload_url": receiver.URL, "web_hook_event_type_ids": []interface{}{float64(101)}})
+	apiRequestAs(ts, "POST", "/posts", "alice", map[string]interface{}{"title": "Delivered before the flush returns", "raw": "The flush endpoint waits for this.", "category": float64(1)})
+	if resp, body := apiRequest(ts, "POST", "/__dtu/webhooks/flush", nil); resp.StatusCode != 200 {
+		t.Fatalf("flush: %d: %s", resp.StatusCode, body)
+	}
+	// admin's visit, from creating the web hook, and alice's visit and
+	// topic each arrived; whichever came first was tried twice.
+	if got := rec.actions(); len(got) != 4 {
+		t.Errorf("expected every event after the flush, got %v", got)
+	}
+
+	_, body := apiGet(ts, "/__dtu/webhooks/deliveries")
+	var log struct {
+		Gamification  []webhook.Dispatched `json:"gamification"`
+		WebHookEvents []struct {
+			Event  string `json:"event"`
+			Status int    `json:"status"`
+		} `json:"web_hook_events"`
+	}
+	if err := json.Unmarshal(body, &log); err != nil {
+		t.Fatalf("deliveries: %v: %s", err, body)
+	}
+	if len(log.Gamification) != 3 {
+		t.Fatalf("expected three gamification deliveries, got %s", body)
+	}
+	attempts := 0
+	for i, g := range log.Gamification {
+		attempts += g.Attempts
+		if g.State != webhook.DispatchDelivered || g.Status != 200 || g.URL != rec.URL || g.FinishedAt == nil {
+			t.Errorf("delivery %d: expected it delivered, got %+v", i, g)
+		}
+	}
+	if attempts != 4 {
+		t.Errorf("expected four attempts in all, got %d", attempts)
+	}
+	if len(log.WebHookEvents) != 1 || log.WebHookEvents[0].Event != "topic_created" || log.WebHookEvents[0].Status != 200 {
+		t.Errorf("expected the topic_created web hook event, got %s", body)
+	}
+	_, body = apiGet(ts, "/__dtu/webhooks/deliveries?action=topic_created&event=post_created")
+	if page := parseJSON(t, body); len(page["gamification"].([]interface{})) != 1 || len(page["web_hook_events"].([]interface{})) != 0 {
+		t.Errorf("expected the filters to apply: %s", body)
+	}
+}
+
+func TestWebHooks_SyncReceiversMayCallBack(t *testing.T) {
+	// Receivers that fetch what they were told about before answering
+	// don't wait on the response that set them off.
+	var ts *httptest.Server
+	var mu sync.Mutex
+	var statuses []int
+	callBack := func(w http.ResponseWriter, r *http.Request) {
+		resp, _ := apiGet(ts, "/t/1.json")
+		mu.Lock()
+		statuses = append(statuses, resp.StatusCode)
+		mu.Unlock()
+	}
+	gamification := httptest.NewServer(http.HandlerFunc(callBack))
+	defer gamification.Close()
+	hooks := httptest.NewServer(http.HandlerFunc(callBack))
+	defer hooks.Close()
+	ts = syncServer(t, webhook.New(gamification.URL, ""))
+	createWebHook(t, ts, map[string]interface{}{"payload_url": hooks.URL, "web_hook_event_type_ids": []interface{}{float64(101)}})
+
+	start := time.Now()
+	resp, body := apiRequestAs(ts, "POST", "/posts", "alice", map[string]interface{}{"title": "Receivers may look this up", "raw": "Both receivers fetch a topic first.", "category": float64(1)})
+	if resp.StatusCode != 200 {
+		t.Fatalf("create topic: %d: %s", resp.StatusCode, body)
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("expected the callbacks not to stall the response, took %s", took)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(statuses) < 3 || slices.ContainsFunc(statuses, func(code int) bool { return code != 200 }) {
+		t.Errorf("expected every callback to succeed before the response, got %v", statuses)
+	}
+}
+
+func TestWebHooks_EventLogKeepsTheLatestThousand(t *testing.T) {
+	ts := testServer(t)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer receiver.Close()
+	id := createWebHook(t, ts, map[string]interface{}{"payload_url": receiver.URL, "web_hook_event_type_ids": []interface{}{float64(101)}})
+	ping := "/admin/api/web_hooks/" + strconv.Itoa(id) + "/ping"
+	for i := 0; i < 1005; i++ {
+		if resp, body := apiRequest(ts, "POST", ping, nil); resp.StatusCode != 200 {
+			t.Fatalf("ping %d: %d: %s", i, resp.StatusCode, body)
+		}
+	}
+	_, body := apiGet(ts, "/admin/api/web_hooks/"+strconv.Itoa(id)+"/events.json")
+	if page := parseJSON(t, body); page["total_rows_web_hook_events"] != float64(1000) {
+		t.Errorf("expected the latest 1000 events, got %v", page["total_rows_web_hook_events"])
+	}
+	if resp, _ := apiRequest(ts, "POST", "/admin/api/web_hooks/"+strconv.Itoa(id)+"/events/1/redeliver", nil); resp.StatusCode != 404 {
+		t.Errorf("expected the oldest event to be forgotten, got %d", resp.StatusCode)
+	}
+}
+
+func TestWebHooks_SlowReceiverDoesNotHoldUpOthers(t *testing.T) {
+	// Without sync mode, so the request doesn't wait for the stuck hook.
+	s := store.New()
+	ts := httptest.NewServer(middleware.RateLimit(s)(middleware.Auth(s)(BuildRouter(s, nil))))
+	defer ts.Close()
+	release := make(chan struct{})
+	stuck := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-release }))
+	defer stuck.Close()
+	defer close(release)
+	receiver, received := hookReceiver(t)
+	createWebHook(t, ts, map[string]interface{}{"payload_url": stuck.URL, "web_hook_event_type_ids": []interface{}{float64(101)}})
+	createWebHook(t, ts, map[string]interface{}{"payload_url": receiver.URL, "web_hook_event_type_ids": []interface{}{float64(101)}})
+
+	apiRequestAs(ts, "POST", "/posts", "alice", map[string]interface{}{"title": "One hook is stuck on this", "raw": "The other should hear about it anyway.", "category": float64(1)})
+	if d := nextDelivery(t, received); d.Header.Get("X-Discourse-Event") != "topic_created" {
+		t.Errorf("expected topic_created, got %v", d.Header)
+	}
+}
@@ -0,0 +1,575 @@
+// Package cook turns a post's raw Markdown into the "cooked" HTML that
+// Discourse stores alongside it. It approximates Discourse's markdown-it
+// pipeline closely enough for clients that compare cooked output:
+// CommonMark blocks and inlines, GFM tables and strikethrough, an HTML
+// allowlist, @mentions, #hashtags, :emoji:, [quote] BBCode, upload://
+// short URLs and oneboxes for links to local topics.
+package cook
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Resolver answers the lookups cooking needs from forum data. Cook works
+// with a nil Resolver; mentions, hashtags, uploads and oneboxes then fall
+// back to their unresolved forms.
+type Resolver interface {
+	// User reports whether username exists and returns its avatar template.
+	User(username string) (avatarTemplate string, ok bool)
+	Group(name string) bool
+	Category(slug string) (id int, name string, ok bool)
+	Tag(name string) bool
+	// Upload maps an upload:// short URL to the file's real URL.
+	Upload(shortURL string) (url string, ok bool)
+	// Topic returns a preview of a topic, or of one of its posts when
+	// postNumber is non-zero.
+	Topic(id, postNumber int) (TopicPreview, bool)
+	// Host is the forum's own host; only links to it are local.
+	Host() string
+}
+
+// TopicPreview is what a local onebox shows for a linked topic.
+type TopicPreview struct {
+	Title    string
+	Slug     string
+	Username string
+	Excerpt  string
+}
+
+type cooker struct {
+	res      Resolver
+	headings map[string]int
+	inLink   bool
+}
+
+// Cook renders raw Markdown to sanitised HTML.
+func Cook(raw string, res Resolver) string {
+	c := &cooker{res: res, headings: map[string]int{}}
+	raw = strings.ReplaceAll(raw, "\r\n", "\n")
+	raw = strings.ReplaceAll(raw, "\r", "\n")
+	raw = strings.ReplaceAll(raw, "\t", "    ")
+	return strings.Join(c.blocks(strings.Split(raw, "\n")), "\n")
+}
+
+var (
+	reATXHeading  = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	reHR          = regexp.MustCompile(`^ {0,3}(?:(?:\*[ \t]*){3,}|(?:-[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	reListItem    = regexp.MustCompile(`^( {0,3})([*+-]|\d{1,9}[.)])( +|$)`)
+	reFence       = regexp.MustCompile("^( {0,3})(`{3,}|~{3,})[ \t]*([^`\\s]*)")
+	reSetext      = regexp.MustCompile(`^ {0,3}(=+|-+)[ \t]*$`)
+	reTableDelim  = regexp.MustCompile(`^ *\|? *:?-+:? *(\| *:?-+:? *)*\|? *$`)
+	reQuoteOpen   = regexp.MustCompile(`(?i)^\[quote(?:=("[^"]*"|[^\]]*))?\]`)
+	reQuoteTag    = regexp.MustCompile(`(?i)\[(/?)quote(?:=(?:"[^"]*"|[^\]]*))?\]`)
+	reHTMLBlock   = regexp.MustCompile(`(?i)^ {0,3}</?(address|article|aside|blockquote|details|div|dl|figure|figcaption|h[1-6]|hr|ol|p|pre|section|summary|table|tbody|td|tfoot|th|thead|tr|ul)(\s|/?>|$)`)
+	reLocalTopic  = regexp.MustCompile(`^https?://([^/\s]+)/t/([^/\s]+)/(\d+)(?:/(\d+))?/?(?:\?[^\s]*)?$`)
+	reBareURLLine = regexp.MustCompile(`^https?://\S+$`)
+)
+
+// blocks renders a run of lines into a list of block-level HTML fragments.
+func (c *cooker) blocks(lines []string) []string {
+	var out []string
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		if isBlank(line) {
+			i++
+			continue
+		}
+		trimmed := strings.TrimSpace(line)
+
+		if m := reFence.FindStringSubmatch(line); m != nil {
+			html, next := c.fencedCode(lines, i, m)
+			out = append(out, html)
+			i = next
+			continue
+		}
+		if reQuoteOpen.MatchString(trimmed) {
+			rest := strings.Join(lines[i:], "\n")
+			rest = rest[strings.Index(rest, "["):]
+			if html, remainder, ok := c.quote(rest); ok {
+				out = append(out, html)
+				return append(out, c.blocks(strings.Split(remainder, "\n"))...)
+			}
+		}
+		if m := reATXHeading.FindStringSubmatch(line); m != nil {
+			out = append(out, c.heading(len(m[1]), m[2]))
+			i++
+			continue
+		}
+		if reHR.MatchString(line) {
+			out = append(out, "<hr>")
+			i++
+			continue
+		}
+		if isBlockquote(line) {
+			html, next := c.blockquote(lines, i)
+			out = append(out, html)
+			i = next
+			continue
+		}
+		if reListItem.MatchString(line) {
+			html, next := c.list(lines, i)
+			out = append(out, html)
+			i = next
+			continue
+		}
+		if indentOf(line) >= 4 {
+			html, next := indentedCode(lines, i)
+			out = append(out, html)
+			i = next
+			continue
+		}
+		if i+1 < len(lines) && strings.Contains(line, "|") && reTableDelim.MatchString(lines[i+1]) {
+			if html, next, ok := c.table(lines, i); ok {
+				out = append(out, html)
+				i = next
+				continue
+			}
+		}
+		if reHTMLBlock.MatchString(line) {
+			j := i
+			for j < len(lines) && !isBlank(lines[j]) {
+				j++
+			}
+			out = append(out, sanitizeHTML(strings.Join(lines[i:j], "\n")))
+			i = j
+			continue
+		}
+
+		html, next := c.paragraph(lines, i)
+		out = append(out, html)
+		i = next
+	}
+	return out
+}
+
+// interrupts reports whether line starts a block that ends a paragraph.
+func interrupts(line string) bool {
+	if reFence.MatchString(line) || reATXHeading.MatchString(line) || reHR.MatchString(line) ||
+		isBlockquote(line) || reHTMLBlock.MatchString(line) || reQuoteOpen.MatchString(strings.TrimSpace(line)) {
+		return true
+	}
+	if m := reListItem.FindStringSubmatch(line); m != nil && m[3] != "" {
+		marker := m[2]
+		return !isDigit(marker[0]) || strings.TrimRight(marker, ".)") == "1"
+	}
+	return false
+}
+
+func (c *cooker) paragraph(lines []string, i int) (string, int) {
+	var para []string
+	for i < len(lines) && !isBlank(lines[i]) {
+		if len(para) > 0 {
+			if m := reSetext.FindStringSubmatch(lines[i]); m != nil {
+				level := 2
+				if m[1][0] == '=' {
+					level = 1
+				}
+				return c.heading(level, strings.Join(para, "\n")), i + 1
+			}
+			if interrupts(lines[i]) {
+				break
+			}
+		}
+		para = append(para, strings.TrimSpace(lines[i]))
+		i++
+	}
+	text := strings.Join(para, "\n")
+	if len(para) == 1 && reBareURLLine.MatchString(text) {
+		return c.onebox(text), i
+	}
+	return "<p>" + c.inline(text) + "</p>", i
+}
+
+func (c *cooker) heading(level int, text string) string {
+	text = strings.TrimSpace(text)
+	inner := c.inline(text)
+	slug := headingSlug(stripTags(inner))
+	c.headings[slug]++
+	name := fmt.Sprintf("%s-%d", slug, c.headings[slug])
+	return fmt.Sprintf(`<h%d><a name="%s" class="anchor" href="#%s"></a>%s</h%d>`, level, name, name, inner, level)
+}
+
+func headingSlug(text string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(unescapeEntities(text)) {
+		if isWordRune(r) {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	slug := strings.TrimSuffix(b.String(), "-")
+	if slug == "" {
+		slug = "heading"
+	}
+	return slug
+}
+
+func (c *cooker) fencedCode(lines []string, i int, m []string) (string, int) {
+	indent, fence, lang := len(m[1]), m[2], m[3]
+	var code []string
+	j := i + 1
+	for ; j < len(lines); j++ {
+		t := strings.TrimSpace(lines[j])
+		if strings.HasPrefix(t, fence[:1]) && strings.Trim(t, fence[:1]) == "" && len(t) >= len(fence) {
+			j++
+			break
+		}
+		l := lines[j]
+		for k := 0; k < indent && strings.HasPrefix(l, " "); k++ {
+			l = l[1:]
+		}
+		code = append(code, l)
+	}
+	if lang == "" {
+		lang = "auto"
+	}
+	body := escapeHTML(strings.Join(code, "\n"))
+	if len(code) > 0 {
+		body += "\n"
+	}
+	return fmt.Sprintf(`<pre><code class="lang-%s">%s</code></pre>`, escapeHTML(lang), body), j
+}
+
+func indentedCode(lines []string, i int) (string, int) {
+	var code []string
+	j := i
+	for ; j < len(lines); j++ {
+		if isBlank(lines[j]) {
+			code = append(code, "")
+			continue
+		}
+		if indentOf(lines[j]) < 4 {
+			break
+		}
+		code = append(code, lines[j][4:])
+	}
+	for len(code) > 0 && code[len(code)-1] == "" {
+		code = code[:len(code)-1]
+	}
+	return "<pre><code>" + escapeHTML(strings.Join(code, "\n")) + "\n</code></pre>", j
+}
+
+func isBlockquote(line string) bool {
+	return indentOf(line) < 4 && strings.HasPrefix(strings.TrimLeft(line, " "), ">")
+}
+
+func (c *cooker) blockquote(lines []string, i int) (string, int) {
+	var inner []string
+	for i < len(lines) {
+		line := lines[i]
+		if isBlockquote(line) {
+			l := strings.TrimLeft(line, " ")[1:]
+			l = strings.TrimPrefix(l, " ")
+			inner = append(inner, l)
+		} else if !isBlank(line) && len(inner) > 0 && !isBlank(inner[len(inner)-1]) && !interrupts(line) {
+			// lazy paragraph continuation
+			inner = append(inner, line)
+		} else {
+			break
+		}
+		i++
+	}
+	return "<blockquote>\n" + strings.Join(c.blocks(inner), "\n") + "\n</blockquote>", i
+}
+
+type listItem struct {
+	lines []string
+}
+
+func (c *cooker) list(lines []string, i int) (string, int) {
+	first := reListItem.FindStringSubmatch(lines[i])
+	ordered := isDigit(first[2][0])
+	kind := first[2][len(first[2])-1:]
+	start := 1
+	if ordered {
+		start, _ = strconv.Atoi(first[2][:len(first[2])-1])
+	}
+
+	var items []listItem
+	loose := false
+	contentIndent := 0
+	sawBlank := false
+	for i < len(lines) {
+		line := lines[i]
+		if m := reListItem.FindStringSubmatch(line); m != nil && (len(items) == 0 || indentOf(line) < contentIndent) {
+			if isDigit(m[2][0]) != ordered || m[2][len(m[2])-1:] != kind || (len(items) > 0 && reHR.MatchString(line)) {
+				break
+			}
+			if sawBlank && len(items) > 0 {
+				loose = true
+			}
+			sawBlank = false
+			spaces := len(m[3])
+			if spaces > 4 {
+				spaces = 1
+			}
+			contentIndent = len(m[1]) + len(m[2]) + spaces
+			if m[3] == "" {
+				contentIndent = len(m[1]) + len(m[2]) + 1
+			}
+			items = append(items, listItem{lines: []string{line[min(len(line), len(m[0])):]}})
+			i++
+			continue
+		}
+		cur := &items[len(items)-1]
+		if isBlank(line) {
+			sawBlank = true
+			cur.lines = append(cur.lines, "")
+			i++
+			continue
+		}
+		if indentOf(line) >= contentIndent {
+			if sawBlank {
+				// a blank line between two blocks of the same item
+				for _, l := range cur.lines {
+					if !isBlank(l) {
+						loose = true
+						break
+					}
+				}
+			}
+			sawBlank = false
+			cur.lines = append(cur.lines, line[contentIndent:])
+			i++
+			continue
+		}
+		if !sawBlank && !interrupts(line) {
+			cur.lines = append(cur.lines, strings.TrimSpace(line))
+			i++
+			continue
+		}
+		break
+	}
+
+	var b strings.Builder
+	tag := "ul"
+	if ordered {
+		tag = "ol"
+		if start != 1 {
+			fmt.Fprintf(&b, "<ol start=\"%d\">\n", start)
+		} else {
+			b.WriteString("<ol>\n")
+		}
+	} else {
+		b.WriteString("<ul>\n")
+	}
+	for _, item := range items {
+		for len(item.lines) > 0 && isBlank(item.lines[len(item.lines)-1]) {
+			item.lines = item.lines[:len(item.lines)-1]
+		}
+		parts := c.blocks(item.lines)
+		// Tight lists drop the <p> around paragraphs; markdown-it then only
+		// breaks the line before </li> when the item ends in another block.
+		endsInText := false
+		if !loose {
+			for k, p := range parts {
+				if strings.HasPrefix(p, "<p>") && strings.HasSuffix(p, "</p>") {
+					parts[k] = p[3 : len(p)-4]
+					endsInText = k == len(parts)-1
+				}
+			}
+		}
+		switch {
+		case len(parts) == 0:
+			b.WriteString("<li></li>\n")
+		case loose:
+			b.WriteString("<li>\n" + strings.Join(parts, "\n") + "\n</li>\n")
+		case endsInText:
+			b.WriteString("<li>" + strings.Join(parts, "\n") + "</li>\n")
+		default:
+			b.WriteString("<li>" + strings.Join(parts, "\n") + "\n</li>\n")
+		}
+	}
+	b.WriteString("</" + tag + ">")
+	return b.String(), i
+}
+
+func splitRow(line string) []string {
+	line = strings.TrimSpace(line)
+	line = strings.TrimPrefix(line, "|")
+	if strings.HasSuffix(line, "|") && !strings.HasSuffix(line, `\|`) {
+		line = line[:len(line)-1]
+	}
+	var cells []string
+	var cur strings.Builder
+	inCode := false
+	for k := 0; k < len(line); k++ {
+		switch {
+		case line[k] == '\\' && k+1 < len(line) && line[k+1] == '|':
+			cur.WriteByte('|')
+			k++
+		case line[k] == '`':
+			inCode = !inCode
+			cur.WriteByte('`')
+		case line[k] == '|' && !inCode:
+			cells = append(cells, strings.TrimSpace(cur.String()))
+			cur.Reset()
+		default:
+			cur.WriteByte(line[k])
+		}
+	}
+	return append(cells, strings.TrimSpace(cur.String()))
+}
+
+func (c *cooker) table(lines []string, i int) (string, int, bool) {
+	header := splitRow(lines[i])
+	delims := splitRow(lines[i+1])
+	if len(header) != len(delims) {
+		return "", i, false
+	}
+	aligns := make([]string, len(delims))
+	for k, d := range delims {
+		left, right := strings.HasPrefix(d, ":"), strings.HasSuffix(d, ":")
+		switch {
+		case left && right:
+			aligns[k] = ` style="text-align:center"`
+		case right:
+			aligns[k] = ` style="text-align:right"`
+		case left:
+			aligns[k] = ` style="text-align:left"`
+		}
+	}
+	row := func(b *strings.Builder, cells []string, tag string) {
+		b.WriteString("<tr>\n")
+		for k := range header {
+			cell := ""
+			if k < len(cells) {
+				cell = c.inline(cells[k])
+			}
+			fmt.Fprintf(b, "<%s%s>%s</%s>\n", tag, aligns[k], cell, tag)
+		}
+		b.WriteString("</tr>\n")
+	}
+
+	var b strings.Builder
+	b.WriteString("<div class=\"md-table\">\n<table>\n<thead>\n")
+	row(&b, header, "th")
+	b.WriteString("</thead>\n")
+	j := i + 2
+	if j < len(lines) && !isBlank(lines[j]) && !interrupts(lines[j]) {
+		b.WriteString("<tbody>\n")
+		for ; j < len(lines) && !isBlank(lines[j]) && !interrupts(lines[j]); j++ {
+			row(&b, splitRow(lines[j]), "td")
+		}
+		b.WriteString("</tbody>\n")
+	}
+	b.WriteString("</table>\n</div>")
+	return b.String(), j, true
+}
+
+// quote renders a [quote="user, post:N, topic:M"]…[/quote] block at the
+// start of text and returns whatever follows it.
+func (c *cooker) quote(text string) (string, string, bool) {
+	open := reQuoteOpen.FindStringSubmatchIndex(text)
+	if open == nil {
+		return "", "", false
+	}
+	attrs := ""
+	if open[2] >= 0 {
+		attrs = strings.Trim(text[open[2]:open[3]], `"`)
+	}
+	body := text[open[1]:]
+	depth := 1
+	end, after := -1, -1
+	for _, m := range reQuoteTag.FindAllStringSubmatchIndex(body, -1) {
+		if body[m[2]:m[3]] == "/" {
+			depth--
+		} else {
+			depth++
+		}
+		if depth == 0 {
+			end, after = m[0], m[1]
+			break
+		}
+	}
+	if end < 0 {
+		return "", "", false
+	}
+
+	username := ""
+	data := ""
+	for k, part := range strings.Split(attrs, ",") {
+		part = strings.TrimSpace(part)
+		if k == 0 && !strings.Contains(part, ":") {
+			username = part
+			continue
+		}
+		if key, val, ok := strings.Cut(part, ":"); ok {
+			switch key = strings.TrimSpace(key); key {
+			case "post", "topic":
+				data += fmt.Sprintf(` data-%s="%s"`, key, escapeHTML(strings.TrimSpace(val)))
+			case "full":
+				data += ` data-full="true"`
+			}
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(`<aside class="quote no-group"`)
+	if username != "" {
+		fmt.Fprintf(&b, ` data-username="%s"`, escapeHTML(username))
+	}
+	b.WriteString(data + ">\n")
+	if username != "" {
+		b.WriteString("<div class=\"title\">\n<div class=\"quote-controls\"></div>\n")
+		if c.res != nil {
+			if avatar, ok := c.res.User(username); ok && avatar != "" {
+				fmt.Fprintf(&b, `<img loading="lazy" alt="" width="24" height="24" src="%s" class="avatar"> `,
+					escapeHTML(strings.ReplaceAll(avatar, "{size}", "48")))
+			}
+		}
+		b.WriteString(escapeHTML(username) + ":</div>\n")
+	}
+	inner := strings.Trim(body[:end], "\n")
+	b.WriteString("<blockquote>\n" + strings.Join(c.blocks(strings.Split(inner, "\n")), "\n") + "\n</blockquote>\n</aside>")
+	return b.String(), body[after:], true
+}
+
+// onebox renders a URL that sits alone on its own line. Links to topics
+// on this forum's host expand into a preview; anything else, another
+// forum's topics included, stays a plain onebox link, which is how
+// Discourse cooks URLs it could not fetch.
+func (c *cooker) onebox(url string) string {
+	if m := reLocalTopic.FindStringSubmatch(url); m != nil && c.res != nil && strings.EqualFold(m[1], c.res.Host()) {
+		host := m[1]
+		id, _ := strconv.Atoi(m[3])
+		postNumber, _ := strconv.Atoi(m[4])
+		if preview, ok := c.res.Topic(id, postNumber); ok && preview.Slug == m[2] {
+			href := escapeHTML(url)
+			var b strings.Builder
+			fmt.Fprintf(&b, "<aside class=\"onebox discoursetopic\" data-onebox-src=\"%s\">\n", href)
+			fmt.Fprintf(&b, "<header class=\"source\">\n<a href=\"%s\" target=\"_blank\" rel=\"noopener\">%s</a>\n</header>\n", href, escapeHTML(host))
+			b.WriteString("<article class=\"onebox-body\">\n")
+			fmt.Fprintf(&b, "<h3><a href=\"%s\" target=\"_blank\" rel=\"noopener\">%s</a></h3>\n", href, escapeHTML(preview.Title))
+			if preview.Excerpt != "" {
+				fmt.Fprintf(&b, "<p>%s</p>\n", escapeHTML(preview.Excerpt))
+			}
+			b.WriteString("</article>\n</aside>")
+			return b.String()
+		}
+	}
+	if !safeURL(url) {
+		return "<p>" + escapeHTML(url) + "</p>"
+	}
+	href := escapeHTML(url)
+	return fmt.Sprintf(`<p><a href="%s" class="onebox" target="_blank" rel="noopener nofollow ugc">%s</a></p>`, href, href)
+}
+
+func isBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+func indentOf(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
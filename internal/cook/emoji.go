@@ -0,0 +1,31 @@
+package cook
+
+// emojis is the subset of Discourse's twitter emoji set the DTU recognises.
+// Unknown :names: are left as text, as Discourse does.
+var emojis = map[string]bool{}
+
+func init() {
+	for _, name := range []string{
+		"+1", "-1", "100", "1234", "alarm_clock", "angry", "astonished", "awesome",
+		"baby", "balloon", "bangbang", "beer", "beers", "bell", "blush", "bomb",
+		"book", "boom", "brain", "broken_heart", "bug", "bulb", "cake", "calendar",
+		"camera", "check", "clap", "coffee", "confused", "construction", "cool",
+		"crossed_fingers", "cry", "crying_cat_face", "dart", "disappointed",
+		"dizzy", "exclamation", "expressionless", "eyes", "facepalm", "fire",
+		"flushed", "frowning", "gift", "grimacing", "grin", "grinning", "heart",
+		"heart_eyes", "heavy_check_mark", "heavy_plus_sign", "hourglass", "hugs",
+		"hushed", "innocent", "joy", "key", "kissing_heart", "laughing", "link",
+		"lock", "mag", "memo", "money_mouth_face", "muscle", "neutral_face",
+		"no_entry", "ok_hand", "open_mouth", "partying_face", "pencil", "pensive",
+		"point_down", "point_left", "point_right", "point_up", "pray",
+		"question", "rage", "raised_hands", "relaxed", "relieved", "rocket",
+		"rofl", "scream", "see_no_evil", "shrug", "sleeping", "slight_frown",
+		"slight_smile", "smile", "smiley", "smirk", "sob", "sparkles", "star",
+		"star_struck", "stuck_out_tongue", "sunglasses", "sweat", "sweat_smile",
+		"tada", "thinking", "thumbsdown", "thumbsup", "tired_face", "trophy",
+		"unamused", "upside_down_face", "v", "warning", "wave", "white_check_mark",
+		"wink", "worried", "x", "yum", "zap", "zipper_mouth_face",
+	} {
+		emojis[name] = true
+	}
+}
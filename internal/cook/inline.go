@@ -0,0 +1,500 @@
+package cook
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	reEntity   = regexp.MustCompile(`^&(?:#[0-9]{1,7}|#[xX][0-9a-fA-F]{1,6}|[a-zA-Z][a-zA-Z0-9]{1,31});`)
+	reAutolink = regexp.MustCompile(`^<([a-zA-Z][a-zA-Z0-9+.-]{1,31}:[^\s<>]*)>`)
+	reBareURL  = regexp.MustCompile(`^(?i)https?://[^\s<]+`)
+	reMention  = regexp.MustCompile(`^@([\p{L}\p{N}_](?:[\p{L}\p{N}_.-]*[\p{L}\p{N}_])?)`)
+	reHashtag  = regexp.MustCompile(`^#([\p{L}\p{N}_-]+)(?:::(tag|category))?`)
+	reEmoji    = regexp.MustCompile(`^:([a-z0-9_+-]+):`)
+	reImageDim = regexp.MustCompile(`^(\d+)x(\d+)`)
+)
+
+// inline renders span-level Markdown inside a single block.
+func (c *cooker) inline(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		ch := s[i]
+		switch ch {
+		case '\\':
+			if i+1 < len(s) && s[i+1] == '\n' {
+				b.WriteString("<br>\n")
+				i += 2
+				continue
+			}
+			if i+1 < len(s) && isASCIIPunct(s[i+1]) {
+				b.WriteString(escapeHTML(s[i+1 : i+2]))
+				i += 2
+				continue
+			}
+		case '`':
+			if html, n := codeSpan(s[i:]); n > 0 {
+				b.WriteString(html)
+				i += n
+				continue
+			}
+			n := runLen(s[i:], '`')
+			b.WriteString(s[i : i+n])
+			i += n
+			continue
+		case '!':
+			if i+1 < len(s) && s[i+1] == '[' {
+				if html, n := c.link(s[i:], true); n > 0 {
+					b.WriteString(html)
+					i += n
+					continue
+				}
+			}
+		case '[':
+			if !c.inLink {
+				if html, n := c.link(s[i:], false); n > 0 {
+					b.WriteString(html)
+					i += n
+					continue
+				}
+			}
+		case '<':
+			if m := reAutolink.FindStringSubmatch(s[i:]); m != nil && !c.inLink {
+				if safeURL(m[1]) {
+					b.WriteString(anchor(m[1], escapeHTML(m[1]), ""))
+				} else {
+					b.WriteString(escapeHTML(m[0]))
+				}
+				i += len(m[0])
+				continue
+			}
+			if html, n := sanitizeTag(s[i:]); n > 0 {
+				b.WriteString(html)
+				i += n
+				continue
+			}
+			b.WriteString("&lt;")
+			i++
+			continue
+		case '*', '_', '~':
+			if html, n := c.emphasis(s, i); n > 0 {
+				b.WriteString(html)
+				i += n
+				continue
+			}
+			n := runLen(s[i:], ch)
+			b.WriteString(s[i : i+n])
+			i += n
+			continue
+		case '@':
+			if !c.inLink && boundaryBefore(s, i) {
+				if html, n := c.mention(s[i:]); n > 0 {
+					b.WriteString(html)
+					i += n
+					continue
+				}
+			}
+		case '#':
+			if !c.inLink && boundaryBefore(s, i) {
+				if html, n := c.hashtag(s[i:]); n > 0 {
+					b.WriteString(html)
+					i += n
+					continue
+				}
+			}
+		case ':':
+			if boundaryBefore(s, i) {
+				if m := reEmoji.FindStringSubmatch(s[i:]); m != nil && emojis[m[1]] {
+					b.WriteString(emojiImage(m[1]))
+					i += len(m[0])
+					continue
+				}
+			}
+		case 'h', 'H':
+			if !c.inLink && boundaryBefore(s, i) {
+				if url := trimURL(reBareURL.FindString(s[i:])); url != "" {
+					b.WriteString(anchor(url, escapeHTML(url), ""))
+					i += len(url)
+					continue
+				}
+			}
+		case '\n':
+			b.WriteString("<br>\n")
+			i++
+			continue
+		case '&':
+			if m := reEntity.FindString(s[i:]); m != "" {
+				b.WriteString(m)
+				i += len(m)
+				continue
+			}
+			b.WriteString("&amp;")
+			i++
+			continue
+		case '>':
+			b.WriteString("&gt;")
+			i++
+			continue
+		case '"':
+			b.WriteString("&quot;")
+			i++
+			continue
+		}
+		b.WriteByte(ch)
+		i++
+	}
+	return b.String()
+}
+
+func codeSpan(s string) (string, int) {
+	n := runLen(s, '`')
+	for j := n; j < len(s); {
+		if s[j] != '`' {
+			j++
+			continue
+		}
+		m := runLen(s[j:], '`')
+		if m == n {
+			content := strings.ReplaceAll(s[n:j], "\n", " ")
+			if len(content) > 2 && content[0] == ' ' && content[len(content)-1] == ' ' && strings.TrimSpace(content) != "" {
+				content = content[1 : len(content)-1]
+			}
+			return "<code>" + escapeHTML(content) + "</code>", j + m
+		}
+		j += m
+	}
+	return "", 0
+}
+
+func (c *cooker) emphasis(s string, i int) (string, int) {
+	ch := s[i]
+	n := runLen(s[i:], ch)
+	if ch == '~' {
+		if n != 2 {
+			return "", 0
+		}
+		end := findCloser(s, i+2, '~', 2)
+		if end < 0 {
+			return "", 0
+		}
+		return "<del>" + c.inline(s[i+2:end]) + "</del>", end + 2 - i
+	}
+	if n > 3 || i+n >= len(s) || isSpaceByte(s[i+n]) {
+		return "", 0
+	}
+	if ch == '_' && i > 0 && isWordByteBefore(s, i) {
+		return "", 0
+	}
+	end := findCloser(s, i+n, ch, n)
+	if end < 0 {
+		return "", 0
+	}
+	inner := c.inline(s[i+n : end])
+	switch n {
+	case 1:
+		inner = "<em>" + inner + "</em>"
+	case 2:
+		inner = "<strong>" + inner + "</strong>"
+	default:
+		inner = "<em><strong>" + inner + "</strong></em>"
+	}
+	return inner, end + n - i
+}
+
+// findCloser finds a delimiter run of exactly n ch characters that can
+// close emphasis opened before from, skipping code spans and escapes.
+func findCloser(s string, from int, ch byte, n int) int {
+	for j := from; j < len(s); {
+		switch s[j] {
+		case '\\':
+			j += 2
+			continue
+		case '`':
+			if _, m := codeSpan(s[j:]); m > 0 {
+				j += m
+				continue
+			}
+		case ch:
+			r := runLen(s[j:], ch)
+			if r == n && j > from && !isSpaceByte(s[j-1]) &&
+				(ch != '_' || j+r >= len(s) || !isWordByteAt(s, j+r)) {
+				return j
+			}
+			j += r
+			continue
+		}
+		j++
+	}
+	return -1
+}
+
+// link renders [text](dest "title") or, when image is set, ![alt](src).
+func (c *cooker) link(s string, image bool) (string, int) {
+	start := 1
+	if image {
+		start = 2
+	}
+	depth := 1
+	j := start
+	for ; j < len(s) && depth > 0; j++ {
+		switch s[j] {
+		case '\\':
+			j++
+		case '`':
+			if _, m := codeSpan(s[j:]); m > 0 {
+				j += m - 1
+			}
+		case '[':
+			depth++
+		case ']':
+			depth--
+		}
+	}
+	if depth != 0 || j >= len(s) || s[j] != '(' {
+		return "", 0
+	}
+	text := s[start : j-1]
+	j++
+	for j < len(s) && s[j] == ' ' {
+		j++
+	}
+	var dest string
+	if j < len(s) && s[j] == '<' {
+		end := strings.IndexByte(s[j:], '>')
+		if end < 0 {
+			return "", 0
+		}
+		dest = s[j+1 : j+end]
+		j += end + 1
+	} else {
+		parens := 0
+		k := j
+		for ; k < len(s) && s[k] > ' '; k++ {
+			if s[k] == '(' {
+				parens++
+			} else if s[k] == ')' {
+				if parens == 0 {
+					break
+				}
+				parens--
+			}
+		}
+		dest = s[j:k]
+		j = k
+	}
+	for j < len(s) && s[j] == ' ' {
+		j++
+	}
+	title := ""
+	if j < len(s) && (s[j] == '"' || s[j] == '\'' || s[j] == '(') {
+		closer := s[j]
+		if closer == '(' {
+			closer = ')'
+		}
+		end := strings.IndexByte(s[j+1:], closer)
+		if end < 0 {
+			return "", 0
+		}
+		title = s[j+1 : j+1+end]
+		j += end + 2
+		for j < len(s) && s[j] == ' ' {
+			j++
+		}
+	}
+	if j >= len(s) || s[j] != ')' {
+		return "", 0
+	}
+	n := j + 1
+	dest = unescapeEntities(dest)
+
+	if image {
+		return c.image(text, dest, title), n
+	}
+
+	label := text
+	class, extra := "", ""
+	href := dest
+	if strings.HasPrefix(dest, "upload://") {
+		if strings.HasSuffix(label, "|attachment") {
+			label = strings.TrimSuffix(label, "|attachment")
+			class = "attachment"
+		}
+		if url, ok := c.upload(dest); ok {
+			href = url
+		} else {
+			href = "/404"
+			extra = fmt.Sprintf(` data-orig-href="%s"`, escapeHTML(dest))
+		}
+	}
+	prev := c.inLink
+	c.inLink = true
+	inner := c.inline(label)
+	c.inLink = prev
+	if !safeURL(href) {
+		return inner, n
+	}
+	if title != "" {
+		extra += fmt.Sprintf(` title="%s"`, escapeHTML(title))
+	}
+	if class != "" {
+		extra = fmt.Sprintf(` class="%s"`, class) + extra
+	}
+	return anchor(href, inner, extra), n
+}
+
+func (c *cooker) image(text, src, title string) string {
+	alt, width, height := text, "", ""
+	if idx := strings.LastIndex(text, "|"); idx >= 0 {
+		if m := reImageDim.FindStringSubmatch(strings.TrimSpace(text[idx+1:])); m != nil {
+			alt, width, height = text[:idx], m[1], m[2]
+		}
+	}
+	extra := ""
+	if strings.HasPrefix(src, "upload://") {
+		short := src
+		if url, ok := c.upload(short); ok {
+			src = url
+		} else {
+			src = "/images/transparent.png"
+			extra += fmt.Sprintf(` data-orig-src="%s"`, escapeHTML(short))
+		}
+		key := strings.TrimPrefix(short, "upload://")
+		extra += fmt.Sprintf(` data-base62-sha1="%s"`, escapeHTML(strings.TrimSuffix(key, path.Ext(key))))
+	}
+	if !safeURL(src) {
+		return escapeHTML(alt)
+	}
+	html := fmt.Sprintf(`<img src="%s" alt="%s"`, escapeHTML(src), escapeHTML(stripTags(alt)))
+	if title != "" {
+		html += fmt.Sprintf(` title="%s"`, escapeHTML(title))
+	}
+	html += extra
+	if width != "" {
+		html += fmt.Sprintf(` width="%s" height="%s"`, width, height)
+	}
+	return html + ">"
+}
+
+func (c *cooker) upload(shortURL string) (string, bool) {
+	if c.res == nil {
+		return "", false
+	}
+	return c.res.Upload(shortURL)
+}
+
+func (c *cooker) mention(s string) (string, int) {
+	m := reMention.FindStringSubmatch(s)
+	if m == nil {
+		return "", 0
+	}
+	name := m[1]
+	if c.res != nil {
+		if _, ok := c.res.User(name); ok {
+			return fmt.Sprintf(`<a class="mention" href="/u/%s">@%s</a>`, escapeHTML(strings.ToLower(name)), escapeHTML(name)), len(m[0])
+		}
+		if c.res.Group(name) {
+			return fmt.Sprintf(`<a class="mention-group" href="/groups/%s">@%s</a>`, escapeHTML(name), escapeHTML(name)), len(m[0])
+		}
+	}
+	return fmt.Sprintf(`<span class="mention">@%s</span>`, escapeHTML(name)), len(m[0])
+}
+
+func (c *cooker) hashtag(s string) (string, int) {
+	m := reHashtag.FindStringSubmatch(s)
+	if m == nil || c.res == nil {
+		return "", 0
+	}
+	slug, kind := m[1], m[2]
+	const icon = `<span class="hashtag-icon-placeholder"></span>`
+	if kind != "tag" {
+		if id, name, ok := c.res.Category(slug); ok {
+			return fmt.Sprintf(`<a class="hashtag-cooked" href="/c/%s/%d" data-type="category" data-slug="%s" data-id="%d">%s<span>%s</span></a>`,
+				escapeHTML(slug), id, escapeHTML(slug), id, icon, escapeHTML(name)), len(m[0])
+		}
+	}
+	if kind != "category" && c.res.Tag(slug) {
+		return fmt.Sprintf(`<a class="hashtag-cooked" href="/tag/%s" data-type="tag" data-slug="%s">%s<span>%s</span></a>`,
+			escapeHTML(slug), escapeHTML(slug), icon, escapeHTML(slug)), len(m[0])
+	}
+	return "", 0
+}
+
+func emojiImage(name string) string {
+	return fmt.Sprintf(`<img src="/images/emoji/twitter/%s.png?v=12" title=":%s:" class="emoji" alt=":%s:" loading="lazy" width="20" height="20">`,
+		name, name, name)
+}
+
+// anchor builds a link, marking absolute links as user-generated the way
+// Discourse does for external destinations.
+func anchor(href, inner, extra string) string {
+	lower := strings.ToLower(href)
+	if strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") {
+		extra += ` rel="noopener nofollow ugc"`
+	}
+	return fmt.Sprintf(`<a href="%s"%s>%s</a>`, escapeHTML(href), extra, inner)
+}
+
+// trimURL drops trailing punctuation that belongs to the sentence rather
+// than the URL, keeping balanced closing parentheses.
+func trimURL(url string) string {
+	for url != "" {
+		last := url[len(url)-1]
+		if strings.IndexByte(`?!.,:;*_~'"`, last) >= 0 {
+			url = url[:len(url)-1]
+			continue
+		}
+		if last == ')' && strings.Count(url, ")") > strings.Count(url, "(") {
+			url = url[:len(url)-1]
+			continue
+		}
+		break
+	}
+	if strings.HasSuffix(url, "://") {
+		return ""
+	}
+	return url
+}
+
+func runLen(s string, ch byte) int {
+	n := 0
+	for n < len(s) && s[n] == ch {
+		n++
+	}
+	return n
+}
+
+// boundaryBefore reports whether position i starts a new word, so that
+// e-mail addresses, C# and times like 10:30:00 are left alone.
+func boundaryBefore(s string, i int) bool {
+	if i == 0 {
+		return true
+	}
+	r, _ := utf8.DecodeLastRuneInString(s[:i])
+	return !isWordRune(r) && !strings.ContainsRune("/@#&:`", r)
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func isWordByteBefore(s string, i int) bool {
+	r, _ := utf8.DecodeLastRuneInString(s[:i])
+	return isWordRune(r) && r != '_'
+}
+
+func isWordByteAt(s string, i int) bool {
+	r, _ := utf8.DecodeRuneInString(s[i:])
+	return isWordRune(r) && r != '_'
+}
+
+func isSpaceByte(b byte) bool {
+	return b == ' ' || b == '\n' || b == '\t'
+}
+
+func isASCIIPunct(b byte) bool {
+	return strings.IndexByte("!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~", b) >= 0
+}
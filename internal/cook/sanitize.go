@@ -0,0 +1,187 @@
+package cook
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	reTag       = regexp.MustCompile("^<(/?)([a-zA-Z][a-zA-Z0-9-]*)((?:\\s+[a-zA-Z_:][-a-zA-Z0-9_:.]*(?:\\s*=\\s*(?:\"[^\"]*\"|'[^']*'|[^\\s\"'=<>`]+))?)*)\\s*(/?)>")
+	reAttr      = regexp.MustCompile("([a-zA-Z_:][-a-zA-Z0-9_:.]*)(?:\\s*=\\s*(?:\"([^\"]*)\"|'([^']*)'|([^\\s\"'=<>`]+)))?")
+	reScheme    = regexp.MustCompile(`^([a-zA-Z][a-zA-Z0-9+.-]*):`)
+	reAnyTag    = regexp.MustCompile(`<[^>]*>`)
+	reSpaces    = regexp.MustCompile(`\s+`)
+	htmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+)
+
+// allowedTags is the HTML allowlist for raw HTML in posts, with the
+// attributes each tag may keep. Everything else is stripped.
+var allowedTags = map[string][]string{
+	"a": {"href", "title", "name"}, "abbr": {"title"}, "b": nil, "big": nil,
+	"blockquote": nil, "br": nil, "code": nil, "dd": nil, "del": nil,
+	"details": {"open"}, "div": nil, "dl": nil, "dt": nil, "em": nil,
+	"h1": nil, "h2": nil, "h3": nil, "h4": nil, "h5": nil, "h6": nil,
+	"hr": nil, "i": nil, "img": {"src", "alt", "title", "width", "height"},
+	"ins": nil, "kbd": nil, "li": nil, "mark": nil, "ol": {"start"}, "p": nil,
+	"pre": nil, "rp": nil, "rt": nil, "ruby": nil, "s": nil, "small": nil,
+	"span": nil, "strike": nil, "strong": nil, "sub": nil, "summary": nil,
+	"sup": nil, "table": nil, "tbody": nil, "td": {"colspan", "rowspan"},
+	"th": {"colspan", "rowspan"}, "thead": nil, "tr": nil, "u": nil, "ul": nil,
+}
+
+// droppedWithContent are tags whose body is removed along with the tag.
+var droppedWithContent = map[string]bool{
+	"script": true, "style": true, "iframe": true, "object": true,
+	"embed": true, "noscript": true, "textarea": true, "title": true,
+}
+
+var safeSchemes = map[string]bool{
+	"http": true, "https": true, "mailto": true, "ftp": true, "upload": true,
+}
+
+// sanitizeTag consumes an HTML tag (or comment) at the start of s and
+// returns its allowlisted form, which may be empty. n is zero when s does
+// not start with a tag and the '<' should be escaped instead.
+func sanitizeTag(s string) (out string, n int) {
+	if strings.HasPrefix(s, "<!--") {
+		if end := strings.Index(s[4:], "-->"); end >= 0 {
+			return "", end + 7
+		}
+		return "", 0
+	}
+	m := reTag.FindStringSubmatch(s)
+	if m == nil {
+		return "", 0
+	}
+	closing, name, attrs, selfClose := m[1] == "/", strings.ToLower(m[2]), m[3], m[4]
+	n = len(m[0])
+
+	if droppedWithContent[name] {
+		if !closing && selfClose == "" {
+			lower := strings.ToLower(s)
+			if end := strings.Index(lower[n:], "</"+name); end >= 0 {
+				n += end
+				if gt := strings.IndexByte(s[n:], '>'); gt >= 0 {
+					n += gt + 1
+				}
+			} else {
+				n = len(s)
+			}
+		}
+		return "", n
+	}
+	allowed, ok := allowedTags[name]
+	if !ok {
+		return "", n
+	}
+	if closing {
+		return "</" + name + ">", n
+	}
+
+	var b strings.Builder
+	b.WriteString("<" + name)
+	for _, a := range reAttr.FindAllStringSubmatch(attrs, -1) {
+		key := strings.ToLower(a[1])
+		if !contains(allowed, key) {
+			continue
+		}
+		val := a[2] + a[3] + a[4]
+		if a[0] == a[1] {
+			b.WriteString(" " + key)
+			continue
+		}
+		val = unescapeEntities(val)
+		if (key == "href" || key == "src") && !safeURL(val) {
+			continue
+		}
+		b.WriteString(" " + key + `="` + escapeHTML(val) + `"`)
+	}
+	b.WriteString(">")
+	return b.String(), n
+}
+
+// sanitizeHTML cleans a raw HTML block, leaving its text untouched.
+func sanitizeHTML(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		switch s[i] {
+		case '<':
+			if out, n := sanitizeTag(s[i:]); n > 0 {
+				b.WriteString(out)
+				i += n
+				continue
+			}
+			b.WriteString("&lt;")
+		case '&':
+			if m := reEntity.FindString(s[i:]); m != "" {
+				b.WriteString(m)
+				i += len(m)
+				continue
+			}
+			b.WriteString("&amp;")
+		default:
+			b.WriteByte(s[i])
+		}
+		i++
+	}
+	return b.String()
+}
+
+// safeURL reports whether a link target is relative or uses an allowed
+// scheme, rejecting javascript: and friends. The scheme is read the way a
+// browser reads it, both as written and with entities decoded.
+func safeURL(u string) bool {
+	for _, v := range []string{u, unescapeEntities(u)} {
+		if m := reScheme.FindStringSubmatch(browserURL(v)); m != nil && !safeSchemes[strings.ToLower(m[1])] {
+			return false
+		}
+	}
+	return true
+}
+
+// browserURL strips what browsers ignore in a URL: tabs and newlines
+// anywhere, and control characters and spaces around it.
+func browserURL(u string) string {
+	u = strings.Map(func(r rune) rune {
+		if r == '\t' || r == '\n' || r == '\r' {
+			return -1
+		}
+		return r
+	}, u)
+	return strings.TrimFunc(u, func(r rune) bool { return r <= ' ' || unicode.IsSpace(r) })
+}
+
+func escapeHTML(s string) string {
+	return htmlEscaper.Replace(s)
+}
+
+func unescapeEntities(s string) string {
+	return html.UnescapeString(s)
+}
+
+func stripTags(s string) string {
+	return reAnyTag.ReplaceAllString(s, "")
+}
+
+// Excerpt returns up to max characters of plain text from cooked HTML,
+// suitable for previews, notifications and e-mail snippets.
+func Excerpt(cooked string, max int) string {
+	text := strings.TrimSpace(reSpaces.ReplaceAllString(unescapeEntities(stripTags(cooked)), " "))
+	if utf8.RuneCountInString(text) <= max {
+		return text
+	}
+	runes := []rune(text)
+	return strings.TrimSpace(string(runes[:max])) + "…"
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
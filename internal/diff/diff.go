@@ -0,0 +1,242 @@
+// Package diff produces the HTML diffs Discourse shows in a post's edit
+// history: an inline diff, a side-by-side diff of the cooked HTML and a
+// side-by-side table of the raw Markdown.
+package diff
+
+import (
+	"strings"
+)
+
+type op int
+
+const (
+	equal op = iota
+	del
+	ins
+)
+
+type edit struct {
+	op  op
+	tok string
+}
+
+// maxCells bounds the LCS table; larger inputs are diffed as a whole
+// replacement rather than word by word.
+const maxCells = 4_000_000
+
+// Inline merges before and after into one document, marking removed
+// words with <del> and added words with <ins>.
+func Inline(before, after string) string {
+	var b strings.Builder
+	b.WriteString(`<div class="inline-diff">`)
+	writeEdits(&b, compare(tokenize(before), tokenize(after)), true, true)
+	b.WriteString("</div>")
+	return b.String()
+}
+
+// SideBySide renders the old document with deletions marked next to the
+// new document with insertions marked.
+func SideBySide(before, after string) string {
+	edits := compare(tokenize(before), tokenize(after))
+	var b strings.Builder
+	b.WriteString(`<div class="revision-content">`)
+	writeEdits(&b, edits, true, false)
+	b.WriteString(`</div><div class="revision-content">`)
+	writeEdits(&b, edits, false, true)
+	b.WriteString("</div>")
+	return b.String()
+}
+
+// SideBySideMarkdown diffs raw Markdown line by line into a two-column
+// table, with word-level markers inside changed lines.
+func SideBySideMarkdown(before, after string) string {
+	lines := compare(strings.Split(before, "\n"), strings.Split(after, "\n"))
+	var b strings.Builder
+	b.WriteString(`<table class="markdown">`)
+	for i := 0; i < len(lines); {
+		if lines[i].op == equal {
+			text := escape(lines[i].tok)
+			b.WriteString("<tr><td>" + text + "</td><td>" + text + "</td></tr>")
+			i++
+			continue
+		}
+		var removed, added []string
+		for ; i < len(lines) && lines[i].op != equal; i++ {
+			if lines[i].op == del {
+				removed = append(removed, lines[i].tok)
+			} else {
+				added = append(added, lines[i].tok)
+			}
+		}
+		for k := 0; k < len(removed) || k < len(added); k++ {
+			switch {
+			case k < len(removed) && k < len(added):
+				words := compare(tokenize(escape(removed[k])), tokenize(escape(added[k])))
+				var l, r strings.Builder
+				writeEdits(&l, words, true, false)
+				writeEdits(&r, words, false, true)
+				b.WriteString(`<tr><td class="diff-del">` + l.String() + `</td><td class="diff-ins">` + r.String() + "</td></tr>")
+			case k < len(removed):
+				b.WriteString(`<tr><td class="diff-del"><del>` + escape(removed[k]) + "</del></td><td></td></tr>")
+			default:
+				b.WriteString(`<tr><td></td><td class="diff-ins"><ins>` + escape(added[k]) + "</ins></td></tr>")
+			}
+		}
+	}
+	b.WriteString("</table>")
+	return b.String()
+}
+
+// writeEdits emits the tokens belonging to one side (or both), wrapping
+// runs of changed text. Tags are never wrapped so the markup stays valid.
+func writeEdits(b *strings.Builder, edits []edit, showDel, showIns bool) {
+	var run strings.Builder
+	runOp := equal
+	flush := func() {
+		if run.Len() == 0 {
+			return
+		}
+		switch runOp {
+		case del:
+			b.WriteString("<del>" + run.String() + "</del>")
+		case ins:
+			b.WriteString("<ins>" + run.String() + "</ins>")
+		default:
+			b.WriteString(run.String())
+		}
+		run.Reset()
+	}
+	for _, e := range edits {
+		if (e.op == del && !showDel) || (e.op == ins && !showIns) {
+			continue
+		}
+		if isTag(e.tok) {
+			flush()
+			// For the merged inline view, keep only the new document's markup.
+			if e.op != del || !showIns {
+				b.WriteString(e.tok)
+			}
+			continue
+		}
+		if e.op != runOp {
+			flush()
+			runOp = e.op
+		}
+		run.WriteString(e.tok)
+	}
+	flush()
+}
+
+// tokenize splits HTML into tags, words and runs of whitespace.
+func tokenize(s string) []string {
+	var toks []string
+	for i := 0; i < len(s); {
+		start := i
+		switch {
+		case s[i] == '<':
+			if end := strings.IndexByte(s[i:], '>'); end >= 0 {
+				i += end + 1
+			} else {
+				i = len(s)
+			}
+		case isSpace(s[i]):
+			for i < len(s) && isSpace(s[i]) {
+				i++
+			}
+		default:
+			for i < len(s) && s[i] != '<' && !isSpace(s[i]) {
+				i++
+			}
+		}
+		toks = append(toks, s[start:i])
+	}
+	return toks
+}
+
+// compare returns the edit script turning a into b, using a longest
+// common subsequence over tokens.
+func compare(a, b []string) []edit {
+	// Trim the common prefix and suffix; edits are usually local.
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	midA, midB := a[pre:len(a)-suf], b[pre:len(b)-suf]
+
+	var out []edit
+	for _, t := range a[:pre] {
+		out = append(out, edit{equal, t})
+	}
+	if len(midA)*len(midB) > maxCells {
+		for _, t := range midA {
+			out = append(out, edit{del, t})
+		}
+		for _, t := range midB {
+			out = append(out, edit{ins, t})
+		}
+	} else {
+		out = append(out, lcs(midA, midB)...)
+	}
+	for _, t := range a[len(a)-suf:] {
+		out = append(out, edit{equal, t})
+	}
+	return out
+}
+
+func lcs(a, b []string) []edit {
+	n, m := len(a), len(b)
+	table := make([][]int, n+1)
+	for i := range table {
+		table[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				table[i][j] = table[i+1][j+1] + 1
+			} else {
+				table[i][j] = max(table[i+1][j], table[i][j+1])
+			}
+		}
+	}
+	var out []edit
+	i, j := 0, 0
+	for i < n && j < m {
+		switch {
+		case a[i] == b[j]:
+			out = append(out, edit{equal, a[i]})
+			i++
+			j++
+		case table[i+1][j] >= table[i][j+1]:
+			out = append(out, edit{del, a[i]})
+			i++
+		default:
+			out = append(out, edit{ins, b[j]})
+			j++
+		}
+	}
+	for ; i < n; i++ {
+		out = append(out, edit{del, a[i]})
+	}
+	for ; j < m; j++ {
+		out = append(out, edit{ins, b[j]})
+	}
+	return out
+}
+
+func isTag(tok string) bool {
+	return strings.HasPrefix(tok, "<")
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\t' || c == '\r'
+}
+
+var escaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+
+func escape(s string) string {
+	return escaper.Replace(s)
+}
@@ -52,35 +52,38 @@ func (h *AdminHandler) Dashboard(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// notificationTypes are Discourse's notification type ids by name.
+var notificationTypes = map[string]int{
+	"mentioned":          1,
+	"replied":            2,
+	"quoted":             3,
+	"edited":             4,
+	"liked":              5,
+	"private_message":    6,
+	"invited_to_private_message": 7,
+	"invitee_accepted":   8,
+	"posted":             9,
+	"moved_post":         10,
+	"linked":             11,
+	"granted_badge":      12,
+	"invited_to_topic":   13,
+	"custom":             14,
+	"group_mentioned":    15,
+	"group_message_summary": 16,
+	"watching_first_post": 17,
+	"topic_reminder":     18,
+	"liked_consolidated": 19,
+	"post_approved":      20,
+	"code_review_commit_approved": 21,
+}
+
 // GET /site.json
 func (h *AdminHandler) SiteInfo(w http.ResponseWriter, r *http.Request) {
 	cats := h.Store.ListCategories()
 	groups := h.Store.ListGroups()
 	writeJSON(w, http.StatusOK, model.SiteInfo{
 		DefaultArchetype: "regular",
-		NotificationTypes: map[string]int{
-			"mentioned":          1,
-			"replied":            2,
-			"quoted":             3,
-			"edited":             4,
-			"liked":              5,
-			"private_message":    6,
-			"invited_to_private_message": 7,
-			"invitee_accepted":   8,
-			"posted":             9,
-			"moved_post":         10,
-			"linked":             11,
-			"granted_badge":      12,
-			"invited_to_topic":   13,
-			"custom":             14,
-			"group_mentioned":    15,
-			"group_message_summary": 16,
-			"watching_first_post": 17,
-			"topic_reminder":     18,
-			"liked_consolidated": 19,
-			"post_approved":      20,
-			"code_review_commit_approved": 21,
-		},
+		NotificationTypes: notificationTypes,
 		PostTypes: map[string]int{
 			"regular":        1,
 			"moderator_action": 2,
@@ -5,6 +5,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/lightcap/dtu-discourse/internal/middleware"
 	"github.com/lightcap/dtu-discourse/internal/model"
 	"github.com/lightcap/dtu-discourse/internal/store"
 )
@@ -99,9 +100,22 @@ func (h *CategoriesHandler) Show(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, model.CategoryResponse{Category: *cat})
 }
 
-// GET /c/{slug}/{id}.json  — list topics in category
+// GET /c/{slug}/{id}.json  — list topics in category (or .rss for the feed)
 // Also handles /c/{slug}.json where {id} captures slug.json
 func (h *CategoriesHandler) ListTopics(w http.ResponseWriter, r *http.Request) {
+	// /c/{slug}/{id}.rss or /c/{slug}.rss
+	if idOrSlug, rss := isRSS(pathParam(r, "id")); rss {
+		cat := h.Store.GetCategoryBySlug(idOrSlug)
+		if id, err := strconv.Atoi(idOrSlug); err == nil {
+			cat = h.Store.GetCategory(id)
+		}
+		if cat == nil {
+			writeError(w, http.StatusNotFound, "category not found")
+			return
+		}
+		writeCategoryFeed(w, r, h.Store, cat)
+		return
+	}
 	id, ok := pathParamInt(r, "id")
 	if ok {
 		topics := h.Store.TopicsByCategory(id)
@@ -200,5 +214,29 @@ func (h *CategoriesHandler) Reorder(w http.ResponseWriter, r *http.Request) {
 
 // POST /category/{category_id}/notifications
 func (h *CategoriesHandler) SetNotificationLevel(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathParamInt(r, "category_id")
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid category id")
+		return
+	}
+	body, err := decodeBody(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	level, ok := notificationLevelParam(body)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid notification_level")
+		return
+	}
+	u := h.Store.GetUserByUsername(middleware.GetUsername(r))
+	if u == nil {
+		writeError(w, http.StatusForbidden, "user not found")
+		return
+	}
+	if err := h.Store.SetCategoryNotificationLevel(id, u.ID, level); err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
 	writeJSON(w, http.StatusOK, model.SuccessResponse{Success: "OK"})
 }
@@ -1,11 +1,21 @@
 package handler
 
 import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/lightcap/dtu-discourse/internal/middleware"
 	"github.com/lightcap/dtu-discourse/internal/model"
 	"github.com/lightcap/dtu-discourse/internal/store"
+	"github.com/lightcap/dtu-discourse/internal/webhook"
 )
 
 // ExtendedAdminHandler covers undocumented admin endpoints: webhooks, themes,
@@ -14,48 +24,333 @@ import (
 // flags, impersonation, silence/unsilence, reports, version check, etc.
 type ExtendedAdminHandler struct {
 	Store *store.Store
+	Ext   *store.ExtStore
 }
 
 // ---- Webhooks ----
 
 func (h *ExtendedAdminHandler) ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	hooks := h.Ext.ListWebhooks()
+	out := make([]model.Webhook, 0, len(hooks))
+	for _, wh := range hooks {
+		out = append(out, h.webhookJSON(wh))
+	}
+	eventTypes := make([]model.WebHookEventType, 0, len(webhook.EventTypes))
+	var defaults []model.WebHookEventType
+	for _, et := range webhook.EventTypes {
+		eventTypes = append(eventTypes, model.WebHookEventType(et))
+		if et.Group == "post" {
+			defaults = append(defaults, model.WebHookEventType(et))
+		}
+	}
 	writeJSON(w, http.StatusOK, map[string]interface{}{
-		"web_hooks":           []interface{}{},
-		"extras":              map[string]interface{}{"default_event_types": []interface{}{}},
-		"total_rows_web_hooks": 0,
-	})
-}
-
-func (h *ExtendedAdminHandler) CreateWebhook(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, http.StatusOK, map[string]interface{}{
-		"web_hook": map[string]interface{}{
-			"id": 1, "payload_url": "", "content_type": 1,
-			"secret": "", "wildcard_web_hook": false, "active": true,
-			"verify_certificate": true, "created_at": time.Now().UTC(),
+		"web_hooks": out,
+		"extras": map[string]interface{}{
+			"event_types":         eventTypes,
+			"default_event_types": defaults,
+			"content_types": []map[string]interface{}{
+				{"id": webhook.ContentTypeJSON, "name": "application/json"},
+				{"id": webhook.ContentTypeURLEncoded, "name": "application/x-www-form-urlencoded"},
+			},
+			"delivery_statuses": []map[string]interface{}{
+				{"id": webhook.StatusInactive, "name": "inactive"}, {"id": webhook.StatusFailed, "name": "failed"},
+				{"id": webhook.StatusSuccessful, "name": "successful"}, {"id": webhook.StatusDisabled, "name": "disabled"},
+			},
 		},
+		"total_rows_web_hooks": len(out),
 	})
 }
 
+// POST /admin/api/web_hooks.json
+func (h *ExtendedAdminHandler) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	body, err := decodeBody(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	wh, err := h.Ext.CreateWebhook(webhookParams(body))
+	if err != nil {
+		writeErrors(w, http.StatusUnprocessableEntity, []string{err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"web_hook": h.webhookJSON(*wh)})
+}
+
+// GET /admin/api/web_hooks/{id}
 func (h *ExtendedAdminHandler) ShowWebhook(w http.ResponseWriter, r *http.Request) {
-	h.CreateWebhook(w, r)
+	id, _ := pathParamInt(r, "id")
+	wh, err := h.Ext.GetWebhook(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"web_hook": h.webhookJSON(*wh)})
 }
 
+// PUT /admin/api/web_hooks/{id}
 func (h *ExtendedAdminHandler) UpdateWebhook(w http.ResponseWriter, r *http.Request) {
-	h.CreateWebhook(w, r)
-}
-
+	id, _ := pathParamInt(r, "id")
+	body, err := decodeBody(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	wh, err := h.Ext.UpdateWebhook(id, webhookParams(body))
+	switch {
+	case errors.Is(err, store.ErrInvalidPayloadURL):
+		writeErrors(w, http.StatusUnprocessableEntity, []string{err.Error()})
+		return
+	case err != nil:
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"web_hook": h.webhookJSON(*wh)})
+}
+
+// DELETE /admin/api/web_hooks/{id}
 func (h *ExtendedAdminHandler) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, _ := pathParamInt(r, "id")
+	if err := h.Ext.DeleteWebhook(id); err != nil {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
 	writeJSON(w, http.StatusOK, model.SuccessResponse{Success: "OK"})
 }
 
+// webhookJSON renders wh as AdminWebHookSerializer does.
+func (h *ExtendedAdminHandler) webhookJSON(wh store.Webhook) model.Webhook {
+	out := model.Webhook{
+		ID: wh.ID, PayloadURL: wh.PayloadURL, ContentType: wh.ContentType,
+		LastDeliveryStatus: h.Store.Hooks.LastStatus(wh.ID), Secret: wh.Secret, WildcardWebHook: wh.WildcardWeb,
+		VerifyCertificate: wh.VerifyCert, Active: wh.Active,
+		WebHookEventTypes: []model.WebHookEventType{}, TagNames: []string{},
+		CreatedAt: wh.CreatedAt, UpdatedAt: wh.UpdatedAt,
+	}
+	for _, name := range wh.EventTypes {
+		if et, ok := webhook.EventTypeNamed(name); ok {
+			out.WebHookEventTypeIDs = append(out.WebHookEventTypeIDs, et.ID)
+			out.WebHookEventTypes = append(out.WebHookEventTypes, model.WebHookEventType(et))
+		}
+	}
+	for _, id := range wh.CategoryIDs {
+		if c := h.Store.GetCategory(id); c != nil {
+			out.Categories = append(out.Categories, *c)
+		}
+	}
+	out.TagNames = append(out.TagNames, wh.TagNames...)
+	for _, id := range wh.GroupIDs {
+		if g := h.Store.GetGroup(id); g != nil {
+			out.Groups = append(out.Groups, *g)
+		}
+	}
+	return out
+}
+
+// webhookParams reads the web_hook[...] params of a create or update into
+// the attributes ExtStore.UpdateWebhook takes. Event types are given by id.
+func webhookParams(body map[string]interface{}) map[string]interface{} {
+	params, ok := body["web_hook"].(map[string]interface{})
+	if !ok {
+		params = body
+	}
+	// Form-encoded arrays arrive as web_hook[category_ids][].
+	param := func(name string) (interface{}, bool) {
+		if v, ok := params[name]; ok {
+			return v, true
+		}
+		v, ok := params[name+"]["]
+		return v, ok
+	}
+	attrs := map[string]interface{}{}
+	for _, name := range []string{"payload_url", "secret"} {
+		if v, ok := param(name); ok {
+			attrs[name], _ = v.(string)
+		}
+	}
+	if v, ok := param("content_type"); ok {
+		if ids := paramInts(v); len(ids) == 1 {
+			attrs["content_type"] = ids[0]
+		}
+	}
+	for _, name := range []string{"wildcard_web_hook", "verify_certificate", "active"} {
+		if v, ok := param(name); ok {
+			attrs[name] = v == true || v == "true"
+		}
+	}
+	if v, ok := param("web_hook_event_type_ids"); ok {
+		names := []string{}
+		for _, id := range paramInts(v) {
+			if et, ok := webhook.EventTypeByID(id); ok {
+				names = append(names, et.Name)
+			}
+		}
+		attrs["event_types"] = names
+	}
+	for _, name := range []string{"category_ids", "group_ids"} {
+		if v, ok := param(name); ok {
+			attrs[name] = paramInts(v)
+		}
+	}
+	if v, ok := param("tag_names"); ok {
+		attrs["tag_names"] = paramStrings(v)
+	}
+	return attrs
+}
+
+// paramStrings reads a JSON array, repeated form values or a
+// comma-separated string.
+func paramStrings(v interface{}) []string {
+	out := []string{}
+	switch v := v.(type) {
+	case []interface{}:
+		for _, item := range v {
+			if s := strings.TrimSpace(fmt.Sprint(item)); s != "" {
+				out = append(out, s)
+			}
+		}
+	case []string:
+		for _, item := range v {
+			out = append(out, paramStrings(item)...)
+		}
+	case string:
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				out = append(out, item)
+			}
+		}
+	case float64:
+		out = append(out, strconv.Itoa(int(v)))
+	}
+	return out
+}
+
+// paramInts is paramStrings for ids; anything that isn't a number is
+// skipped.
+func paramInts(v interface{}) []int {
+	out := []int{}
+	for _, s := range paramStrings(v) {
+		if id, err := strconv.Atoi(s); err == nil {
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+// GET /admin/api/web_hooks/{id}/events
+// Lists a web hook's delivery attempts newest first, 50 at a time from
+// ?offset, only the successful or failed ones with ?status=.
 func (h *ExtendedAdminHandler) WebhookEvents(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, http.StatusOK, map[string]interface{}{"web_hook_events": []interface{}{}})
+	id, _ := pathParamInt(r, "id")
+	if _, err := h.Ext.GetWebhook(id); err != nil {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	status := r.URL.Query().Get("status")
+	events := []model.WebhookEvent{}
+	for _, a := range h.Store.Hooks.Attempts(id) {
+		if (status == "successful" && !a.Succeeded()) || (status == "failed" && (a.Status == 0 || a.Succeeded())) {
+			continue
+		}
+		events = append(events, webhookEventJSON(a))
+	}
+	total := len(events)
+	offset := max(0, queryInt(r, "offset", 0))
+	events = page(events, offset, 50)
+	more := url.Values{"offset": {strconv.Itoa(offset + 50)}}
+	if status != "" {
+		more.Set("status", status)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"web_hook_events":            events,
+		"total_rows_web_hook_events": total,
+		"load_more_web_hook_events":  fmt.Sprintf("/admin/api/web_hooks/%d/events.json?%s", id, more.Encode()),
+		"extras":                     map[string]interface{}{"web_hook_id": id},
+	})
 }
 
+// POST /admin/api/web_hooks/{id}/events/{event_id}/redeliver
+// Sends the event again under the same id; the attempt is updated once it
+// has been delivered.
+func (h *ExtendedAdminHandler) RedeliverWebhookEvent(w http.ResponseWriter, r *http.Request) {
+	id, _ := pathParamInt(r, "id")
+	eventID, _ := pathParamInt(r, "event_id")
+	a, ok := h.Store.Hooks.Redeliver(id, eventID)
+	if !ok {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"web_hook_event": webhookEventJSON(a)})
+}
+
+// POST /admin/api/web_hooks/{id}/ping
 func (h *ExtendedAdminHandler) PingWebhook(w http.ResponseWriter, r *http.Request) {
+	id, _ := pathParamInt(r, "id")
+	if !h.Store.Hooks.Ping(id) {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, model.SuccessResponse{Success: "OK"})
+}
+
+// ---- DTU webhook deliveries ----
+
+// POST /__dtu/webhooks/flush
+// Blocks until every queued gamification and web hook event has been
+// delivered, or dead-lettered, for up to ?timeout seconds (30 by default).
+func (h *ExtendedAdminHandler) FlushWebhooks(w http.ResponseWriter, r *http.Request) {
+	timeout := queryInt(r, "timeout", 30)
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(timeout)*time.Second)
+	defer cancel()
+	if err := h.Store.FlushWebhooks(ctx); err != nil {
+		writeError(w, http.StatusGatewayTimeout, fmt.Sprintf("webhook deliveries still pending after %ds", timeout))
+		return
+	}
 	writeJSON(w, http.StatusOK, model.SuccessResponse{Success: "OK"})
 }
 
+// GET /__dtu/webhooks/deliveries
+// Returns the gamification payloads dispatched to each URL and every admin
+// web hook event, oldest first, with how their delivery went. ?action
+// narrows the gamification payloads and ?event the web hook events.
+func (h *ExtendedAdminHandler) WebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	action, event := r.URL.Query().Get("action"), r.URL.Query().Get("event")
+	gamification := []webhook.Dispatched{}
+	for _, d := range h.Store.Gamification.Deliveries() {
+		if action == "" || d.Payload.Action == action {
+			gamification = append(gamification, d)
+		}
+	}
+	type webHookDelivery struct {
+		model.WebhookEvent
+		Event string `json:"event"`
+	}
+	events := []webHookDelivery{}
+	for _, a := range h.Store.Hooks.Deliveries() {
+		if event == "" || a.Event == event {
+			events = append(events, webHookDelivery{webhookEventJSON(a), a.Event})
+		}
+	}
+	dead := h.Store.Gamification.DeadLetters()
+	if dead == nil {
+		dead = []webhook.DeadLetter{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"gamification":    gamification,
+		"dead_letters":    dead,
+		"web_hook_events": events,
+	})
+}
+
+// webhookEventJSON renders a as WebHookEventSerializer does.
+func webhookEventJSON(a webhook.Attempt) model.WebhookEvent {
+	return model.WebhookEvent{
+		ID: a.ID, WebHookID: a.HookID, RequestURL: a.RequestURL, Headers: a.Headers,
+		Payload: a.Payload, Status: a.Status, ResponseHeaders: a.ResponseHeaders,
+		ResponseBody: a.ResponseBody, Duration: a.Duration, CreatedAt: a.CreatedAt,
+		Redelivering: a.Redelivering,
+	}
+}
+
 // ---- Themes ----
 
 func (h *ExtendedAdminHandler) ListThemes(w http.ResponseWriter, r *http.Request) {
@@ -115,30 +410,136 @@ func (h *ExtendedAdminHandler) DeleteColorScheme(w http.ResponseWriter, r *http.
 // ---- Watched Words ----
 
 func (h *ExtendedAdminHandler) ListWatchedWords(w http.ResponseWriter, r *http.Request) {
+	words := h.Ext.ListWatchedWords()
+	sort.Slice(words, func(i, j int) bool { return words[i].ID < words[j].ID })
+	out := make([]map[string]interface{}, 0, len(words))
+	for _, ww := range words {
+		out = append(out, serializeWatchedWord(ww))
+	}
 	writeJSON(w, http.StatusOK, map[string]interface{}{
-		"words":   []interface{}{},
-		"actions": []string{"block", "censor", "require_approval", "flag", "replace", "tag", "silence", "link"},
+		"words":   out,
+		"actions": store.WatchedWordActions,
 	})
 }
 
+// POST /admin/customize/watched_words.json
 func (h *ExtendedAdminHandler) CreateWatchedWord(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, http.StatusOK, map[string]interface{}{
-		"id": 1, "word": "", "action": "block",
-	})
-}
-
+	body, err := decodeBody(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if nested, ok := body["watched_word"].(map[string]interface{}); ok {
+		body = nested
+	}
+	word, _ := body["word"].(string)
+	replacement, _ := body["replacement"].(string)
+	action, ok := watchedWordAction(body)
+	if !ok {
+		writeError(w, http.StatusUnprocessableEntity, "Action is invalid")
+		return
+	}
+	caseSensitive := body["case_sensitive"] == true || body["case_sensitive"] == "true"
+	ww, err := h.Ext.CreateWatchedWord(word, action, replacement, caseSensitive)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, serializeWatchedWord(*ww))
+}
+
+// DELETE /admin/customize/watched_words/{id}
 func (h *ExtendedAdminHandler) DeleteWatchedWord(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathParamInt(r, "id")
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid watched word id")
+		return
+	}
+	if err := h.Ext.DeleteWatchedWord(id); err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
 	writeJSON(w, http.StatusOK, model.SuccessResponse{Success: "OK"})
 }
 
+// POST /admin/customize/watched_words/upload
+//
+// The multipart "file" is a CSV of word[,replacement[,case_sensitive]]
+// rows, all added with the action named by action_key. A bad row rejects
+// the whole file.
 func (h *ExtendedAdminHandler) UploadWatchedWords(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(10 << 20)
+	action, ok := store.WatchedWordActionID(r.FormValue("action_key"))
+	if !ok {
+		writeError(w, http.StatusUnprocessableEntity, "Action is invalid")
+		return
+	}
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "file is required")
+		return
+	}
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	rows, err := reader.ReadAll()
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "Unable to read the CSV file: "+err.Error())
+		return
+	}
+	words := make([]store.WatchedWordRow, 0, len(rows))
+	for _, row := range rows {
+		word := store.WatchedWordRow{Word: strings.TrimPrefix(row[0], "\ufeff")}
+		if len(row) > 1 {
+			word.Replacement = strings.TrimSpace(row[1])
+		}
+		word.CaseSensitive = len(row) > 2 && strings.EqualFold(strings.TrimSpace(row[2]), "true")
+		words = append(words, word)
+	}
+	if err := h.Ext.ImportWatchedWords(action, words); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
 	writeJSON(w, http.StatusOK, model.SuccessResponse{Success: "OK"})
 }
 
+// DELETE /admin/customize/watched_words/action/{action}
 func (h *ExtendedAdminHandler) ClearWatchedWordsAction(w http.ResponseWriter, r *http.Request) {
+	action, ok := store.WatchedWordActionID(strings.TrimSuffix(pathParam(r, "action"), ".json"))
+	if !ok {
+		writeError(w, http.StatusUnprocessableEntity, "Action is invalid")
+		return
+	}
+	h.Ext.ClearWatchedWords(action)
 	writeJSON(w, http.StatusOK, model.SuccessResponse{Success: "OK"})
 }
 
+// watchedWordAction reads the action from action_key, or from action given
+// either by name or by id.
+func watchedWordAction(body map[string]interface{}) (int, bool) {
+	if name, ok := body["action_key"].(string); ok {
+		return store.WatchedWordActionID(name)
+	}
+	switch v := body["action"].(type) {
+	case string:
+		return store.WatchedWordActionID(v)
+	case float64:
+		return int(v), int(v) >= 0 && int(v) < len(store.WatchedWordActions)
+	}
+	return 0, false
+}
+
+func serializeWatchedWord(ww store.WatchedWord) map[string]interface{} {
+	out := map[string]interface{}{
+		"id": ww.ID, "word": ww.Word, "action": store.WatchedWordActions[ww.Action],
+		"case_sensitive": ww.CaseSensitive,
+	}
+	if ww.Replacement != nil {
+		out["replacement"] = *ww.Replacement
+	}
+	return out
+}
+
 // ---- Site Texts ----
 
 func (h *ExtendedAdminHandler) ListSiteTexts(w http.ResponseWriter, r *http.Request) {
@@ -290,19 +691,65 @@ func (h *ExtendedAdminHandler) DeleteCustomUserField(w http.ResponseWriter, r *h
 // ---- Review Queue / Reviewables ----
 
 func (h *ExtendedAdminHandler) ListReviewables(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = "pending"
+	}
+	want, ok := reviewableStatuses[status]
+	if !ok && status != "all" {
+		writeError(w, http.StatusBadRequest, "invalid status")
+		return
+	}
+	reviewableType := r.URL.Query().Get("type")
+	list := []store.Reviewable{}
+	for _, rv := range h.Ext.ListReviewables() {
+		if (status == "all" || rv.Status == want) && (reviewableType == "" || rv.Type == reviewableType) {
+			list = append(list, rv)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Score != list[j].Score {
+			return list[i].Score > list[j].Score
+		}
+		return list[i].ID < list[j].ID
+	})
 	writeJSON(w, http.StatusOK, map[string]interface{}{
-		"reviewables":       []interface{}{},
-		"meta":              map[string]interface{}{"total_rows_reviewables": 0},
+		"reviewables":       list,
+		"meta":              map[string]interface{}{"total_rows_reviewables": len(list), "status": status},
 		"__rest_serializer": "1",
 	})
 }
 
+// reviewableStatuses maps the ?status= filter of /review.json to store statuses.
+var reviewableStatuses = map[string]int{
+	"pending":  store.ReviewablePending,
+	"approved": store.ReviewableApproved,
+	"rejected": store.ReviewableRejected,
+	"ignored":  store.ReviewableIgnored,
+}
+
 func (h *ExtendedAdminHandler) ShowReviewable(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, http.StatusOK, map[string]interface{}{"reviewable": map[string]interface{}{}})
+	id, _ := pathParamInt(r, "id")
+	rv, err := h.Ext.GetReviewable(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"reviewable": rv})
 }
 
 func (h *ExtendedAdminHandler) ReviewableCount(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, http.StatusOK, map[string]interface{}{"reviewable_count": 0})
+	writeJSON(w, http.StatusOK, map[string]interface{}{"reviewable_count": h.pendingReviewables()})
+}
+
+func (h *ExtendedAdminHandler) pendingReviewables() int {
+	n := 0
+	for _, rv := range h.Ext.ListReviewables() {
+		if rv.Status == store.ReviewablePending {
+			n++
+		}
+	}
+	return n
 }
 
 func (h *ExtendedAdminHandler) ReviewableTopics(w http.ResponseWriter, r *http.Request) {
@@ -321,8 +768,42 @@ func (h *ExtendedAdminHandler) UpdateReviewSettings(w http.ResponseWriter, r *ht
 }
 
 func (h *ExtendedAdminHandler) PerformReviewAction(w http.ResponseWriter, r *http.Request) {
+	id, _ := pathParamInt(r, "id")
+	action := pathParam(r, "action")
+	reviewer := h.Store.GetUserByUsername(middleware.GetUsername(r))
+	if reviewer == nil {
+		writeError(w, http.StatusForbidden, "user not found")
+		return
+	}
+	rv, err := h.Ext.PerformReviewable(id, reviewer.ID, action)
+	if errors.Is(err, store.ErrInvalidReviewAction) {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	var verr *store.ValidationError
+	if errors.As(err, &verr) {
+		writeErrors(w, http.StatusUnprocessableEntity, verr.Messages)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	transition := "pending"
+	for name, status := range reviewableStatuses {
+		if status == rv.Status {
+			transition = name
+		}
+	}
 	writeJSON(w, http.StatusOK, map[string]interface{}{
-		"reviewable_perform_result": map[string]interface{}{"success": "OK"},
+		"reviewable_perform_result": map[string]interface{}{
+			"success":               "OK",
+			"transition_to":         transition,
+			"transition_to_id":      rv.Status,
+			"remove_reviewable_ids": []int{rv.ID},
+			"version":               rv.Version,
+			"reviewable_count":      h.pendingReviewables(),
+		},
 	})
 }
 
@@ -491,23 +972,40 @@ func (h *ExtendedAdminHandler) AdminSearch(w http.ResponseWriter, r *http.Reques
 // ---- Email Templates ----
 
 func (h *ExtendedAdminHandler) ListEmailTemplates(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, http.StatusOK, []interface{}{})
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"email_templates": h.Store.EmailTemplates.List(),
+	})
 }
 
 func (h *ExtendedAdminHandler) ShowEmailTemplate(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, http.StatusOK, map[string]interface{}{
-		"email_template": map[string]interface{}{
-			"id": "", "title": "", "subject": "", "body": "",
-		},
-	})
+	t, ok := h.Store.EmailTemplates.Get(strings.TrimSuffix(pathParam(r, "id"), ".json"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "The requested URL or resource could not be found.")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"email_template": t})
 }
 
 func (h *ExtendedAdminHandler) UpdateEmailTemplate(w http.ResponseWriter, r *http.Request) {
-	h.ShowEmailTemplate(w, r)
+	body, _ := decodeBody(r)
+	params, _ := body["email_template"].(map[string]interface{})
+	subject, _ := params["subject"].(string)
+	text, _ := params["body"].(string)
+	t, err := h.Store.EmailTemplates.Override(strings.TrimSuffix(pathParam(r, "id"), ".json"), subject, text)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "The requested URL or resource could not be found.")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"email_template": t})
 }
 
 func (h *ExtendedAdminHandler) RevertEmailTemplate(w http.ResponseWriter, r *http.Request) {
-	h.ShowEmailTemplate(w, r)
+	t, err := h.Store.EmailTemplates.Revert(strings.TrimSuffix(pathParam(r, "id"), ".json"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, "The requested URL or resource could not be found.")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"email_template": t})
 }
 
 // ---- Email Style ----
@@ -2,7 +2,10 @@ package handler
 
 import (
 	"net/http"
+	"strconv"
+	"strings"
 
+	"github.com/lightcap/dtu-discourse/internal/middleware"
 	"github.com/lightcap/dtu-discourse/internal/model"
 	"github.com/lightcap/dtu-discourse/internal/store"
 )
@@ -76,41 +79,143 @@ type ExtendedNotificationsHandler struct {
 }
 
 // PUT /notifications/mark-read
+//
+// Marks the notification with id read, or those of the types listed in
+// dismiss_types, or otherwise all of the user's notifications.
 func (h *ExtendedNotificationsHandler) MarkRead(w http.ResponseWriter, r *http.Request) {
+	u := h.Store.GetUserByUsername(middleware.GetUsername(r))
+	if u == nil {
+		writeError(w, http.StatusForbidden, "user not found")
+		return
+	}
+	// With no body, everything is marked read.
+	body, _ := decodeBody(r)
+	id := 0
+	switch v := body["id"].(type) {
+	case float64:
+		id = int(v)
+	case string:
+		id, _ = strconv.Atoi(v)
+	}
+	var types []int
+	var names []string
+	switch v := body["dismiss_types"].(type) {
+	case string:
+		names = strings.Split(v, ",")
+	case []interface{}:
+		for _, name := range v {
+			if s, ok := name.(string); ok {
+				names = append(names, s)
+			}
+		}
+	}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if t, ok := notificationTypes[name]; ok {
+			types = append(types, t)
+		} else if t, err := strconv.Atoi(name); err == nil {
+			types = append(types, t)
+		}
+	}
+	if len(names) > 0 && len(types) == 0 {
+		writeError(w, http.StatusBadRequest, "invalid dismiss_types")
+		return
+	}
+	if err := h.Store.MarkNotificationsRead(u.ID, id, types); err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
 	writeJSON(w, http.StatusOK, model.SuccessResponse{Success: "OK"})
 }
 
 // GET /notifications/totals
 func (h *ExtendedNotificationsHandler) Totals(w http.ResponseWriter, r *http.Request) {
+	u := h.Store.GetUserByUsername(middleware.GetUsername(r))
+	if u == nil {
+		writeError(w, http.StatusForbidden, "user not found")
+		return
+	}
+	totals := h.Store.GetNotificationTotals(u.ID)
 	writeJSON(w, http.StatusOK, map[string]interface{}{
-		"total_notifications":           0,
-		"unread_notifications":          0,
-		"unread_high_priority":          0,
-		"read_first_notification":       true,
-		"seen_notification_id":          0,
+		"total_notifications":            totals.Total,
+		"unread_notifications":           totals.Unread,
+		"unread_high_priority":           totals.UnreadHighPriority,
+		"all_unread_notifications_count": totals.AllUnread,
+		"read_first_notification":        totals.SeenID > 0,
+		"seen_notification_id":           totals.SeenID,
 	})
 }
 
+// notification finds the notification in the path that the current user
+// may see: their own, or anyone's for staff.
+func (h *ExtendedNotificationsHandler) notification(w http.ResponseWriter, r *http.Request) (*model.Notification, *model.User, bool) {
+	id, ok := pathParamInt(r, "id")
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid notification id")
+		return nil, nil, false
+	}
+	u := h.Store.GetUserByUsername(middleware.GetUsername(r))
+	n := h.Store.GetNotification(id)
+	if n == nil || u == nil || (n.UserID != u.ID && !u.Admin && !u.Moderator) {
+		writeError(w, http.StatusNotFound, "notification not found")
+		return nil, nil, false
+	}
+	return n, u, true
+}
+
 // GET /notifications/{id}
 func (h *ExtendedNotificationsHandler) Show(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, http.StatusOK, map[string]interface{}{
-		"notification": map[string]interface{}{
-			"id":                1,
-			"notification_type": 1,
-			"read":              false,
-			"created_at":        "2024-01-01T00:00:00.000Z",
-			"data":              map[string]interface{}{},
-		},
-	})
+	n, _, ok := h.notification(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"notification": n})
 }
 
 // PUT /notifications/{id}
+//
+// Only admins may change notifications, as in Discourse.
 func (h *ExtendedNotificationsHandler) Update(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, http.StatusOK, model.SuccessResponse{Success: "OK"})
+	n, u, ok := h.notification(w, r)
+	if !ok {
+		return
+	}
+	if !u.Admin {
+		writeError(w, http.StatusForbidden, "You are not permitted to view the requested resource.")
+		return
+	}
+	body, err := decodeBody(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if nested, ok := body["notification"].(map[string]interface{}); ok {
+		body = nested
+	}
+	n, err = h.Store.UpdateNotification(n.ID, body)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, n)
 }
 
 // DELETE /notifications/{id}
+//
+// Only admins may delete notifications, as in Discourse.
 func (h *ExtendedNotificationsHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	n, u, ok := h.notification(w, r)
+	if !ok {
+		return
+	}
+	if !u.Admin {
+		writeError(w, http.StatusForbidden, "You are not permitted to view the requested resource.")
+		return
+	}
+	if err := h.Store.DeleteNotification(n.ID); err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
 	writeJSON(w, http.StatusOK, model.SuccessResponse{Success: "OK"})
 }
 
@@ -290,28 +395,50 @@ func (h *ExtendedTagsHandler) Search(w http.ResponseWriter, r *http.Request) {
 func (h *ExtendedTagsHandler) Create(w http.ResponseWriter, r *http.Request) {
 	body, _ := decodeBody(r)
 	name, _ := body["name"].(string)
+	if tag, ok := body["tag"].(map[string]interface{}); ok && name == "" {
+		name, _ = tag["name"].(string)
+	}
+	tag, err := h.Store.CreateTag(name)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
 	writeJSON(w, http.StatusOK, map[string]interface{}{
 		"tag": map[string]interface{}{
-			"id":    name,
-			"text":  name,
-			"count": 0,
+			"id":    tag.TagName,
+			"text":  tag.TagName,
+			"count": tag.Count,
 		},
 	})
 }
 
 // PUT /tags/{tag}
 func (h *ExtendedTagsHandler) Update(w http.ResponseWriter, r *http.Request) {
+	body, _ := decodeBody(r)
+	var newName string
+	if tag, ok := body["tag"].(map[string]interface{}); ok {
+		newName, _ = tag["id"].(string)
+	}
+	tag, err := h.Store.RenameTag(r.PathValue("tag"), newName)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
 	writeJSON(w, http.StatusOK, map[string]interface{}{
 		"tag": map[string]interface{}{
-			"id":    r.PathValue("tag"),
-			"text":  r.PathValue("tag"),
-			"count": 0,
+			"id":    tag.TagName,
+			"text":  tag.TagName,
+			"count": tag.Count,
 		},
 	})
 }
 
 // DELETE /tags/{tag}
 func (h *ExtendedTagsHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	if err := h.Store.DeleteTag(r.PathValue("tag")); err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
 	writeJSON(w, http.StatusOK, model.SuccessResponse{Success: "OK"})
 }
 
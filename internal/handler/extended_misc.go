@@ -1,20 +1,24 @@
 package handler
 
 import (
+	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/lightcap/dtu-discourse/internal/middleware"
 	"github.com/lightcap/dtu-discourse/internal/model"
 	"github.com/lightcap/dtu-discourse/internal/store"
 )
 
 // MiscHandler covers miscellaneous undocumented endpoints: hot topics,
 // directory items, about, site basic info, drafts, bookmarks, published
-// pages, sidebar sections, clicks, onebox, slugs, embed, presence, DND,
+// pages, sidebar sections, clicks, onebox, slugs, embed, DND,
 // emoji, hashtags, form templates, composer, etc.
 type MiscHandler struct {
 	Store *store.Store
+	Ext   *store.ExtStore
 }
 
 // ---- Hot/Filter Topics ----
@@ -168,8 +172,24 @@ func (h *MiscHandler) DeleteDraft(w http.ResponseWriter, r *http.Request) {
 
 // POST /bookmarks
 func (h *MiscHandler) CreateBookmark(w http.ResponseWriter, r *http.Request) {
+	body, _ := decodeBody(r)
+	u := h.Store.GetUserByUsername(middleware.GetUsername(r))
+	if u == nil {
+		writeError(w, http.StatusForbidden, "user not found")
+		return
+	}
+	bookmarkableID, _ := strconv.Atoi(fmt.Sprint(body["bookmarkable_id"]))
+	bookmarkableType, _ := body["bookmarkable_type"].(string)
+	if bookmarkableType == "" {
+		bookmarkableType = "Post"
+	}
+	b, err := h.Ext.CreateBookmark(u.ID, bookmarkableID, bookmarkableType)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	writeJSON(w, http.StatusOK, map[string]interface{}{
-		"id": 1, "created_at": time.Now().UTC(),
+		"success": "OK", "id": b.ID, "created_at": b.CreatedAt,
 	})
 }
 
@@ -180,6 +200,17 @@ func (h *MiscHandler) UpdateBookmark(w http.ResponseWriter, r *http.Request) {
 
 // DELETE /bookmarks/{id}
 func (h *MiscHandler) DeleteBookmark(w http.ResponseWriter, r *http.Request) {
+	id, _ := pathParamInt(r, "id")
+	b, err := h.Ext.GetBookmark(id)
+	u := h.Store.GetUserByUsername(middleware.GetUsername(r))
+	if err != nil || u == nil || b.UserID != u.ID {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if err := h.Ext.DeleteBookmark(id); err != nil {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
 	writeJSON(w, http.StatusOK, model.SuccessResponse{Success: "OK"})
 }
 
@@ -300,18 +331,6 @@ func (h *MiscHandler) EmbedInfo(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, map[string]interface{}{})
 }
 
-// ---- Presence ----
-
-// POST /presence/update
-func (h *MiscHandler) PresenceUpdate(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, http.StatusOK, model.SuccessResponse{Success: "OK"})
-}
-
-// GET /presence/get
-func (h *MiscHandler) PresenceGet(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, http.StatusOK, map[string]interface{}{})
-}
-
 // ---- User Status / DND ----
 
 // GET /user-status
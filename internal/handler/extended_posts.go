@@ -1,11 +1,13 @@
 package handler
 
 import (
+	"html"
 	"net/http"
 	"strconv"
 	"strings"
-	"time"
 
+	"github.com/lightcap/dtu-discourse/internal/diff"
+	"github.com/lightcap/dtu-discourse/internal/middleware"
 	"github.com/lightcap/dtu-discourse/internal/model"
 	"github.com/lightcap/dtu-discourse/internal/store"
 )
@@ -13,6 +15,7 @@ import (
 // ExtendedPostsHandler handles undocumented post operations.
 type ExtendedPostsHandler struct {
 	Store *store.Store
+	Ext   *store.ExtStore
 }
 
 // PUT /posts/{id}/recover
@@ -53,44 +56,173 @@ func (h *ExtendedPostsHandler) LatestRevision(w http.ResponseWriter, r *http.Req
 		writeError(w, http.StatusNotFound, "post not found")
 		return
 	}
-	writeJSON(w, http.StatusOK, map[string]interface{}{
-		"post_revision": map[string]interface{}{
-			"post_id":        id,
-			"version":        p.Version,
-			"revision_number": p.Version,
-			"created_at":     time.Now().UTC(),
-			"body_changes": map[string]interface{}{
-				"inline": p.Cooked,
-			},
-		},
-	})
+	revs := h.visibleRevisions(r, id)
+	if len(revs) == 0 {
+		// A post that was never edited only has its original version.
+		writeJSON(w, http.StatusOK, h.serializeRevision(r, *p, nil, store.PostRevision{
+			PostID: p.ID, UserID: p.UserID, Number: 1,
+			PreviousRaw: p.Raw, CurrentRaw: p.Raw,
+			PreviousCooked: p.Cooked, CurrentCooked: p.Cooked,
+			CreatedAt: p.CreatedAt,
+		}))
+		return
+	}
+	writeJSON(w, http.StatusOK, h.serializeRevision(r, *p, revs, revs[len(revs)-1]))
 }
 
 // GET /posts/{id}/revisions/{revision}
 func (h *ExtendedPostsHandler) Revision(w http.ResponseWriter, r *http.Request) {
-	h.LatestRevision(w, r)
+	id, _ := pathParamInt(r, "id")
+	p := h.Store.GetPost(id)
+	if p == nil {
+		writeError(w, http.StatusNotFound, "post not found")
+		return
+	}
+	number, ok := pathParamInt(r, "revision")
+	if !ok || number < 2 {
+		writeError(w, http.StatusBadRequest, "invalid revision")
+		return
+	}
+	rev, err := h.Ext.PostRevisionByNumber(id, number)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if rev.Hidden && !middleware.IsAdmin(r) {
+		writeError(w, http.StatusForbidden, "revision is hidden")
+		return
+	}
+	writeJSON(w, http.StatusOK, h.serializeRevision(r, *p, h.visibleRevisions(r, id), *rev))
 }
 
 // PUT /posts/{id}/revisions/{revision}/hide
 func (h *ExtendedPostsHandler) HideRevision(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, http.StatusOK, model.SuccessResponse{Success: "OK"})
+	h.setRevisionHidden(w, r, true)
 }
 
 // PUT /posts/{id}/revisions/{revision}/show
 func (h *ExtendedPostsHandler) ShowRevision(w http.ResponseWriter, r *http.Request) {
+	h.setRevisionHidden(w, r, false)
+}
+
+func (h *ExtendedPostsHandler) setRevisionHidden(w http.ResponseWriter, r *http.Request, hidden bool) {
+	id, _ := pathParamInt(r, "id")
+	number, _ := pathParamInt(r, "revision")
+	if err := h.Ext.SetPostRevisionHidden(id, number, hidden); err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
 	writeJSON(w, http.StatusOK, model.SuccessResponse{Success: "OK"})
 }
 
 // PUT /posts/{id}/revisions/{revision}/revert
 func (h *ExtendedPostsHandler) RevertRevision(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, http.StatusOK, model.SuccessResponse{Success: "OK"})
+	id, _ := pathParamInt(r, "id")
+	number, _ := pathParamInt(r, "revision")
+	if h.Store.GetPost(id) == nil {
+		writeError(w, http.StatusNotFound, "post not found")
+		return
+	}
+	u := h.Store.GetUserByUsername(middleware.GetUsername(r))
+	if u == nil {
+		writeError(w, http.StatusForbidden, "user not found")
+		return
+	}
+	if _, err := h.Ext.PostRevisionByNumber(id, number); err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	p, err := h.Ext.RevertPostRevision(id, number, u.ID)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
 }
 
 // DELETE /posts/{id}/revisions/permanently_delete
 func (h *ExtendedPostsHandler) PermanentlyDeleteRevisions(w http.ResponseWriter, r *http.Request) {
+	id, _ := pathParamInt(r, "id")
+	if h.Store.GetPost(id) == nil {
+		writeError(w, http.StatusNotFound, "post not found")
+		return
+	}
+	h.Ext.DeletePostRevisions(id)
 	writeJSON(w, http.StatusOK, model.SuccessResponse{Success: "OK"})
 }
 
+// visibleRevisions lists a post's revisions, leaving out hidden ones for
+// non-admins.
+func (h *ExtendedPostsHandler) visibleRevisions(r *http.Request, postID int) []store.PostRevision {
+	all := h.Ext.ListPostRevisions(postID)
+	if middleware.IsAdmin(r) {
+		return all
+	}
+	out := make([]store.PostRevision, 0, len(all))
+	for _, rev := range all {
+		if !rev.Hidden {
+			out = append(out, rev)
+		}
+	}
+	return out
+}
+
+// serializeRevision renders rev the way PostRevisionSerializer does, with
+// navigation over the original version plus the visible revisions.
+func (h *ExtendedPostsHandler) serializeRevision(r *http.Request, p model.Post, revs []store.PostRevision, rev store.PostRevision) model.PostRevision {
+	numbers := []int{1}
+	for _, v := range revs {
+		numbers = append(numbers, v.Number)
+	}
+	out := model.PostRevision{
+		CreatedAt: rev.CreatedAt, PostID: p.ID,
+		PreviousHidden: p.Hidden, CurrentHidden: p.Hidden,
+		FirstRevision: numbers[0], CurrentRevision: rev.Number,
+		LastRevision: numbers[len(numbers)-1], CurrentVersion: rev.Number,
+		VersionCount: len(numbers), EditReason: rev.EditReason,
+		CanEdit: middleware.IsAdmin(r),
+		BodyChanges: &model.RevisionDiff{
+			Inline:             diff.Inline(rev.PreviousCooked, rev.CurrentCooked),
+			SideBySide:         diff.SideBySide(rev.PreviousCooked, rev.CurrentCooked),
+			SideBySideMarkdown: diff.SideBySideMarkdown(rev.PreviousRaw, rev.CurrentRaw),
+		},
+	}
+	for _, n := range numbers {
+		if n < rev.Number {
+			prev := n
+			out.PreviousRevision = &prev
+		}
+		if n > rev.Number {
+			next := n
+			out.NextRevision = &next
+			break
+		}
+	}
+	if u := h.Store.GetUser(rev.UserID); u != nil {
+		out.Username = u.Username
+		out.DisplayUsername = u.Username
+		if u.Name != "" {
+			out.DisplayUsername = u.Name
+		}
+		out.AvatarTemplate = u.AvatarTemplate
+	}
+	if v, ok := rev.Modifications["title"].([]interface{}); ok {
+		before := "<h1>" + html.EscapeString(v[0].(string)) + "</h1>"
+		after := "<h1>" + html.EscapeString(v[1].(string)) + "</h1>"
+		out.TitleChanges = &model.RevisionDiff{
+			Inline:     diff.Inline(before, after),
+			SideBySide: diff.SideBySide(before, after),
+		}
+	}
+	if v, ok := rev.Modifications["category_id"].([]interface{}); ok {
+		out.CategoryIDChanges = map[string]interface{}{"previous": v[0], "current": v[1]}
+	}
+	if v, ok := rev.Modifications["tags"].([]interface{}); ok {
+		out.TagsChanges = map[string]interface{}{"previous": v[0], "current": v[1]}
+	}
+	return out
+}
+
 // DELETE /posts/destroy_many
 func (h *ExtendedPostsHandler) DestroyMany(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, model.SuccessResponse{Success: "OK"})
@@ -118,12 +250,24 @@ func (h *ExtendedPostsHandler) ByNumber(w http.ResponseWriter, r *http.Request)
 
 // GET /posts/{id}/reply-history
 func (h *ExtendedPostsHandler) ReplyHistory(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, http.StatusOK, []interface{}{})
+	id, _ := pathParamInt(r, "id")
+	posts, err := h.Store.GetPostReplyHistory(id, queryInt(r, "max_replies", 100))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, posts)
 }
 
 // GET /posts/{id}/reply-ids
 func (h *ExtendedPostsHandler) ReplyIDs(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, http.StatusOK, []interface{}{})
+	id, _ := pathParamInt(r, "id")
+	ids, err := h.Store.GetPostReplyIDs(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, ids)
 }
 
 // GET /posts/{id}/cooked
@@ -174,13 +318,32 @@ func (h *ExtendedPostsHandler) Deleted(w http.ResponseWriter, r *http.Request) {
 }
 
 // GET /posts/{username}/pending
+//
+// Lists the user's posts awaiting approval; only the user and staff may
+// see them.
 func (h *ExtendedPostsHandler) Pending(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, http.StatusOK, map[string]interface{}{"pending_posts": []interface{}{}})
+	u := h.Store.GetUserByUsername(pathParam(r, "username"))
+	if u == nil {
+		writeError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	viewer := h.Store.GetUserByUsername(middleware.GetUsername(r))
+	if viewer == nil || (viewer.ID != u.ID && !viewer.Admin && !viewer.Moderator) {
+		writeError(w, http.StatusForbidden, "You are not permitted to view the requested resource.")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"pending_posts": h.Ext.PendingPosts(u.ID)})
 }
 
 // GET /posts/{id}/replies
 func (h *ExtendedPostsHandler) Replies(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, http.StatusOK, []interface{}{})
+	id, _ := pathParamInt(r, "id")
+	posts, err := h.Store.GetPostReplies(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, posts)
 }
 
 // DELETE /posts/{id}/bookmark
@@ -1,10 +1,13 @@
 package handler
 
 import (
+	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/lightcap/dtu-discourse/internal/middleware"
 	"github.com/lightcap/dtu-discourse/internal/model"
 	"github.com/lightcap/dtu-discourse/internal/store"
 )
@@ -18,7 +21,51 @@ type ExtendedUsersHandler struct {
 // ---- Avatar ----
 
 // PUT /u/{username}/preferences/avatar/pick
+// Picks an uploaded avatar (type uploaded or custom, with upload_id), or
+// goes back to the letter avatar for any other type. Users may only pick
+// their own unless they are staff.
 func (h *ExtendedUsersHandler) PickAvatar(w http.ResponseWriter, r *http.Request) {
+	u := h.Store.GetUserByUsername(strings.TrimSuffix(r.PathValue("username"), ".json"))
+	if u == nil {
+		writeError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	acting := h.Store.GetUserByUsername(middleware.GetUsername(r))
+	if acting == nil || (acting.ID != u.ID && !acting.Admin && !acting.Moderator) {
+		writeError(w, http.StatusForbidden, "You are not permitted to view the requested resource.")
+		return
+	}
+	body, err := decodeBody(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	var uploadID *int
+	if t, _ := body["type"].(string); t == "uploaded" || t == "custom" {
+		id, err := strconv.Atoi(fmt.Sprint(body["upload_id"]))
+		if err != nil {
+			writeError(w, http.StatusUnprocessableEntity, "upload_id is required")
+			return
+		}
+		uploadID = &id
+	}
+	if err := h.Store.PickAvatar(u.ID, uploadID); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, model.SuccessResponse{Success: "OK"})
+}
+
+// PUT /__dtu/users/{username}/complete_tutorial
+// Stands in for finishing the new user tutorial, which the DTU has no bot
+// to run, granting Certified.
+func (h *ExtendedUsersHandler) CompleteTutorial(w http.ResponseWriter, r *http.Request) {
+	u := h.Store.GetUserByUsername(r.PathValue("username"))
+	if u == nil {
+		writeError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	h.Store.CompleteTutorial(u.ID)
 	writeJSON(w, http.StatusOK, model.SuccessResponse{Success: "OK"})
 }
 
@@ -231,8 +278,72 @@ func (h *ExtendedUsersHandler) Drafts(w http.ResponseWriter, r *http.Request) {
 
 // ---- Password / Token ----
 
-// POST /u/password-reset/{token}
+// PUT /u/password-reset/{token}
 func (h *ExtendedUsersHandler) PasswordReset(w http.ResponseWriter, r *http.Request) {
+	body, _ := decodeBody(r)
+	password, _ := body["password"].(string)
+	u, err := h.Store.ResetPassword(r.PathValue("token"), password)
+	if err == store.ErrInvalidEmailToken {
+		writeError(w, http.StatusUnprocessableEntity, "Password reset link has expired.")
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+			"success": false,
+			"message": err.Error(),
+			"errors":  map[string]interface{}{"password": []string{err.Error()}},
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success":           true,
+		"message":           "You successfully changed your password and are now logged in.",
+		"requires_approval": false,
+		"redirect_to":       "/",
+		"username":          u.Username,
+	})
+}
+
+// ---- Account activation ----
+
+const activationExpired = "Sorry, this account confirmation link is no longer valid. Perhaps your account is already active?"
+
+// PUT /u/activate-account/{token}
+func (h *ExtendedUsersHandler) ActivateAccount(w http.ResponseWriter, r *http.Request) {
+	u, err := h.Store.ActivateAccount(r.PathValue("token"))
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, activationExpired)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success":        "OK",
+		"username":       u.Username,
+		"needs_approval": false,
+		"redirect_to":    "/",
+	})
+}
+
+// GET /u/activate-account/{token}
+// Discourse shows a page with an activation button here; the DTU
+// activates straight away so a test can simply follow the emailed link.
+func (h *ExtendedUsersHandler) ActivateAccountPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if _, err := h.Store.ActivateAccount(r.PathValue("token")); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("<div class='activate-account'><p>" + activationExpired + "</p></div>"))
+		return
+	}
+	w.Write([]byte("<div class='activate-account'><p>Your account is activated and ready to use.</p></div>"))
+}
+
+// POST /u/action/send_activation_email
+func (h *ExtendedUsersHandler) SendActivationEmail(w http.ResponseWriter, r *http.Request) {
+	body, _ := decodeBody(r)
+	username, _ := body["username"].(string)
+	if err := h.Store.SendActivationEmail(username); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
 	writeJSON(w, http.StatusOK, model.SuccessResponse{Success: "OK"})
 }
 
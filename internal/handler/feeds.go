@@ -0,0 +1,311 @@
+package handler
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lightcap/dtu-discourse/internal/model"
+	"github.com/lightcap/dtu-discourse/internal/store"
+)
+
+// feedLimit caps the number of items in any RSS feed, like Discourse's
+// default page size.
+const feedLimit = 30
+
+// FeedsHandler serves the RSS 2.0 feeds Discourse exposes alongside the
+// JSON API. Feeds are public, so private messages and read-restricted
+// categories never appear in them.
+type FeedsHandler struct {
+	Store *store.Store
+}
+
+type rssFeed struct {
+	XMLName      xml.Name   `xml:"rss"`
+	Version      string     `xml:"version,attr"`
+	XMLNSDC      string     `xml:"xmlns:dc,attr"`
+	XMLNSContent string     `xml:"xmlns:content,attr"`
+	XMLNSAtom    string     `xml:"xmlns:atom,attr"`
+	XMLNSDisc    string     `xml:"xmlns:discourse,attr"`
+	Channel      rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	Language      string    `xml:"language,omitempty"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	AtomLink      rssAtom   `xml:"atom:link"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssAtom struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type rssItem struct {
+	Title         string     `xml:"title"`
+	Creator       rssCDATA   `xml:"dc:creator"`
+	Category      string     `xml:"category,omitempty"`
+	Description   rssCDATA   `xml:"description"`
+	Link          string     `xml:"link"`
+	PubDate       string     `xml:"pubDate"`
+	TopicPinned   string     `xml:"discourse:topicPinned,omitempty"`
+	TopicClosed   string     `xml:"discourse:topicClosed,omitempty"`
+	TopicArchived string     `xml:"discourse:topicArchived,omitempty"`
+	GUID          rssGUID    `xml:"guid"`
+	Source        *rssSource `xml:"source,omitempty"`
+}
+
+type rssCDATA struct {
+	Text string `xml:",cdata"`
+}
+
+type rssGUID struct {
+	IsPermaLink string `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssSource struct {
+	URL   string `xml:"url,attr"`
+	Title string `xml:",chardata"`
+}
+
+// GET /latest.rss
+func (h *FeedsHandler) Latest(w http.ResponseWriter, r *http.Request) {
+	topics := h.Store.ListTopics("latest")
+	writeTopicFeed(w, r, h.Store, "Latest topics", "/latest", topics)
+}
+
+// GET /posts.rss
+func (h *FeedsHandler) Posts(w http.ResponseWriter, r *http.Request) {
+	writePostFeed(w, r, h.Store, "Latest posts", "/posts", h.Store.ListPosts())
+}
+
+// GET /u/{username}/activity.rss
+func (h *FeedsHandler) UserActivity(w http.ResponseWriter, r *http.Request) {
+	username := pathParam(r, "username")
+	u := h.Store.GetUserByUsername(username)
+	if u == nil {
+		writeError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	var posts []model.Post
+	for _, p := range h.Store.ListPosts() {
+		if p.UserID == u.ID {
+			posts = append(posts, p)
+		}
+	}
+	writePostFeed(w, r, h.Store, u.Username+"'s activity", "/u/"+u.Username+"/activity", posts)
+}
+
+// writeCategoryFeed serves /c/{slug}/{id}.rss. Read-restricted categories
+// have no feed.
+func writeCategoryFeed(w http.ResponseWriter, r *http.Request, s *store.Store, cat *model.Category) {
+	if !s.CategoryPublic(cat.ID) {
+		writeError(w, http.StatusNotFound, "category not found")
+		return
+	}
+	link := fmt.Sprintf("/c/%s/%d", cat.Slug, cat.ID)
+	writeTopicFeed(w, r, s, cat.Name+" topics", link, s.TopicsByCategory(cat.ID))
+}
+
+// writeTagFeed serves /tag/{tag}.rss.
+func writeTagFeed(w http.ResponseWriter, r *http.Request, s *store.Store, tag string) {
+	writeTopicFeed(w, r, s, "Topics tagged "+tag, "/tag/"+tag, s.TopicsByTag(tag))
+}
+
+// writeTopicPostsFeed serves /t/{slug}/{id}.rss: every post in the topic.
+func writeTopicPostsFeed(w http.ResponseWriter, r *http.Request, s *store.Store, topicID int) {
+	t := s.GetTopic(topicID)
+	if t == nil || !s.TopicPublic(t) {
+		writeError(w, http.StatusNotFound, "topic not found")
+		return
+	}
+	link := fmt.Sprintf("/t/%s/%d", t.Slug, t.ID)
+	writePostFeed(w, r, s, t.Title, link, s.GetTopicPosts(t.ID, nil))
+}
+
+func writeTopicFeed(w http.ResponseWriter, r *http.Request, s *store.Store, title, path string, topics []model.Topic) {
+	base := baseURL(r)
+	public := make([]model.Topic, 0, len(topics))
+	for _, t := range topics {
+		if s.TopicPublic(&t) {
+			public = append(public, t)
+		}
+	}
+	sort.Slice(public, func(i, j int) bool {
+		if !public[i].BumpedAt.Equal(public[j].BumpedAt) {
+			return public[i].BumpedAt.After(public[j].BumpedAt)
+		}
+		return public[i].ID > public[j].ID
+	})
+	if len(public) > feedLimit {
+		public = public[:feedLimit]
+	}
+
+	items := make([]rssItem, 0, len(public))
+	for _, t := range public {
+		link := fmt.Sprintf("%s/t/%s/%d", base, t.Slug, t.ID)
+		item := rssItem{
+			Title:         t.Title,
+			Link:          link,
+			PubDate:       t.CreatedAt.UTC().Format(time.RFC1123Z),
+			TopicPinned:   yesNo(t.Pinned),
+			TopicClosed:   yesNo(t.Closed),
+			TopicArchived: yesNo(t.Archived),
+			GUID:          rssGUID{IsPermaLink: "false", Value: fmt.Sprintf("%s-topic-%d", r.Host, t.ID)},
+			Source:        &rssSource{URL: link + ".rss", Title: t.Title},
+		}
+		if cat := s.GetCategory(t.CategoryID); cat != nil {
+			item.Category = cat.Name
+		}
+		cooked := ""
+		if posts := s.GetTopicPosts(t.ID, nil); len(posts) > 0 {
+			item.Creator.Text = "@" + posts[0].Username
+			if !posts[0].Hidden {
+				cooked = posts[0].Cooked
+			}
+		}
+		item.Description.Text = fmt.Sprintf(
+			"%s\n<p><small>%d posts - %d participants</small></p>\n<p><a href=\"%s\">Read full topic</a></p>",
+			cooked, t.PostsCount, len(topicParticipants(s, t.ID)), link)
+		items = append(items, item)
+	}
+	writeRSS(w, r, s, title, path, items)
+}
+
+func writePostFeed(w http.ResponseWriter, r *http.Request, s *store.Store, title, path string, posts []model.Post) {
+	base := baseURL(r)
+	public := make([]model.Post, 0, len(posts))
+	topics := map[int]*model.Topic{}
+	for _, p := range posts {
+		if p.Hidden {
+			continue
+		}
+		t, seen := topics[p.TopicID]
+		if !seen {
+			t = s.GetTopic(p.TopicID)
+			topics[p.TopicID] = t
+		}
+		if t == nil || !s.TopicPublic(t) {
+			continue
+		}
+		public = append(public, p)
+	}
+	sort.Slice(public, func(i, j int) bool {
+		if !public[i].CreatedAt.Equal(public[j].CreatedAt) {
+			return public[i].CreatedAt.After(public[j].CreatedAt)
+		}
+		return public[i].ID > public[j].ID
+	})
+	if len(public) > feedLimit {
+		public = public[:feedLimit]
+	}
+
+	items := make([]rssItem, 0, len(public))
+	for _, p := range public {
+		t := topics[p.TopicID]
+		link := fmt.Sprintf("%s/t/%s/%d/%d", base, t.Slug, t.ID, p.PostNumber)
+		item := rssItem{
+			Title:       t.Title,
+			Creator:     rssCDATA{Text: "@" + p.Username},
+			Description: rssCDATA{Text: p.Cooked},
+			Link:        link,
+			PubDate:     p.CreatedAt.UTC().Format(time.RFC1123Z),
+			GUID:        rssGUID{IsPermaLink: "false", Value: fmt.Sprintf("%s-post-%d", r.Host, p.ID)},
+			Source:      &rssSource{URL: fmt.Sprintf("%s/t/%s/%d.rss", base, t.Slug, t.ID), Title: t.Title},
+		}
+		if cat := s.GetCategory(t.CategoryID); cat != nil {
+			item.Category = cat.Name
+		}
+		items = append(items, item)
+	}
+	writeRSS(w, r, s, title, path, items)
+}
+
+func writeRSS(w http.ResponseWriter, r *http.Request, s *store.Store, title, path string, items []rssItem) {
+	base := baseURL(r)
+	siteTitle, _ := s.GetSiteSetting("title").(string)
+	description, _ := s.GetSiteSetting("site_description").(string)
+	locale, _ := s.GetSiteSetting("default_locale").(string)
+	if siteTitle != "" {
+		title = siteTitle + " - " + title
+	}
+	feed := rssFeed{
+		Version:      "2.0",
+		XMLNSDC:      "http://purl.org/dc/elements/1.1/",
+		XMLNSContent: "http://purl.org/rss/1.0/modules/content/",
+		XMLNSAtom:    "http://www.w3.org/2005/Atom",
+		XMLNSDisc:    "http://www.discourse.org/",
+		Channel: rssChannel{
+			Title:         title,
+			Link:          base + path,
+			Description:   description,
+			Language:      locale,
+			LastBuildDate: time.Now().UTC().Format(time.RFC1123Z),
+			AtomLink:      rssAtom{Href: base + path + ".rss", Rel: "self", Type: "application/rss+xml"},
+			Items:         items,
+		},
+	}
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	enc.Encode(feed)
+}
+
+// baseURL reconstructs the public origin of the request so feed links are
+// absolute, as RSS readers require.
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if fwd := r.Header.Get("X-Forwarded-Proto"); fwd != "" {
+		scheme = fwd
+	}
+	return scheme + "://" + r.Host
+}
+
+func topicParticipants(s *store.Store, topicID int) map[int]bool {
+	users := map[int]bool{}
+	for _, p := range s.GetTopicPosts(topicID, nil) {
+		users[p.UserID] = true
+	}
+	return users
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "Yes"
+	}
+	return "No"
+}
+
+// isRSS reports whether a path segment requests the RSS representation and
+// returns the segment with the suffix removed.
+func isRSS(segment string) (string, bool) {
+	if strings.HasSuffix(segment, ".rss") {
+		return strings.TrimSuffix(segment, ".rss"), true
+	}
+	return segment, false
+}
+
+// rssTopicID parses the numeric id out of an "{id}.rss" segment.
+func rssTopicID(segment string) (int, bool) {
+	trimmed, ok := isRSS(segment)
+	if !ok {
+		return 0, false
+	}
+	id, err := strconv.Atoi(trimmed)
+	return id, err == nil
+}
@@ -2,9 +2,12 @@ package handler
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
 	"strings"
+
+	"github.com/lightcap/dtu-discourse/internal/store"
 )
 
 func writeJSON(w http.ResponseWriter, status int, v interface{}) {
@@ -14,12 +17,35 @@ func writeJSON(w http.ResponseWriter, status int, v interface{}) {
 }
 
 func writeError(w http.ResponseWriter, status int, msg string) {
+	writeErrors(w, status, []string{msg})
+}
+
+// writeErrors reports several messages at once, as Discourse does when a
+// record fails more than one validation.
+func writeErrors(w http.ResponseWriter, status int, msgs []string) {
 	writeJSON(w, status, map[string]interface{}{
-		"errors":     []string{msg},
+		"errors":     msgs,
 		"error_type": errorType(status),
 	})
 }
 
+// writeRateLimited answers 429 when err is a rate limit, rendered as
+// Discourse renders RateLimiter::LimitExceeded, and reports whether it did.
+func writeRateLimited(w http.ResponseWriter, err error) bool {
+	var rl *store.RateLimitError
+	if !errors.As(err, &rl) {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(rl.WaitSeconds))
+	w.Header().Set("Discourse-Rate-Limit-Error-Code", rl.ErrorCode)
+	writeJSON(w, http.StatusTooManyRequests, map[string]interface{}{
+		"errors":     []string{rl.Message},
+		"error_type": errorType(http.StatusTooManyRequests),
+		"extras":     map[string]interface{}{"wait_seconds": rl.WaitSeconds, "time_left": rl.TimeLeft},
+	})
+	return true
+}
+
 func errorType(status int) string {
 	switch status {
 	case http.StatusNotFound:
@@ -94,3 +120,14 @@ func queryInt(r *http.Request, name string, def int) int {
 	}
 	return v
 }
+
+// page returns up to limit items starting at offset, clamping offset to
+// the list so that a negative or overlong one gives the first or no page.
+func page[T any](items []T, offset, limit int) []T {
+	offset = max(0, min(offset, len(items)))
+	items = items[offset:]
+	if len(items) > limit {
+		items = items[:limit]
+	}
+	return items
+}
@@ -1,8 +1,12 @@
 package handler
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
 
+	"github.com/lightcap/dtu-discourse/internal/middleware"
 	"github.com/lightcap/dtu-discourse/internal/model"
 	"github.com/lightcap/dtu-discourse/internal/store"
 )
@@ -18,8 +22,18 @@ func (h *InvitesHandler) Create(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, "invalid request body")
 		return
 	}
-	email, _ := body["email"].(string)
-	inv, err := h.Store.CreateInvite(email, nil, nil)
+	params := store.InviteParams{}
+	params.Email, _ = body["email"].(string)
+	params.SkipEmail = body["skip_email"] == true || body["skip_email"] == "true"
+	if inviter := h.Store.GetUserByUsername(middleware.GetUsername(r)); inviter != nil {
+		params.InviterID = inviter.ID
+	}
+	if v, ok := body["topic_id"]; ok {
+		if id, err := strconv.Atoi(fmt.Sprint(v)); err == nil {
+			params.TopicID = &id
+		}
+	}
+	inv, err := h.Store.CreateInvite(params)
 	if err != nil {
 		writeError(w, http.StatusUnprocessableEntity, err.Error())
 		return
@@ -27,6 +41,38 @@ func (h *InvitesHandler) Create(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, inv)
 }
 
+// PUT /invites/show/{id}
+// Accepts an invite, signing up the invited user with email, username and
+// name.
+func (h *InvitesHandler) Accept(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathParamInt(r, "id")
+	if !ok {
+		writeError(w, http.StatusNotFound, store.ErrInviteInvalid.Error())
+		return
+	}
+	body, err := decodeBody(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	name, _ := body["name"].(string)
+	username, _ := body["username"].(string)
+	email, _ := body["email"].(string)
+	u, err := h.Store.RedeemInvite(id, name, username, email)
+	if errors.Is(err, store.ErrInviteInvalid) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true, "message": "You have accepted the invitation.", "redirect_to": "/",
+		"user_id": u.ID,
+	})
+}
+
 // GET /invites/retrieve.json
 func (h *InvitesHandler) Retrieve(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, model.Invite{})
@@ -0,0 +1,166 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lightcap/dtu-discourse/internal/messagebus"
+	"github.com/lightcap/dtu-discourse/internal/middleware"
+	"github.com/lightcap/dtu-discourse/internal/store"
+)
+
+// MessageBusHandler serves the MessageBus poll endpoint and the presence
+// endpoints that ride on it.
+type MessageBusHandler struct {
+	Store *store.Store
+}
+
+// messageBusChunkSeparator ends each batch of a chunked poll response.
+const messageBusChunkSeparator = "\r\n|\r\n"
+
+// POST /message-bus/{client_id}/poll
+//
+// The body maps channels to the last message id the client has seen
+// there. dlp=t polls without waiting. Otherwise the request is held open
+// for up to the long polling interval: with the Dont-Chunk header it
+// answers once messages arrive, and without it it streams each batch as
+// a chunk until the interval ends.
+func (h *MessageBusHandler) Poll(w http.ResponseWriter, r *http.Request) {
+	subs, err := messageBusSubscriptions(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid subscriptions")
+		return
+	}
+	client := h.Store.MessageBusClient(middleware.GetUsername(r))
+	w.Header().Set("Cache-Control", "must-revalidate, private, max-age=0")
+
+	short := r.URL.Query().Get("dlp") == "t"
+	if short || r.Header.Get("Dont-Chunk") == "true" {
+		writeJSON(w, http.StatusOK, h.Store.Bus.Poll(r.Context(), client, subs, !short))
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	h.Store.Bus.Stream(r.Context(), client, subs, func(msgs []messagebus.Message) {
+		b, _ := json.Marshal(msgs)
+		w.Write(b)
+		w.Write([]byte(messageBusChunkSeparator))
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+}
+
+// messageBusSubscriptions reads the channel -> last id map of a poll,
+// sent as a form or a JSON object. Keys that aren't channels, such as
+// __seq, are ignored.
+func messageBusSubscriptions(r *http.Request) (map[string]int, error) {
+	subs := map[string]int{}
+	add := func(channel string, v interface{}) {
+		if !strings.HasPrefix(channel, "/") {
+			return
+		}
+		switch t := v.(type) {
+		case float64:
+			subs[channel] = int(t)
+		case string:
+			if id, err := strconv.Atoi(t); err == nil {
+				subs[channel] = id
+			}
+		}
+	}
+	if strings.Contains(r.Header.Get("Content-Type"), "application/json") {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return nil, err
+		}
+		for channel, v := range body {
+			add(channel, v)
+		}
+		return subs, nil
+	}
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	for channel, v := range r.PostForm {
+		add(channel, v[0])
+	}
+	return subs, nil
+}
+
+// POST /presence/update
+//
+// Marks the current user present in present_channels and gone from
+// leave_channels for client_id, answering whether each present channel
+// let them in.
+func (h *MessageBusHandler) UpdatePresence(w http.ResponseWriter, r *http.Request) {
+	u := h.Store.GetUserByUsername(middleware.GetUsername(r))
+	if u == nil {
+		writeError(w, http.StatusForbidden, "You are not permitted to view the requested resource.")
+		return
+	}
+	var clientID string
+	var present, leave []string
+	if strings.Contains(r.Header.Get("Content-Type"), "application/json") {
+		var body struct {
+			ClientID        string   `json:"client_id"`
+			PresentChannels []string `json:"present_channels"`
+			LeaveChannels   []string `json:"leave_channels"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid body")
+			return
+		}
+		clientID, present, leave = body.ClientID, body.PresentChannels, body.LeaveChannels
+	} else {
+		if err := r.ParseForm(); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid body")
+			return
+		}
+		clientID = r.PostForm.Get("client_id")
+		present = formList(r.PostForm, "present_channels")
+		leave = formList(r.PostForm, "leave_channels")
+	}
+	if clientID == "" {
+		writeError(w, http.StatusBadRequest, "param is missing or the value is empty: client_id")
+		return
+	}
+	if len(present)+len(leave) > 50 {
+		writeError(w, http.StatusBadRequest, "Too many channels")
+		return
+	}
+	writeJSON(w, http.StatusOK, h.Store.UpdatePresence(u.ID, clientID, present, leave))
+}
+
+// GET /presence/get?channels[]=...
+//
+// Returns each channel's state, or null for channels that don't exist or
+// the current user may not see.
+func (h *MessageBusHandler) GetPresence(w http.ResponseWriter, r *http.Request) {
+	userID := 0
+	if u := h.Store.GetUserByUsername(middleware.GetUsername(r)); u != nil {
+		userID = u.ID
+	}
+	channels := formList(r.URL.Query(), "channels")
+	if len(channels) == 0 {
+		writeError(w, http.StatusBadRequest, "param is missing or the value is empty: channels")
+		return
+	}
+	res := make(map[string]*store.PresenceState, len(channels))
+	for _, name := range channels {
+		res[name] = h.Store.GetPresence(userID, name)
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// formList reads a list parameter sent as name[] or repeated name.
+func formList(values map[string][]string, name string) []string {
+	return append(append([]string{}, values[name+"[]"]...), values[name]...)
+}
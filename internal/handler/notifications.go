@@ -2,6 +2,8 @@ package handler
 
 import (
 	"net/http"
+	"net/url"
+	"strconv"
 
 	"github.com/lightcap/dtu-discourse/internal/middleware"
 	"github.com/lightcap/dtu-discourse/internal/model"
@@ -13,19 +15,56 @@ type NotificationsHandler struct {
 }
 
 // GET /notifications.json
+//
+// Supports ?filter=read|unread, ?limit and ?offset, and recent=true for
+// the notifications menu, which lists unread high priority notifications
+// first and marks everything seen unless silent=true. Staff may pass
+// ?username to list another user's notifications.
 func (h *NotificationsHandler) List(w http.ResponseWriter, r *http.Request) {
-	username := middleware.GetUsername(r)
-	u := h.Store.GetUserByUsername(username)
-	if u == nil {
+	current := h.Store.GetUserByUsername(middleware.GetUsername(r))
+	if current == nil {
 		writeJSON(w, http.StatusOK, model.NotificationListResponse{
 			Notifications: []model.Notification{},
 		})
 		return
 	}
-	notifs := h.Store.GetNotifications(u.ID)
-	writeJSON(w, http.StatusOK, model.NotificationListResponse{
-		Notifications:            notifs,
-		TotalRowsNotifications:   len(notifs),
-		SeenNotificationID:       0,
-	})
+	u := current
+	q := r.URL.Query()
+	if name := q.Get("username"); name != "" {
+		if u = h.Store.GetUserByUsername(name); u == nil {
+			writeError(w, http.StatusNotFound, "user not found")
+			return
+		}
+		if u.ID != current.ID && !current.Admin && !current.Moderator {
+			writeError(w, http.StatusForbidden, "You are not permitted to view the requested resource.")
+			return
+		}
+	}
+
+	recent := q.Get("recent") == "true"
+	query := store.NotificationQuery{Filter: q.Get("filter"), Recent: recent, Offset: queryInt(r, "offset", 0)}
+	if recent {
+		query.Limit = min(queryInt(r, "limit", 30), 60)
+		query.Offset = 0
+	} else {
+		query.Limit = min(queryInt(r, "limit", 60), 60)
+	}
+	notifs, total := h.Store.ListNotifications(u.ID, query)
+	seen := h.Store.GetNotificationTotals(u.ID).SeenID
+	if recent && u.ID == current.ID && q.Get("silent") != "true" {
+		seen = h.Store.SawNotifications(u.ID)
+	}
+	res := model.NotificationListResponse{
+		Notifications:          notifs,
+		TotalRowsNotifications: total,
+		SeenNotificationID:     seen,
+	}
+	if !recent && query.Offset+len(notifs) < total {
+		more := url.Values{"offset": {strconv.Itoa(query.Offset + query.Limit)}, "username": {u.Username}}
+		if query.Filter != "" {
+			more.Set("filter", query.Filter)
+		}
+		res.LoadMoreNotifications = "/notifications?" + more.Encode()
+	}
+	writeJSON(w, http.StatusOK, res)
 }
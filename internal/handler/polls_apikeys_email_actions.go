@@ -1,36 +1,59 @@
 package handler
 
 import (
+	"encoding/base64"
+	"fmt"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/lightcap/dtu-discourse/internal/mailer"
+	"github.com/lightcap/dtu-discourse/internal/middleware"
 	"github.com/lightcap/dtu-discourse/internal/model"
 	"github.com/lightcap/dtu-discourse/internal/store"
 )
 
 type PollsHandler struct {
 	Store *store.Store
+	Ext   *store.ExtStore
 }
 
-// PUT /polls/vote
-func (h *PollsHandler) Vote(w http.ResponseWriter, r *http.Request) {
-	body, _ := decodeBody(r)
-	postID := 0
-	if v, ok := body["post_id"].(float64); ok {
-		postID = int(v)
+// pollParams reads the post_id and poll_name of a poll request, from the
+// body or the query string.
+func pollParams(r *http.Request, body map[string]interface{}) (int, string) {
+	postID, _ := strconv.Atoi(fmt.Sprint(body["post_id"]))
+	if postID == 0 {
+		postID = queryInt(r, "post_id", 0)
 	}
 	pollName, _ := body["poll_name"].(string)
+	if pollName == "" {
+		pollName = r.URL.Query().Get("poll_name")
+	}
 	if pollName == "" {
 		pollName = "poll"
 	}
+	return postID, pollName
+}
 
-	var options []string
-	if v, ok := body["options"].([]interface{}); ok {
-		for _, opt := range v {
-			if s, ok := opt.(string); ok {
-				options = append(options, s)
-			}
-		}
+// PUT /polls/vote
+func (h *PollsHandler) Vote(w http.ResponseWriter, r *http.Request) {
+	body, _ := decodeBody(r)
+	postID, pollName := pollParams(r, body)
+	options := paramStrings(body["options"])
+	if len(options) == 0 {
+		options = paramStrings(body["options]["])
+	}
+	u := h.Store.GetUserByUsername(middleware.GetUsername(r))
+	if u == nil {
+		writeError(w, http.StatusForbidden, "user not found")
+		return
+	}
+	voters, err := h.Ext.VotePoll(postID, pollName, u.ID, options)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
 	}
 
 	writeJSON(w, http.StatusOK, map[string]interface{}{
@@ -40,12 +63,33 @@ func (h *PollsHandler) Vote(w http.ResponseWriter, r *http.Request) {
 			"status":  "open",
 			"post_id": postID,
 			"options": options,
-			"voters":  1,
+			"voters":  voters,
 		},
 		"vote": options,
 	})
 }
 
+// DELETE /polls/vote
+func (h *PollsHandler) RemoveVote(w http.ResponseWriter, r *http.Request) {
+	body, _ := decodeBody(r)
+	postID, pollName := pollParams(r, body)
+	u := h.Store.GetUserByUsername(middleware.GetUsername(r))
+	if u == nil {
+		writeError(w, http.StatusForbidden, "user not found")
+		return
+	}
+	voters, err := h.Ext.RemovePollVote(postID, pollName, u.ID)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"poll": map[string]interface{}{
+			"name": pollName, "type": "regular", "status": "open", "post_id": postID, "voters": voters,
+		},
+	})
+}
+
 // PUT /polls/toggle_status
 func (h *PollsHandler) ToggleStatus(w http.ResponseWriter, r *http.Request) {
 	body, _ := decodeBody(r)
@@ -162,41 +206,281 @@ func (h *APIKeysHandler) Scopes(w http.ResponseWriter, r *http.Request) {
 
 type EmailHandler struct {
 	Store *store.Store
+	Ext   *store.ExtStore
 }
 
 // GET /admin/email.json
 func (h *EmailHandler) Settings(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, http.StatusOK, map[string]interface{}{
-		"delivery_method":       "smtp",
-		"smtp_address":          "localhost",
-		"smtp_port":             25,
-		"smtp_domain":           "localhost",
-		"smtp_authentication":   "plain",
-		"smtp_enable_start_tls": true,
-	})
+	writeJSON(w, http.StatusOK, h.emailSettings())
+}
+
+// emailSettings describes how outgoing email is delivered: over SMTP when
+// the DTU has a server to deliver to, otherwise only to the outbox.
+func (h *EmailHandler) emailSettings() model.EmailSettings {
+	smtpSender, ok := h.Store.Outbox.Sender().(mailer.SMTPSender)
+	if !ok {
+		return model.EmailSettings{DeliveryMethod: "test", Settings: map[string]interface{}{}}
+	}
+	host, port, _ := net.SplitHostPort(smtpSender.Addr)
+	portNum, _ := strconv.Atoi(port)
+	domain := smtpSender.Domain
+	if domain == "" {
+		domain = "localhost"
+	}
+	return model.EmailSettings{
+		DeliveryMethod: "smtp",
+		Settings: map[string]interface{}{
+			"address":              host,
+			"port":                 portNum,
+			"domain":               domain,
+			"authentication":       nil,
+			"enable_starttls_auto": false,
+		},
+	}
 }
 
 // GET /admin/email/{filter}.json
+// Lists the outbox newest first, 50 at a time. Emails that failed to
+// deliver are skipped, and bounced too when the server refused them.
+// received and rejected list the emails given to handle_mail instead.
 func (h *EmailHandler) List(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, http.StatusOK, []interface{}{})
+	filter := strings.TrimSuffix(r.PathValue("filter"), ".json")
+	switch filter {
+	case "received", "rejected":
+		h.listIncoming(w, r, filter == "rejected")
+		return
+	case "sent", "skipped", "bounced":
+	default:
+		writeJSON(w, http.StatusOK, []model.EmailLog{})
+		return
+	}
+	q := r.URL.Query()
+	user, address, emailType := strings.ToLower(q.Get("user")), strings.ToLower(q.Get("address")), q.Get("type")
+	msgs := h.Store.Outbox.List()
+	logs := []model.EmailLog{}
+	for i := len(msgs) - 1; i >= 0; i-- {
+		m := msgs[i]
+		switch filter {
+		case "sent":
+			if m.SkippedReason != "" {
+				continue
+			}
+		case "skipped":
+			if m.SkippedReason == "" {
+				continue
+			}
+		case "bounced":
+			if !m.Bounced {
+				continue
+			}
+		}
+		if emailType != "" && m.EmailType != emailType {
+			continue
+		}
+		if address != "" && !strings.Contains(strings.ToLower(m.To), address) {
+			continue
+		}
+		log := model.EmailLog{
+			ID: m.ID, To: m.To, EmailType: m.EmailType, ReplyKey: m.ReplyKey,
+			SkippedReason: m.SkippedReason, Bounced: m.Bounced, CreatedAt: m.CreatedAt,
+		}
+		if u := h.Store.GetUser(m.UserID); u != nil && m.UserID != 0 {
+			log.User = &model.BasicUser{ID: u.ID, Username: u.Username, Name: u.Name, AvatarTemplate: u.AvatarTemplate}
+		}
+		if user != "" && (log.User == nil || !strings.Contains(strings.ToLower(log.User.Username), user)) {
+			continue
+		}
+		if m.PostID != 0 {
+			postID := m.PostID
+			log.PostID = &postID
+			if p := h.Store.GetPost(postID); p != nil {
+				log.PostURL = fmt.Sprintf("/t/%s/%d/%d", p.TopicSlug, p.TopicID, p.PostNumber)
+			}
+		}
+		logs = append(logs, log)
+	}
+	writeJSON(w, http.StatusOK, page(logs, queryInt(r, "offset", 0), 50))
+}
+
+// listIncoming lists the received emails newest first, 50 at a time,
+// only the ones rejected with an error when rejected is set.
+func (h *EmailHandler) listIncoming(w http.ResponseWriter, r *http.Request, rejected bool) {
+	q := r.URL.Query()
+	from, to, subject, errName := strings.ToLower(q.Get("from")), strings.ToLower(q.Get("to")), strings.ToLower(q.Get("subject")), q.Get("error")
+	emails := h.Store.ListIncomingEmails()
+	out := []model.IncomingEmail{}
+	for i := len(emails) - 1; i >= 0; i-- {
+		in := emails[i]
+		if rejected && in.Error == "" {
+			continue
+		}
+		toAddresses := strings.Join(in.To, ";")
+		if (from != "" && !strings.Contains(in.From, from)) || (to != "" && !strings.Contains(toAddresses, to)) ||
+			(subject != "" && !strings.Contains(strings.ToLower(in.Subject), subject)) ||
+			(errName != "" && !strings.Contains(in.Error, errName)) {
+			continue
+		}
+		item := model.IncomingEmail{
+			ID: in.ID, CreatedAt: in.CreatedAt, FromAddress: in.From, ToAddresses: toAddresses,
+			CCAddresses: strings.Join(in.CC, ";"), Subject: in.Subject, Error: in.Error, PostURL: in.PostURL,
+		}
+		if u := h.Store.GetUser(in.UserID); u != nil && in.UserID != 0 {
+			item.User = &model.BasicUser{ID: u.ID, Username: u.Username, Name: u.Name, AvatarTemplate: u.AvatarTemplate}
+		}
+		out = append(out, item)
+	}
+	writeJSON(w, http.StatusOK, page(out, queryInt(r, "offset", 0), 50))
+}
+
+// GET /admin/email/incoming/{id}.json
+func (h *EmailHandler) Incoming(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathParamInt(r, "id")
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+	in := h.Store.GetIncomingEmail(id)
+	if in == nil {
+		writeError(w, http.StatusNotFound, "The requested URL or resource could not be found.")
+		return
+	}
+	writeJSON(w, http.StatusOK, model.IncomingEmailDetails{
+		ID: in.ID, Error: in.Error, ErrorDescription: in.ErrorDescription,
+		Headers: in.Header, Subject: in.Subject, Body: in.Body,
+	})
+}
+
+// POST /admin/email/handle_mail
+// Takes the raw message as email, or base64-encoded as email_encoded. As
+// in Discourse the reply is the same whatever becomes of the email; the
+// outcome shows in the received and rejected lists.
+func (h *EmailHandler) HandleMail(w http.ResponseWriter, r *http.Request) {
+	body, _ := decodeBody(r)
+	raw, _ := body["email"].(string)
+	if encoded, _ := body["email_encoded"].(string); encoded != "" {
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "email_encoded is not valid base64")
+			return
+		}
+		raw = string(data)
+	}
+	if raw == "" {
+		writeError(w, http.StatusBadRequest, "param is missing or the value is empty: email")
+		return
+	}
+	h.Ext.ReceiveEmail(raw)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("email has been received and is queued for processing"))
 }
 
 // POST /admin/email/test
 func (h *EmailHandler) Test(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, http.StatusOK, model.SuccessResponse{Success: "OK"})
+	body, _ := decodeBody(r)
+	address, _ := body["email_address"].(string)
+	if address == "" {
+		writeError(w, http.StatusBadRequest, "param is missing or the value is empty: email_address")
+		return
+	}
+	m := h.Store.SendTestEmail(address)
+	if m.SkippedReason != "" {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"sent_test_email_message": m.SkippedReason})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"sent_test_email_message": "sent"})
 }
 
 // GET /admin/email/server-settings
 func (h *EmailHandler) ServerSettings(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, http.StatusOK, map[string]interface{}{
-		"delivery_method": "smtp",
-		"settings":        map[string]interface{}{},
-	})
+	writeJSON(w, http.StatusOK, h.emailSettings())
+}
+
+// digestSince reads the last_seen_at parameter a digest covers, a week
+// ago by default.
+func digestSince(v string) time.Time {
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t
+		}
+	}
+	return time.Now().AddDate(0, 0, -7)
 }
 
 // GET /admin/email/preview-digest
 func (h *EmailHandler) PreviewDigest(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, http.StatusOK, map[string]interface{}{"html": "<p>Digest preview</p>"})
+	u := h.Store.GetUserByUsername(r.URL.Query().Get("username"))
+	if u == nil {
+		writeError(w, http.StatusNotFound, "The requested URL or resource could not be found.")
+		return
+	}
+	html, text, err := h.Store.PreviewDigest(u.ID, digestSince(r.URL.Query().Get("last_seen_at")))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"html_content": html,
+		"text_content": text,
+	})
+}
+
+// POST /admin/email/send-digest.json
+func (h *EmailHandler) SendDigest(w http.ResponseWriter, r *http.Request) {
+	body, _ := decodeBody(r)
+	username, _ := body["username"].(string)
+	address, _ := body["email"].(string)
+	lastSeen, _ := body["last_seen_at"].(string)
+	u := h.Store.GetUserByUsername(username)
+	if u == nil {
+		writeError(w, http.StatusNotFound, "The requested URL or resource could not be found.")
+		return
+	}
+	if _, err := h.Store.SendDigest(u.ID, address, digestSince(lastSeen)); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, model.SuccessResponse{Success: "OK"})
+}
+
+// ---------- DTU Mail ----------
+
+// GET /__dtu/mail
+// Returns the outbox, oldest first, optionally narrowed to one recipient
+// (to) or email type (email_type).
+func (h *EmailHandler) Outbox(w http.ResponseWriter, r *http.Request) {
+	to, emailType := strings.ToLower(r.URL.Query().Get("to")), r.URL.Query().Get("email_type")
+	msgs := []mailer.Message{}
+	for _, m := range h.Store.Outbox.List() {
+		if to != "" && strings.ToLower(mailer.Address(m.To)) != to {
+			continue
+		}
+		if emailType != "" && m.EmailType != emailType {
+			continue
+		}
+		msgs = append(msgs, m)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"messages": msgs})
+}
+
+// GET /__dtu/mail/{id}
+func (h *EmailHandler) OutboxMessage(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathParamInt(r, "id")
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+	m := h.Store.Outbox.Get(id)
+	if m == nil {
+		writeError(w, http.StatusNotFound, "The requested URL or resource could not be found.")
+		return
+	}
+	writeJSON(w, http.StatusOK, m)
+}
+
+// DELETE /__dtu/mail
+func (h *EmailHandler) ClearOutbox(w http.ResponseWriter, r *http.Request) {
+	h.Store.Outbox.Clear()
+	writeJSON(w, http.StatusOK, model.SuccessResponse{Success: "OK"})
 }
 
 // ---------- User Actions ----------
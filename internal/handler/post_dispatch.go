@@ -42,7 +42,7 @@ func (d *PostSubRouter) ServeGET(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		r.SetPathValue("username", first)
 		if len(parts) >= 2 {
-			switch parts[1] {
+			switch strings.TrimSuffix(parts[1], ".json") {
 			case "deleted":
 				d.Extended.Deleted(w, r)
 				return
@@ -63,12 +63,12 @@ func (d *PostSubRouter) ServeGET(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	second := parts[1]
+	second := strings.TrimSuffix(parts[1], ".json")
 
 	switch second {
 	case "revisions":
 		if len(parts) == 3 {
-			third := parts[2]
+			third := strings.TrimSuffix(parts[2], ".json")
 			if third == "latest" {
 				d.Extended.LatestRevision(w, r)
 				return
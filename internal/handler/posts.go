@@ -1,18 +1,20 @@
 package handler
 
 import (
+	"errors"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
 
 	"github.com/lightcap/dtu-discourse/internal/middleware"
 	"github.com/lightcap/dtu-discourse/internal/model"
 	"github.com/lightcap/dtu-discourse/internal/store"
-	"github.com/lightcap/dtu-discourse/internal/webhook"
 )
 
 type PostsHandler struct {
-	Store   *store.Store
-	Webhook *webhook.Dispatcher
+	Store *store.Store
+	Ext   *store.ExtStore
 }
 
 // POST /posts  — create post or topic
@@ -57,20 +59,24 @@ func (h *PostsHandler) Create(w http.ResponseWriter, r *http.Request) {
 		}
 
 		archetype, _ := body["archetype"].(string)
-		targetUsernames, _ := body["target_usernames"].(string)
-		if archetype == "" && targetUsernames != "" {
+		targets := targetUsernames(body)
+		if archetype == "" && len(targets) > 0 {
 			archetype = "private_message"
 		}
 
-		topic, post, err := h.Store.CreateTopic(title, raw, categoryID, u.ID, tags, archetype)
+		res, err := h.Ext.SubmitPost(store.NewPostParams{
+			UserID: u.ID, Raw: raw, Title: title, CategoryID: categoryID, Tags: tags, Archetype: archetype,
+			TargetUsernames: targets,
+		})
 		if err != nil {
-			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			writeCreateError(w, err)
 			return
 		}
-		h.Webhook.Dispatch(webhook.GamificationPayload{
-			DiscourseUserID: u.ID, Action: "topic_created", DiscourseResourceID: topic.ID,
-		})
-		writeJSON(w, http.StatusOK, post)
+		if res.Queued != nil {
+			writeEnqueued(w, res)
+			return
+		}
+		writeJSON(w, http.StatusOK, res.Post)
 		return
 	}
 
@@ -91,17 +97,72 @@ func (h *PostsHandler) Create(w http.ResponseWriter, r *http.Request) {
 	if v, ok := body["reply_to_post_number"].(float64); ok {
 		i := int(v)
 		replyTo = &i
+	} else if v, ok := body["reply_to_post_number"].(string); ok {
+		if i, err := strconv.Atoi(v); err == nil {
+			replyTo = &i
+		}
 	}
 
-	post, err := h.Store.CreatePost(topicID, raw, u.ID, replyTo)
+	res, err := h.Ext.SubmitPost(store.NewPostParams{
+		UserID: u.ID, Raw: raw, TopicID: topicID, ReplyToPostNumber: replyTo,
+	})
 	if err != nil {
-		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		writeCreateError(w, err)
+		return
+	}
+	if res.Queued != nil {
+		writeEnqueued(w, res)
 		return
 	}
-	h.Webhook.Dispatch(webhook.GamificationPayload{
-		DiscourseUserID: u.ID, Action: "post_created", DiscourseResourceID: post.ID,
+	writeJSON(w, http.StatusOK, res.Post)
+}
+
+// targetUsernames reads the recipients of a new private message from
+// target_recipients or the older target_usernames, given either as a
+// comma-separated string or a list.
+func targetUsernames(body map[string]interface{}) []string {
+	v, ok := body["target_recipients"]
+	if !ok {
+		v = body["target_usernames"]
+	}
+	var names []string
+	switch v := v.(type) {
+	case string:
+		names = strings.Split(v, ",")
+	case []interface{}:
+		for _, name := range v {
+			if s, ok := name.(string); ok {
+				names = append(names, s)
+			}
+		}
+	}
+	return slices.DeleteFunc(names, func(name string) bool { return strings.TrimSpace(name) == "" })
+}
+
+// writeEnqueued answers a create that was held for approval, in the shape
+// of Discourse's NewPostResultSerializer.
+func writeEnqueued(w http.ResponseWriter, res *store.NewPostResult) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success":       true,
+		"action":        "enqueued",
+		"pending_post":  res.Pending,
+		"pending_count": res.PendingCount,
+		"reason":        res.Reason,
 	})
-	writeJSON(w, http.StatusOK, post)
+}
+
+// writeCreateError reports a failed post or topic creation, listing every
+// validation message when the store rejected the content.
+func writeCreateError(w http.ResponseWriter, err error) {
+	if writeRateLimited(w, err) {
+		return
+	}
+	var verr *store.ValidationError
+	if errors.As(err, &verr) {
+		writeErrors(w, http.StatusUnprocessableEntity, verr.Messages)
+		return
+	}
+	writeError(w, http.StatusUnprocessableEntity, err.Error())
 }
 
 // GET /posts/{id}.json
@@ -116,7 +177,11 @@ func (h *PostsHandler) Get(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusNotFound, "post not found")
 		return
 	}
-	writeJSON(w, http.StatusOK, p)
+	viewerID := 0
+	if u := h.Store.GetUserByUsername(middleware.GetUsername(r)); u != nil {
+		viewerID = u.ID
+	}
+	writeJSON(w, http.StatusOK, h.postForViewer(p, viewerID))
 }
 
 // GET /posts.json
@@ -150,7 +215,26 @@ func (h *PostsHandler) Update(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusUnprocessableEntity, "raw is required")
 		return
 	}
-	p, err := h.Store.UpdatePost(id, raw)
+	u := h.Store.GetUserByUsername(middleware.GetUsername(r))
+	if u == nil {
+		writeError(w, http.StatusForbidden, "user not found")
+		return
+	}
+	originalText, _ := body["original_text"].(string)
+	editReason, _ := body["edit_reason"].(string)
+	p, err := h.Ext.RevisePost(id, u.ID, raw, originalText, editReason)
+	if writeRateLimited(w, err) {
+		return
+	}
+	if errors.Is(err, store.ErrEditConflict) {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	var verr *store.ValidationError
+	if errors.As(err, &verr) {
+		writeErrors(w, http.StatusUnprocessableEntity, verr.Messages)
+		return
+	}
 	if err != nil {
 		writeError(w, http.StatusNotFound, err.Error())
 		return
@@ -216,47 +300,99 @@ func (h *PostsHandler) CreateAction(w http.ResponseWriter, r *http.Request) {
 
 	username := middleware.GetUsername(r)
 	actingUser := h.Store.GetUserByUsername(username)
+	if actingUser == nil {
+		writeError(w, http.StatusForbidden, "user not found")
+		return
+	}
 
-	pa, err := h.Store.CreatePostAction(postID, actionType)
+	if store.IsFlagType(actionType) {
+		message, _ := body["message"].(string)
+		_, _, err = h.Ext.FlagPost(postID, actingUser.ID, actionType, message)
+	} else {
+		_, err = h.Store.CreatePostAction(postID, actingUser.ID, actionType)
+	}
+	if writeRateLimited(w, err) {
+		return
+	}
+	if errors.Is(err, store.ErrAlreadyActed) || errors.Is(err, store.ErrCannotFlag) {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
 	if err != nil {
 		writeError(w, http.StatusNotFound, err.Error())
 		return
 	}
-
-	// Dispatch like webhooks
-	if actionType == 2 && actingUser != nil {
-		post := h.Store.GetPost(postID)
-		if post != nil {
-			authorID := post.UserID
-			h.Webhook.Dispatch(webhook.GamificationPayload{
-				DiscourseUserID: authorID, Action: "reaction_received",
-				DiscourseResourceID: postID, CounterpartyDiscourseUserID: &actingUser.ID,
-			})
-			h.Webhook.Dispatch(webhook.GamificationPayload{
-				DiscourseUserID: actingUser.ID, Action: "reaction_given",
-				DiscourseResourceID: postID,
-			})
-		}
+	post := h.Store.GetPost(postID)
+	if post == nil {
+		writeError(w, http.StatusNotFound, "post not found")
+		return
 	}
-
-	writeJSON(w, http.StatusOK, pa)
+	writeJSON(w, http.StatusOK, h.postForViewer(post, actingUser.ID))
 }
 
-// DELETE /post_actions/{id}.json
+// DELETE /post_actions/{id}.json?post_action_type_id=…
+// As in Discourse, {id} is the post and the acting user's action of the
+// given type is the one removed.
 func (h *PostsHandler) DeleteAction(w http.ResponseWriter, r *http.Request) {
-	id, ok := pathParamInt(r, "id")
+	postID, ok := pathParamInt(r, "id")
 	if !ok {
-		writeError(w, http.StatusBadRequest, "invalid post action id")
+		writeError(w, http.StatusBadRequest, "invalid post id")
+		return
+	}
+	actionType := queryInt(r, "post_action_type_id", 0)
+	if actionType == 0 {
+		body, _ := decodeBody(r)
+		if v, ok := body["post_action_type_id"].(float64); ok {
+			actionType = int(v)
+		} else if v, ok := body["post_action_type_id"].(string); ok {
+			actionType, _ = strconv.Atoi(v)
+		}
+	}
+	u := h.Store.GetUserByUsername(middleware.GetUsername(r))
+	if u == nil {
+		writeError(w, http.StatusForbidden, "user not found")
 		return
 	}
-	if err := h.Store.DeletePostAction(id); err != nil {
+	var err error
+	if store.IsFlagType(actionType) {
+		err = h.Ext.UnflagPost(postID, u.ID, actionType)
+	} else {
+		err = h.Store.DeletePostAction(postID, u.ID, actionType)
+	}
+	if errors.Is(err, store.ErrUndoWindowPassed) {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if err != nil {
 		writeError(w, http.StatusNotFound, err.Error())
 		return
 	}
-	writeJSON(w, http.StatusOK, model.SuccessResponse{Success: "OK"})
+	post := h.Store.GetPost(postID)
+	if post == nil {
+		writeError(w, http.StatusNotFound, "post not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, h.postForViewer(post, u.ID))
 }
 
-// GET /post_action_users.json
+// GET /post_action_users.json?id=…&post_action_type_id=…
 func (h *PostsHandler) ActionUsers(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, http.StatusOK, map[string]interface{}{"post_action_users": []interface{}{}})
+	users := []model.BasicUser{}
+	if postID := queryInt(r, "id", 0); postID != 0 {
+		users = h.Store.PostActionUsers(postID, queryInt(r, "post_action_type_id", 2))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"post_action_users":            users,
+		"total_rows_post_action_users": len(users),
+	})
+}
+
+// postForViewer copies p with its actions_summary, reactions and
+// solution permissions personalised for userID.
+func (h *PostsHandler) postForViewer(p *model.Post, userID int) model.Post {
+	out := *p
+	out.ActionsSummary = h.Store.ActionsSummaryFor(p.ID, userID)
+	h.Ext.ApplyReactions(&out, userID)
+	h.Store.ApplySolved(&out, userID)
+	return out
 }
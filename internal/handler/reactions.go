@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/lightcap/dtu-discourse/internal/middleware"
+	"github.com/lightcap/dtu-discourse/internal/store"
+)
+
+// ReactionsHandler emulates the discourse-reactions plugin.
+type ReactionsHandler struct {
+	Store *store.Store
+	Ext   *store.ExtStore
+}
+
+// PUT /discourse-reactions/posts/{id}/custom-reactions/{reaction}/toggle.json
+func (h *ReactionsHandler) Toggle(w http.ResponseWriter, r *http.Request) {
+	postID, ok := pathParamInt(r, "id")
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid post id")
+		return
+	}
+	reaction := pathParam(r, "reaction")
+	u := h.Store.GetUserByUsername(middleware.GetUsername(r))
+	if u == nil {
+		writeError(w, http.StatusForbidden, "user not found")
+		return
+	}
+	_, err := h.Ext.ToggleReaction(postID, u.ID, reaction)
+	switch {
+	case writeRateLimited(w, err):
+		return
+	case errors.Is(err, store.ErrReactionNotAllowed):
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	case errors.Is(err, store.ErrUndoWindowPassed):
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	case err != nil:
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	p := h.Store.GetPost(postID)
+	if p == nil {
+		writeError(w, http.StatusNotFound, "post not found")
+		return
+	}
+	post := *p
+	post.ActionsSummary = h.Store.ActionsSummaryFor(postID, u.ID)
+	h.Ext.ApplyReactions(&post, u.ID)
+	writeJSON(w, http.StatusOK, post)
+}
+
+// GET /discourse-reactions/posts/{id}/reactions-users.json?reaction_value=…
+func (h *ReactionsHandler) ReactionUsers(w http.ResponseWriter, r *http.Request) {
+	postID, ok := pathParamInt(r, "id")
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid post id")
+		return
+	}
+	entries, err := h.Ext.PostReactionUsers(postID, r.URL.Query().Get("reaction_value"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"reaction_users": entries})
+}
+
+// GET /discourse-reactions/posts/reactions.json?username=…
+func (h *ReactionsHandler) UserReactions(w http.ResponseWriter, r *http.Request) {
+	username := strings.TrimSpace(r.URL.Query().Get("username"))
+	if username == "" {
+		username = middleware.GetUsername(r)
+	}
+	u := h.Store.GetUserByUsername(username)
+	if u == nil {
+		writeError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, h.Ext.UserReactions(u.ID))
+}
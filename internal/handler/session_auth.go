@@ -10,6 +10,7 @@ import (
 	"net/url"
 	"time"
 
+	"github.com/lightcap/dtu-discourse/internal/middleware"
 	"github.com/lightcap/dtu-discourse/internal/model"
 	"github.com/lightcap/dtu-discourse/internal/store"
 )
@@ -53,19 +54,28 @@ func (h *SessionHandler) Logout(w http.ResponseWriter, r *http.Request) {
 
 // GET /session/current.json
 func (h *SessionHandler) Current(w http.ResponseWriter, r *http.Request) {
+	u := h.Store.GetUserByUsername(middleware.GetUsername(r))
+	if u == nil {
+		writeError(w, http.StatusNotFound, "not logged in")
+		return
+	}
+	totals := h.Store.GetNotificationTotals(u.ID)
 	writeJSON(w, http.StatusOK, map[string]interface{}{
 		"current_user": map[string]interface{}{
-			"id":              1,
-			"username":        "admin",
-			"name":            "Admin User",
-			"avatar_template": "/letter_avatar_proxy/v4/letter/a/bbce88/{size}.png",
-			"admin":           true,
-			"moderator":       true,
-			"trust_level":     4,
+			"id":              u.ID,
+			"username":        u.Username,
+			"name":            u.Name,
+			"avatar_template": u.AvatarTemplate,
+			"admin":           u.Admin,
+			"moderator":       u.Moderator,
+			"trust_level":     u.TrustLevel,
 			"can_create_topic": true,
-			"can_review":       true,
-			"unread_notifications": 0,
-			"unread_high_priority_notifications": 0,
+			"can_review":       u.Admin || u.Moderator,
+			"unread_notifications": totals.Unread,
+			"unread_high_priority_notifications": totals.UnreadHighPriority,
+			"all_unread_notifications_count": totals.AllUnread,
+			"seen_notification_id": totals.SeenID,
+			"read_first_notification": totals.SeenID > 0,
 		},
 	})
 }
@@ -74,8 +84,16 @@ func (h *SessionHandler) Current(w http.ResponseWriter, r *http.Request) {
 
 // POST /session/forgot_password
 func (h *SessionHandler) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	body, _ := decodeBody(r)
+	login, _ := body["login"].(string)
+	if login == "" {
+		writeError(w, http.StatusBadRequest, "param is missing or the value is empty: login")
+		return
+	}
+	found := h.Store.ForgotPassword(login)
 	writeJSON(w, http.StatusOK, map[string]interface{}{
-		"user_found": true,
+		"success":    "OK",
+		"user_found": found,
 	})
 }
 
@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/lightcap/dtu-discourse/internal/middleware"
+	"github.com/lightcap/dtu-discourse/internal/store"
+)
+
+// SolvedHandler emulates the discourse-solved plugin.
+type SolvedHandler struct {
+	Store *store.Store
+}
+
+// POST /solution/accept
+func (h *SolvedHandler) Accept(w http.ResponseWriter, r *http.Request) {
+	postID, userID, ok := h.solutionParams(w, r)
+	if !ok {
+		return
+	}
+	accepted, err := h.Store.AcceptAnswer(postID, userID)
+	if err != nil {
+		writeSolvedError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, accepted)
+}
+
+// POST /solution/unaccept
+func (h *SolvedHandler) Unaccept(w http.ResponseWriter, r *http.Request) {
+	postID, userID, ok := h.solutionParams(w, r)
+	if !ok {
+		return
+	}
+	if err := h.Store.UnacceptAnswer(postID, userID); err != nil {
+		writeSolvedError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"success": "OK"})
+}
+
+// solutionParams reads the post id and acting user shared by both
+// endpoints, writing the error response itself when either is missing.
+func (h *SolvedHandler) solutionParams(w http.ResponseWriter, r *http.Request) (int, int, bool) {
+	body, err := decodeBody(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return 0, 0, false
+	}
+	postID := 0
+	if v, ok := body["id"].(float64); ok {
+		postID = int(v)
+	} else if v, ok := body["id"].(string); ok {
+		postID, _ = strconv.Atoi(v)
+	}
+	if postID == 0 {
+		writeError(w, http.StatusBadRequest, "id is required")
+		return 0, 0, false
+	}
+	u := h.Store.GetUserByUsername(middleware.GetUsername(r))
+	if u == nil {
+		writeError(w, http.StatusForbidden, "user not found")
+		return 0, 0, false
+	}
+	return postID, u.ID, true
+}
+
+func writeSolvedError(w http.ResponseWriter, err error) {
+	if errors.Is(err, store.ErrCannotAcceptAnswer) {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	writeError(w, http.StatusNotFound, err.Error())
+}
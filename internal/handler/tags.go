@@ -61,14 +61,18 @@ func (h *TagsHandler) TopicsByCategoryAndTag(w http.ResponseWriter, r *http.Requ
 	})
 }
 
-// GET /tag/{tag}
+// GET /tag/{tag}  or  /tag/{tag}.rss
 func (h *TagsHandler) Show(w http.ResponseWriter, r *http.Request) {
-	tagName := pathParam(r, "tag")
+	tagName, rss := isRSS(pathParam(r, "tag"))
 	tag := h.Store.GetTag(tagName)
 	if tag == nil {
 		writeError(w, http.StatusNotFound, "tag not found")
 		return
 	}
+	if rss {
+		writeTagFeed(w, r, h.Store, tagName)
+		return
+	}
 	topics := h.Store.TopicsByTag(tagName)
 	writeJSON(w, http.StatusOK, model.TagResponse{
 		Tag: *tag,
@@ -40,6 +40,12 @@ func (d *TopicSubRouter) ServeGET(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// /t/{slug}/{id}.rss or /t/{id}.rss — topic posts feed
+	if tid, ok := rssTopicID(parts[len(parts)-1]); ok && len(parts) <= 2 {
+		writeTopicPostsFeed(w, r, d.Topics.Store, tid)
+		return
+	}
+
 	// Strip .json from first segment for topic ID
 	idStr := strings.TrimSuffix(first, ".json")
 	topicID, err := strconv.Atoi(idStr)
@@ -49,6 +55,9 @@ func (d *TopicSubRouter) ServeGET(w http.ResponseWriter, r *http.Request) {
 		secondStr := strings.TrimSuffix(parts[1], ".json")
 		if tid2, err2 := strconv.Atoi(secondStr); err2 == nil {
 			r.SetPathValue("id", strconv.Itoa(tid2))
+			if len(parts) >= 3 {
+				r.SetPathValue("post_number", strings.TrimSuffix(parts[2], ".json"))
+			}
 			d.Topics.GetTopic(w, r)
 			return
 		}
@@ -82,6 +91,7 @@ func (d *TopicSubRouter) ServeGET(w http.ResponseWriter, r *http.Request) {
 	secondStr := strings.TrimSuffix(second, ".json")
 	if _, err := strconv.Atoi(secondStr); err == nil {
 		r.SetPathValue("id", tid)
+		r.SetPathValue("post_number", secondStr)
 		d.Topics.GetTopic(w, r)
 		return
 	}
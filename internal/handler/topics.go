@@ -1,16 +1,19 @@
 package handler
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 	"strings"
 
+	"github.com/lightcap/dtu-discourse/internal/middleware"
 	"github.com/lightcap/dtu-discourse/internal/model"
 	"github.com/lightcap/dtu-discourse/internal/store"
 )
 
 type TopicsHandler struct {
 	Store *store.Store
+	Ext   *store.ExtStore
 }
 
 // GET /latest.json
@@ -37,6 +40,8 @@ func (h *TopicsHandler) New(w http.ResponseWriter, r *http.Request) {
 }
 
 // GET /t/{id}.json
+// A ?u=username share link counts as that user sharing the post it points
+// to, for First Share.
 func (h *TopicsHandler) GetTopic(w http.ResponseWriter, r *http.Request) {
 	id, ok := pathParamInt(r, "id")
 	if !ok {
@@ -48,6 +53,21 @@ func (h *TopicsHandler) GetTopic(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusNotFound, "topic not found")
 		return
 	}
+	viewerID := 0
+	if u := h.Store.GetUserByUsername(middleware.GetUsername(r)); u != nil {
+		viewerID = u.ID
+	}
+	for i := range t.PostStream.Posts {
+		h.Ext.ApplyReactions(&t.PostStream.Posts[i], viewerID)
+		h.Store.ApplySolved(&t.PostStream.Posts[i], viewerID)
+	}
+	if sharer := r.URL.Query().Get("u"); sharer != "" {
+		postNumber, err := strconv.Atoi(r.PathValue("post_number"))
+		if err != nil {
+			postNumber = 1
+		}
+		h.Store.RecordShare(sharer, viewerID, id, postNumber)
+	}
 	writeJSON(w, http.StatusOK, t)
 }
 
@@ -97,7 +117,20 @@ func (h *TopicsHandler) UpdateTopic(w http.ResponseWriter, r *http.Request) {
 			body[k] = v
 		}
 	}
-	t, err := h.Store.UpdateTopic(id, body)
+	u := h.Store.GetUserByUsername(middleware.GetUsername(r))
+	if u == nil {
+		writeError(w, http.StatusForbidden, "user not found")
+		return
+	}
+	t, err := h.Ext.ReviseTopic(id, u.ID, body)
+	if writeRateLimited(w, err) {
+		return
+	}
+	var verr *store.ValidationError
+	if errors.As(err, &verr) {
+		writeErrors(w, http.StatusUnprocessableEntity, verr.Messages)
+		return
+	}
 	if err != nil {
 		writeError(w, http.StatusNotFound, err.Error())
 		return
@@ -184,9 +217,49 @@ func (h *TopicsHandler) ChangeOwner(w http.ResponseWriter, r *http.Request) {
 
 // POST /t/{topic_id}/notifications
 func (h *TopicsHandler) SetNotificationLevel(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathParamInt(r, "topic_id")
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid topic id")
+		return
+	}
+	body, err := decodeBody(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	level, ok := notificationLevelParam(body)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid notification_level")
+		return
+	}
+	u := h.Store.GetUserByUsername(middleware.GetUsername(r))
+	if u == nil {
+		writeError(w, http.StatusForbidden, "user not found")
+		return
+	}
+	if err := h.Store.SetTopicNotificationLevel(id, u.ID, level); err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
 	writeJSON(w, http.StatusOK, model.SuccessResponse{Success: "OK"})
 }
 
+// notificationLevelParam reads notification_level as a number or as one
+// of the level names.
+func notificationLevelParam(body map[string]interface{}) (int, bool) {
+	switch v := body["notification_level"].(type) {
+	case float64:
+		return int(v), v >= 0 && v <= 4
+	case string:
+		if level, ok := store.NotificationLevels[v]; ok {
+			return level, true
+		}
+		level, err := strconv.Atoi(v)
+		return level, err == nil && level >= 0 && level <= 4
+	}
+	return 0, false
+}
+
 // PUT /t/{topic_id}/bookmark.json
 func (h *TopicsHandler) Bookmark(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, model.SuccessResponse{Success: "OK"})
@@ -199,5 +272,51 @@ func (h *TopicsHandler) RemoveBookmark(w http.ResponseWriter, r *http.Request) {
 
 // POST /t/{topic_id}/invite
 func (h *TopicsHandler) InviteToTopic(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, http.StatusOK, model.SuccessResponse{Success: "OK"})
+	id, ok := pathParamInt(r, "topic_id")
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid topic id")
+		return
+	}
+	body, err := decodeBody(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	inviter := h.Store.GetUserByUsername(middleware.GetUsername(r))
+	if inviter == nil {
+		writeError(w, http.StatusForbidden, "user not found")
+		return
+	}
+	if h.Store.GetTopic(id) == nil {
+		writeError(w, http.StatusNotFound, "topic not found")
+		return
+	}
+	username, _ := body["user"].(string)
+	email, _ := body["email"].(string)
+	invitee := h.Store.GetUserByUsername(username)
+	if invitee == nil {
+		if email == "" {
+			writeError(w, http.StatusUnprocessableEntity, "user not found")
+			return
+		}
+		if _, err := h.Store.CreateInvite(store.InviteParams{InviterID: inviter.ID, Email: email, TopicID: &id}); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, model.SuccessResponse{Success: "OK"})
+		return
+	}
+	err = h.Store.InviteToTopic(id, inviter.ID, invitee.ID)
+	if errors.Is(err, store.ErrCannotInvite) {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": "OK",
+		"user":    model.BasicUser{ID: invitee.ID, Username: invitee.Username, Name: invitee.Name, AvatarTemplate: invitee.AvatarTemplate},
+	})
 }
@@ -1,15 +1,27 @@
 package handler
 
 import (
+	"html"
 	"net/http"
 	"strings"
 
+	"github.com/lightcap/dtu-discourse/internal/middleware"
 	"github.com/lightcap/dtu-discourse/internal/model"
 	"github.com/lightcap/dtu-discourse/internal/store"
 )
 
 type UsersHandler struct {
 	Store *store.Store
+	Ext   *store.ExtStore
+}
+
+// blockedUsername returns the error for a username containing a blocked
+// watched word, or "" if it is allowed.
+func (h *UsersHandler) blockedUsername(username string) string {
+	if words := h.Ext.BlockedWords(username); len(words) > 0 {
+		return "Username contains a word that's not allowed: " + strings.Join(words, ", ")
+	}
+	return ""
 }
 
 // GET /users/{username}.json
@@ -67,13 +79,24 @@ func (h *UsersHandler) CreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	u, err := h.Store.CreateUser(name, username, email, password)
+	if msg := h.blockedUsername(username); msg != "" {
+		writeError(w, http.StatusUnprocessableEntity, msg)
+		return
+	}
+	// Only admins may skip email activation, as with an admin API key.
+	active := middleware.IsAdmin(r) && (body["active"] == true || body["active"] == "true")
+	u, err := h.Store.CreateUser(name, username, email, password, active)
 	if err != nil {
 		writeError(w, http.StatusUnprocessableEntity, err.Error())
 		return
 	}
+	msg := "Your account is activated and ready to use."
+	if !u.Active {
+		msg = "You're almost done! We sent an activation mail to <b>" + html.EscapeString(email) +
+			"</b>. Please follow the instructions in the mail to activate your account."
+	}
 	writeJSON(w, http.StatusOK, model.CreateUserResponse{
-		Success: true, Active: u.Active, Message: "user created", UserID: u.ID,
+		Success: true, Active: u.Active, Message: msg, UserID: u.ID,
 	})
 }
 
@@ -102,6 +125,10 @@ func (h *UsersHandler) UpdateUsername(w http.ResponseWriter, r *http.Request) {
 	}
 	body, _ := decodeBody(r)
 	if newName, ok := body["new_username"].(string); ok {
+		if msg := h.blockedUsername(newName); msg != "" {
+			writeError(w, http.StatusUnprocessableEntity, msg)
+			return
+		}
 		h.Store.UpdateUser(u.ID, map[string]interface{}{"username": newName})
 	}
 	writeJSON(w, http.StatusOK, model.SuccessResponse{Success: "OK"})
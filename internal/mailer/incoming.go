@@ -0,0 +1,223 @@
+package mailer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	netmail "net/mail"
+	"regexp"
+	"strings"
+)
+
+// Incoming is a received email, parsed.
+type Incoming struct {
+	MessageID string
+	From      string
+	FromName  string
+	To        []string
+	CC        []string
+	Subject   string
+	// References are the message ids the email answers, from its
+	// In-Reply-To and References headers.
+	References []string
+	// Text is the plain-text body, or the HTML one as text when there is
+	// no plain part.
+	Text string
+	// Header is the raw header block.
+	Header string
+	// AutoGenerated is set for autoresponders, bounces and bulk mail.
+	AutoGenerated bool
+}
+
+// ErrEmptyEmail is returned for a message with no headers or body.
+var ErrEmptyEmail = errors.New("the email is empty")
+
+// ParseIncoming reads a raw RFC 822 message.
+func ParseIncoming(raw string) (*Incoming, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, ErrEmptyEmail
+	}
+	msg, err := netmail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	in := &Incoming{Header: headerBlock(raw)}
+	h := msg.Header
+	in.MessageID = strings.Trim(strings.TrimSpace(h.Get("Message-ID")), "<>")
+	if from, err := netmail.ParseAddress(h.Get("From")); err == nil {
+		in.From, in.FromName = strings.ToLower(from.Address), from.Name
+	} else {
+		in.From = strings.ToLower(strings.TrimSpace(h.Get("From")))
+	}
+	in.To = addressList(h.Get("To"))
+	in.CC = addressList(h.Get("Cc"))
+	dec := new(mime.WordDecoder)
+	if in.Subject, err = dec.DecodeHeader(h.Get("Subject")); err != nil {
+		in.Subject = h.Get("Subject")
+	}
+	in.Subject = strings.TrimSpace(in.Subject)
+	for _, field := range []string{"In-Reply-To", "References"} {
+		for _, id := range strings.Fields(h.Get(field)) {
+			in.References = append(in.References, strings.Trim(id, "<>"))
+		}
+	}
+	auto := strings.ToLower(h.Get("Auto-Submitted"))
+	precedence := strings.ToLower(h.Get("Precedence"))
+	in.AutoGenerated = (auto != "" && auto != "no") || precedence == "bulk" || precedence == "list" ||
+		precedence == "junk" || precedence == "auto_reply" || h.Get("X-Autoreply") != "" ||
+		h.Get("X-Autorespond") != ""
+
+	plain, htmlBody := readBody(h.Get("Content-Type"), h.Get("Content-Transfer-Encoding"), msg.Body)
+	in.Text = plain
+	if strings.TrimSpace(in.Text) == "" {
+		in.Text = htmlToText(htmlBody)
+	}
+	in.Text = strings.ReplaceAll(in.Text, "\r\n", "\n")
+	return in, nil
+}
+
+// headerBlock returns the raw header lines of raw.
+func headerBlock(raw string) string {
+	raw = strings.ReplaceAll(raw, "\r\n", "\n")
+	header, _, _ := strings.Cut(raw, "\n\n")
+	return header
+}
+
+func addressList(v string) []string {
+	if strings.TrimSpace(v) == "" {
+		return nil
+	}
+	list, err := netmail.ParseAddressList(v)
+	if err != nil {
+		var out []string
+		for _, a := range strings.Split(v, ",") {
+			out = append(out, strings.ToLower(Address(a)))
+		}
+		return out
+	}
+	out := make([]string, 0, len(list))
+	for _, a := range list {
+		out = append(out, strings.ToLower(a.Address))
+	}
+	return out
+}
+
+// readBody returns the first plain-text and HTML parts of a body, walking
+// into multipart bodies. Attachments are ignored.
+func readBody(contentType, encoding string, body io.Reader) (plain, htmlBody string) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+			if disposition, _, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition")); disposition == "attachment" {
+				continue
+			}
+			// multipart.Part undoes quoted-printable itself and drops
+			// the header; base64 is left to us.
+			p, h := readBody(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part)
+			if plain == "" {
+				plain = p
+			}
+			if htmlBody == "" {
+				htmlBody = h
+			}
+		}
+		return plain, htmlBody
+	}
+	data, _ := io.ReadAll(decodeTransfer(encoding, body))
+	switch mediaType {
+	case "text/plain":
+		return string(data), ""
+	case "text/html":
+		return "", string(data)
+	}
+	return "", ""
+}
+
+func decodeTransfer(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		data, _ := io.ReadAll(r)
+		clean := bytes.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+				return -1
+			}
+			return r
+		}, data)
+		return base64.NewDecoder(base64.StdEncoding, bytes.NewReader(clean))
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+var (
+	reHTMLBreak = regexp.MustCompile(`(?i)<br\s*/?>|</p>|</div>|</li>|</h[1-6]>`)
+	reHTMLTag   = regexp.MustCompile(`<[^>]*>`)
+	reHTMLDrop  = regexp.MustCompile(`(?is)<(style|script|head)[^>]*>.*?</(style|script|head)>`)
+)
+
+func htmlToText(s string) string {
+	s = reHTMLDrop.ReplaceAllString(s, "")
+	s = reHTMLBreak.ReplaceAllString(s, "\n")
+	s = reHTMLTag.ReplaceAllString(s, "")
+	return html.UnescapeString(s)
+}
+
+// replyDelimiters start the part of a reply that repeats the message
+// answered, or a signature.
+var replyDelimiters = []*regexp.Regexp{
+	regexp.MustCompile(`^On\b.*\bwrote:\s*$`),
+	regexp.MustCompile(`^-+\s*Original Message\s*-+\s*$`),
+	regexp.MustCompile(`^_{10,}\s*$`),
+	regexp.MustCompile(`^-- ?$`),
+	regexp.MustCompile(`^Sent from my `),
+	regexp.MustCompile(`^Get Outlook for `),
+}
+
+var reFromHeader = regexp.MustCompile(`^\*?From:\*? `)
+
+// TrimReply strips the quoted message and signature from an email reply,
+// as Discourse's EmailReplyTrimmer does.
+func TrimReply(text string) string {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	var out []string
+scan:
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		// "On <date>, <name> wrote:" is often wrapped onto two lines.
+		joined := trimmed
+		if i+1 < len(lines) {
+			joined = trimmed + " " + strings.TrimSpace(lines[i+1])
+		}
+		for _, re := range replyDelimiters {
+			if re.MatchString(trimmed) || (strings.HasPrefix(trimmed, "On ") && re.MatchString(joined)) {
+				break scan
+			}
+		}
+		// An Outlook-style header block: From: followed by Sent: or To:.
+		if reFromHeader.MatchString(trimmed) && i+1 < len(lines) {
+			next := strings.TrimSpace(lines[i+1])
+			if strings.HasPrefix(next, "Sent:") || strings.HasPrefix(next, "Date:") || strings.HasPrefix(next, "To:") {
+				break
+			}
+		}
+		if strings.HasPrefix(trimmed, ">") {
+			continue
+		}
+		out = append(out, strings.TrimRight(line, " \t"))
+	}
+	return strings.TrimSpace(strings.Join(out, "\n"))
+}
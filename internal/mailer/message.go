@@ -0,0 +1,160 @@
+// Package mailer renders the emails Discourse sends from its site-text
+// templates, builds them as MIME messages and keeps them in an outbox so
+// tests can read them back.
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	netmail "net/mail"
+	"net/textproto"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Message is one outgoing email.
+type Message struct {
+	ID        int               `json:"id"`
+	EmailType string            `json:"email_type"`
+	From      string            `json:"from"`
+	To        string            `json:"to"`
+	ReplyTo   string            `json:"reply_to,omitempty"`
+	Subject   string            `json:"subject"`
+	Text      string            `json:"text"`
+	HTML      string            `json:"html"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	MessageID string            `json:"message_id"`
+	UserID    int               `json:"user_id,omitempty"`
+	PostID    int               `json:"post_id,omitempty"`
+	TopicID   int               `json:"topic_id,omitempty"`
+	ReplyKey  string            `json:"reply_key,omitempty"`
+	// SkippedReason is set for emails the forum decided not to send.
+	SkippedReason string `json:"skipped_reason,omitempty"`
+	// Bounced is set when the SMTP server refused the message for good.
+	Bounced bool `json:"bounced"`
+	// Links are the absolute URLs in the email and Tokens the secrets
+	// carried by its links, keyed by what they are for (activation,
+	// password_reset, invite, email_login).
+	Links     []string          `json:"links"`
+	Tokens    map[string]string `json:"tokens"`
+	Raw       string            `json:"raw"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// FromAddress formats a From header naming name, as "Name" <address>.
+func FromAddress(name, address string) string {
+	return (&netmail.Address{Name: name, Address: address}).String()
+}
+
+// Address returns the bare address of a header value such as
+// "Name" <user@example.com>, or the value itself if it doesn't parse.
+func Address(header string) string {
+	if a, err := netmail.ParseAddress(header); err == nil {
+		return a.Address
+	}
+	return strings.TrimSpace(header)
+}
+
+var (
+	reHref    = regexp.MustCompile(`href="([^"]+)"`)
+	reTextURL = regexp.MustCompile(`https?://[^\s<>()"\]]+`)
+)
+
+// tokenPaths maps the path prefixes of links that carry a token to the
+// name the token is reported under.
+var tokenPaths = []struct{ prefix, name string }{
+	{"/u/activate-account/", "activation"},
+	{"/u/password-reset/", "password_reset"},
+	{"/u/confirm-new-email/", "confirm_email"},
+	{"/session/email-login/", "email_login"},
+	{"/invites/", "invite"},
+	{"/email/unsubscribe/", "unsubscribe"},
+}
+
+// extractLinks collects the absolute URLs in the message's bodies, making
+// relative links absolute against baseURL, and the tokens they carry.
+func (m *Message) extractLinks(baseURL string) {
+	seen := map[string]bool{}
+	m.Links = []string{}
+	m.Tokens = map[string]string{}
+	add := func(link string) {
+		link = strings.TrimRight(link, ".,;:!?")
+		if strings.HasPrefix(link, "/") && !strings.HasPrefix(link, "//") {
+			link = baseURL + link
+		}
+		if !strings.HasPrefix(link, "http://") && !strings.HasPrefix(link, "https://") {
+			return
+		}
+		if seen[link] {
+			return
+		}
+		seen[link] = true
+		m.Links = append(m.Links, link)
+		path := strings.TrimPrefix(link, baseURL)
+		for _, tp := range tokenPaths {
+			if rest, ok := strings.CutPrefix(path, tp.prefix); ok {
+				token, _, _ := strings.Cut(rest, "?")
+				token, _, _ = strings.Cut(token, "/")
+				if token != "" && m.Tokens[tp.name] == "" {
+					m.Tokens[tp.name] = token
+				}
+			}
+		}
+	}
+	for _, h := range reHref.FindAllStringSubmatch(m.HTML, -1) {
+		add(strings.ReplaceAll(h[1], "&amp;", "&"))
+	}
+	for _, u := range reTextURL.FindAllString(m.Text, -1) {
+		add(u)
+	}
+}
+
+// build renders the message as a multipart/alternative MIME message with
+// quoted-printable text and HTML parts.
+func (m *Message) build() string {
+	var buf bytes.Buffer
+	header := func(k, v string) { fmt.Fprintf(&buf, "%s: %s\r\n", k, v) }
+	header("Date", m.CreatedAt.Format(time.RFC1123Z))
+	header("From", m.From)
+	header("To", m.To)
+	if m.ReplyTo != "" {
+		header("Reply-To", m.ReplyTo)
+	}
+	header("Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	header("Message-ID", "<"+m.MessageID+">")
+	header("MIME-Version", "1.0")
+	keys := make([]string, 0, len(m.Headers))
+	for k := range m.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		header(k, m.Headers[k])
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	w.SetBoundary(fmt.Sprintf("--==_mimepart_%d_%d", m.ID, m.CreatedAt.UnixNano()))
+	header("Content-Type", `multipart/alternative; boundary="`+w.Boundary()+`"`)
+	buf.WriteString("\r\n")
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=UTF-8", m.Text},
+		{"text/html; charset=UTF-8", m.HTML},
+	} {
+		pw, _ := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		qp := quotedprintable.NewWriter(pw)
+		qp.Write([]byte(strings.ReplaceAll(part.content, "\n", "\r\n")))
+		qp.Close()
+	}
+	w.Close()
+	buf.Write(body.Bytes())
+	return buf.String()
+}
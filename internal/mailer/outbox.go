@@ -0,0 +1,163 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Outbox keeps every email the forum sent or skipped, oldest first.
+type Outbox struct {
+	// BaseURL is the forum's URL, used to make links absolute and to
+	// name the host in Message-IDs.
+	BaseURL string
+
+	mu       sync.Mutex
+	messages []*Message
+	nextID   int
+
+	// sender, when set, delivers each message that isn't skipped, in
+	// order, from a goroutine that holds no lock while it talks to it.
+	sender  Sender
+	pending []int
+	wake    chan struct{}
+}
+
+// NewOutbox creates an empty Outbox for the forum at baseURL.
+func NewOutbox(baseURL string) *Outbox {
+	return &Outbox{BaseURL: baseURL, nextID: 1}
+}
+
+// Add numbers m, fills in its Message-ID, links, tokens and raw MIME
+// form, and keeps it. It returns a copy of the stored message.
+func (o *Outbox) Add(m *Message) Message {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	m.ID = o.nextID
+	o.nextID++
+	if m.CreatedAt.IsZero() {
+		m.CreatedAt = time.Now().UTC()
+	}
+	host := "localhost"
+	if u, err := url.Parse(o.BaseURL); err == nil && u.Hostname() != "" {
+		host = u.Hostname()
+	}
+	if m.MessageID == "" {
+		m.MessageID = fmt.Sprintf("%s.%d.%d@%s", m.EmailType, m.ID, m.CreatedAt.UnixNano(), host)
+	}
+	m.extractLinks(o.BaseURL)
+	m.Raw = m.build()
+	o.messages = append(o.messages, m)
+	if o.sender != nil && m.SkippedReason == "" {
+		o.pending = append(o.pending, m.ID)
+		select {
+		case o.wake <- struct{}{}:
+		default:
+		}
+	}
+	return *m
+}
+
+// DeliverVia has every message added from now on delivered with sender
+// as well as kept. Failed deliveries are marked skipped with the reason.
+func (o *Outbox) DeliverVia(sender Sender) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.sender = sender
+	if o.wake == nil {
+		o.wake = make(chan struct{}, 1)
+		go o.deliver()
+	}
+}
+
+// Sender returns the sender messages are delivered with, or nil.
+func (o *Outbox) Sender() Sender {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.sender
+}
+
+func (o *Outbox) deliver() {
+	for range o.wake {
+		for {
+			o.mu.Lock()
+			if len(o.pending) == 0 {
+				o.mu.Unlock()
+				break
+			}
+			id := o.pending[0]
+			o.pending = o.pending[1:]
+			m, sender := o.find(id), o.sender
+			var cp Message
+			if m != nil {
+				cp = *m
+			}
+			o.mu.Unlock()
+			if m == nil {
+				continue
+			}
+			if err := sender.Send(cp); err != nil {
+				o.failed(id, err)
+			}
+		}
+	}
+}
+
+// failed records why message id could not be delivered.
+func (o *Outbox) failed(id int, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	m := o.find(id)
+	if m == nil {
+		return
+	}
+	var de *DeliveryError
+	if errors.As(err, &de) && de.Permanent {
+		m.Bounced = true
+		m.SkippedReason = "The email bounced: " + err.Error()
+		return
+	}
+	m.SkippedReason = "Delivering the email failed: " + err.Error()
+}
+
+// Caller must hold o.mu.
+func (o *Outbox) find(id int) *Message {
+	for _, m := range o.messages {
+		if m.ID == id {
+			return m
+		}
+	}
+	return nil
+}
+
+// List returns copies of the kept messages, oldest first.
+func (o *Outbox) List() []Message {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	out := make([]Message, 0, len(o.messages))
+	for _, m := range o.messages {
+		out = append(out, *m)
+	}
+	return out
+}
+
+// Get returns a copy of the message with id, or nil.
+func (o *Outbox) Get(id int) *Message {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if m := o.find(id); m != nil {
+		cp := *m
+		return &cp
+	}
+	return nil
+}
+
+// Clear empties the outbox.
+func (o *Outbox) Clear() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.messages = nil
+	o.pending = nil
+}
@@ -0,0 +1,84 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"time"
+)
+
+// Sender delivers a message somewhere outside the DTU.
+type Sender interface {
+	Send(m Message) error
+}
+
+// SMTPSender delivers messages over plain SMTP to Addr, a local sink such
+// as MailHog. It neither authenticates nor starts TLS.
+type SMTPSender struct {
+	Addr string
+	// Domain is the name given in HELO; "localhost" by default.
+	Domain string
+}
+
+// DeliveryError is a failed delivery. Permanent failures, the 5xx
+// replies, are bounces.
+type DeliveryError struct {
+	Permanent bool
+	Err       error
+}
+
+func (e *DeliveryError) Error() string { return e.Err.Error() }
+
+func (e *DeliveryError) Unwrap() error { return e.Err }
+
+// Send delivers m's raw form to its recipient.
+func (s SMTPSender) Send(m Message) error {
+	conn, err := net.DialTimeout("tcp", s.Addr, 10*time.Second)
+	if err != nil {
+		return &DeliveryError{Err: err}
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	host, _, _ := net.SplitHostPort(s.Addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return deliveryError(err)
+	}
+	defer c.Close()
+	domain := s.Domain
+	if domain == "" {
+		domain = "localhost"
+	}
+	if err := c.Hello(domain); err != nil {
+		return deliveryError(err)
+	}
+	if err := c.Mail(Address(m.From)); err != nil {
+		return deliveryError(err)
+	}
+	if err := c.Rcpt(Address(m.To)); err != nil {
+		return deliveryError(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		return deliveryError(err)
+	}
+	if _, err := w.Write([]byte(m.Raw)); err != nil {
+		return deliveryError(err)
+	}
+	if err := w.Close(); err != nil {
+		return deliveryError(err)
+	}
+	// The message is accepted; a failed QUIT doesn't undo that.
+	c.Quit()
+	return nil
+}
+
+func deliveryError(err error) error {
+	var reply *textproto.Error
+	if errors.As(err, &reply) {
+		return &DeliveryError{Permanent: reply.Code >= 500, Err: fmt.Errorf("%d %s", reply.Code, reply.Msg)}
+	}
+	return &DeliveryError{Err: err}
+}
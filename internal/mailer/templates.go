@@ -0,0 +1,172 @@
+package mailer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Template is an email's site-text template: a subject and a Markdown
+// body with %{name} placeholders.
+type Template struct {
+	ID        string `json:"id"`
+	Title     string `json:"title"`
+	Subject   string `json:"subject"`
+	Body      string `json:"body"`
+	CanRevert bool   `json:"can_revert"`
+}
+
+// notificationBody is shared by the notification emails.
+const notificationBody = "%{message}\n\n---\n%{respond_instructions}\n"
+
+// defaultTemplates are Discourse's English templates for the emails the
+// DTU sends.
+var defaultTemplates = []Template{
+	{
+		ID: "user_notifications.signup", Title: "Signup",
+		Subject: "[%{email_prefix}] Confirm your new account",
+		Body: "Welcome to %{site_name}!\n\nClick the following link to confirm and activate your new account:\n" +
+			"%{base_url}/u/activate-account/%{email_token}\n\n" +
+			"If the above link is not clickable, try copying and pasting it into the address bar of your web browser.\n",
+	},
+	{
+		ID: "user_notifications.forgot_password", Title: "Forgot password",
+		Subject: "[%{email_prefix}] Password reset",
+		Body: "Somebody asked to reset your password on [%{site_name}](%{base_url}).\n\n" +
+			"If it was not you, you can safely ignore this email.\n\nClick the following link to choose a new password:\n" +
+			"%{base_url}/u/password-reset/%{email_token}\n",
+	},
+	{
+		ID: "invite_forum_mailer", Title: "Invite forum mailer",
+		Subject: "%{inviter_name} invited you to join %{site_domain_name}",
+		Body: "%{inviter_name} invited you to join\n\n> **%{site_title}**\n>\n> %{site_description}\n\n" +
+			"If you're interested, click the link below:\n\n%{invite_link}\n",
+	},
+	{
+		ID: "invite_mailer", Title: "Invite mailer",
+		Subject: "%{inviter_name} invited you to '%{topic_title}' on %{site_domain_name}",
+		Body: "%{inviter_name} invited you to a discussion\n\n> **%{topic_title}**\n>\n> %{topic_excerpt}\n\n" +
+			"at\n\n> %{site_title} -- %{site_description}\n\nIf you're interested, click the link below:\n\n%{invite_link}\n",
+	},
+	{
+		ID: "user_notifications.user_replied", Title: "User replied",
+		Subject: "[%{email_prefix}] %{topic_title}", Body: notificationBody,
+	},
+	{
+		ID: "user_notifications.user_mentioned", Title: "User mentioned",
+		Subject: "[%{email_prefix}] %{topic_title}", Body: notificationBody,
+	},
+	{
+		ID: "user_notifications.user_group_mentioned", Title: "User group mentioned",
+		Subject: "[%{email_prefix}] %{topic_title}", Body: notificationBody,
+	},
+	{
+		ID: "user_notifications.user_private_message", Title: "User private message",
+		Subject: "[%{email_prefix}] [PM] %{topic_title}", Body: notificationBody,
+	},
+	{
+		ID: "user_notifications.digest", Title: "Digest",
+		Subject: "[%{email_prefix}] Summary",
+		Body: "### Since your last visit on %{last_seen_at}\n\n%{topics}\n\n" +
+			"[Visit %{site_name}](%{base_url}) to catch up.\n\n" +
+			"To stop receiving these summaries, [unsubscribe](%{unsubscribe_url}).\n",
+	},
+	{
+		ID: "test_mailer", Title: "Test mailer",
+		Subject: "[%{email_prefix}] Email Deliverability Test",
+		Body: "This is a test email from\n\n[**%{base_url}**](%{base_url})\n\n" +
+			"We hope you received this email deliverability test OK!\n",
+	},
+}
+
+// Templates holds the email templates and the admin's overrides of them.
+type Templates struct {
+	mu        sync.RWMutex
+	overrides map[string]Template
+}
+
+// NewTemplates creates the default template set.
+func NewTemplates() *Templates {
+	return &Templates{overrides: make(map[string]Template)}
+}
+
+// List returns every template as it currently reads, by id.
+func (ts *Templates) List() []Template {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	out := make([]Template, 0, len(defaultTemplates))
+	for _, t := range defaultTemplates {
+		out = append(out, ts.current(t))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// Get returns the template with id as it currently reads.
+func (ts *Templates) Get(id string) (Template, bool) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	for _, t := range defaultTemplates {
+		if t.ID == id {
+			return ts.current(t), true
+		}
+	}
+	return Template{}, false
+}
+
+// Caller must hold ts.mu.
+func (ts *Templates) current(t Template) Template {
+	if o, ok := ts.overrides[t.ID]; ok {
+		t.Subject, t.Body, t.CanRevert = o.Subject, o.Body, true
+	}
+	return t
+}
+
+// Override replaces a template's subject and body; empty values keep
+// the current ones.
+func (ts *Templates) Override(id, subject, body string) (Template, error) {
+	t, ok := ts.Get(id)
+	if !ok {
+		return Template{}, fmt.Errorf("email template not found")
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if subject != "" {
+		t.Subject = subject
+	}
+	if body != "" {
+		t.Body = body
+	}
+	ts.overrides[id] = t
+	t.CanRevert = true
+	return t, nil
+}
+
+// Revert restores a template's defaults.
+func (ts *Templates) Revert(id string) (Template, error) {
+	ts.mu.Lock()
+	delete(ts.overrides, id)
+	ts.mu.Unlock()
+	t, ok := ts.Get(id)
+	if !ok {
+		return Template{}, fmt.Errorf("email template not found")
+	}
+	return t, nil
+}
+
+// Render fills in the template with id from vars. Placeholders without a
+// value are left as they are, as Discourse's interpolation does.
+func (ts *Templates) Render(id string, vars map[string]string) (subject, body string) {
+	t, _ := ts.Get(id)
+	return Interpolate(t.Subject, vars), Interpolate(t.Body, vars)
+}
+
+// Interpolate replaces the %{name} placeholders in s.
+func Interpolate(s string, vars map[string]string) string {
+	pairs := make([]string, 0, 2*len(vars))
+	for k, v := range vars {
+		pairs = append(pairs, "%{"+k+"}", v)
+	}
+	return strings.NewReplacer(pairs...).Replace(s)
+}
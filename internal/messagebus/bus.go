@@ -0,0 +1,216 @@
+// Package messagebus emulates the MessageBus server Discourse uses to push
+// real-time updates. Messages are published to channels, each with its own
+// backlog and message ids, and clients poll for what is new since the ids
+// they last saw, either returning at once or holding the request open
+// until something arrives (long polling).
+//
+// A message may be restricted to some users or groups; clients only ever
+// receive messages they are allowed to see.
+package messagebus
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// StatusChannel is the channel of the message that tells a client the
+// current position of channels it subscribed to from "now" (-1) or from
+// beyond the end of the backlog.
+const StatusChannel = "/__status"
+
+// DefaultLongPollInterval is how long a long poll is held open, as
+// MessageBus.long_polling_interval defaults to.
+const DefaultLongPollInterval = 25 * time.Second
+
+// DefaultMaxBacklog is how many messages each channel keeps.
+const DefaultMaxBacklog = 1000
+
+// Message is one message on a channel, serialized as MessageBus sends it.
+type Message struct {
+	GlobalID  int         `json:"global_id"`
+	MessageID int         `json:"message_id"`
+	Channel   string      `json:"channel"`
+	Data      interface{} `json:"data"`
+
+	// UserIDs and GroupIDs restrict who may receive the message. A message
+	// with neither is public.
+	UserIDs  []int `json:"-"`
+	GroupIDs []int `json:"-"`
+}
+
+// Client identifies who is polling: a user and the groups they belong to.
+// UserID is zero for anonymous clients.
+type Client struct {
+	UserID   int
+	GroupIDs []int
+}
+
+// allowed reports whether c may receive m.
+func (c Client) allowed(m *Message) bool {
+	if len(m.UserIDs) == 0 && len(m.GroupIDs) == 0 {
+		return true
+	}
+	if c.UserID != 0 && slices.Contains(m.UserIDs, c.UserID) {
+		return true
+	}
+	for _, id := range m.GroupIDs {
+		if slices.Contains(c.GroupIDs, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// Bus holds every channel's backlog and wakes long polls on publish.
+type Bus struct {
+	// LongPollInterval is how long Poll waits for messages.
+	LongPollInterval time.Duration
+	// MaxBacklog is how many messages each channel keeps.
+	MaxBacklog int
+
+	mu       sync.Mutex
+	globalID int
+	backlogs map[string][]*Message
+	lastIDs  map[string]int
+	wake     chan struct{}
+}
+
+// New creates an empty Bus.
+func New() *Bus {
+	return &Bus{
+		LongPollInterval: DefaultLongPollInterval,
+		MaxBacklog:       DefaultMaxBacklog,
+		backlogs:         make(map[string][]*Message),
+		lastIDs:          make(map[string]int),
+		wake:             make(chan struct{}),
+	}
+}
+
+// Publish adds a message to channel, restricted to userIDs and groupIDs
+// when either is set, and wakes any waiting polls.
+func (b *Bus) Publish(channel string, data interface{}, userIDs, groupIDs []int) *Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.globalID++
+	b.lastIDs[channel]++
+	m := &Message{
+		GlobalID: b.globalID, MessageID: b.lastIDs[channel], Channel: channel, Data: data,
+		UserIDs: slices.Clone(userIDs), GroupIDs: slices.Clone(groupIDs),
+	}
+	backlog := append(b.backlogs[channel], m)
+	if len(backlog) > b.MaxBacklog {
+		backlog = backlog[len(backlog)-b.MaxBacklog:]
+	}
+	b.backlogs[channel] = backlog
+	close(b.wake)
+	b.wake = make(chan struct{})
+	return m
+}
+
+// LastID returns the id of the newest message on channel, or 0.
+func (b *Bus) LastID(channel string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.lastIDs[channel]
+}
+
+// Backlog returns what client should receive for subscriptions, a map of
+// channel to the last message id the client saw there, in global order.
+// A last id of -1 subscribes from now, and one past the end of a channel
+// resubscribes from its end: both are answered with a status message
+// giving the channel's current position. A last id below -1 asks for the
+// channel's last -id-1 messages.
+func (b *Bus) Backlog(client Client, subscriptions map[string]int) []Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	msgs, _ := b.backlog(client, subscriptions)
+	return msgs
+}
+
+// Caller must hold b.mu.
+func (b *Bus) backlog(client Client, subscriptions map[string]int) ([]Message, <-chan struct{}) {
+	var msgs []Message
+	status := map[string]int{}
+	for channel, lastID := range subscriptions {
+		last := b.lastIDs[channel]
+		if lastID < -1 {
+			lastID = max(last+lastID+1, 0)
+		}
+		if lastID == -1 || lastID > last {
+			status[channel] = last
+			continue
+		}
+		for _, m := range b.backlogs[channel] {
+			if m.MessageID > lastID && client.allowed(m) {
+				msgs = append(msgs, *m)
+			}
+		}
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].GlobalID < msgs[j].GlobalID })
+	if len(status) > 0 {
+		msgs = append(msgs, Message{GlobalID: -1, MessageID: -1, Channel: StatusChannel, Data: status})
+	}
+	return msgs, b.wake
+}
+
+// Poll returns client's backlog for subscriptions. When there is nothing
+// yet and long is set, it waits up to LongPollInterval for a message to
+// arrive, returning early if ctx is done. It returns an empty slice when
+// nothing arrived.
+func (b *Bus) Poll(ctx context.Context, client Client, subscriptions map[string]int, long bool) []Message {
+	timer := time.NewTimer(b.LongPollInterval)
+	defer timer.Stop()
+	for {
+		b.mu.Lock()
+		msgs, wake := b.backlog(client, subscriptions)
+		b.mu.Unlock()
+		if len(msgs) > 0 || !long {
+			if msgs == nil {
+				msgs = []Message{}
+			}
+			return msgs
+		}
+		select {
+		case <-wake:
+		case <-timer.C:
+			return []Message{}
+		case <-ctx.Done():
+			return []Message{}
+		}
+	}
+}
+
+// Stream delivers client's messages for subscriptions as they arrive until
+// LongPollInterval passes or ctx is done, as a chunked MessageBus poll
+// does. deliver is called with each non-empty batch, its backlog first;
+// subscriptions advance past what was delivered.
+func (b *Bus) Stream(ctx context.Context, client Client, subscriptions map[string]int, deliver func([]Message)) {
+	subs := make(map[string]int, len(subscriptions))
+	for channel, lastID := range subscriptions {
+		subs[channel] = lastID
+	}
+	timer := time.NewTimer(b.LongPollInterval)
+	defer timer.Stop()
+	for {
+		b.mu.Lock()
+		msgs, wake := b.backlog(client, subs)
+		// Later batches continue from where each channel now stands.
+		for channel := range subs {
+			subs[channel] = b.lastIDs[channel]
+		}
+		b.mu.Unlock()
+		if len(msgs) > 0 {
+			deliver(msgs)
+		}
+		select {
+		case <-wake:
+		case <-timer.C:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -28,6 +28,11 @@ func Auth(s *store.Store) func(http.Handler) http.Handler {
 				next.ServeHTTP(w, r)
 				return
 			}
+			// RSS feeds are public; feed readers don't send API keys
+			if r.Method == http.MethodGet && strings.HasSuffix(p, ".rss") {
+				next.ServeHTTP(w, r)
+				return
+			}
 
 			apiKey := r.Header.Get("Api-Key")
 			apiUsername := r.Header.Get("Api-Username")
@@ -40,6 +45,20 @@ func Auth(s *store.Store) func(http.Handler) http.Handler {
 				apiUsername = r.URL.Query().Get("api_username")
 			}
 
+			// Anonymous visitors poll the message bus and read public
+			// presence too; they only receive what is public
+			if apiKey == "" && (strings.HasPrefix(p, "/message-bus/") || (r.Method == http.MethodGet && p == "/presence/get")) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Account activation and password reset links are followed
+			// from an email; the token in the path is the credential
+			if apiKey == "" && (strings.HasPrefix(p, "/u/activate-account/") || strings.HasPrefix(p, "/u/password-reset/")) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
 			if apiKey == "" {
 				http.Error(w, `{"errors":["not logged in"],"error_type":"not_logged_in"}`, http.StatusForbidden)
 				return
@@ -58,6 +77,9 @@ func Auth(s *store.Store) func(http.Handler) http.Handler {
 
 			u := s.GetUserByUsername(apiUsername)
 			isAdmin := u != nil && u.Admin
+			if u != nil {
+				s.RecordVisit(u.ID)
+			}
 
 			ctx := context.WithValue(r.Context(), ContextKeyUsername, apiUsername)
 			ctx = context.WithValue(ctx, ContextKeyIsAdmin, isAdmin)
@@ -0,0 +1,43 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/lightcap/dtu-discourse/internal/store"
+)
+
+// RateLimit applies Discourse's global request limits, per client IP and
+// per API key, before the request reaches authentication. Refused requests
+// get the same 429 body as Discourse's rate_limit errors.
+func RateLimit(s *store.Store) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				ip = r.RemoteAddr
+			}
+			apiKey := r.Header.Get("Api-Key")
+			if apiKey == "" {
+				apiKey = r.URL.Query().Get("api_key")
+			}
+			var rl *store.RateLimitError
+			if errors.As(s.CheckRequestLimits(ip, apiKey), &rl) {
+				w.Header().Set("Content-Type", "application/json; charset=utf-8")
+				w.Header().Set("Retry-After", strconv.Itoa(rl.WaitSeconds))
+				w.Header().Set("Discourse-Rate-Limit-Error-Code", rl.ErrorCode)
+				w.WriteHeader(http.StatusTooManyRequests)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"errors":     []string{rl.Message},
+					"error_type": "rate_limit",
+					"extras":     map[string]interface{}{"wait_seconds": rl.WaitSeconds, "time_left": rl.TimeLeft},
+				})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
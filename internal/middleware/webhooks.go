@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lightcap/dtu-discourse/internal/store"
+)
+
+// syncWebhooksTimeout bounds how long a response waits for deliveries, so
+// a receiver that calls back into the DTU can't hold it forever.
+const syncWebhooksTimeout = 30 * time.Second
+
+// SyncWebhooks, when s.WebhooksSync is set, holds each response back until
+// the webhooks queued while it was handled have been delivered, so a
+// test's receiver has seen what its request set off by the time the
+// request returns. Requests that queue nothing aren't held back, so a
+// receiver may call the DTU while handling a delivery.
+func SyncWebhooks(s *store.Store) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !s.WebhooksSync {
+				next.ServeHTTP(w, r)
+				return
+			}
+			sw := &syncWriter{ResponseWriter: w, store: s, mark: s.MarkWebhooks()}
+			next.ServeHTTP(sw, r)
+			sw.flushWebhooks()
+		})
+	}
+}
+
+// syncWriter flushes the webhooks before the first byte of the response.
+type syncWriter struct {
+	http.ResponseWriter
+	store   *store.Store
+	mark    store.WebhookMark
+	flushed bool
+}
+
+func (w *syncWriter) flushWebhooks() {
+	if w.flushed {
+		return
+	}
+	w.flushed = true
+	ctx, cancel := context.WithTimeout(context.Background(), syncWebhooksTimeout)
+	defer cancel()
+	if err := w.store.FlushWebhooksSince(ctx, w.mark); err != nil {
+		log.Printf("[webhook] response sent before deliveries finished: %v", err)
+	}
+}
+
+func (w *syncWriter) WriteHeader(code int) {
+	w.flushWebhooks()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *syncWriter) Write(b []byte) (int, error) {
+	w.flushWebhooks()
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush lets streaming handlers such as the message bus keep streaming.
+func (w *syncWriter) Flush() {
+	w.flushWebhooks()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
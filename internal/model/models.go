@@ -24,12 +24,15 @@ type User struct {
 	Suspended        bool      `json:"suspended,omitempty"`
 	SuspendedTill    string    `json:"suspended_till,omitempty"`
 	Silenced         bool      `json:"silenced,omitempty"`
+	Staged           bool      `json:"staged,omitempty"`
 	Title            string    `json:"title,omitempty"`
 	ExternalID       string    `json:"external_id,omitempty"`
 	GroupIDs         []int     `json:"group_ids,omitempty"`
 	PrimaryGroupID   *int      `json:"primary_group_id"`
 	FlairGroupID     *int      `json:"flair_group_id"`
 	UserFields       map[string]interface{} `json:"user_fields,omitempty"`
+	BioRaw           string    `json:"bio_raw,omitempty"`
+	UploadedAvatarID *int      `json:"uploaded_avatar_id,omitempty"`
 }
 
 type UserResponse struct {
@@ -83,10 +86,21 @@ type Category struct {
 	SubcategoryListStyle  string    `json:"subcategory_list_style"`
 	DefaultTopPeriod      string    `json:"default_top_period"`
 	MinimumRequiredTags   int       `json:"minimum_required_tags"`
+	EmailIn               string    `json:"email_in"`
+	EmailInAllowStrangers bool      `json:"email_in_allow_strangers"`
+	CustomFields          map[string]interface{} `json:"custom_fields,omitempty"`
+	GroupPermissions      []GroupPermission `json:"group_permissions,omitempty"`
 	CreatedAt             time.Time `json:"created_at,omitempty"`
 	UpdatedAt             time.Time `json:"updated_at,omitempty"`
 }
 
+// GroupPermission grants a group access to a category: 1 full,
+// 2 create_post, 3 readonly.
+type GroupPermission struct {
+	PermissionType int    `json:"permission_type"`
+	GroupName      string `json:"group_name"`
+}
+
 type CategoryListResponse struct {
 	CategoryList CategoryList `json:"category_list"`
 }
@@ -131,6 +145,7 @@ type Topic struct {
 	CategoryID        int       `json:"category_id"`
 	PinnedGlobally    bool      `json:"pinned_globally"`
 	HasAcceptedAnswer bool      `json:"has_accepted_answer"`
+	AcceptedAnswer    *AcceptedAnswer `json:"accepted_answer,omitempty"`
 	Posters           []Poster  `json:"posters,omitempty"`
 	Tags              []string  `json:"tags"`
 	ExternalID        string    `json:"external_id,omitempty"`
@@ -140,6 +155,16 @@ type Topic struct {
 	Details    *TopicDetails `json:"details,omitempty"`
 }
 
+// AcceptedAnswer summarises a topic's solution (discourse-solved).
+type AcceptedAnswer struct {
+	PostNumber       int    `json:"post_number"`
+	Username         string `json:"username"`
+	Name             string `json:"name"`
+	Excerpt          string `json:"excerpt"`
+	AccepterUsername string `json:"accepter_username"`
+	AccepterName     string `json:"accepter_name"`
+}
+
 type Poster struct {
 	Extras      string `json:"extras,omitempty"`
 	Description string `json:"description"`
@@ -204,6 +229,7 @@ type Post struct {
 	UpdatedAt         time.Time `json:"updated_at"`
 	ReplyCount        int       `json:"reply_count"`
 	ReplyToPostNumber *int      `json:"reply_to_post_number"`
+	ReplyToUser       *ReplyToUser `json:"reply_to_user,omitempty"`
 	QuoteCount        int       `json:"quote_count"`
 	AvgTime           *int      `json:"avg_time"`
 	Score             float64   `json:"score"`
@@ -223,6 +249,32 @@ type Post struct {
 	Hidden            bool      `json:"hidden"`
 	TrustLevel        int       `json:"trust_level"`
 	Yours             bool      `json:"yours"`
+	ActionsSummary    []ActionSummary `json:"actions_summary"`
+
+	// discourse-reactions fields
+	Reactions                   []PostReaction       `json:"reactions"`
+	CurrentUserReaction         *CurrentUserReaction `json:"current_user_reaction"`
+	ReactionUsersCount          int                  `json:"reaction_users_count"`
+	CurrentUserUsedMainReaction bool                 `json:"current_user_used_main_reaction"`
+
+	// discourse-solved fields
+	AcceptedAnswer      bool `json:"accepted_answer"`
+	TopicAcceptedAnswer bool `json:"topic_accepted_answer"`
+	CanAcceptAnswer     bool `json:"can_accept_answer"`
+	CanUnacceptAnswer   bool `json:"can_unaccept_answer"`
+}
+
+// ReplyToUser identifies the author of the post being replied to.
+type ReplyToUser struct {
+	Username       string `json:"username"`
+	Name           string `json:"name"`
+	AvatarTemplate string `json:"avatar_template"`
+}
+
+// PostReplyID is one entry from /posts/{id}/reply-ids.json.
+type PostReplyID struct {
+	ID    int `json:"id"`
+	Level int `json:"level"`
 }
 
 type PostResponse struct {
@@ -345,6 +397,9 @@ type Badge struct {
 	System      bool   `json:"system"`
 	Slug        string `json:"slug,omitempty"`
 	BadgeTypeID int    `json:"badge_type_id"`
+	// Trigger is what the badge is checked on, as Discourse's
+	// Badge::Trigger numbers it; 0 for badges granted another way.
+	Trigger     int    `json:"trigger"`
 }
 
 type BadgeListResponse struct {
@@ -367,6 +422,9 @@ type UserBadge struct {
 	BadgeID   int       `json:"badge_id"`
 	UserID    int       `json:"user_id"`
 	GrantedByID int     `json:"granted_by_id"`
+	// PostID and TopicID are the post a badge was granted for, if any.
+	PostID    *int      `json:"post_id,omitempty"`
+	TopicID   *int      `json:"topic_id,omitempty"`
 }
 
 type UserBadgeResponse struct {
@@ -378,11 +436,14 @@ type UserBadgeResponse struct {
 
 type Notification struct {
 	ID               int       `json:"id"`
+	UserID           int       `json:"user_id"`
 	NotificationType int       `json:"notification_type"`
 	Read             bool      `json:"read"`
+	HighPriority     bool      `json:"high_priority"`
 	CreatedAt        time.Time `json:"created_at"`
 	PostNumber       *int      `json:"post_number"`
 	TopicID          *int      `json:"topic_id"`
+	FancyTitle       string    `json:"fancy_title,omitempty"`
 	Slug             string    `json:"slug"`
 	Data             NotificationData `json:"data"`
 }
@@ -396,6 +457,13 @@ type NotificationData struct {
 	OriginalPostType int    `json:"original_post_type,omitempty"`
 	OriginalUsername string `json:"original_username,omitempty"`
 	DisplayUsername   string `json:"display_username,omitempty"`
+	RevisionNumber   int    `json:"revision_number,omitempty"`
+	GroupID          int    `json:"group_id,omitempty"`
+	GroupName        string `json:"group_name,omitempty"`
+	Username         string `json:"username,omitempty"`
+	Username2        string `json:"username2,omitempty"`
+	Count            int    `json:"count,omitempty"`
+	BadgeTitle       *bool  `json:"badge_title,omitempty"`
 }
 
 type NotificationListResponse struct {
@@ -485,7 +553,35 @@ type BackupListResponse []Backup
 type PostAction struct {
 	ID         int `json:"id"`
 	PostID     int `json:"post_id"`
+	UserID     int `json:"user_id"`
 	PostActionTypeID int `json:"post_action_type_id"`
+	CreatedAt  time.Time `json:"created_at"`
+	AgreedAt    *time.Time `json:"agreed_at,omitempty"`
+	DisagreedAt *time.Time `json:"disagreed_at,omitempty"`
+	DeferredAt  *time.Time `json:"deferred_at,omitempty"`
+}
+
+// ActionSummary is one entry of a post's actions_summary.
+type ActionSummary struct {
+	ID      int  `json:"id"`
+	Count   int  `json:"count"`
+	Acted   bool `json:"acted,omitempty"`
+	CanUndo bool `json:"can_undo,omitempty"`
+	CanAct  bool `json:"can_act,omitempty"`
+}
+
+// PostReaction counts one emoji reaction on a post.
+type PostReaction struct {
+	ID    string `json:"id"`
+	Type  string `json:"type"`
+	Count int    `json:"count"`
+}
+
+// CurrentUserReaction is the viewing user's own reaction to a post.
+type CurrentUserReaction struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	CanUndo bool   `json:"can_undo"`
 }
 
 type PostActionResponse struct {
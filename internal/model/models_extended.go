@@ -119,9 +119,34 @@ type EmailLog struct {
 	Bounced                  bool       `json:"bounced"`
 	HasBounceKey             bool       `json:"has_bounce_key"`
 	SMTPTransactionResponse  string     `json:"smtp_transaction_response,omitempty"`
+	SkippedReason            string     `json:"skipped_reason,omitempty"`
 	CreatedAt                time.Time  `json:"created_at"`
 }
 
+// IncomingEmail is one row from GET /admin/email/{received,rejected}.json.
+type IncomingEmail struct {
+	ID          int        `json:"id"`
+	CreatedAt   time.Time  `json:"created_at"`
+	FromAddress string     `json:"from_address"`
+	ToAddresses string     `json:"to_addresses"`
+	CCAddresses string     `json:"cc_addresses"`
+	Subject     string     `json:"subject"`
+	Error       string     `json:"error"`
+	PostURL     string     `json:"post_url,omitempty"`
+	User        *BasicUser `json:"user,omitempty"`
+}
+
+// IncomingEmailDetails is the shape returned by GET /admin/email/incoming/{id}.json.
+type IncomingEmailDetails struct {
+	ID               int    `json:"id"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+	RejectionMessage string `json:"rejection_message,omitempty"`
+	Headers          string `json:"headers"`
+	Subject          string `json:"subject"`
+	Body             string `json:"body"`
+}
+
 // ============================================================================
 // User Actions
 //
@@ -186,13 +211,22 @@ type Webhook struct {
 	VerifyCertificate   bool       `json:"verify_certificate"`
 	Active              bool       `json:"active"`
 	WebHookEventTypeIDs []int      `json:"web_hook_event_type_ids,omitempty"`
+	WebHookEventTypes   []WebHookEventType `json:"web_hook_event_types"`
 	Categories          []Category `json:"categories,omitempty"`
 	Tags                []Tag      `json:"tags,omitempty"`
+	TagNames            []string   `json:"tag_names"`
 	Groups              []Group    `json:"groups,omitempty"`
 	CreatedAt           time.Time  `json:"created_at,omitempty"`
 	UpdatedAt           time.Time  `json:"updated_at,omitempty"`
 }
 
+// WebHookEventType is an event a webhook can subscribe to.
+type WebHookEventType struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Group string `json:"group"`
+}
+
 // WebhookEvent is one delivery attempt recorded for a webhook.
 type WebhookEvent struct {
 	ID              int       `json:"id"`
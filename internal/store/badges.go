@@ -0,0 +1,336 @@
+package store
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lightcap/dtu-discourse/internal/model"
+	"github.com/lightcap/dtu-discourse/internal/webhook"
+)
+
+// The default badges, numbered as Discourse numbers them. Certified comes
+// from Discourse's new user tutorial plugin, so it takes the first id left
+// for badges that aren't built in.
+const (
+	BadgeBasic          = 1
+	BadgeMember         = 2
+	BadgeRegular        = 3
+	BadgeWelcome        = 5
+	BadgeNicePost       = 6
+	BadgeGoodPost       = 7
+	BadgeGreatPost      = 8
+	BadgeAutobiographer = 9
+	BadgeEditor         = 10
+	BadgeFirstLike      = 11
+	BadgeFirstShare     = 12
+	BadgeFirstFlag      = 13
+	BadgeNiceTopic      = 18
+	BadgeGoodTopic      = 19
+	BadgeGreatTopic     = 20
+	BadgeAnniversary    = 24
+	BadgeCertified      = 100
+)
+
+// Badge types and groupings.
+const (
+	BadgeTypeGold   = 1
+	BadgeTypeSilver = 2
+	BadgeTypeBronze = 3
+
+	groupingGettingStarted = 1
+	groupingCommunity      = 2
+	groupingPosting        = 3
+	groupingTrustLevel     = 4
+)
+
+// Badge triggers: the events a badge is checked on.
+const (
+	TriggerNone             = 0
+	TriggerPostAction       = 1
+	TriggerPostRevision     = 2
+	TriggerTrustLevelChange = 4
+	TriggerUserChange       = 8
+)
+
+// ErrBadgeDisabled is returned for granting a badge that isn't enabled.
+var ErrBadgeDisabled = errors.New("badge is not enabled")
+
+// trustLevelBadges are the badges for reaching each trust level.
+var trustLevelBadges = []struct{ level, badgeID int }{
+	{1, BadgeBasic}, {2, BadgeMember}, {3, BadgeRegular},
+}
+
+// likeBadges are the badges for a post reaching a number of likes: the
+// Topic badges for a topic's first post, the Post badges for the rest.
+var likeBadges = []struct{ likes, postBadgeID, topicBadgeID int }{
+	{10, BadgeNicePost, BadgeNiceTopic},
+	{25, BadgeGoodPost, BadgeGoodTopic},
+	{50, BadgeGreatPost, BadgeGreatTopic},
+}
+
+// seedBadges adds the default badges and grants the seeded users the
+// trust level badges they have earned, without notifying them.
+func (s *Store) seedBadges() {
+	for _, b := range []model.Badge{
+		{ID: BadgeBasic, Name: "Basic", Description: "Granted all essential community functions", BadgeTypeID: BadgeTypeBronze, BadgeGroupingID: groupingTrustLevel, Trigger: TriggerTrustLevelChange, Icon: "user"},
+		{ID: BadgeMember, Name: "Member", Description: "Granted invitations, group messaging, more likes", BadgeTypeID: BadgeTypeBronze, BadgeGroupingID: groupingTrustLevel, Trigger: TriggerTrustLevelChange, Icon: "user"},
+		{ID: BadgeRegular, Name: "Regular", Description: "Granted recategorize, rename, followed links, wiki, more likes", BadgeTypeID: BadgeTypeSilver, BadgeGroupingID: groupingTrustLevel, Trigger: TriggerTrustLevelChange, Icon: "user", AllowTitle: true},
+		{ID: BadgeWelcome, Name: "Welcome", Description: "Received a like", BadgeTypeID: BadgeTypeBronze, BadgeGroupingID: groupingGettingStarted, Trigger: TriggerPostAction, Icon: "heart"},
+		{ID: BadgeAutobiographer, Name: "Autobiographer", Description: "Filled out profile information", BadgeTypeID: BadgeTypeBronze, BadgeGroupingID: groupingGettingStarted, Trigger: TriggerUserChange, Icon: "user-pen"},
+		{ID: BadgeEditor, Name: "Editor", Description: "First post edit", BadgeTypeID: BadgeTypeBronze, BadgeGroupingID: groupingGettingStarted, Trigger: TriggerPostRevision, Icon: "pencil"},
+		{ID: BadgeFirstLike, Name: "First Like", Description: "Liked a post", BadgeTypeID: BadgeTypeBronze, BadgeGroupingID: groupingGettingStarted, Trigger: TriggerPostAction, Icon: "heart"},
+		{ID: BadgeFirstShare, Name: "First Share", Description: "Shared a post", BadgeTypeID: BadgeTypeBronze, BadgeGroupingID: groupingGettingStarted, Trigger: TriggerNone, Icon: "share-nodes"},
+		{ID: BadgeFirstFlag, Name: "First Flag", Description: "Flagged a post", BadgeTypeID: BadgeTypeBronze, BadgeGroupingID: groupingGettingStarted, Trigger: TriggerPostAction, Icon: "flag"},
+		{ID: BadgeNicePost, Name: "Nice Post", Description: "Received 10 likes on a post", BadgeTypeID: BadgeTypeBronze, BadgeGroupingID: groupingPosting, Trigger: TriggerPostAction, Icon: "heart", MultipleGrant: true},
+		{ID: BadgeGoodPost, Name: "Good Post", Description: "Received 25 likes on a post", BadgeTypeID: BadgeTypeSilver, BadgeGroupingID: groupingPosting, Trigger: TriggerPostAction, Icon: "heart", MultipleGrant: true},
+		{ID: BadgeGreatPost, Name: "Great Post", Description: "Received 50 likes on a post", BadgeTypeID: BadgeTypeGold, BadgeGroupingID: groupingPosting, Trigger: TriggerPostAction, Icon: "heart", MultipleGrant: true},
+		{ID: BadgeNiceTopic, Name: "Nice Topic", Description: "Received 10 likes on a topic", BadgeTypeID: BadgeTypeBronze, BadgeGroupingID: groupingPosting, Trigger: TriggerPostAction, Icon: "heart", MultipleGrant: true},
+		{ID: BadgeGoodTopic, Name: "Good Topic", Description: "Received 25 likes on a topic", BadgeTypeID: BadgeTypeSilver, BadgeGroupingID: groupingPosting, Trigger: TriggerPostAction, Icon: "heart", MultipleGrant: true},
+		{ID: BadgeGreatTopic, Name: "Great Topic", Description: "Received 50 likes on a topic", BadgeTypeID: BadgeTypeGold, BadgeGroupingID: groupingPosting, Trigger: TriggerPostAction, Icon: "heart", MultipleGrant: true},
+		{ID: BadgeAnniversary, Name: "Anniversary", Description: "Active member for a year, posted at least once", BadgeTypeID: BadgeTypeSilver, BadgeGroupingID: groupingCommunity, Trigger: TriggerNone, Icon: "far-clock", MultipleGrant: true},
+		{ID: BadgeCertified, Name: "Certified", Description: "Completed our new user tutorial", BadgeTypeID: BadgeTypeBronze, BadgeGroupingID: groupingGettingStarted, Trigger: TriggerNone, Icon: "certificate"},
+	} {
+		b.Slug = strings.ToLower(strings.ReplaceAll(b.Name, " ", "-"))
+		b.Enabled, b.Listable, b.System = true, true, true
+		s.Badges[b.ID] = &b
+	}
+	s.NextBadgeID = BadgeCertified + 1
+
+	for id := 1; id < s.NextUserID; id++ {
+		u := s.Users[id]
+		if u == nil {
+			continue
+		}
+		for _, tl := range trustLevelBadges {
+			if u.TrustLevel >= tl.level {
+				s.UserBadges[u.ID] = append(s.UserBadges[u.ID], &model.UserBadge{
+					ID: s.NextUserBadgeID, GrantedAt: u.CreatedAt, BadgeID: tl.badgeID,
+					UserID: u.ID, GrantedByID: -1,
+				})
+				s.NextUserBadgeID++
+				s.Badges[tl.badgeID].GrantCount++
+			}
+		}
+	}
+}
+
+// GrantUserBadge grants a badge to userID by hand. A badge that can only
+// be granted once is not granted again; the existing grant is returned.
+func (s *Store) GrantUserBadge(userID, badgeID int) (*model.UserBadge, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.Badges[badgeID]
+	if !ok {
+		return nil, errors.New("badge not found")
+	}
+	if !b.Enabled {
+		return nil, ErrBadgeDisabled
+	}
+	u := s.Users[userID]
+	if u == nil {
+		return nil, errors.New("user not found")
+	}
+	if !b.MultipleGrant {
+		for _, ub := range s.UserBadges[userID] {
+			if ub.BadgeID == badgeID {
+				cp := *ub
+				return &cp, nil
+			}
+		}
+	}
+	cp := *s.grantBadge(u, b, nil, 1)
+	return &cp, nil
+}
+
+// grantBadge grants b to u, for p if it isn't nil, telling u about it.
+// Caller must hold s.mu.
+func (s *Store) grantBadge(u *model.User, b *model.Badge, p *model.Post, grantedByID int) *model.UserBadge {
+	ub := &model.UserBadge{
+		ID: s.NextUserBadgeID, GrantedAt: time.Now().UTC(),
+		BadgeID: b.ID, UserID: u.ID, GrantedByID: grantedByID,
+	}
+	if p != nil {
+		postID, topicID := p.ID, p.TopicID
+		ub.PostID, ub.TopicID = &postID, &topicID
+	}
+	s.UserBadges[u.ID] = append(s.UserBadges[u.ID], ub)
+	b.GrantCount++
+	s.NextUserBadgeID++
+	s.alertBadgeGranted(u.ID, b)
+	s.gamify(webhook.GamificationPayload{DiscourseUserID: u.ID, Action: "badge_granted", DiscourseResourceID: b.ID}, ub.ID)
+	return ub
+}
+
+// awardBadge grants badge badgeID to userID automatically, for p if it
+// isn't nil, unless the badge is disabled or userID already has it. A
+// badge that may be granted more than once is granted once per post.
+// Caller must hold s.mu.
+func (s *Store) awardBadge(userID, badgeID int, p *model.Post) {
+	if s.earnsBadge(userID, badgeID, p) {
+		s.grantBadge(s.Users[userID], s.Badges[badgeID], p, -1)
+	}
+}
+
+// earnsBadge reports whether awarding userID badgeID for p would grant it.
+// Caller must hold s.mu, for reading at least.
+func (s *Store) earnsBadge(userID, badgeID int, p *model.Post) bool {
+	b, u := s.Badges[badgeID], s.Users[userID]
+	if b == nil || !b.Enabled || u == nil || u.ID <= 0 {
+		return false
+	}
+	for _, ub := range s.UserBadges[userID] {
+		if ub.BadgeID != badgeID {
+			continue
+		}
+		if !b.MultipleGrant || p == nil || (ub.PostID != nil && *ub.PostID == p.ID) {
+			return false
+		}
+	}
+	return true
+}
+
+// badgesOnTrustLevel grants u the badges for its trust level and those
+// below it.
+// Caller must hold s.mu.
+func (s *Store) badgesOnTrustLevel(u *model.User) {
+	for _, tl := range trustLevelBadges {
+		if u.TrustLevel >= tl.level {
+			s.awardBadge(u.ID, tl.badgeID, nil)
+		}
+	}
+}
+
+// badgesOnProfile grants Autobiographer once u has both an about me and
+// an uploaded avatar.
+// Caller must hold s.mu.
+func (s *Store) badgesOnProfile(u *model.User) {
+	if strings.TrimSpace(u.BioRaw) != "" && u.UploadedAvatarID != nil {
+		s.awardBadge(u.ID, BadgeAutobiographer, nil)
+	}
+}
+
+// badgesOnPostAction grants the badges for userID liking or flagging p:
+// First Like to the liker, Welcome to the author and the like count
+// badges for p, or First Flag to the flagger.
+// Caller must hold s.mu.
+func (s *Store) badgesOnPostAction(p *model.Post, userID, actionTypeID int) {
+	if IsFlagType(actionTypeID) {
+		s.awardBadge(userID, BadgeFirstFlag, p)
+		return
+	}
+	if actionTypeID != 2 {
+		return
+	}
+	s.awardBadge(userID, BadgeFirstLike, p)
+	if p.UserID == userID {
+		return
+	}
+	s.awardBadge(p.UserID, BadgeWelcome, p)
+	likes := 0
+	for _, pa := range s.PostActions {
+		if pa.PostID == p.ID && pa.PostActionTypeID == 2 {
+			likes++
+		}
+	}
+	for _, lb := range likeBadges {
+		if likes < lb.likes {
+			continue
+		}
+		if p.PostNumber == 1 {
+			s.awardBadge(p.UserID, lb.topicBadgeID, p)
+		} else {
+			s.awardBadge(p.UserID, lb.postBadgeID, p)
+		}
+	}
+}
+
+// badgesOnRevision grants Editor when the author of p edits it.
+// Caller must hold s.mu.
+func (s *Store) badgesOnRevision(p *model.Post, editorID int) {
+	if editorID == p.UserID {
+		s.awardBadge(editorID, BadgeEditor, p)
+	}
+}
+
+// badgesOnPost grants the author of p Anniversary, once a year, for
+// posting after a year or more of membership.
+// Caller must hold s.mu.
+func (s *Store) badgesOnPost(p *model.Post) {
+	u, b := s.Users[p.UserID], s.Badges[BadgeAnniversary]
+	if u == nil || u.ID <= 0 || b == nil || !b.Enabled {
+		return
+	}
+	yearAgo := time.Now().AddDate(-1, 0, 0)
+	if u.CreatedAt.After(yearAgo) {
+		return
+	}
+	for _, ub := range s.UserBadges[u.ID] {
+		if ub.BadgeID == BadgeAnniversary && (!b.MultipleGrant || ub.GrantedAt.After(yearAgo)) {
+			return
+		}
+	}
+	s.grantBadge(u, b, nil, -1)
+}
+
+// RecordShare notes that viewerID followed a link to a topic's post that
+// sharer shared, granting sharer First Share. Only a signed-in user
+// following someone else's link counts. Most views earn nothing, so they
+// only take the write lock when they do.
+func (s *Store) RecordShare(sharer string, viewerID, topicID, postNumber int) {
+	s.mu.RLock()
+	u, _ := s.shareTarget(sharer, viewerID, topicID, postNumber)
+	s.mu.RUnlock()
+	if u == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, p := s.shareTarget(sharer, viewerID, topicID, postNumber); u != nil {
+		s.awardBadge(u.ID, BadgeFirstShare, p)
+	}
+}
+
+// shareTarget returns the sharer and post First Share would be granted
+// for, or nil if the share earns nothing.
+// Caller must hold s.mu, for reading at least.
+func (s *Store) shareTarget(sharer string, viewerID, topicID, postNumber int) (*model.User, *model.Post) {
+	u := s.UsersByName[strings.ToLower(sharer)]
+	if u == nil || viewerID <= 0 || s.Users[viewerID] == nil || u.ID == viewerID {
+		return nil, nil
+	}
+	p := s.postByNumber(topicID, postNumber)
+	if p == nil || !s.earnsBadge(u.ID, BadgeFirstShare, p) {
+		return nil, nil
+	}
+	return u, p
+}
+
+// CompleteTutorial records that userID finished the new user tutorial,
+// granting Certified.
+func (s *Store) CompleteTutorial(userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Users[userID] == nil {
+		return errors.New("user not found")
+	}
+	s.awardBadge(userID, BadgeCertified, nil)
+	return nil
+}
+
+// PickAvatar sets the upload userID uses as their avatar, or goes back to
+// the letter avatar when uploadID is nil.
+func (s *Store) PickAvatar(userID int, uploadID *int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.Users[userID]
+	if u == nil {
+		return errors.New("user not found")
+	}
+	if uploadID != nil && s.Uploads[*uploadID] == nil {
+		return errors.New("upload not found")
+	}
+	u.UploadedAvatarID = uploadID
+	s.badgesOnProfile(u)
+	return nil
+}
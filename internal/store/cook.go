@@ -0,0 +1,86 @@
+package store
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/lightcap/dtu-discourse/internal/cook"
+)
+
+// cookResolver answers the cook package's lookups straight from the
+// store's maps. Callers must already hold s.mu.
+type cookResolver struct {
+	s *Store
+}
+
+// cook renders raw Markdown against the current forum state.
+// Caller must hold s.mu.
+func (s *Store) cook(raw string) string {
+	return cook.Cook(raw, cookResolver{s})
+}
+
+func (r cookResolver) User(username string) (string, bool) {
+	u := r.s.UsersByName[strings.ToLower(username)]
+	if u == nil {
+		return "", false
+	}
+	return u.AvatarTemplate, true
+}
+
+func (r cookResolver) Group(name string) bool {
+	for _, g := range r.s.Groups {
+		if strings.EqualFold(g.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r cookResolver) Category(slug string) (int, string, bool) {
+	c := r.s.CategoriesBySlug[strings.ToLower(slug)]
+	if c == nil {
+		return 0, "", false
+	}
+	return c.ID, c.Name, true
+}
+
+func (r cookResolver) Tag(name string) bool {
+	_, ok := r.s.Tags[strings.ToLower(name)]
+	return ok
+}
+
+func (r cookResolver) Upload(shortURL string) (string, bool) {
+	for _, up := range r.s.Uploads {
+		if up.ShortURL == shortURL {
+			return up.URL, true
+		}
+	}
+	return "", false
+}
+
+func (r cookResolver) Topic(id, postNumber int) (cook.TopicPreview, bool) {
+	t := r.s.Topics[id]
+	if t == nil || t.Archetype == "private_message" {
+		return cook.TopicPreview{}, false
+	}
+	preview := cook.TopicPreview{Title: t.Title, Slug: t.Slug}
+	if postNumber == 0 {
+		postNumber = 1
+	}
+	for _, p := range r.s.PostsByTopic[id] {
+		if p.PostNumber == postNumber {
+			preview.Username = p.Username
+			preview.Excerpt = cook.Excerpt(p.Cooked, 300)
+			break
+		}
+	}
+	return preview, true
+}
+
+func (r cookResolver) Host() string {
+	u, err := url.Parse(r.s.Outbox.BaseURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
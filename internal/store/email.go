@@ -0,0 +1,370 @@
+package store
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lightcap/dtu-discourse/internal/cook"
+	"github.com/lightcap/dtu-discourse/internal/mailer"
+	"github.com/lightcap/dtu-discourse/internal/model"
+)
+
+// Emails are rendered and put in s.Outbox while s.mu is held; the outbox
+// and the templates take no store locks.
+
+// Email token scopes.
+const (
+	EmailTokenSignup        = "signup"
+	EmailTokenPasswordReset = "password_reset"
+)
+
+// ErrInvalidEmailToken is returned for unknown, used or expired email
+// tokens.
+var ErrInvalidEmailToken = errors.New("Sorry, this link has expired or is invalid.")
+
+// EmailToken is a secret sent to a user's address to confirm it.
+type EmailToken struct {
+	Token     string
+	UserID    int
+	Email     string
+	Scope     string
+	Confirmed bool
+	CreatedAt time.Time
+}
+
+// notificationEmailTypes maps the notifications that are emailed to the
+// email type, which also names the template.
+var notificationEmailTypes = map[int]string{
+	NotificationMentioned:      "user_mentioned",
+	NotificationGroupMentioned: "user_group_mentioned",
+	NotificationReplied:        "user_replied",
+	NotificationPrivateMessage: "user_private_message",
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// emailVars are the placeholders every email template may use.
+// Caller must hold s.mu.
+func (s *Store) emailVars() map[string]string {
+	title := s.siteSettingString("title")
+	prefix := s.siteSettingString("email_prefix")
+	if prefix == "" {
+		prefix = title
+	}
+	host := "localhost"
+	if u, err := url.Parse(s.Outbox.BaseURL); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	return map[string]string{
+		"site_name": title, "site_title": title, "email_prefix": prefix,
+		"site_description": s.siteSettingString("site_description"),
+		"base_url":         s.Outbox.BaseURL, "site_domain_name": host,
+	}
+}
+
+// sendEmail renders templateID with vars into m and puts it in the
+// outbox, as skipped when skipReason is set or outgoing email is disabled
+// for the recipient.
+// Caller must hold s.mu.
+func (s *Store) sendEmail(m *mailer.Message, templateID string, vars map[string]string, skipReason string) mailer.Message {
+	all := s.emailVars()
+	for k, v := range vars {
+		all[k] = v
+	}
+	m.Subject, m.Text = s.EmailTemplates.Render(templateID, all)
+	m.HTML = s.emailHTML(m.Text)
+	if m.From == "" {
+		m.From = mailer.FromAddress(all["site_name"], s.siteSettingString("notification_email"))
+	}
+	if skipReason == "" {
+		skipReason = s.emailSkipReason(m)
+	}
+	m.SkippedReason = skipReason
+	return s.Outbox.Add(m)
+}
+
+// emailHTML renders an email's Markdown text as its HTML part.
+// Caller must hold s.mu.
+func (s *Store) emailHTML(text string) string {
+	return "<html><body>\n" + s.cook(text) + "\n</body></html>"
+}
+
+// emailSkipReason says why m must not be sent, or "".
+// Caller must hold s.mu.
+func (s *Store) emailSkipReason(m *mailer.Message) string {
+	if m.To == "" {
+		return "The email has no recipient address."
+	}
+	switch s.siteSettingString("disable_emails") {
+	case "yes":
+		return "Outgoing email is disabled (disable_emails)."
+	case "non-staff":
+		if u := s.Users[m.UserID]; u == nil || !isStaff(u) {
+			return "Outgoing email to non-staff users is disabled (disable_emails)."
+		}
+	}
+	return ""
+}
+
+// createEmailToken issues a token confirming u's address for scope.
+// Caller must hold s.mu.
+func (s *Store) createEmailToken(u *model.User, scope string) string {
+	t := &EmailToken{
+		Token: randomHex(16), UserID: u.ID, Email: u.Email, Scope: scope, CreatedAt: time.Now().UTC(),
+	}
+	s.EmailTokens[t.Token] = t
+	return t.Token
+}
+
+// confirmEmailToken uses up a valid token of scope and returns its user.
+// Caller must hold s.mu.
+func (s *Store) confirmEmailToken(token, scope string) (*model.User, error) {
+	t := s.EmailTokens[token]
+	valid := time.Duration(s.siteSettingInt("email_token_valid_hours")) * time.Hour
+	if t == nil || t.Scope != scope || t.Confirmed || time.Since(t.CreatedAt) > valid {
+		return nil, ErrInvalidEmailToken
+	}
+	u := s.Users[t.UserID]
+	if u == nil || !strings.EqualFold(u.Email, t.Email) {
+		return nil, ErrInvalidEmailToken
+	}
+	t.Confirmed = true
+	return u, nil
+}
+
+// emailSignup sends u the link that activates their account.
+// Caller must hold s.mu.
+func (s *Store) emailSignup(u *model.User) {
+	token := s.createEmailToken(u, EmailTokenSignup)
+	s.sendEmail(&mailer.Message{EmailType: "signup", To: u.Email, UserID: u.ID},
+		"user_notifications.signup", map[string]string{"email_token": token}, "")
+}
+
+// SendActivationEmail sends the named inactive user a new activation link.
+func (s *Store) SendActivationEmail(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.UsersByName[strings.ToLower(username)]
+	if u == nil {
+		return fmt.Errorf("user not found")
+	}
+	if u.Active {
+		return fmt.Errorf("Your account is already activated.")
+	}
+	s.emailSignup(u)
+	return nil
+}
+
+// ActivateAccount activates the account a signup token was sent for.
+func (s *Store) ActivateAccount(token string) (*model.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, err := s.confirmEmailToken(token, EmailTokenSignup)
+	if err != nil {
+		return nil, err
+	}
+	u.Active = true
+	s.userWebHook("user_confirmed_email", u)
+	cp := *u
+	return &cp, nil
+}
+
+// ForgotPassword sends a password reset link to the user with login as
+// their username or email, reporting whether there was one.
+func (s *Store) ForgotPassword(login string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.UsersByName[strings.ToLower(login)]
+	if u == nil {
+		u = s.UsersByEmail[login]
+	}
+	if u == nil || u.ID <= 0 {
+		return false
+	}
+	token := s.createEmailToken(u, EmailTokenPasswordReset)
+	s.sendEmail(&mailer.Message{EmailType: "forgot_password", To: u.Email, UserID: u.ID},
+		"user_notifications.forgot_password", map[string]string{"email_token": token}, "")
+	return true
+}
+
+// ResetPassword sets a new password with a password reset token. Using
+// the emailed link also confirms the address, so the account becomes
+// active.
+func (s *Store) ResetPassword(token, password string) (*model.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t := s.EmailTokens[token]; t == nil || t.Scope != EmailTokenPasswordReset {
+		return nil, ErrInvalidEmailToken
+	}
+	if min := s.siteSettingInt("min_password_length"); len(password) < min {
+		return nil, fmt.Errorf("Password is too short (minimum is %d characters)", min)
+	}
+	u, err := s.confirmEmailToken(token, EmailTokenPasswordReset)
+	if err != nil {
+		return nil, err
+	}
+	u.Active = true
+	cp := *u
+	return &cp, nil
+}
+
+// emailInvite sends inv to its address on behalf of inviter, inviting
+// them to t when set.
+// Caller must hold s.mu.
+func (s *Store) emailInvite(inv *model.Invite, inviter *model.User, t *model.Topic) {
+	vars := map[string]string{"invite_link": s.Outbox.BaseURL + inv.Link, "inviter_name": "Someone"}
+	if inviter != nil {
+		vars["inviter_name"] = inviter.Username
+	}
+	templateID := "invite_forum_mailer"
+	if t != nil {
+		templateID = "invite_mailer"
+		vars["topic_title"] = t.Title
+		if first := s.postByNumber(t.ID, 1); first != nil {
+			vars["topic_excerpt"] = cook.Excerpt(first.Cooked, 200)
+		}
+	}
+	m := &mailer.Message{EmailType: "invite", To: inv.Email}
+	if t != nil {
+		m.TopicID = t.ID
+	}
+	s.sendEmail(m, templateID, vars, "")
+}
+
+// emailNotification emails n to its user when it is one of the
+// notifications Discourse emails. Replies to the email reach the topic
+// through the message's reply key.
+// Caller must hold s.mu.
+func (s *Store) emailNotification(n *model.Notification) {
+	emailType, ok := notificationEmailTypes[n.NotificationType]
+	u := s.Users[n.UserID]
+	p := s.Posts[n.Data.OriginalPostID]
+	if !ok || u == nil || p == nil {
+		return
+	}
+	t := s.Topics[p.TopicID]
+	if t == nil {
+		return
+	}
+	postURL := fmt.Sprintf("/t/%s/%d/%d", t.Slug, t.ID, p.PostNumber)
+	m := &mailer.Message{
+		EmailType: emailType, To: u.Email, UserID: u.ID, PostID: p.ID, TopicID: t.ID,
+		ReplyKey: randomHex(16),
+		Headers: map[string]string{
+			"X-Discourse-Post-Id":      fmt.Sprint(p.ID),
+			"X-Discourse-Topic-Id":     fmt.Sprint(t.ID),
+			"Auto-Submitted":           "auto-generated",
+			"X-Auto-Response-Suppress": "All",
+			"List-Unsubscribe":         "<" + s.Outbox.BaseURL + "/email/unsubscribe/" + randomHex(16) + ">",
+		},
+	}
+	respond := fmt.Sprintf("[Visit Topic](%s%s) to respond.", s.Outbox.BaseURL, postURL)
+	if address := s.siteSettingString("reply_by_email_address"); s.siteSettingBool("reply_by_email_enabled") && strings.Contains(address, "%{reply_key}") {
+		m.ReplyTo = strings.ReplaceAll(address, "%{reply_key}", m.ReplyKey)
+		respond = fmt.Sprintf("[Visit Topic](%s%s) or reply to this email to respond.", s.Outbox.BaseURL, postURL)
+	}
+	if poster := s.Users[p.UserID]; poster != nil {
+		m.From = mailer.FromAddress(poster.Username+" via "+s.siteSettingString("title"), s.siteSettingString("notification_email"))
+	}
+	skip := ""
+	if u.Suspended && n.NotificationType != NotificationPrivateMessage {
+		skip = "The user is suspended and the email is not a message."
+	}
+	sent := s.sendEmail(m, "user_notifications."+emailType, map[string]string{
+		"topic_title": t.Title, "message": p.Raw, "username": p.Username,
+		"post_url": postURL, "respond_instructions": respond,
+	}, skip)
+	s.ReplyKeys[sent.ReplyKey] = &PostReplyKey{
+		Key: sent.ReplyKey, UserID: u.ID, PostID: p.ID, MessageID: sent.MessageID, CreatedAt: sent.CreatedAt,
+	}
+}
+
+// SendTestEmail sends the deliverability test email to address.
+func (s *Store) SendTestEmail(address string) mailer.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := &mailer.Message{EmailType: "test_message", To: address}
+	if u := s.UsersByEmail[address]; u != nil {
+		m.UserID = u.ID
+	}
+	return s.sendEmail(m, "test_mailer", nil, "")
+}
+
+// digestVars lists the topics created since since that userID can see
+// and didn't start, newest first, for the digest template. ok is false
+// when there are none.
+// Caller must hold s.mu.
+func (s *Store) digestVars(u *model.User, since time.Time) (map[string]string, bool) {
+	var topics []*model.Topic
+	for _, t := range s.Topics {
+		if t.Archetype == "private_message" || !t.CreatedAt.After(since) {
+			continue
+		}
+		if first := s.postByNumber(t.ID, 1); first != nil && first.UserID == u.ID {
+			continue
+		}
+		if c := s.Categories[t.CategoryID]; c != nil && s.categoryPermission(c, u) == 0 {
+			continue
+		}
+		topics = append(topics, t)
+	}
+	sort.Slice(topics, func(i, j int) bool { return topics[i].CreatedAt.After(topics[j].CreatedAt) })
+	if max := s.siteSettingInt("digest_topics"); max > 0 && len(topics) > max {
+		topics = topics[:max]
+	}
+	lines := make([]string, 0, len(topics))
+	for _, t := range topics {
+		lines = append(lines, fmt.Sprintf("- [%s](%s/t/%s/%d) (%d replies)", t.Title, s.Outbox.BaseURL, t.Slug, t.ID, t.ReplyCount))
+	}
+	return map[string]string{
+		"topics": strings.Join(lines, "\n"), "last_seen_at": since.Format("January 2, 2006"),
+		"unsubscribe_url": s.Outbox.BaseURL + "/email/unsubscribe/" + randomHex(16),
+	}, len(topics) > 0
+}
+
+// SendDigest emails userID a summary of the topics created since since,
+// to address or else their own. A digest with no topics is skipped.
+func (s *Store) SendDigest(userID int, address string, since time.Time) (mailer.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.Users[userID]
+	if u == nil {
+		return mailer.Message{}, fmt.Errorf("user not found")
+	}
+	if address == "" {
+		address = u.Email
+	}
+	vars, ok := s.digestVars(u, since)
+	skip := ""
+	if !ok {
+		skip = "The digest had no new topics."
+	}
+	return s.sendEmail(&mailer.Message{EmailType: "digest", To: address, UserID: u.ID}, "user_notifications.digest", vars, skip), nil
+}
+
+// PreviewDigest renders userID's digest since since without sending it.
+func (s *Store) PreviewDigest(userID int, since time.Time) (html, text string, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u := s.Users[userID]
+	if u == nil {
+		return "", "", fmt.Errorf("user not found")
+	}
+	vars, _ := s.digestVars(u, since)
+	all := s.emailVars()
+	for k, v := range vars {
+		all[k] = v
+	}
+	_, text = s.EmailTemplates.Render("user_notifications.digest", all)
+	return s.emailHTML(text), text, nil
+}
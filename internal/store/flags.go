@@ -0,0 +1,272 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lightcap/dtu-discourse/internal/model"
+)
+
+// Post action types that flag a post for review.
+const (
+	FlagOffTopic         = 3
+	FlagInappropriate    = 4
+	FlagNotifyModerators = 7
+	FlagSpam             = 8
+)
+
+// Reviewable statuses.
+const (
+	ReviewablePending  = 0
+	ReviewableApproved = 1
+	ReviewableRejected = 2
+	ReviewableIgnored  = 3
+)
+
+// ReviewableScore statuses.
+const (
+	ScorePending   = 0
+	ScoreAgreed    = 1
+	ScoreDisagreed = 2
+	ScoreIgnored   = 3
+)
+
+var (
+	// ErrCannotFlag is returned when a user flags their own post.
+	ErrCannotFlag = errors.New("you can't flag your own post")
+	// ErrInvalidReviewAction is returned for actions a reviewable doesn't
+	// offer in its current state.
+	ErrInvalidReviewAction = errors.New("invalid action for this reviewable")
+)
+
+// IsFlagType reports whether a post action type is a flag.
+func IsFlagType(actionTypeID int) bool {
+	switch actionTypeID {
+	case FlagOffTopic, FlagInappropriate, FlagNotifyModerators, FlagSpam:
+		return true
+	}
+	return false
+}
+
+// flagScore weighs a flag by the flagger's standing: staff flags count
+// for 5, everyone else 1 plus half a point per trust level.
+func flagScore(u *model.User) float64 {
+	if u.Admin || u.Moderator {
+		return 5
+	}
+	return 1 + 0.5*float64(u.TrustLevel)
+}
+
+// FlagPost records userID flagging a post and adds the flag's score to the
+// post's ReviewableFlaggedPost, reopening it if it was already resolved.
+// The post is hidden once the pending score reaches score_to_hide_post.
+func (es *ExtStore) FlagPost(postID, userID, flagType int, message string) (*model.PostAction, *Reviewable, error) {
+	es.Store.mu.Lock()
+	defer es.Store.mu.Unlock()
+	p, ok := es.Posts[postID]
+	if !ok {
+		return nil, nil, fmt.Errorf("post not found")
+	}
+	u := es.Users[userID]
+	if u == nil {
+		return nil, nil, fmt.Errorf("user not found")
+	}
+	if p.UserID == userID {
+		return nil, nil, ErrCannotFlag
+	}
+	for _, pa := range es.PostActions {
+		if pa.PostID == postID && pa.UserID == userID && IsFlagType(pa.PostActionTypeID) {
+			return nil, nil, ErrAlreadyActed
+		}
+	}
+	return es.flagPost(p, u, flagType, message)
+}
+
+// flagPost records the flag and updates the post's reviewable.
+// Caller must hold es.Store.mu; es.mu is taken here.
+func (es *ExtStore) flagPost(p *model.Post, u *model.User, flagType int, message string) (*model.PostAction, *Reviewable, error) {
+	userID := u.ID
+	pa, err := es.createPostAction(p.ID, userID, flagType)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	now := time.Now().UTC()
+	r := es.reviewableFor(p)
+	event := "reviewable_updated"
+	if r == nil {
+		event = "reviewable_created"
+		r = &Reviewable{
+			ID: es.NextReviewableID, Type: "ReviewableFlaggedPost",
+			CreatedByID: userID, TargetID: p.ID, TargetType: "Post",
+			TopicID: p.TopicID, CreatedAt: now,
+		}
+		if t := es.Topics[p.TopicID]; t != nil {
+			r.CategoryID = t.CategoryID
+		}
+		es.Reviewables[r.ID] = r
+		es.NextReviewableID++
+	}
+	r.Status = ReviewablePending
+	r.Version++
+	r.UpdatedAt = now
+	r.Scores = append(r.Scores, ReviewableScore{
+		ID: len(r.Scores) + 1, UserID: userID, ReviewableScoreType: flagType,
+		Score: flagScore(u), Status: ScorePending, Reason: message, CreatedAt: now,
+	})
+	r.Score = pendingScore(r)
+
+	if threshold := es.siteSettingInt("score_to_hide_post"); threshold > 0 && r.Score >= float64(threshold) {
+		es.setPostHidden(p, true)
+	}
+	es.reviewableWebHook(event, r)
+	cp := *r
+	return pa, &cp, nil
+}
+
+// UnflagPost withdraws userID's flag on a post within the undo window,
+// removing its score and dropping the reviewable once nothing is left.
+func (es *ExtStore) UnflagPost(postID, userID, flagType int) error {
+	es.Store.mu.Lock()
+	defer es.Store.mu.Unlock()
+	if err := es.deletePostAction(postID, userID, flagType); err != nil {
+		return err
+	}
+	p := es.Posts[postID]
+	if p == nil {
+		return nil
+	}
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	r := es.reviewableFor(p)
+	if r == nil {
+		return nil
+	}
+	scores := make([]ReviewableScore, 0, len(r.Scores))
+	for _, sc := range r.Scores {
+		if sc.UserID == userID && sc.ReviewableScoreType == flagType && sc.Status == ScorePending {
+			continue
+		}
+		scores = append(scores, sc)
+	}
+	if len(scores) == 0 {
+		delete(es.Reviewables, r.ID)
+		return nil
+	}
+	r.Scores = scores
+	r.Score = pendingScore(r)
+	r.UpdatedAt = time.Now().UTC()
+	return nil
+}
+
+// PerformReviewable resolves a pending flagged post on behalf of reviewerID:
+//   - agree_and_keep: flags are agreed with and the post stays visible
+//   - agree_and_hide: flags are agreed with and the post is hidden
+//   - disagree: flags are rejected and the post is restored
+//   - ignore: flags are set aside and the post is left as it is
+//
+// Queued posts take approve_post and reject_post instead.
+func (es *ExtStore) PerformReviewable(id, reviewerID int, action string) (*Reviewable, error) {
+	es.Store.mu.Lock()
+	defer es.Store.mu.Unlock()
+	es.mu.RLock()
+	r, ok := es.Reviewables[id]
+	queued := ok && r.Status == ReviewablePending && r.Type == "ReviewableQueuedPost"
+	es.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("reviewable not found")
+	}
+	if queued {
+		rv, _, err := es.performQueuedPost(r, reviewerID, action)
+		return rv, err
+	}
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if r.Status != ReviewablePending || r.Type != "ReviewableFlaggedPost" {
+		return nil, ErrInvalidReviewAction
+	}
+	var status, scoreStatus int
+	switch action {
+	case "agree_and_keep", "agree_and_hide":
+		status, scoreStatus = ReviewableApproved, ScoreAgreed
+	case "disagree":
+		status, scoreStatus = ReviewableRejected, ScoreDisagreed
+	case "ignore", "ignore_and_do_nothing":
+		status, scoreStatus = ReviewableIgnored, ScoreIgnored
+	default:
+		return nil, ErrInvalidReviewAction
+	}
+
+	now := time.Now().UTC()
+	p := es.Posts[r.TargetID]
+	if p != nil {
+		switch action {
+		case "agree_and_keep", "disagree":
+			es.setPostHidden(p, false)
+		case "agree_and_hide":
+			es.setPostHidden(p, true)
+		}
+	}
+
+	// Mark each pending flag, and the flagger's post action, with the outcome.
+	scores := make([]ReviewableScore, len(r.Scores))
+	for i, sc := range r.Scores {
+		if sc.Status == ScorePending {
+			sc.Status = scoreStatus
+			sc.ReviewedByID = &reviewerID
+			sc.ReviewedAt = &now
+			if pa := es.findPostAction(r.TargetID, sc.UserID, sc.ReviewableScoreType); pa != nil {
+				switch scoreStatus {
+				case ScoreAgreed:
+					pa.AgreedAt = &now
+				case ScoreDisagreed:
+					pa.DisagreedAt = &now
+				case ScoreIgnored:
+					pa.DeferredAt = &now
+				}
+			}
+		}
+		scores[i] = sc
+	}
+	r.Scores = scores
+	r.Status = status
+	r.Score = 0
+	r.Version++
+	r.UpdatedAt = now
+	es.reviewableWebHook("reviewable_updated", r)
+	cp := *r
+	return &cp, nil
+}
+
+// reviewableFor finds the flagged-post reviewable targeting p.
+// Caller must hold es.mu.
+func (es *ExtStore) reviewableFor(p *model.Post) *Reviewable {
+	for _, r := range es.Reviewables {
+		if r.Type == "ReviewableFlaggedPost" && r.TargetType == "Post" && r.TargetID == p.ID {
+			return r
+		}
+	}
+	return nil
+}
+
+// setPostHidden hides or restores a post; hiding a topic's first post
+// hides the topic too. Caller must hold es.Store.mu.
+func (es *ExtStore) setPostHidden(p *model.Post, hidden bool) {
+	p.Hidden = hidden
+	if t := es.Topics[p.TopicID]; t != nil && p.PostNumber == 1 {
+		t.Visible = !hidden
+	}
+}
+
+func pendingScore(r *Reviewable) float64 {
+	var total float64
+	for _, sc := range r.Scores {
+		if sc.Status == ScorePending {
+			total += sc.Score
+		}
+	}
+	return total
+}
@@ -0,0 +1,239 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lightcap/dtu-discourse/internal/model"
+	"github.com/lightcap/dtu-discourse/internal/webhook"
+)
+
+// Gamification events go to s.Gamification while s.mu is held, so each
+// user's events are dispatched in the order they happened. Every event has
+// an id derived from what it is about, e.g. post_created:42, so a receiver
+// can tell a retried event from a new one. When the same thing happens
+// again, e.g. a post is liked, unliked and liked again, the id gets a
+// #n suffix. Undoing something sends a reversal whose reversesEventId is
+// the id of the event undone: post_deleted and topic_deleted undo
+// post_created and topic_created, and <action>_reversed undoes the rest.
+
+// gamify dispatches p with an id based on key, returning the id.
+// Caller must hold s.mu.
+func (s *Store) gamify(p webhook.GamificationPayload, key ...interface{}) string {
+	if s.Gamification == nil || p.DiscourseUserID <= 0 {
+		return ""
+	}
+	base := gamificationKey(p.Action, key)
+	s.gamificationIDs[base]++
+	p.EventID = base
+	if n := s.gamificationIDs[base]; n > 1 {
+		p.EventID = fmt.Sprintf("%s#%d", base, n)
+	}
+	s.Gamification.Dispatch(p)
+	return p.EventID
+}
+
+// gamifyReversal dispatches a reversal of the last action event about key,
+// if one was sent.
+// Caller must hold s.mu.
+func (s *Store) gamifyReversal(reversal string, p webhook.GamificationPayload, key ...interface{}) {
+	reverses := s.lastGamificationID(p.Action, key...)
+	if reverses == "" {
+		return
+	}
+	p.Action, p.ReversesEventID = reversal, reverses
+	s.gamify(p, key...)
+}
+
+// lastGamificationID is the id of the last action event about key, or ""
+// if none was sent.
+// Caller must hold s.mu.
+func (s *Store) lastGamificationID(action string, key ...interface{}) string {
+	base := gamificationKey(action, key)
+	switch n := s.gamificationIDs[base]; n {
+	case 0:
+		return ""
+	case 1:
+		return base
+	default:
+		return fmt.Sprintf("%s#%d", base, n)
+	}
+}
+
+func gamificationKey(action string, key []interface{}) string {
+	parts := []string{action}
+	for _, k := range key {
+		parts = append(parts, fmt.Sprint(k))
+	}
+	return strings.Join(parts, ":")
+}
+
+// counterparty is userID as a payload's counterparty, or nil for nobody
+// or the system user.
+func counterparty(userID int) *int {
+	if userID <= 0 {
+		return nil
+	}
+	return &userID
+}
+
+// gamifyPostCreated dispatches topic_created or post_created for p, and
+// reply_received to the author of the post it replies to.
+// Caller must hold s.mu.
+func (s *Store) gamifyPostCreated(p *model.Post) {
+	if p.PostNumber == 1 {
+		s.gamify(webhook.GamificationPayload{DiscourseUserID: p.UserID, Action: "topic_created", DiscourseResourceID: p.TopicID}, p.TopicID)
+		return
+	}
+	s.gamify(webhook.GamificationPayload{DiscourseUserID: p.UserID, Action: "post_created", DiscourseResourceID: p.ID}, p.ID)
+	if parent := s.repliedToAuthor(p); parent != p.UserID {
+		s.gamify(webhook.GamificationPayload{
+			DiscourseUserID: parent, Action: "reply_received",
+			DiscourseResourceID: p.ID, CounterpartyDiscourseUserID: counterparty(p.UserID),
+		}, p.ID)
+	}
+}
+
+// gamifyPostDeleted reverses what gamifyPostCreated sent for p. The
+// first post stands for its topic, which only deleting the topic undoes.
+// Caller must hold s.mu.
+func (s *Store) gamifyPostDeleted(p *model.Post) {
+	if p.PostNumber == 1 {
+		return
+	}
+	s.gamifyReversal("post_deleted", webhook.GamificationPayload{DiscourseUserID: p.UserID, Action: "post_created", DiscourseResourceID: p.ID}, p.ID)
+	if parent := s.repliedToAuthor(p); parent != p.UserID {
+		s.gamifyReversal("reply_received_reversed", webhook.GamificationPayload{
+			DiscourseUserID: parent, Action: "reply_received",
+			DiscourseResourceID: p.ID, CounterpartyDiscourseUserID: counterparty(p.UserID),
+		}, p.ID)
+	}
+}
+
+// gamifyTopicDeleted reverses topic_created for t, whose first post
+// firstPosterID wrote, and what was sent for each of its replies.
+// Caller must hold s.mu.
+func (s *Store) gamifyTopicDeleted(t *model.Topic, firstPosterID int) {
+	for _, p := range s.PostsByTopic[t.ID] {
+		s.gamifyPostDeleted(p)
+	}
+	s.gamifyReversal("topic_deleted", webhook.GamificationPayload{DiscourseUserID: firstPosterID, Action: "topic_created", DiscourseResourceID: t.ID}, t.ID)
+}
+
+// repliedToAuthor is the author of the post p replies to, or of the
+// topic's first post when p replies to the topic.
+// Caller must hold s.mu.
+func (s *Store) repliedToAuthor(p *model.Post) int {
+	number := 1
+	if p.ReplyToPostNumber != nil {
+		number = *p.ReplyToPostNumber
+	}
+	if parent := s.postByNumber(p.TopicID, number); parent != nil {
+		return parent.UserID
+	}
+	return 0
+}
+
+// gamifyPostEdited dispatches post_edited to p's author for its current
+// version, with the editor as counterparty when someone else edited it.
+// Caller must hold s.mu.
+func (s *Store) gamifyPostEdited(p *model.Post, editorID int) {
+	payload := webhook.GamificationPayload{DiscourseUserID: p.UserID, Action: "post_edited", DiscourseResourceID: p.ID}
+	if editorID != p.UserID {
+		payload.CounterpartyDiscourseUserID = counterparty(editorID)
+	}
+	s.gamify(payload, p.ID, p.Version)
+}
+
+// gamifySolution dispatches solution_accepted to p's author, accepted by
+// accepterID, or its reversal when undo is set.
+// Caller must hold s.mu.
+func (s *Store) gamifySolution(p *model.Post, accepterID int, undo bool) {
+	payload := webhook.GamificationPayload{
+		DiscourseUserID: p.UserID, Action: "solution_accepted",
+		DiscourseResourceID: p.ID, CounterpartyDiscourseUserID: counterparty(accepterID),
+	}
+	if undo {
+		s.gamifyReversal("solution_accepted_reversed", payload, p.ID)
+		return
+	}
+	s.gamify(payload, p.ID)
+}
+
+// gamifyUserCreated dispatches user_created for u.
+// Caller must hold s.mu.
+func (s *Store) gamifyUserCreated(u *model.User) {
+	s.gamify(webhook.GamificationPayload{DiscourseUserID: u.ID, Action: "user_created", DiscourseResourceID: u.ID}, u.ID)
+}
+
+// gamifyReaction dispatches reaction_given to userID and
+// reaction_received to the author of p, or their reversals when undo is
+// set.
+// Caller must hold s.mu.
+func (s *Store) gamifyReaction(p *model.Post, userID int, undo bool) {
+	given := webhook.GamificationPayload{DiscourseUserID: userID, Action: "reaction_given", DiscourseResourceID: p.ID}
+	received := webhook.GamificationPayload{
+		DiscourseUserID: p.UserID, Action: "reaction_received",
+		DiscourseResourceID: p.ID, CounterpartyDiscourseUserID: counterparty(userID),
+	}
+	if undo {
+		s.gamifyReversal("reaction_received_reversed", received, p.ID, userID)
+		s.gamifyReversal("reaction_given_reversed", given, p.ID, userID)
+		return
+	}
+	s.gamify(received, p.ID, userID)
+	s.gamify(given, p.ID, userID)
+}
+
+// gamifyPollVote dispatches poll_voted to userID for a post's poll, or
+// its reversal when undo is set.
+// Caller must hold s.mu.
+func (s *Store) gamifyPollVote(postID int, name string, userID int, undo bool) {
+	payload := webhook.GamificationPayload{DiscourseUserID: userID, Action: "poll_voted", DiscourseResourceID: postID}
+	if undo {
+		s.gamifyReversal("poll_voted_reversed", payload, postID, name, userID)
+		return
+	}
+	s.gamify(payload, postID, name, userID)
+}
+
+// gamifyBookmark dispatches bookmark_created for b, or its reversal when
+// undo is set.
+// Caller must hold s.mu.
+func (s *Store) gamifyBookmark(b *Bookmark, undo bool) {
+	payload := webhook.GamificationPayload{DiscourseUserID: b.UserID, Action: "bookmark_created", DiscourseResourceID: b.BookmarkableID}
+	if undo {
+		s.gamifyReversal("bookmark_created_reversed", payload, b.ID)
+		return
+	}
+	s.gamify(payload, b.ID)
+}
+
+// RecordVisit notes that userID made an authenticated request, moving
+// their LastSeenAt on at most once each UTC day. It sends first_visit if
+// they had never been seen before and daily_visit once each UTC day.
+func (s *Store) RecordVisit(userID int) {
+	if userID <= 0 {
+		return
+	}
+	now := time.Now().UTC()
+	today := now.Format("2006-01-02")
+	s.mu.RLock()
+	u := s.Users[userID]
+	seen := u == nil || u.LastSeenAt.UTC().Format("2006-01-02") == today
+	s.mu.RUnlock()
+	if seen {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u = s.Users[userID]; u == nil || u.LastSeenAt.UTC().Format("2006-01-02") == today {
+		return
+	}
+	if u.LastSeenAt.IsZero() {
+		s.gamify(webhook.GamificationPayload{DiscourseUserID: userID, Action: "first_visit", DiscourseResourceID: userID}, userID)
+	}
+	u.LastSeenAt = now
+	s.gamify(webhook.GamificationPayload{DiscourseUserID: userID, Action: "daily_visit", DiscourseResourceID: today}, userID, today)
+}
@@ -0,0 +1,279 @@
+package store
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lightcap/dtu-discourse/internal/mailer"
+	"github.com/lightcap/dtu-discourse/internal/model"
+)
+
+// PostReplyKey ties the reply key of a notification email to the post it
+// was about and the user it was sent to, so a reply reaches the topic.
+type PostReplyKey struct {
+	Key       string
+	UserID    int
+	PostID    int
+	MessageID string
+	CreatedAt time.Time
+}
+
+// IncomingEmail is an email received through handle_mail and what became
+// of it: a post, or the error it was rejected with.
+type IncomingEmail struct {
+	ID               int
+	MessageID        string
+	From             string
+	To               []string
+	CC               []string
+	Subject          string
+	Header           string
+	Body             string
+	UserID           int
+	PostID           int
+	TopicID          int
+	PostURL          string
+	Error            string
+	ErrorDescription string
+	CreatedAt        time.Time
+}
+
+// The errors incoming emails are rejected with, named after the
+// Email::Receiver exceptions Discourse records.
+const (
+	emailErrEmpty             = "Email::Receiver::EmptyEmailError"
+	emailErrAutoGenerated     = "Email::Receiver::AutoGeneratedEmailError"
+	emailErrNoBody            = "Email::Receiver::NoBodyDetectedError"
+	emailErrBadDestination    = "Email::Receiver::BadDestinationAddress"
+	emailErrReplyUserMismatch = "Email::Receiver::ReplyUserNotMatchingError"
+	emailErrStrangers         = "Email::Receiver::StrangersNotAllowedError"
+	emailErrUserNotFound      = "Email::Receiver::UserNotFoundError"
+	emailErrInactiveUser      = "Email::Receiver::InactiveUserError"
+	emailErrSilencedUser      = "Email::Receiver::SilencedUserError"
+	emailErrTrustLevel        = "Email::Receiver::InsufficientTrustLevelError"
+	emailErrTopicNotFound     = "Email::Receiver::TopicNotFoundError"
+	emailErrTopicClosed       = "Email::Receiver::TopicClosedError"
+	emailErrInvalidPost       = "Email::Receiver::InvalidPost"
+)
+
+// rejectEmail records why in was not turned into a post.
+func rejectEmail(in *IncomingEmail, name, description string) {
+	in.Error, in.ErrorDescription = name, description
+}
+
+// ReceiveEmail turns a raw email into a post as Discourse's
+// Email::Receiver does: a reply when it is addressed to a notification's
+// reply key or answers its Message-ID, a new topic when it is addressed
+// to a category's email_in address. The quoted message and signature are
+// stripped first. Unknown senders may only start topics, as staged users,
+// in categories that allow strangers. The email is recorded either way.
+func (es *ExtStore) ReceiveEmail(raw string) IncomingEmail {
+	es.Store.mu.Lock()
+	defer es.Store.mu.Unlock()
+	in := &IncomingEmail{ID: es.NextIncomingEmailID, CreatedAt: time.Now().UTC()}
+	es.NextIncomingEmailID++
+	es.IncomingEmails = append(es.IncomingEmails, in)
+	es.receiveEmail(in, raw)
+	return *in
+}
+
+// Caller must hold es.Store.mu.
+func (es *ExtStore) receiveEmail(in *IncomingEmail, raw string) {
+	msg, err := mailer.ParseIncoming(raw)
+	if err != nil {
+		rejectEmail(in, emailErrEmpty, err.Error())
+		return
+	}
+	in.MessageID, in.From, in.To, in.CC = msg.MessageID, msg.From, msg.To, msg.CC
+	in.Subject, in.Header = msg.Subject, msg.Header
+	if msg.AutoGenerated {
+		rejectEmail(in, emailErrAutoGenerated, "The email was generated automatically.")
+		return
+	}
+	in.Body = mailer.TrimReply(msg.Text)
+	if in.Body == "" {
+		rejectEmail(in, emailErrNoBody, "No reply was found in the email body.")
+		return
+	}
+	user := es.userByEmail(msg.From)
+	if user != nil {
+		in.UserID = user.ID
+	}
+
+	var params NewPostParams
+	if key := es.replyKeyFor(msg); key != nil {
+		p := es.Posts[key.PostID]
+		var t *model.Topic
+		if p != nil {
+			t = es.Topics[p.TopicID]
+		}
+		switch {
+		case user == nil || user.ID != key.UserID:
+			rejectEmail(in, emailErrReplyUserMismatch, "The reply did not come from the address the notification was sent to.")
+			return
+		case t == nil:
+			rejectEmail(in, emailErrTopicNotFound, "The topic replied to no longer exists.")
+			return
+		case t.Closed:
+			rejectEmail(in, emailErrTopicClosed, "The topic replied to is closed.")
+			return
+		}
+		replyTo := p.PostNumber
+		params = NewPostParams{UserID: user.ID, Raw: in.Body, TopicID: t.ID, ReplyToPostNumber: &replyTo}
+	} else if c := es.emailInCategory(msg); c != nil {
+		if user == nil {
+			if !c.EmailInAllowStrangers {
+				rejectEmail(in, emailErrStrangers, fmt.Sprintf("Strangers may not start topics by email in %s.", c.Name))
+				return
+			}
+			if user, err = es.stageUser(msg.From, msg.FromName); err != nil {
+				rejectEmail(in, emailErrUserNotFound, err.Error())
+				return
+			}
+			in.UserID = user.ID
+		} else if !user.Staged && !c.EmailInAllowStrangers && !isStaff(user) && user.TrustLevel < es.siteSettingInt("email_in_min_trust") {
+			rejectEmail(in, emailErrTrustLevel, fmt.Sprintf("Starting topics by email needs trust level %d.", es.siteSettingInt("email_in_min_trust")))
+			return
+		}
+		params = NewPostParams{UserID: user.ID, Raw: in.Body, Title: in.Subject, CategoryID: c.ID}
+	} else {
+		rejectEmail(in, emailErrBadDestination, "None of the email's addresses is a reply key or a category's incoming email address.")
+		return
+	}
+
+	switch {
+	case !user.Active && !user.Staged:
+		rejectEmail(in, emailErrInactiveUser, "The sender's account is not activated.")
+		return
+	case user.Silenced:
+		rejectEmail(in, emailErrSilencedUser, "The sender is silenced.")
+		return
+	}
+	res, err := es.submitPost(params)
+	if err != nil {
+		rejectEmail(in, emailErrInvalidPost, err.Error())
+		return
+	}
+	if res.Post != nil {
+		t := es.Topics[res.Post.TopicID]
+		in.PostID, in.TopicID = res.Post.ID, res.Post.TopicID
+		if t != nil {
+			in.PostURL = fmt.Sprintf("/t/%s/%d/%d", t.Slug, t.ID, res.Post.PostNumber)
+		}
+	}
+}
+
+// userByEmail finds the user with address, ignoring case.
+// Caller must hold s.mu.
+func (s *Store) userByEmail(address string) *model.User {
+	if u := s.UsersByEmail[address]; u != nil {
+		return u
+	}
+	for email, u := range s.UsersByEmail {
+		if strings.EqualFold(email, address) {
+			return u
+		}
+	}
+	return nil
+}
+
+// replyKeyFor finds the notification email msg answers: by a reply key in
+// one of its addresses when replying by email is enabled, otherwise by
+// the Message-ID it is in reply to.
+// Caller must hold s.mu.
+func (s *Store) replyKeyFor(msg *mailer.Incoming) *PostReplyKey {
+	if address := s.siteSettingString("reply_by_email_address"); s.siteSettingBool("reply_by_email_enabled") && strings.Contains(address, "%{reply_key}") {
+		pattern := "^" + strings.ReplaceAll(regexp.QuoteMeta(strings.ToLower(address)), "%\\{reply_key\\}", "([0-9a-f]+)") + "$"
+		if re, err := regexp.Compile(pattern); err == nil {
+			for _, to := range append(append([]string{}, msg.To...), msg.CC...) {
+				if m := re.FindStringSubmatch(to); m != nil && s.ReplyKeys[m[1]] != nil {
+					return s.ReplyKeys[m[1]]
+				}
+			}
+		}
+	}
+	for _, ref := range msg.References {
+		for _, k := range s.ReplyKeys {
+			if k.MessageID == ref {
+				return k
+			}
+		}
+	}
+	return nil
+}
+
+// emailInCategory finds the category one of msg's addresses belongs to,
+// when new topics by email are enabled. A category's email_in may list
+// several addresses separated by |.
+// Caller must hold s.mu.
+func (s *Store) emailInCategory(msg *mailer.Incoming) *model.Category {
+	if !s.siteSettingBool("email_in") {
+		return nil
+	}
+	for _, to := range append(append([]string{}, msg.To...), msg.CC...) {
+		for _, c := range s.Categories {
+			for _, address := range strings.Split(c.EmailIn, "|") {
+				if address = strings.TrimSpace(address); address != "" && strings.EqualFold(address, to) {
+					return c
+				}
+			}
+		}
+	}
+	return nil
+}
+
+var reUsernameChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// stageUser creates the staged user Discourse makes for a stranger who
+// emails the forum, named after their address.
+// Caller must hold s.mu.
+func (s *Store) stageUser(address, name string) (*model.User, error) {
+	local, _, _ := strings.Cut(address, "@")
+	base := strings.Trim(reUsernameChars.ReplaceAllString(local, "_"), "_.-")
+	if len(base) > 20 {
+		base = base[:20]
+	}
+	if len(base) < 3 {
+		base = "user" + base
+	}
+	username := base
+	for i := 1; s.UsersByName[strings.ToLower(username)] != nil; i++ {
+		username = fmt.Sprintf("%s%d", base, i)
+	}
+	if name == "" {
+		name = local
+	}
+	u, err := s.createUser(name, username, address, false)
+	if err != nil {
+		return nil, err
+	}
+	u.Staged = true
+	s.userWebHook("user_created", u)
+	return u, nil
+}
+
+// ListIncomingEmails returns the received emails, oldest first.
+func (s *Store) ListIncomingEmails() []IncomingEmail {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]IncomingEmail, 0, len(s.IncomingEmails))
+	for _, in := range s.IncomingEmails {
+		out = append(out, *in)
+	}
+	return out
+}
+
+// GetIncomingEmail returns the received email with id, or nil.
+func (s *Store) GetIncomingEmail(id int) *IncomingEmail {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, in := range s.IncomingEmails {
+		if in.ID == id {
+			cp := *in
+			return &cp
+		}
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/lightcap/dtu-discourse/internal/messagebus"
+	"github.com/lightcap/dtu-discourse/internal/model"
+)
+
+// Everything published to s.Bus is published while s.mu is held, so
+// subscribers see messages in the order the changes were made. The bus
+// takes no store locks.
+
+// MessageBusClient identifies username to the message bus: their user id
+// and the groups they belong to. An unknown or empty username polls
+// anonymously.
+func (s *Store) MessageBusClient(username string) messagebus.Client {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u := s.UsersByName[username]
+	if u == nil {
+		return messagebus.Client{}
+	}
+	client := messagebus.Client{UserID: u.ID}
+	for groupID, members := range s.GroupMembers {
+		for _, id := range members {
+			if id == u.ID {
+				client.GroupIDs = append(client.GroupIDs, groupID)
+				break
+			}
+		}
+	}
+	sort.Ints(client.GroupIDs)
+	return client
+}
+
+// topicAudience returns who may see messages about t: the participants of
+// a private message, the groups granted a read-restricted category plus
+// staff, or everyone (both nil).
+// Caller must hold s.mu.
+func (s *Store) topicAudience(t *model.Topic) (userIDs, groupIDs []int) {
+	if t.Archetype == "private_message" {
+		return append([]int{}, s.TopicAllowedUsers[t.ID]...), nil
+	}
+	c := s.Categories[t.CategoryID]
+	if c == nil || len(c.GroupPermissions) == 0 {
+		return nil, nil
+	}
+	for _, gp := range c.GroupPermissions {
+		if gp.GroupName == "everyone" {
+			return nil, nil
+		}
+		if g := s.GroupsByName[gp.GroupName]; g != nil {
+			groupIDs = append(groupIDs, g.ID)
+		}
+	}
+	if staff := s.GroupsByName["staff"]; staff != nil {
+		groupIDs = append(groupIDs, staff.ID)
+	}
+	return nil, groupIDs
+}
+
+// TopicPublic reports whether anyone, signed in or not, may read t: it is
+// no private message and its category isn't read restricted.
+func (s *Store) TopicPublic(t *model.Topic) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if t.Archetype == "private_message" {
+		return false
+	}
+	userIDs, groupIDs := s.topicAudience(t)
+	return userIDs == nil && groupIDs == nil
+}
+
+// CategoryPublic reports whether anyone may read the category's topics.
+func (s *Store) CategoryPublic(id int) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c := s.Categories[id]
+	return c != nil && !readRestricted(c)
+}
+
+// readRestricted reports whether c's group permissions leave out everyone.
+func readRestricted(c *model.Category) bool {
+	if len(c.GroupPermissions) == 0 {
+		return false
+	}
+	for _, gp := range c.GroupPermissions {
+		if gp.GroupName == "everyone" {
+			return false
+		}
+	}
+	return true
+}
+
+// publishPostChange tells a topic's readers that p was created, revised
+// or deleted, as Post#publish_change_to_clients! does.
+// Caller must hold s.mu.
+func (s *Store) publishPostChange(p *model.Post, kind string, editorID int) {
+	t := s.Topics[p.TopicID]
+	if t == nil {
+		return
+	}
+	userIDs, groupIDs := s.topicAudience(t)
+	s.Bus.Publish(fmt.Sprintf("/topic/%d", t.ID), map[string]interface{}{
+		"id": p.ID, "post_number": p.PostNumber, "updated_at": p.UpdatedAt,
+		"user_id": p.UserID, "last_editor_id": editorID, "type": kind, "version": p.Version,
+	}, userIDs, groupIDs)
+}
+
+// publishTopicTracking feeds the topic tracking state of the topic lists:
+// /new for a new topic, /latest whenever a topic is bumped and /unread for
+// each user tracking or watching a topic that got a reply. Private
+// messages have their own tracking state and are left out.
+// Caller must hold s.mu.
+func (s *Store) publishTopicTracking(t *model.Topic, p *model.Post) {
+	if t.Archetype == "private_message" {
+		return
+	}
+	userIDs, groupIDs := s.topicAudience(t)
+	if p.PostNumber == 1 {
+		s.Bus.Publish("/new", map[string]interface{}{
+			"topic_id": t.ID, "message_type": "new_topic",
+			"payload": map[string]interface{}{
+				"last_read_post_number": nil, "highest_post_number": 1,
+				"created_at": t.CreatedAt, "topic_id": t.ID, "category_id": t.CategoryID,
+				"archetype": t.Archetype, "created_in_new_period": true,
+			},
+		}, userIDs, groupIDs)
+	}
+	s.Bus.Publish("/latest", map[string]interface{}{
+		"topic_id": t.ID, "message_type": "latest",
+		"payload": map[string]interface{}{
+			"bumped_at": t.BumpedAt, "category_id": t.CategoryID, "archetype": t.Archetype, "tags": t.Tags,
+		},
+	}, userIDs, groupIDs)
+	if p.PostNumber == 1 {
+		return
+	}
+	readers := make([]int, 0, len(s.TopicNotificationLevels[t.ID]))
+	for id := range s.TopicNotificationLevels[t.ID] {
+		readers = append(readers, id)
+	}
+	sort.Ints(readers)
+	for _, id := range readers {
+		level := s.topicNotificationLevel(t, id)
+		if id == p.UserID || level < NotificationLevelTracking {
+			continue
+		}
+		s.Bus.Publish("/unread", map[string]interface{}{
+			"topic_id": t.ID, "message_type": "unread",
+			"payload": map[string]interface{}{
+				"last_read_post_number": nil, "highest_post_number": t.HighestPostNumber,
+				"created_at": t.CreatedAt, "updated_at": p.CreatedAt, "category_id": t.CategoryID,
+				"notification_level": level, "archetype": t.Archetype,
+			},
+		}, []int{id}, nil)
+	}
+}
+
+// publishTopicDeleted tells the topic lists that t is gone.
+// Caller must hold s.mu.
+func (s *Store) publishTopicDeleted(t *model.Topic) {
+	if t.Archetype == "private_message" {
+		return
+	}
+	userIDs, groupIDs := s.topicAudience(t)
+	s.Bus.Publish("/delete", map[string]interface{}{"topic_id": t.ID, "message_type": "delete"}, userIDs, groupIDs)
+}
+
+// publishNotificationState sends userID's notification counts on
+// /notification/{user_id}, as User#publish_notifications_state does, with
+// last when a notification was just created.
+// Caller must hold s.mu.
+func (s *Store) publishNotificationState(userID int, last *model.Notification) {
+	totals := s.notificationTotals(userID)
+	notifs := s.Notifications[userID]
+	recent := [][]interface{}{}
+	for i := len(notifs) - 1; i >= 0 && len(recent) < 10; i-- {
+		recent = append(recent, []interface{}{notifs[i].ID, notifs[i].Read})
+	}
+	grouped := map[int]int{}
+	newPMs := 0
+	for _, n := range notifs {
+		if n.Read {
+			continue
+		}
+		grouped[n.NotificationType]++
+		if n.NotificationType == NotificationPrivateMessage && n.ID > totals.SeenID {
+			newPMs++
+		}
+	}
+	data := map[string]interface{}{
+		"unread_notifications":                      totals.Unread,
+		"unread_high_priority_notifications":        totals.UnreadHighPriority,
+		"read_first_notification":                   totals.SeenID > 0,
+		"all_unread_notifications_count":            totals.AllUnread,
+		"seen_notification_id":                      totals.SeenID,
+		"new_personal_messages_notifications_count": newPMs,
+		"recent":                       recent,
+		"grouped_unread_notifications": grouped,
+	}
+	if last != nil {
+		cp := *last
+		data["last_notification"] = map[string]interface{}{"notification": cp}
+	}
+	s.Bus.Publish(fmt.Sprintf("/notification/%d", userID), data, []int{userID}, nil)
+}
@@ -0,0 +1,677 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lightcap/dtu-discourse/internal/model"
+)
+
+// Notification types, matching the notification_types in the site info.
+const (
+	NotificationMentioned               = 1
+	NotificationReplied                 = 2
+	NotificationQuoted                  = 3
+	NotificationEdited                  = 4
+	NotificationLiked                   = 5
+	NotificationPrivateMessage          = 6
+	NotificationInvitedToPrivateMessage = 7
+	NotificationPosted                  = 9
+	NotificationGrantedBadge            = 12
+	NotificationInvitedToTopic          = 13
+	NotificationGroupMentioned          = 15
+	NotificationWatchingFirstPost       = 17
+	NotificationLikedConsolidated       = 19
+)
+
+// Notification levels a user can set on a topic or category.
+const (
+	NotificationLevelMuted             = 0
+	NotificationLevelRegular           = 1
+	NotificationLevelTracking          = 2
+	NotificationLevelWatching          = 3
+	NotificationLevelWatchingFirstPost = 4
+)
+
+// NotificationLevels maps the level names Discourse accepts in place of
+// their numbers.
+var NotificationLevels = map[string]int{
+	"muted":               NotificationLevelMuted,
+	"regular":             NotificationLevelRegular,
+	"tracking":            NotificationLevelTracking,
+	"watching":            NotificationLevelWatching,
+	"watching_first_post": NotificationLevelWatchingFirstPost,
+}
+
+// ErrCannotInvite is returned when a user may not invite others to a
+// private message.
+var ErrCannotInvite = errors.New("you are not allowed to invite users to this message")
+
+var (
+	reGroupMentionTag = regexp.MustCompile(`<a\b[^>]*class="mention-group"[^>]*>@([\w.-]+)<`)
+	reQuotedAside     = regexp.MustCompile(`<aside class="quote[^"]*" data-username="([^"]+)"`)
+	reQuoteBlock      = regexp.MustCompile(`(?s)<aside class="quote.*?</aside>`)
+)
+
+// notify gives userID a notification about post postNumber of t, or about
+// no topic when t is nil.
+// Caller must hold s.mu.
+func (s *Store) notify(userID, notificationType int, t *model.Topic, postNumber int, data model.NotificationData) *model.Notification {
+	n := &model.Notification{
+		ID: s.NextNotifID, UserID: userID, NotificationType: notificationType,
+		HighPriority: notificationType == NotificationPrivateMessage,
+		CreatedAt:    time.Now().UTC(), Data: data,
+	}
+	if t != nil {
+		topicID := t.ID
+		n.TopicID = &topicID
+		n.FancyTitle = t.FancyTitle
+		n.Slug = t.Slug
+		if postNumber > 0 {
+			n.PostNumber = &postNumber
+		}
+	}
+	s.NextNotifID++
+	s.Notifications[userID] = append(s.Notifications[userID], n)
+	s.publishNotificationState(userID, n)
+	s.emailNotification(n)
+	s.notificationWebHook(n)
+	return n
+}
+
+// unnotify removes one of userID's notifications.
+// Caller must hold s.mu.
+func (s *Store) unnotify(userID int, n *model.Notification) {
+	s.Notifications[userID] = slices.DeleteFunc(s.Notifications[userID], func(o *model.Notification) bool { return o == n })
+	s.publishNotificationState(userID, nil)
+}
+
+// postNotificationData is the data of a notification about p on behalf of
+// actor.
+func postNotificationData(p *model.Post, t *model.Topic, actor *model.User) model.NotificationData {
+	return model.NotificationData{
+		TopicTitle: t.Title, OriginalPostID: p.ID, OriginalPostType: p.PostType,
+		OriginalUsername: p.Username, DisplayUsername: actor.Username,
+	}
+}
+
+// topicNotificationLevel returns userID's level on t: the one they chose
+// for the topic, otherwise their category level, otherwise regular.
+// Caller must hold s.mu.
+func (s *Store) topicNotificationLevel(t *model.Topic, userID int) int {
+	if level, ok := s.TopicNotificationLevels[t.ID][userID]; ok {
+		return level
+	}
+	if level, ok := s.CategoryNotificationLevels[t.CategoryID][userID]; ok && level != NotificationLevelWatchingFirstPost {
+		return level
+	}
+	return NotificationLevelRegular
+}
+
+// setTopicNotificationLevel records userID's level on a topic. With
+// onlyIfUnset, a level the user already has is kept, as when Discourse
+// automatically tracks topics a user posts in.
+// Caller must hold s.mu.
+func (s *Store) setTopicNotificationLevel(topicID, userID, level int, onlyIfUnset bool) {
+	levels := s.TopicNotificationLevels[topicID]
+	if levels == nil {
+		levels = make(map[int]int)
+		s.TopicNotificationLevels[topicID] = levels
+	}
+	if _, ok := levels[userID]; ok && onlyIfUnset {
+		return
+	}
+	levels[userID] = level
+}
+
+// SetTopicNotificationLevel sets userID's notification level on a topic.
+func (s *Store) SetTopicNotificationLevel(topicID, userID, level int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.Topics[topicID]; !ok {
+		return fmt.Errorf("topic not found")
+	}
+	s.setTopicNotificationLevel(topicID, userID, level, false)
+	return nil
+}
+
+// SetCategoryNotificationLevel sets userID's notification level on a
+// category, which applies to its topics unless set per topic.
+func (s *Store) SetCategoryNotificationLevel(categoryID, userID, level int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.Categories[categoryID]; !ok {
+		return fmt.Errorf("category not found")
+	}
+	levels := s.CategoryNotificationLevels[categoryID]
+	if levels == nil {
+		levels = make(map[int]int)
+		s.CategoryNotificationLevels[categoryID] = levels
+	}
+	levels[userID] = level
+	return nil
+}
+
+// allowPrivateMessage adds users to a private message's participants, who
+// all watch it.
+// Caller must hold s.mu.
+func (s *Store) allowPrivateMessage(t *model.Topic, userIDs ...int) {
+	for _, id := range userIDs {
+		if !slices.Contains(s.TopicAllowedUsers[t.ID], id) {
+			s.TopicAllowedUsers[t.ID] = append(s.TopicAllowedUsers[t.ID], id)
+		}
+		s.setTopicNotificationLevel(t.ID, id, NotificationLevelWatching, true)
+	}
+}
+
+// messageRecipients resolves the target usernames of a new private
+// message, expanding group names to their members. Unknown names are
+// skipped.
+// Caller must hold s.mu.
+func (s *Store) messageRecipients(names []string) []int {
+	var ids []int
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if u := s.UsersByName[strings.ToLower(name)]; u != nil {
+			ids = append(ids, u.ID)
+			continue
+		}
+		for _, g := range s.Groups {
+			if strings.EqualFold(g.Name, name) {
+				ids = append(ids, s.GroupMembers[g.ID]...)
+			}
+		}
+	}
+	return ids
+}
+
+// canMentionGroup reports whether u may notify g's members by mentioning
+// it, according to the group's mentionable_level.
+// Caller must hold s.mu.
+func (s *Store) canMentionGroup(u *model.User, g *model.Group) bool {
+	switch g.MentionableLevel {
+	case 99:
+		return true
+	case 1:
+		return u.Admin
+	case 2:
+		return isStaff(u)
+	case 3:
+		return isStaff(u) || slices.Contains(s.GroupMembers[g.ID], u.ID)
+	case 4:
+		return isStaff(u) || slices.Contains(s.GroupOwners[g.ID], u.ID)
+	}
+	return false
+}
+
+// mentions returns the usernames and group names a cooked post mentions
+// outside of quotes.
+func mentions(cooked string) (users, groups []string) {
+	cooked = reQuoteBlock.ReplaceAllString(cooked, "")
+	for _, m := range reMentionTag.FindAllStringSubmatch(cooked, -1) {
+		users = append(users, strings.ToLower(m[1]))
+	}
+	for _, m := range reGroupMentionTag.FindAllStringSubmatch(cooked, -1) {
+		groups = append(groups, strings.ToLower(m[1]))
+	}
+	return users, groups
+}
+
+// postAlert notifies each user at most once about a post.
+type postAlert struct {
+	s        *Store
+	p        *model.Post
+	t        *model.Topic
+	notified map[int]bool
+}
+
+// send notifies userID unless they were already notified about the post,
+// wrote it, muted its topic or, for a private message, aren't taking part.
+func (a *postAlert) send(userID, notificationType int, data model.NotificationData) {
+	if a.notified[userID] || a.s.Users[userID] == nil {
+		return
+	}
+	if a.s.topicNotificationLevel(a.t, userID) == NotificationLevelMuted {
+		return
+	}
+	if a.t.Archetype == "private_message" && !slices.Contains(a.s.TopicAllowedUsers[a.t.ID], userID) {
+		return
+	}
+	a.notified[userID] = true
+	a.s.notify(userID, notificationType, a.t, a.p.PostNumber, data)
+}
+
+// mentions notifies the users and mentionable groups in usernames and
+// groupNames.
+func (a *postAlert) mentions(author *model.User, usernames, groupNames []string) {
+	data := postNotificationData(a.p, a.t, author)
+	for _, name := range usernames {
+		if u := a.s.UsersByName[name]; u != nil {
+			a.send(u.ID, NotificationMentioned, data)
+		}
+	}
+	for _, name := range groupNames {
+		for _, g := range a.s.Groups {
+			if !strings.EqualFold(g.Name, name) || !a.s.canMentionGroup(author, g) {
+				continue
+			}
+			gd := data
+			gd.GroupID, gd.GroupName = g.ID, g.Name
+			for _, id := range a.s.GroupMembers[g.ID] {
+				a.send(id, NotificationGroupMentioned, gd)
+			}
+		}
+	}
+}
+
+// alertPostCreated notifies the users a new post concerns, in the order
+// Discourse's PostAlerter does: mentioned users and groups, the author of
+// the post it replies to, quoted users, then the other participants of a
+// private message or the watchers of a topic. The author watches a topic
+// they create and tracks one they reply to.
+// Caller must hold s.mu.
+func (s *Store) alertPostCreated(p *model.Post) {
+	t := s.Topics[p.TopicID]
+	author := s.Users[p.UserID]
+	if t == nil || author == nil {
+		return
+	}
+	if p.PostNumber == 1 {
+		s.setTopicNotificationLevel(t.ID, author.ID, NotificationLevelWatching, true)
+	} else {
+		s.setTopicNotificationLevel(t.ID, author.ID, NotificationLevelTracking, true)
+	}
+
+	a := &postAlert{s: s, p: p, t: t, notified: map[int]bool{author.ID: true}}
+	data := postNotificationData(p, t, author)
+	users, groups := mentions(p.Cooked)
+	a.mentions(author, users, groups)
+	if p.ReplyToPostNumber != nil {
+		if parent := s.postByNumber(t.ID, *p.ReplyToPostNumber); parent != nil {
+			a.send(parent.UserID, NotificationReplied, data)
+		}
+	}
+	for _, m := range reQuotedAside.FindAllStringSubmatch(p.Cooked, -1) {
+		if u := s.UsersByName[strings.ToLower(m[1])]; u != nil {
+			a.send(u.ID, NotificationQuoted, data)
+		}
+	}
+	if t.Archetype == "private_message" {
+		for _, id := range s.TopicAllowedUsers[t.ID] {
+			a.send(id, NotificationPrivateMessage, data)
+		}
+		return
+	}
+
+	watchers := map[int]int{}
+	for id, level := range s.CategoryNotificationLevels[t.CategoryID] {
+		switch {
+		case level == NotificationLevelWatching:
+			watchers[id] = NotificationPosted
+		case level == NotificationLevelWatchingFirstPost && p.PostNumber == 1:
+			watchers[id] = NotificationWatchingFirstPost
+		}
+	}
+	for id, level := range s.TopicNotificationLevels[t.ID] {
+		if level == NotificationLevelWatching {
+			watchers[id] = NotificationPosted
+		} else {
+			delete(watchers, id)
+		}
+	}
+	ids := make([]int, 0, len(watchers))
+	for id := range watchers {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		a.send(id, watchers[id], data)
+	}
+}
+
+// alertPostEdited notifies users newly mentioned by an edit and, when
+// someone else made the edit, the post's author.
+// Caller must hold s.mu.
+func (s *Store) alertPostEdited(p *model.Post, editorID int, previousCooked string) {
+	t := s.Topics[p.TopicID]
+	editor := s.Users[editorID]
+	if t == nil || editor == nil {
+		return
+	}
+	a := &postAlert{s: s, p: p, t: t, notified: map[int]bool{p.UserID: true, editorID: true}}
+	oldUsers, oldGroups := mentions(previousCooked)
+	users, groups := mentions(p.Cooked)
+	users = slices.DeleteFunc(users, func(name string) bool { return slices.Contains(oldUsers, name) })
+	groups = slices.DeleteFunc(groups, func(name string) bool { return slices.Contains(oldGroups, name) })
+	a.mentions(editor, users, groups)
+
+	if editorID != p.UserID {
+		data := postNotificationData(p, t, editor)
+		data.RevisionNumber = p.Version
+		delete(a.notified, p.UserID)
+		a.send(p.UserID, NotificationEdited, data)
+	}
+}
+
+// alertLiked notifies a post's author that liker liked it. Likes of the
+// same post while its notification is unread are folded into one
+// notification naming the two most recent likers. Once one user has
+// liked more than notification_consolidation_threshold of the author's
+// posts within likes_notification_consolidation_window_mins, their likes
+// are consolidated into a single liked_consolidated notification.
+// Caller must hold s.mu.
+func (s *Store) alertLiked(p *model.Post, liker *model.User) {
+	t := s.Topics[p.TopicID]
+	if t == nil || p.UserID == liker.ID || s.Users[p.UserID] == nil {
+		return
+	}
+	if s.topicNotificationLevel(t, p.UserID) == NotificationLevelMuted {
+		return
+	}
+	window := time.Duration(s.siteSettingInt("likes_notification_consolidation_window_mins")) * time.Minute
+	threshold := s.siteSettingInt("notification_consolidation_threshold")
+	since := time.Now().Add(-window)
+
+	var recent []*model.Notification
+	for _, n := range s.Notifications[p.UserID] {
+		if n.Read || n.CreatedAt.Before(since) || n.Data.Username != liker.Username {
+			continue
+		}
+		switch n.NotificationType {
+		case NotificationLikedConsolidated:
+			n.Data.Count++
+			n.CreatedAt = time.Now().UTC()
+			s.publishNotificationState(p.UserID, nil)
+			return
+		case NotificationLiked:
+			if n.Data.Username2 == "" {
+				recent = append(recent, n)
+			}
+		}
+	}
+	if threshold > 0 && len(recent) >= threshold {
+		for _, n := range recent {
+			s.unnotify(p.UserID, n)
+		}
+		s.notify(p.UserID, NotificationLikedConsolidated, nil, 0, model.NotificationData{
+			Username: liker.Username, DisplayUsername: liker.Username, Count: len(recent) + 1,
+		})
+		return
+	}
+
+	data := postNotificationData(p, t, liker)
+	data.Username = liker.Username
+	for _, n := range s.Notifications[p.UserID] {
+		if n.NotificationType == NotificationLiked && !n.Read && n.Data.OriginalPostID == p.ID {
+			data.Username2 = n.Data.Username
+			data.Count = max(n.Data.Count, 1) + 1
+			s.unnotify(p.UserID, n)
+			break
+		}
+	}
+	s.notify(p.UserID, NotificationLiked, t, p.PostNumber, data)
+}
+
+// unalertLiked withdraws the unread notification of a like that was
+// undone, unless other likes were folded into it.
+// Caller must hold s.mu.
+func (s *Store) unalertLiked(p *model.Post, liker *model.User) {
+	for _, n := range s.Notifications[p.UserID] {
+		if n.NotificationType == NotificationLiked && !n.Read && n.Data.OriginalPostID == p.ID &&
+			n.Data.Username == liker.Username && n.Data.Username2 == "" {
+			s.unnotify(p.UserID, n)
+			return
+		}
+	}
+}
+
+// alertBadgeGranted tells userID they were granted b.
+// Caller must hold s.mu.
+func (s *Store) alertBadgeGranted(userID int, b *model.Badge) {
+	u := s.Users[userID]
+	if u == nil {
+		return
+	}
+	slug := b.Slug
+	if slug == "" {
+		slug = strings.ToLower(strings.ReplaceAll(b.Name, " ", "-"))
+	}
+	badgeTitle := false
+	s.notify(userID, NotificationGrantedBadge, nil, 0, model.NotificationData{
+		BadgeID: b.ID, BadgeName: b.Name, BadgeSlug: slug, BadgeTitle: &badgeTitle, Username: u.Username,
+	})
+}
+
+// InviteToTopic invites a user to a topic on behalf of inviterID. Invitees
+// to a private message join it; only its participants and staff may
+// invite to one.
+func (s *Store) InviteToTopic(topicID, inviterID, userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.Topics[topicID]
+	if !ok {
+		return fmt.Errorf("topic not found")
+	}
+	inviter, invitee := s.Users[inviterID], s.Users[userID]
+	if inviter == nil || invitee == nil {
+		return fmt.Errorf("user not found")
+	}
+	data := model.NotificationData{TopicTitle: t.Title, DisplayUsername: inviter.Username}
+	if first := s.postByNumber(t.ID, 1); first != nil {
+		data.OriginalPostID, data.OriginalPostType, data.OriginalUsername = first.ID, first.PostType, first.Username
+	}
+	notificationType := NotificationInvitedToTopic
+	if t.Archetype == "private_message" {
+		if !isStaff(inviter) && !slices.Contains(s.TopicAllowedUsers[t.ID], inviterID) {
+			return ErrCannotInvite
+		}
+		s.allowPrivateMessage(t, userID)
+		notificationType = NotificationInvitedToPrivateMessage
+	}
+	if userID != inviterID {
+		s.notify(userID, notificationType, t, 1, data)
+	}
+	return nil
+}
+
+// NotificationQuery selects a page of a user's notifications for
+// GET /notifications.json.
+type NotificationQuery struct {
+	// Filter is "read", "unread" or "" for all.
+	Filter string
+	// Recent lists unread high priority notifications first, as the
+	// notifications menu does.
+	Recent bool
+	Limit  int
+	Offset int
+}
+
+// ListNotifications returns a page of userID's notifications, newest first,
+// and how many match the query in total.
+func (s *Store) ListNotifications(userID int, q NotificationQuery) ([]model.Notification, int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	notifs := s.Notifications[userID]
+	matched := make([]model.Notification, 0, len(notifs))
+	for i := len(notifs) - 1; i >= 0; i-- {
+		n := notifs[i]
+		if (q.Filter == "read" && !n.Read) || (q.Filter == "unread" && n.Read) {
+			continue
+		}
+		matched = append(matched, *n)
+	}
+	if q.Recent {
+		sort.SliceStable(matched, func(i, j int) bool {
+			return unreadHighPriority(&matched[i]) && !unreadHighPriority(&matched[j])
+		})
+	}
+	total := len(matched)
+	if q.Offset > 0 {
+		matched = matched[min(q.Offset, len(matched)):]
+	}
+	if q.Limit > 0 && len(matched) > q.Limit {
+		matched = matched[:q.Limit]
+	}
+	return matched, total
+}
+
+func unreadHighPriority(n *model.Notification) bool {
+	return n.HighPriority && !n.Read
+}
+
+// NotificationTotals are the counts behind a user's notification badge.
+type NotificationTotals struct {
+	// Unread counts unread notifications that aren't high priority and
+	// arrived since the user last saw their notifications.
+	Unread int
+	// UnreadHighPriority counts every unread high priority notification.
+	UnreadHighPriority int
+	// AllUnread counts unread notifications since the user last saw them.
+	AllUnread int
+	Total     int
+	SeenID    int
+}
+
+// GetNotificationTotals counts userID's notifications the way Discourse's
+// current user serializer does.
+func (s *Store) GetNotificationTotals(userID int) NotificationTotals {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.notificationTotals(userID)
+}
+
+// Caller must hold s.mu.
+func (s *Store) notificationTotals(userID int) NotificationTotals {
+	totals := NotificationTotals{SeenID: s.SeenNotificationIDs[userID]}
+	for _, n := range s.Notifications[userID] {
+		totals.Total++
+		if n.Read {
+			continue
+		}
+		if n.HighPriority {
+			totals.UnreadHighPriority++
+		}
+		if n.ID > totals.SeenID {
+			totals.AllUnread++
+			if !n.HighPriority {
+				totals.Unread++
+			}
+		}
+	}
+	return totals
+}
+
+// SawNotifications records that userID has seen all their notifications,
+// as opening the notifications menu does, and returns the new
+// seen_notification_id.
+func (s *Store) SawNotifications(userID int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := s.sawNotifications(userID)
+	s.publishNotificationState(userID, nil)
+	return seen
+}
+
+// Caller must hold s.mu.
+func (s *Store) sawNotifications(userID int) int {
+	seen := s.SeenNotificationIDs[userID]
+	for _, n := range s.Notifications[userID] {
+		seen = max(seen, n.ID)
+	}
+	s.SeenNotificationIDs[userID] = seen
+	return seen
+}
+
+// MarkNotificationsRead marks userID's notifications read: the one with
+// id when id is set, otherwise those of the given types, otherwise all of
+// them. Marking them all read also marks them seen.
+func (s *Store) MarkNotificationsRead(userID, id int, types []int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	found := false
+	for _, n := range s.Notifications[userID] {
+		switch {
+		case id != 0:
+			if n.ID != id {
+				continue
+			}
+		case len(types) > 0:
+			if !slices.Contains(types, n.NotificationType) {
+				continue
+			}
+		}
+		n.Read = true
+		found = true
+	}
+	if id != 0 && !found {
+		return fmt.Errorf("notification not found")
+	}
+	if id == 0 && len(types) == 0 {
+		s.sawNotifications(userID)
+	}
+	s.publishNotificationState(userID, nil)
+	return nil
+}
+
+// GetNotification returns a copy of the notification with id, or nil.
+func (s *Store) GetNotification(id int) *model.Notification {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if n := s.notification(id); n != nil {
+		cp := *n
+		return &cp
+	}
+	return nil
+}
+
+// Caller must hold s.mu.
+func (s *Store) notification(id int) *model.Notification {
+	for _, notifs := range s.Notifications {
+		for _, n := range notifs {
+			if n.ID == id {
+				return n
+			}
+		}
+	}
+	return nil
+}
+
+// UpdateNotification changes a notification's type, read state or
+// priority.
+func (s *Store) UpdateNotification(id int, updates map[string]interface{}) (*model.Notification, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.notification(id)
+	if n == nil {
+		return nil, fmt.Errorf("notification not found")
+	}
+	if v, ok := updates["notification_type"].(float64); ok {
+		n.NotificationType = int(v)
+	}
+	if v, ok := updates["read"].(bool); ok {
+		n.Read = v
+	}
+	if v, ok := updates["high_priority"].(bool); ok {
+		n.HighPriority = v
+	}
+	s.publishNotificationState(n.UserID, nil)
+	cp := *n
+	return &cp, nil
+}
+
+// DeleteNotification removes the notification with id.
+func (s *Store) DeleteNotification(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.notification(id)
+	if n == nil {
+		return fmt.Errorf("notification not found")
+	}
+	s.unnotify(n.UserID, n)
+	return nil
+}
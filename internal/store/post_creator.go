@@ -0,0 +1,405 @@
+package store
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lightcap/dtu-discourse/internal/model"
+)
+
+// NeedsApprovalScoreType is the reviewable score type of queued posts.
+const NeedsApprovalScoreType = 9
+
+// NewPostParams is a post submitted through POST /posts: a new topic when
+// TopicID is zero, otherwise a reply.
+type NewPostParams struct {
+	UserID int
+	Raw    string
+
+	Title      string
+	CategoryID int
+	Tags       []string
+	Archetype  string
+
+	TopicID           int
+	ReplyToPostNumber *int
+
+	// TargetUsernames are the users and groups a private message is sent to.
+	TargetUsernames []string
+}
+
+// NewPostResult is what became of a submitted post: either it was created,
+// or it was queued for approval as a ReviewableQueuedPost.
+type NewPostResult struct {
+	Topic        *model.Topic
+	Post         *model.Post
+	Queued       *Reviewable
+	Pending      *PendingPost
+	PendingCount int
+	Reason       string
+}
+
+// SubmitPost creates a topic or reply the way Discourse's PostCreator
+// does, unless it contains blocked words or NewPostManager would hold it
+// for approval, in which case it is queued as a ReviewableQueuedPost.
+// Published posts count against the author's rate limits.
+func (es *ExtStore) SubmitPost(params NewPostParams) (*NewPostResult, error) {
+	es.Store.mu.Lock()
+	defer es.Store.mu.Unlock()
+	return es.submitPost(params)
+}
+
+// Caller must hold es.Store.mu.
+func (es *ExtStore) submitPost(params NewPostParams) (*NewPostResult, error) {
+	u := es.Users[params.UserID]
+	if u == nil {
+		return nil, fmt.Errorf("user not found")
+	}
+	if err := es.checkBlocked(submittedText(params)); err != nil {
+		return nil, err
+	}
+	if reason := es.approvalReason(u, params); reason != "" {
+		return es.enqueuePost(u, params, reason)
+	}
+	// As in Discourse, invalid posts fail validation before they count
+	// against, or are refused by, the rate limits.
+	if err := es.validateSubmission(u, params); err != nil {
+		return nil, err
+	}
+	limits := es.postLimits(u, params)
+	if err := es.checkLimits(u, limits); err != nil {
+		return nil, err
+	}
+	res, err := es.publishPost(u, params)
+	if err != nil {
+		return nil, err
+	}
+	es.recordLimits(u, limits)
+	return res, nil
+}
+
+// submittedText is the text watched words are matched against.
+func submittedText(params NewPostParams) string {
+	if params.TopicID != 0 {
+		return params.Raw
+	}
+	return params.Title + "\n" + params.Raw + "\n" + strings.Join(params.Tags, " ")
+}
+
+// approvalReason returns why a post from u must be approved before it is
+// published, checking in the order NewPostManager does, or "" when it
+// can be published straight away. Staff never need approval.
+// Caller must hold es.Store.mu; es.mu is taken here.
+func (es *ExtStore) approvalReason(u *model.User, params NewPostParams) string {
+	if isStaff(u) {
+		return ""
+	}
+	if u.TrustLevel <= 1 && es.approvedPostCount(u.ID) < es.siteSettingInt("approve_post_count") {
+		return "post_count"
+	}
+	if u.TrustLevel < es.siteSettingInt("approve_unless_trust_level") {
+		return "trust_level"
+	}
+	isTopic := params.TopicID == 0
+	if isTopic && u.TrustLevel < es.siteSettingInt("approve_new_topics_unless_trust_level") {
+		return "new_topics_unless_trust_level"
+	}
+	es.mu.RLock()
+	watched := len(es.watchedMatches(WatchedRequireApproval, submittedText(params))) > 0
+	es.mu.RUnlock()
+	if watched {
+		return "watched_word"
+	}
+	categoryID := params.CategoryID
+	if t := es.Topics[params.TopicID]; !isTopic && t != nil {
+		categoryID = t.CategoryID
+	}
+	if c := es.Categories[categoryID]; c != nil && params.Archetype != "private_message" {
+		if (isTopic && customFieldBool(c, "require_topic_approval")) || (!isTopic && customFieldBool(c, "require_reply_approval")) {
+			return "category"
+		}
+	}
+	return ""
+}
+
+// approvedPostCount counts userID's published posts.
+// Caller must hold s.mu.
+func (s *Store) approvedPostCount(userID int) int {
+	n := 0
+	for _, p := range s.Posts {
+		if p.UserID == userID {
+			n++
+		}
+	}
+	return n
+}
+
+// publishPost creates the topic or reply and applies the watched words
+// that act on published posts: the cooked text is filtered, tag words tag
+// the topic, flag words flag the post and silence words silence its
+// author. Staff skip the flag and silence actions.
+// Caller must hold es.Store.mu; es.mu is taken here.
+func (es *ExtStore) publishPost(u *model.User, params NewPostParams) (*NewPostResult, error) {
+	isTopic := params.TopicID == 0
+	text := submittedText(params)
+	res := &NewPostResult{}
+	var err error
+	if isTopic {
+		res.Topic, res.Post, err = es.createTopic(params.Title, params.Raw, params.CategoryID, u.ID, params.Tags, params.Archetype)
+	} else {
+		res.Post, err = es.createPost(params.TopicID, params.Raw, u.ID, params.ReplyToPostNumber)
+	}
+	if err != nil {
+		return nil, err
+	}
+	p := res.Post
+	if isTopic && res.Topic.Archetype == "private_message" {
+		es.allowPrivateMessage(res.Topic, append([]int{u.ID}, es.messageRecipients(params.TargetUsernames)...)...)
+	}
+
+	es.mu.RLock()
+	p.Cooked = es.filterCooked(p.Cooked)
+	var tags []string
+	if t := es.Topics[p.TopicID]; t != nil {
+		es.censorTitle(t)
+		if isTopic {
+			for _, m := range es.watchedMatchers(WatchedTag) {
+				if len(m.find(text)) > 0 {
+					tags = append(tags, strings.Split(replacementOf(m.word), ",")...)
+				}
+			}
+			for _, tag := range tags {
+				if tag = strings.TrimSpace(tag); tag != "" && !slices.Contains(t.Tags, tag) {
+					t.Tags = append(t.Tags, tag)
+				}
+			}
+		}
+	}
+	flagged := es.watchedMatches(WatchedFlag, text)
+	silenced := len(es.watchedMatches(WatchedSilence, text)) > 0
+	es.mu.RUnlock()
+
+	if !isStaff(u) {
+		if len(flagged) > 0 {
+			if system := es.Users[-1]; system != nil {
+				msg := "The post contains watched words: " + strings.Join(flagged, ", ")
+				if _, _, err := es.flagPost(p, system, FlagInappropriate, msg); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if silenced {
+			u.Silenced = true
+		}
+	}
+	es.publishPostChange(p, "created", p.UserID)
+	if t := es.Topics[p.TopicID]; t != nil {
+		es.publishTopicTracking(t, p)
+		if isTopic {
+			es.ensureTags(t.Tags)
+			es.topicWebHook("topic_created", t)
+		}
+	}
+	es.postWebHook("post_created", p)
+	es.gamifyPostCreated(p)
+	es.alertPostCreated(p)
+	es.badgesOnPost(p)
+	if res.Topic != nil {
+		cp := *res.Topic
+		res.Topic = &cp
+	}
+	cp := *p
+	res.Post = &cp
+	return res, nil
+}
+
+// enqueuePost validates a post and holds it as a pending
+// ReviewableQueuedPost instead of creating it.
+// Caller must hold es.Store.mu; es.mu is taken here.
+func (es *ExtStore) enqueuePost(u *model.User, params NewPostParams, reason string) (*NewPostResult, error) {
+	if err := es.validateSubmission(u, params); err != nil {
+		return nil, err
+	}
+	payload := map[string]interface{}{"raw": params.Raw}
+	categoryID := params.CategoryID
+	if params.TopicID == 0 {
+		payload["title"] = params.Title
+		payload["archetype"] = params.Archetype
+		if len(params.TargetUsernames) > 0 {
+			payload["target_usernames"] = params.TargetUsernames
+		}
+		if len(params.Tags) > 0 {
+			payload["tags"] = params.Tags
+		}
+	} else {
+		categoryID = es.Topics[params.TopicID].CategoryID
+		if params.ReplyToPostNumber != nil {
+			payload["reply_to_post_number"] = *params.ReplyToPostNumber
+		}
+	}
+
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	now := time.Now().UTC()
+	r := &Reviewable{
+		ID: es.NextReviewableID, Type: "ReviewableQueuedPost", Status: ReviewablePending,
+		CreatedByID: u.ID, TargetCreatedByID: u.ID, TopicID: params.TopicID,
+		CategoryID: categoryID, Version: 1, Payload: payload,
+		CreatedAt: now, UpdatedAt: now,
+	}
+	if system := es.Users[-1]; system != nil {
+		r.Scores = []ReviewableScore{{
+			ID: 1, UserID: system.ID, ReviewableScoreType: NeedsApprovalScoreType,
+			Score: flagScore(system), Status: ScorePending, Reason: reason, CreatedAt: now,
+		}}
+	}
+	r.Score = pendingScore(r)
+	es.Reviewables[r.ID] = r
+	es.NextReviewableID++
+	es.reviewableWebHook("reviewable_created", r)
+
+	pending := es.pendingPosts(u.ID)
+	cp := *r
+	return &NewPostResult{Queued: &cp, Pending: es.pendingPost(r), PendingCount: len(pending), Reason: reason}, nil
+}
+
+// validateSubmission checks a new topic or reply without creating it.
+// Caller must hold s.mu.
+func (s *Store) validateSubmission(u *model.User, params NewPostParams) error {
+	if params.TopicID == 0 {
+		return s.validateNewTopic(u, params.Title, params.Raw, params.CategoryID, params.Archetype)
+	}
+	t := s.Topics[params.TopicID]
+	if t == nil {
+		return fmt.Errorf("topic not found")
+	}
+	return s.validateNewPost(u, t, params.Raw)
+}
+
+// PendingPost is a queued post as Discourse's PendingPostSerializer shows
+// it to its author.
+type PendingPost struct {
+	ID             int       `json:"id"`
+	AvatarTemplate string    `json:"avatar_template"`
+	CategoryID     int       `json:"category_id"`
+	CreatedAt      time.Time `json:"created_at"`
+	CreatedByID    int       `json:"created_by_id"`
+	Name           string    `json:"name"`
+	RawText        string    `json:"raw_text"`
+	Title          string    `json:"title"`
+	TopicID        int       `json:"topic_id,omitempty"`
+	TopicURL       string    `json:"topic_url,omitempty"`
+	Username       string    `json:"username"`
+}
+
+// PendingPosts lists userID's posts awaiting approval, oldest first.
+func (es *ExtStore) PendingPosts(userID int) []PendingPost {
+	es.Store.mu.RLock()
+	defer es.Store.mu.RUnlock()
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+	out := []PendingPost{}
+	for _, r := range es.pendingPosts(userID) {
+		out = append(out, *es.pendingPost(r))
+	}
+	return out
+}
+
+// pendingPosts returns userID's pending queued posts, oldest first.
+// Caller must hold es.mu.
+func (es *ExtStore) pendingPosts(userID int) []*Reviewable {
+	var out []*Reviewable
+	for _, r := range es.Reviewables {
+		if r.Type == "ReviewableQueuedPost" && r.Status == ReviewablePending && r.CreatedByID == userID {
+			out = append(out, r)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// pendingPost serialises a queued post; replies take the title and URL
+// of the topic they were written for.
+// Caller must hold es.Store.mu and es.mu.
+func (es *ExtStore) pendingPost(r *Reviewable) *PendingPost {
+	pp := &PendingPost{
+		ID: r.ID, CategoryID: r.CategoryID, CreatedAt: r.CreatedAt, CreatedByID: r.CreatedByID,
+	}
+	pp.RawText, _ = r.Payload["raw"].(string)
+	pp.Title, _ = r.Payload["title"].(string)
+	if u := es.Users[r.CreatedByID]; u != nil {
+		pp.Username, pp.Name, pp.AvatarTemplate = u.Username, u.Name, u.AvatarTemplate
+	}
+	if t := es.Topics[r.TopicID]; t != nil {
+		pp.TopicID = t.ID
+		pp.Title = t.Title
+		pp.TopicURL = fmt.Sprintf("/t/%s/%d", t.Slug, t.ID)
+	}
+	return pp
+}
+
+// queuedParams rebuilds the submission held by a queued post.
+func queuedParams(r *Reviewable) NewPostParams {
+	params := NewPostParams{UserID: r.CreatedByID, CategoryID: r.CategoryID, TopicID: r.TopicID}
+	params.Raw, _ = r.Payload["raw"].(string)
+	params.Title, _ = r.Payload["title"].(string)
+	params.Archetype, _ = r.Payload["archetype"].(string)
+	params.Tags, _ = r.Payload["tags"].([]string)
+	params.TargetUsernames, _ = r.Payload["target_usernames"].([]string)
+	if n, ok := r.Payload["reply_to_post_number"].(int); ok {
+		params.ReplyToPostNumber = &n
+	}
+	return params
+}
+
+// performQueuedPost resolves a queued post: approve_post publishes it as
+// its author and points the reviewable at the new post, reject_post
+// discards it.
+// Caller must hold es.Store.mu; es.mu is taken here.
+func (es *ExtStore) performQueuedPost(r *Reviewable, reviewerID int, action string) (*Reviewable, *NewPostResult, error) {
+	var res *NewPostResult
+	var status, scoreStatus int
+	switch action {
+	case "approve_post":
+		u := es.Users[r.CreatedByID]
+		if u == nil {
+			return nil, nil, fmt.Errorf("user not found")
+		}
+		var err error
+		if res, err = es.publishPost(u, queuedParams(r)); err != nil {
+			return nil, nil, err
+		}
+		status, scoreStatus = ReviewableApproved, ScoreAgreed
+	case "reject_post":
+		status, scoreStatus = ReviewableRejected, ScoreDisagreed
+	default:
+		return nil, nil, ErrInvalidReviewAction
+	}
+
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	now := time.Now().UTC()
+	if res != nil {
+		r.TargetID, r.TargetType, r.TopicID = res.Post.ID, "Post", res.Post.TopicID
+	}
+	scores := make([]ReviewableScore, len(r.Scores))
+	for i, sc := range r.Scores {
+		if sc.Status == ScorePending {
+			sc.Status = scoreStatus
+			sc.ReviewedByID = &reviewerID
+			sc.ReviewedAt = &now
+		}
+		scores[i] = sc
+	}
+	r.Scores = scores
+	r.Status = status
+	r.Score = 0
+	r.Version++
+	r.UpdatedAt = now
+	es.reviewableWebHook("reviewable_updated", r)
+	cp := *r
+	return &cp, res, nil
+}
@@ -0,0 +1,186 @@
+package store
+
+import (
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lightcap/dtu-discourse/internal/model"
+)
+
+// PresenceTimeout is how long a client stays present in a channel without
+// renewing its presence, as PresenceChannel::DEFAULT_TIMEOUT.
+const PresenceTimeout = 60 * time.Second
+
+// presenceChannel tracks who is present in one channel: user id -> client
+// id -> when the client last said it was there.
+type presenceChannel map[int]map[string]time.Time
+
+// PresenceState is a channel's state as /presence/get returns it.
+type PresenceState struct {
+	Count         int               `json:"count"`
+	LastMessageID int               `json:"last_message_id"`
+	Users         []model.BasicUser `json:"users"`
+}
+
+// presenceAudience returns who may see the presence channel name, in the
+// manner of topicAudience. Replying is visible to everyone who can see
+// the topic, whispering to staff and editing to staff and the author of
+// the post being edited. ok is false for channels that don't exist.
+// Caller must hold s.mu.
+func (s *Store) presenceAudience(name string) (userIDs, groupIDs []int, ok bool) {
+	rest, found := strings.CutPrefix(name, "/discourse-presence/")
+	if !found {
+		return nil, nil, false
+	}
+	kind, idStr, _ := strings.Cut(rest, "/")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return nil, nil, false
+	}
+	var staff []int
+	if g := s.GroupsByName["staff"]; g != nil {
+		staff = []int{g.ID}
+	}
+	switch kind {
+	case "reply":
+		t := s.Topics[id]
+		if t == nil {
+			return nil, nil, false
+		}
+		userIDs, groupIDs = s.topicAudience(t)
+		return userIDs, groupIDs, true
+	case "whisper":
+		if s.Topics[id] == nil {
+			return nil, nil, false
+		}
+		return nil, staff, true
+	case "edit":
+		p := s.Posts[id]
+		if p == nil {
+			return nil, nil, false
+		}
+		return []int{p.UserID}, staff, true
+	}
+	return nil, nil, false
+}
+
+// inAudience reports whether userID is among userIDs or groupIDs; an
+// empty audience is everyone's.
+// Caller must hold s.mu.
+func (s *Store) inAudience(userID int, userIDs, groupIDs []int) bool {
+	if len(userIDs) == 0 && len(groupIDs) == 0 {
+		return true
+	}
+	if userID == 0 {
+		return false
+	}
+	if slices.Contains(userIDs, userID) {
+		return true
+	}
+	for _, id := range groupIDs {
+		if slices.Contains(s.GroupMembers[id], userID) {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdatePresence marks clientID of userID present in each of present and
+// gone from each of leave, publishing entering and leaving users on the
+// channels' message bus channels. It reports, for each present channel,
+// whether the user was allowed in.
+func (s *Store) UpdatePresence(userID int, clientID string, present, leave []string) map[string]bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.Users[userID]
+	res := make(map[string]bool, len(present))
+	for _, name := range present {
+		userIDs, groupIDs, ok := s.presenceAudience(name)
+		if !ok || u == nil || !s.inAudience(userID, userIDs, groupIDs) {
+			res[name] = false
+			continue
+		}
+		res[name] = true
+		s.expirePresence(name)
+		ch := s.Presence[name]
+		if ch == nil {
+			ch = presenceChannel{}
+			s.Presence[name] = ch
+		}
+		entering := ch[userID] == nil
+		if entering {
+			ch[userID] = map[string]time.Time{}
+		}
+		ch[userID][clientID] = time.Now()
+		if entering {
+			s.Bus.Publish("/presence"+name, map[string]interface{}{
+				"entering_users": []model.BasicUser{{ID: u.ID, Username: u.Username, Name: u.Name, AvatarTemplate: u.AvatarTemplate}},
+			}, userIDs, groupIDs)
+		}
+	}
+	for _, name := range leave {
+		if clients := s.Presence[name][userID]; clients != nil {
+			delete(clients, clientID)
+			if len(clients) == 0 {
+				s.leavePresence(name, userID)
+			}
+		}
+	}
+	return res
+}
+
+// GetPresence returns the state of the presence channel name as userID
+// (0 for anonymous) sees it, or nil when it doesn't exist or they may not
+// see it.
+func (s *Store) GetPresence(userID int, name string) *PresenceState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	userIDs, groupIDs, ok := s.presenceAudience(name)
+	if !ok || !s.inAudience(userID, userIDs, groupIDs) {
+		return nil
+	}
+	s.expirePresence(name)
+	state := &PresenceState{LastMessageID: s.Bus.LastID("/presence" + name), Users: []model.BasicUser{}}
+	ids := make([]int, 0, len(s.Presence[name]))
+	for id := range s.Presence[name] {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		if u := s.Users[id]; u != nil {
+			state.Users = append(state.Users, model.BasicUser{ID: u.ID, Username: u.Username, Name: u.Name, AvatarTemplate: u.AvatarTemplate})
+		}
+	}
+	state.Count = len(state.Users)
+	return state
+}
+
+// expirePresence drops the clients of name that haven't renewed their
+// presence within PresenceTimeout.
+// Caller must hold s.mu.
+func (s *Store) expirePresence(name string) {
+	cutoff := time.Now().Add(-PresenceTimeout)
+	for userID, clients := range s.Presence[name] {
+		for clientID, at := range clients {
+			if at.Before(cutoff) {
+				delete(clients, clientID)
+			}
+		}
+		if len(clients) == 0 {
+			s.leavePresence(name, userID)
+		}
+	}
+}
+
+// leavePresence removes userID from name and announces it.
+// Caller must hold s.mu.
+func (s *Store) leavePresence(name string, userID int) {
+	delete(s.Presence[name], userID)
+	userIDs, groupIDs, _ := s.presenceAudience(name)
+	s.Bus.Publish("/presence"+name, map[string]interface{}{
+		"leaving_user_ids": []int{userID},
+	}, userIDs, groupIDs)
+}
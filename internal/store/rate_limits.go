@@ -0,0 +1,266 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lightcap/dtu-discourse/internal/model"
+)
+
+// RateLimitError is returned when a request or action exceeds one of
+// Discourse's rate limits. WaitSeconds is how long until it may be retried.
+type RateLimitError struct {
+	Message     string
+	WaitSeconds int
+	TimeLeft    string
+	ErrorCode   string
+}
+
+func (e *RateLimitError) Error() string { return e.Message }
+
+// rateLimiter counts performances per key over a sliding window, as
+// Discourse's RateLimiter does with its Redis lists: an action is refused
+// once max performances fall inside the window, until the oldest expires.
+type rateLimiter struct {
+	mu     sync.Mutex
+	events map[string][]time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{events: make(map[string][]time.Time)}
+}
+
+// wait returns how long until key may be performed again, or zero.
+func (rl *rateLimiter) wait(key string, max int, window time.Duration, now time.Time) time.Duration {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.waitLocked(key, max, window, now)
+}
+
+func (rl *rateLimiter) waitLocked(key string, max int, window time.Duration, now time.Time) time.Duration {
+	events := rl.events[key]
+	for len(events) > 0 && now.Sub(events[0]) >= window {
+		events = events[1:]
+	}
+	rl.events[key] = events
+	if len(events) < max {
+		return 0
+	}
+	return events[len(events)-max].Add(window).Sub(now)
+}
+
+func (rl *rateLimiter) record(key string, now time.Time) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.events[key] = append(rl.events[key], now)
+}
+
+// perform records key unless it is limited, returning the wait otherwise.
+func (rl *rateLimiter) perform(key string, max int, window time.Duration, now time.Time) time.Duration {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if wait := rl.waitLocked(key, max, window, now); wait > 0 {
+		return wait
+	}
+	rl.events[key] = append(rl.events[key], now)
+	return 0
+}
+
+// actionLimit is one of the per-user limiters Discourse applies when a
+// user creates, likes, flags or edits: at most max in window.
+type actionLimit struct {
+	key    string
+	max    int
+	window time.Duration
+}
+
+// rateLimitMessages are Discourse's rate_limiter.by_type messages; other
+// limits use the generic message.
+var rateLimitMessages = map[string]string{
+	"create_topic":              "You’re creating topics too quickly. Please wait %s before trying again.",
+	"create_post":               "You’re replying too quickly. Please wait %s before trying again.",
+	"topics_per_day":            "You’ve reached the maximum number of new topics today. Please wait %s before trying again.",
+	"pms_per_day":               "You’ve reached the maximum number of messages today. Please wait %s before trying again.",
+	"create_like":               "Wow! You’ve been sharing the love! You’ve reached the maximum number of daily likes. Please wait %s before trying again.",
+	"first_day_topics_per_day":  "You’ve reached the maximum number of topics a new user can create on their first day. Please wait %s before trying again.",
+	"first_day_replies_per_day": "You’ve reached the maximum number of replies a new user can create on their first day. Please wait %s before trying again.",
+}
+
+const genericRateLimitMessage = "You’ve performed this action too many times. Please wait %s before trying again."
+
+// newRateLimitError describes a refusal the way RateLimiter::LimitExceeded does.
+func newRateLimitError(key string, wait time.Duration) *RateLimitError {
+	secs := int((wait + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	msg, ok := rateLimitMessages[key]
+	if !ok {
+		msg = genericRateLimitMessage
+	}
+	left := timeLeft(secs)
+	return &RateLimitError{Message: fmt.Sprintf(msg, left), WaitSeconds: secs, TimeLeft: left, ErrorCode: key}
+}
+
+// timeLeft renders a wait as Discourse's rate_limiter time strings do.
+func timeLeft(secs int) string {
+	plural := func(n int, unit string) string {
+		if n == 1 {
+			return "1 " + unit
+		}
+		return strconv.Itoa(n) + " " + unit + "s"
+	}
+	switch {
+	case secs <= 3:
+		return "a few seconds"
+	case secs < 60:
+		return plural(secs, "second")
+	case secs < 3600:
+		return plural(secs/60, "minute")
+	case secs < 86400:
+		return plural(secs/3600, "hour")
+	}
+	return plural(secs/86400, "day")
+}
+
+// newUserPosting reports whether u is held to the new-user posting limits:
+// below trust level 2 and either at trust level 0 or on their first day.
+func newUserPosting(u *model.User) bool {
+	return !isStaff(u) && u.TrustLevel < 2 && (u.TrustLevel == 0 || time.Since(u.CreatedAt) < 24*time.Hour)
+}
+
+// postLimits returns the limiters PostCreator applies to a new topic,
+// message or reply.
+// Caller must hold s.mu.
+func (s *Store) postLimits(u *model.User, params NewPostParams) []actionLimit {
+	newUser := newUserPosting(u)
+	if params.TopicID == 0 {
+		seconds := s.siteSettingInt("rate_limit_create_topic")
+		if newUser {
+			seconds = s.siteSettingInt("rate_limit_new_user_create_topic")
+		}
+		limits := []actionLimit{{"create_topic", 1, time.Duration(seconds) * time.Second}}
+		if params.Archetype == "private_message" {
+			return append(limits, actionLimit{"pms_per_day", s.siteSettingInt("max_personal_messages_per_day"), 24 * time.Hour})
+		}
+		limits = append(limits, actionLimit{"topics_per_day", s.siteSettingInt("max_topics_per_day"), 24 * time.Hour})
+		if newUser {
+			limits = append(limits, actionLimit{"first_day_topics_per_day", s.siteSettingInt("max_topics_in_first_day"), 24 * time.Hour})
+		}
+		return limits
+	}
+	seconds := s.siteSettingInt("rate_limit_create_post")
+	if newUser {
+		seconds = s.siteSettingInt("rate_limit_new_user_create_post")
+	}
+	limits := []actionLimit{{"create_post", 1, time.Duration(seconds) * time.Second}}
+	if newUser {
+		limits = append(limits, actionLimit{"first_day_replies_per_day", s.siteSettingInt("max_replies_in_first_day"), 24 * time.Hour})
+	}
+	return limits
+}
+
+// postActionLimits returns the daily like or flag limit for a post action.
+// Higher trust levels get more likes per day, as in Discourse.
+// Caller must hold s.mu.
+func (s *Store) postActionLimits(u *model.User, actionTypeID int) []actionLimit {
+	switch {
+	case actionTypeID == 2:
+		max := float64(s.siteSettingInt("max_likes_per_day"))
+		if u.TrustLevel >= 2 && u.TrustLevel <= 4 {
+			max *= s.siteSettingFloat(fmt.Sprintf("tl%d_additional_likes_per_day_multiplier", u.TrustLevel))
+		}
+		return []actionLimit{{"create_like", int(max), 24 * time.Hour}}
+	case IsFlagType(actionTypeID):
+		return []actionLimit{{"create_flag", s.siteSettingInt("max_flags_per_day"), 24 * time.Hour}}
+	}
+	return nil
+}
+
+// editLimits returns the daily edit limit.
+// Caller must hold s.mu.
+func (s *Store) editLimits() []actionLimit {
+	return []actionLimit{{"edit_post", s.siteSettingInt("max_edits_per_day"), 24 * time.Hour}}
+}
+
+// checkLimits refuses an action u has performed too often. Staff are
+// exempt, and a limit of zero is off.
+// Caller must hold s.mu.
+func (s *Store) checkLimits(u *model.User, limits []actionLimit) error {
+	if s.RateLimitsDisabled || isStaff(u) {
+		return nil
+	}
+	now := time.Now()
+	for _, l := range limits {
+		if l.max <= 0 || l.window <= 0 {
+			continue
+		}
+		if wait := s.limiter.wait(userLimitKey(u, l.key), l.max, l.window, now); wait > 0 {
+			return newRateLimitError(l.key, wait)
+		}
+	}
+	return nil
+}
+
+// recordLimits counts an action that went ahead against u's limits.
+// Caller must hold s.mu.
+func (s *Store) recordLimits(u *model.User, limits []actionLimit) {
+	if s.RateLimitsDisabled || isStaff(u) {
+		return
+	}
+	now := time.Now()
+	for _, l := range limits {
+		if l.max > 0 && l.window > 0 {
+			s.limiter.record(userLimitKey(u, l.key), now)
+		}
+	}
+}
+
+func userLimitKey(u *model.User, key string) string {
+	return "user:" + strconv.Itoa(u.ID) + ":" + key
+}
+
+// CheckRequestLimits applies the global request limits: per IP address
+// over ten seconds and over a minute, and per API key over a minute.
+// A limit of zero is off.
+func (s *Store) CheckRequestLimits(ip, apiKey string) error {
+	s.mu.RLock()
+	disabled := s.RateLimitsDisabled
+	per10s := s.siteSettingInt("max_reqs_per_ip_per_10_seconds")
+	perMin := s.siteSettingInt("max_reqs_per_ip_per_minute")
+	perKey := s.siteSettingInt("max_admin_api_reqs_per_minute")
+	s.mu.RUnlock()
+	if disabled {
+		return nil
+	}
+	now := time.Now()
+	if ip != "" {
+		if per10s > 0 {
+			if wait := s.limiter.perform("ip_10s:"+ip, per10s, 10*time.Second, now); wait > 0 {
+				return requestLimitError("ip_10_secs_limit", wait)
+			}
+		}
+		if perMin > 0 {
+			if wait := s.limiter.perform("ip_60s:"+ip, perMin, time.Minute, now); wait > 0 {
+				return requestLimitError("ip_60_secs_limit", wait)
+			}
+		}
+	}
+	if apiKey != "" && perKey > 0 {
+		if wait := s.limiter.perform("api_key:"+apiKey, perKey, time.Minute, now); wait > 0 {
+			return requestLimitError("admin_api_key_rate_limit", wait)
+		}
+	}
+	return nil
+}
+
+func requestLimitError(code string, wait time.Duration) *RateLimitError {
+	e := newRateLimitError(code, wait)
+	if strings.HasPrefix(code, "ip_") {
+		e.Message = fmt.Sprintf("Slow down, too many requests from this IP address. Please retry again in %d seconds. Error code: %s.", e.WaitSeconds, code)
+	}
+	return e
+}
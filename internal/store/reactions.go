@@ -0,0 +1,288 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lightcap/dtu-discourse/internal/model"
+)
+
+// ErrReactionNotAllowed is returned for reactions outside
+// discourse_reactions_enabled_reactions and the main reaction.
+var ErrReactionNotAllowed = errors.New("reaction is not enabled on this site")
+
+// ReactionUser is one user's discourse-reactions reaction to a post. As in
+// the plugin, the main reaction (discourse_reactions_reaction_for_like) is
+// not stored here: it is a like, kept as a post action.
+type ReactionUser struct {
+	ID        int       `json:"id"`
+	PostID    int       `json:"post_id"`
+	UserID    int       `json:"user_id"`
+	Reaction  string    `json:"reaction_value"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ReactionUsersEntry groups the users who reacted to a post with one emoji.
+type ReactionUsersEntry struct {
+	ID    string            `json:"id"`
+	Type  string            `json:"type"`
+	Count int               `json:"count"`
+	Users []model.BasicUser `json:"users"`
+}
+
+// UserReaction is one reaction a user gave, as listed by
+// /discourse-reactions/posts/reactions.json.
+type UserReaction struct {
+	ID        int             `json:"id"`
+	UserID    int             `json:"user_id"`
+	PostID    int             `json:"post_id"`
+	CreatedAt time.Time       `json:"created_at"`
+	User      model.BasicUser `json:"user"`
+	Post      model.Post      `json:"post"`
+	Reaction  struct {
+		ReactionType  string `json:"reaction_type"`
+		ReactionValue string `json:"reaction_value"`
+	} `json:"reaction"`
+}
+
+// mainReaction returns the emoji that stands for a like.
+// Caller must hold es.Store.mu.
+func (es *ExtStore) mainReaction() string {
+	if v := es.siteSettingString("discourse_reactions_reaction_for_like"); v != "" {
+		return v
+	}
+	return "heart"
+}
+
+// reactionAllowed reports whether reaction may be used on this site.
+// Caller must hold es.Store.mu.
+func (es *ExtStore) reactionAllowed(reaction string) bool {
+	if reaction == es.mainReaction() {
+		return true
+	}
+	for _, r := range strings.Split(es.siteSettingString("discourse_reactions_enabled_reactions"), "|") {
+		if r == reaction {
+			return true
+		}
+	}
+	return false
+}
+
+// userReaction returns userID's non-like reaction to a post.
+// Caller must hold es.mu.
+func (es *ExtStore) userReaction(postID, userID int) *ReactionUser {
+	for _, ru := range es.ReactionUsers {
+		if ru.PostID == postID && ru.UserID == userID {
+			return ru
+		}
+	}
+	return nil
+}
+
+// ToggleReaction adds userID's reaction to a post, replacing any reaction
+// they gave before, or removes it if it is the one they already gave.
+// It reports whether the reaction was added. Removing a reaction is
+// subject to post_undo_action_window_mins, like undoing a like.
+func (es *ExtStore) ToggleReaction(postID, userID int, reaction string) (bool, error) {
+	es.Store.mu.Lock()
+	defer es.Store.mu.Unlock()
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if _, ok := es.Posts[postID]; !ok {
+		return false, fmt.Errorf("post not found")
+	}
+	if !es.reactionAllowed(reaction) {
+		return false, ErrReactionNotAllowed
+	}
+	main := es.mainReaction()
+	current := es.userReaction(postID, userID)
+	liked := es.findPostAction(postID, userID, 2) != nil
+
+	// Take back whatever the user reacted with before.
+	switch {
+	case liked:
+		if err := es.deletePostAction(postID, userID, 2); err != nil {
+			return false, err
+		}
+		if reaction == main {
+			return false, nil
+		}
+	case current != nil:
+		window := time.Duration(es.siteSettingInt("post_undo_action_window_mins")) * time.Minute
+		if time.Since(current.CreatedAt) > window {
+			return false, ErrUndoWindowPassed
+		}
+		delete(es.ReactionUsers, current.ID)
+		es.gamifyReaction(es.Posts[postID], userID, true)
+		if current.Reaction == reaction {
+			return false, nil
+		}
+	}
+
+	if reaction == main {
+		if _, err := es.createPostAction(postID, userID, 2); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	ru := &ReactionUser{
+		ID: es.NextReactionUserID, PostID: postID, UserID: userID,
+		Reaction: reaction, CreatedAt: time.Now().UTC(),
+	}
+	es.ReactionUsers[ru.ID] = ru
+	es.NextReactionUserID++
+	es.gamifyReaction(es.Posts[postID], userID, false)
+	return true, nil
+}
+
+// ApplyReactions fills in p's reactions, reaction_users_count and the
+// current_user_* fields as seen by viewerID (0 for anonymous).
+func (es *ExtStore) ApplyReactions(p *model.Post, viewerID int) {
+	es.Store.mu.RLock()
+	defer es.Store.mu.RUnlock()
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+	es.applyReactions(p, viewerID)
+}
+
+// applyReactions is ApplyReactions without locking.
+// Caller must hold es.Store.mu and es.mu.
+func (es *ExtStore) applyReactions(p *model.Post, viewerID int) {
+	main := es.mainReaction()
+	window := time.Duration(es.siteSettingInt("post_undo_action_window_mins")) * time.Minute
+	counts := map[string]int{}
+	p.ReactionUsersCount = 0
+	p.CurrentUserReaction = nil
+	p.CurrentUserUsedMainReaction = false
+	for _, pa := range es.PostActions {
+		if pa.PostID != p.ID || pa.PostActionTypeID != 2 {
+			continue
+		}
+		counts[main]++
+		p.ReactionUsersCount++
+		if viewerID != 0 && pa.UserID == viewerID {
+			p.CurrentUserUsedMainReaction = true
+			p.CurrentUserReaction = &model.CurrentUserReaction{
+				ID: main, Type: "emoji", CanUndo: time.Since(pa.CreatedAt) <= window,
+			}
+		}
+	}
+	for _, ru := range es.ReactionUsers {
+		if ru.PostID != p.ID {
+			continue
+		}
+		counts[ru.Reaction]++
+		p.ReactionUsersCount++
+		if viewerID != 0 && ru.UserID == viewerID {
+			p.CurrentUserReaction = &model.CurrentUserReaction{
+				ID: ru.Reaction, Type: "emoji", CanUndo: time.Since(ru.CreatedAt) <= window,
+			}
+		}
+	}
+	p.Reactions = make([]model.PostReaction, 0, len(counts))
+	for id, n := range counts {
+		p.Reactions = append(p.Reactions, model.PostReaction{ID: id, Type: "emoji", Count: n})
+	}
+	sort.Slice(p.Reactions, func(i, j int) bool {
+		if p.Reactions[i].Count != p.Reactions[j].Count {
+			return p.Reactions[i].Count > p.Reactions[j].Count
+		}
+		return p.Reactions[i].ID < p.Reactions[j].ID
+	})
+}
+
+// PostReactionUsers lists who reacted to a post, grouped by reaction and
+// optionally limited to a single reaction value.
+func (es *ExtStore) PostReactionUsers(postID int, reaction string) ([]ReactionUsersEntry, error) {
+	es.Store.mu.RLock()
+	defer es.Store.mu.RUnlock()
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+	p, ok := es.Posts[postID]
+	if !ok {
+		return nil, fmt.Errorf("post not found")
+	}
+	type given struct {
+		userID int
+		at     time.Time
+	}
+	byReaction := map[string][]given{}
+	main := es.mainReaction()
+	for _, pa := range es.PostActions {
+		if pa.PostID == p.ID && pa.PostActionTypeID == 2 {
+			byReaction[main] = append(byReaction[main], given{pa.UserID, pa.CreatedAt})
+		}
+	}
+	for _, ru := range es.ReactionUsers {
+		if ru.PostID == p.ID {
+			byReaction[ru.Reaction] = append(byReaction[ru.Reaction], given{ru.UserID, ru.CreatedAt})
+		}
+	}
+
+	out := []ReactionUsersEntry{}
+	for id, list := range byReaction {
+		if reaction != "" && id != reaction {
+			continue
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].at.After(list[j].at) })
+		entry := ReactionUsersEntry{ID: id, Type: "emoji", Count: len(list), Users: []model.BasicUser{}}
+		for _, g := range list {
+			if u := es.Users[g.userID]; u != nil {
+				entry.Users = append(entry.Users, model.BasicUser{
+					ID: u.ID, Username: u.Username, Name: u.Name, AvatarTemplate: u.AvatarTemplate,
+				})
+			}
+		}
+		out = append(out, entry)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out, nil
+}
+
+// UserReactions lists the reactions userID has given, likes included,
+// newest first.
+func (es *ExtStore) UserReactions(userID int) []UserReaction {
+	es.Store.mu.RLock()
+	defer es.Store.mu.RUnlock()
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+	u := es.Users[userID]
+	if u == nil {
+		return []UserReaction{}
+	}
+	basic := model.BasicUser{ID: u.ID, Username: u.Username, Name: u.Name, AvatarTemplate: u.AvatarTemplate}
+
+	out := []UserReaction{}
+	add := func(id, postID int, value string, at time.Time) {
+		p := es.Posts[postID]
+		if p == nil {
+			return
+		}
+		ur := UserReaction{ID: id, UserID: userID, PostID: postID, CreatedAt: at, User: basic, Post: *p}
+		es.applyReactions(&ur.Post, userID)
+		ur.Reaction.ReactionType = "emoji"
+		ur.Reaction.ReactionValue = value
+		out = append(out, ur)
+	}
+	main := es.mainReaction()
+	for _, pa := range es.PostActions {
+		if pa.UserID == userID && pa.PostActionTypeID == 2 {
+			add(pa.ID, pa.PostID, main, pa.CreatedAt)
+		}
+	}
+	for _, ru := range es.ReactionUsers {
+		if ru.UserID == userID {
+			add(ru.ID, ru.PostID, ru.Reaction, ru.CreatedAt)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out
+}
@@ -0,0 +1,101 @@
+package store
+
+import (
+	"fmt"
+
+	"github.com/lightcap/dtu-discourse/internal/model"
+)
+
+// postByNumber finds a post by its number within a topic.
+// Caller must hold s.mu.
+func (s *Store) postByNumber(topicID, postNumber int) *model.Post {
+	for _, p := range s.PostsByTopic[topicID] {
+		if p.PostNumber == postNumber {
+			return p
+		}
+	}
+	return nil
+}
+
+// directReplies returns the posts replying to p, in post-number order.
+// Caller must hold s.mu.
+func (s *Store) directReplies(p *model.Post) []*model.Post {
+	var out []*model.Post
+	for _, c := range s.PostsByTopic[p.TopicID] {
+		if c.ReplyToPostNumber != nil && *c.ReplyToPostNumber == p.PostNumber {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// GetPostReplies returns the direct replies to a post.
+func (s *Store) GetPostReplies(id int) ([]model.Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.Posts[id]
+	if !ok {
+		return nil, fmt.Errorf("post not found")
+	}
+	replies := s.directReplies(p)
+	out := make([]model.Post, 0, len(replies))
+	for _, c := range replies {
+		out = append(out, *c)
+	}
+	return out, nil
+}
+
+// GetPostReplyHistory returns the chain of posts a post replies to, oldest
+// first and excluding the post itself, keeping at most max ancestors.
+func (s *Store) GetPostReplyHistory(id, max int) ([]model.Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.Posts[id]
+	if !ok {
+		return nil, fmt.Errorf("post not found")
+	}
+	var chain []model.Post
+	seen := map[int]bool{p.ID: true}
+	for p.ReplyToPostNumber != nil && len(chain) < max {
+		parent := s.postByNumber(p.TopicID, *p.ReplyToPostNumber)
+		if parent == nil || seen[parent.ID] {
+			break
+		}
+		seen[parent.ID] = true
+		chain = append(chain, *parent)
+		p = parent
+	}
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	return chain, nil
+}
+
+// GetPostReplyIDs walks every reply below a post breadth-first, tagging
+// each with its depth beneath the post.
+func (s *Store) GetPostReplyIDs(id int) ([]model.PostReplyID, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.Posts[id]
+	if !ok {
+		return nil, fmt.Errorf("post not found")
+	}
+	out := []model.PostReplyID{}
+	seen := map[int]bool{p.ID: true}
+	level := []*model.Post{p}
+	for depth := 1; len(level) > 0; depth++ {
+		var next []*model.Post
+		for _, parent := range level {
+			for _, c := range s.directReplies(parent) {
+				if seen[c.ID] {
+					continue
+				}
+				seen[c.ID] = true
+				out = append(out, model.PostReplyID{ID: c.ID, Level: depth})
+				next = append(next, c)
+			}
+		}
+		level = next
+	}
+	return out, nil
+}
@@ -0,0 +1,312 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"time"
+
+	"github.com/lightcap/dtu-discourse/internal/model"
+)
+
+// ErrEditConflict is returned when an edit was made against raw that has
+// since been changed by someone else.
+var ErrEditConflict = errors.New("someone else edited this post")
+
+// Revisions are numbered after the post version they produce, so a post's
+// original text is version 1 and its first edit is revision 2. Edits hold
+// es.Store.mu while taking es.mu to record the revision, which keeps the
+// per-post list in version order; nothing takes the locks the other way.
+
+// RevisePost replaces a post's raw on behalf of editorID and records the
+// edit as a revision. When originalText is set and no longer matches the
+// post's raw, the edit is rejected with ErrEditConflict. An edit that
+// leaves raw unchanged is a no-op.
+func (es *ExtStore) RevisePost(postID, editorID int, raw, originalText, editReason string) (*model.Post, error) {
+	es.Store.mu.Lock()
+	defer es.Store.mu.Unlock()
+	p, ok := es.Posts[postID]
+	if !ok {
+		return nil, fmt.Errorf("post not found")
+	}
+	if originalText != "" && originalText != p.Raw {
+		return nil, ErrEditConflict
+	}
+	if err := es.checkBlocked(raw); err != nil {
+		return nil, err
+	}
+	if err := es.checkEditLimit(editorID); err != nil {
+		return nil, err
+	}
+	previousRaw, previousCooked := p.Raw, p.Cooked
+	es.revise(p, editorID, raw, nil, editReason)
+	es.recordEdit(editorID)
+	if p.Raw != previousRaw {
+		es.publishPostChange(p, "revised", editorID)
+		es.postWebHook("post_edited", p)
+		es.gamifyPostEdited(p, editorID)
+		es.badgesOnRevision(p, editorID)
+		if t := es.Topics[p.TopicID]; t != nil && p.PostNumber == 1 {
+			es.topicWebHook("topic_revised", t)
+		}
+	}
+	if p.Cooked != previousCooked {
+		es.alertPostEdited(p, editorID, previousCooked)
+	}
+	return p, nil
+}
+
+// ReviseTopic applies updates to a topic and records title, category and
+// tag changes as a revision of its first post.
+func (es *ExtStore) ReviseTopic(topicID, editorID int, updates map[string]interface{}) (*model.Topic, error) {
+	es.Store.mu.Lock()
+	defer es.Store.mu.Unlock()
+	t, ok := es.Topics[topicID]
+	if !ok {
+		return nil, fmt.Errorf("topic not found")
+	}
+	if title, ok := updates["title"].(string); ok {
+		if err := es.checkBlocked(title); err != nil {
+			return nil, err
+		}
+	}
+	if err := es.checkEditLimit(editorID); err != nil {
+		return nil, err
+	}
+	defer es.recordEdit(editorID)
+	defer es.topicWebHook("topic_edited", t)
+	editReason, _ := updates["edit_reason"].(string)
+	for _, p := range es.PostsByTopic[topicID] {
+		if p.PostNumber == 1 {
+			es.revise(p, editorID, p.Raw, updates, editReason)
+			return t, nil
+		}
+	}
+	es.applyTopicUpdates(t, updates)
+	return t, nil
+}
+
+// checkEditLimit refuses an edit once the editor has used up
+// max_edits_per_day.
+// Caller must hold s.mu.
+func (s *Store) checkEditLimit(editorID int) error {
+	if u := s.Users[editorID]; u != nil {
+		return s.checkLimits(u, s.editLimits())
+	}
+	return nil
+}
+
+// recordEdit counts an edit against the editor's daily limit.
+// Caller must hold s.mu.
+func (s *Store) recordEdit(editorID int) {
+	if u := s.Users[editorID]; u != nil {
+		s.recordLimits(u, s.editLimits())
+	}
+}
+
+// RevertPostRevision undoes the changes made by revision number of a post,
+// recording the revert itself as a new revision.
+func (es *ExtStore) RevertPostRevision(postID, number, editorID int) (*model.Post, error) {
+	rev, err := es.PostRevisionByNumber(postID, number)
+	if err != nil {
+		return nil, err
+	}
+	es.Store.mu.Lock()
+	defer es.Store.mu.Unlock()
+	p, ok := es.Posts[postID]
+	if !ok {
+		return nil, fmt.Errorf("post not found")
+	}
+	raw := p.Raw
+	if _, ok := rev.Modifications["raw"]; ok {
+		raw = rev.PreviousRaw
+	}
+	updates := map[string]interface{}{}
+	if v, ok := rev.Modifications["title"].([]interface{}); ok {
+		updates["title"] = v[0]
+	}
+	if v, ok := rev.Modifications["category_id"].([]interface{}); ok {
+		updates["category_id"] = float64(v[0].(int))
+	}
+	if v, ok := rev.Modifications["tags"].([]interface{}); ok {
+		updates["tags"] = v[0]
+	}
+	reason := fmt.Sprintf("reverted to version #%d", number-1)
+	if es.revise(p, editorID, raw, updates, reason) == nil {
+		return nil, fmt.Errorf("revision is already the current version")
+	}
+	return p, nil
+}
+
+// revise applies a new raw and, for a topic's first post, topic updates to
+// p, then records the changes. Edits inside the grace period are folded
+// into the current version rather than starting a new one. It returns the
+// revision holding the changes, or nil when nothing revisable changed or
+// the post is still on its original version. Caller must hold es.Store.mu.
+func (es *ExtStore) revise(p *model.Post, editorID int, raw string, topicUpdates map[string]interface{}, editReason string) *PostRevision {
+	mods := map[string]interface{}{}
+	if raw != p.Raw {
+		mods["raw"] = []interface{}{p.Raw, raw}
+	}
+	if t := es.Topics[p.TopicID]; t != nil && p.PostNumber == 1 && len(topicUpdates) > 0 {
+		title, categoryID, tags := t.Title, t.CategoryID, slices.Clone(t.Tags)
+		es.applyTopicUpdates(t, topicUpdates)
+		if t.Title != title {
+			mods["title"] = []interface{}{title, t.Title}
+		}
+		if t.CategoryID != categoryID {
+			mods["category_id"] = []interface{}{categoryID, t.CategoryID}
+		}
+		if !slices.Equal(tags, t.Tags) {
+			mods["tags"] = []interface{}{tags, slices.Clone(t.Tags)}
+		}
+	}
+	if len(mods) == 0 {
+		return nil
+	}
+
+	previousRaw, previousCooked := p.Raw, p.Cooked
+	// Topic-only edits still touch the first post.
+	es.editPost(p, raw)
+	es.filterPost(p)
+	if _, ok := mods["raw"]; ok {
+		mods["cooked"] = []interface{}{previousCooked, p.Cooked}
+	}
+	if editReason == "" && es.inGracePeriod(p, editorID, previousRaw, raw) {
+		return es.foldIntoCurrentVersion(p, mods)
+	}
+	if editReason != "" {
+		mods["edit_reason"] = []interface{}{nil, editReason}
+	}
+	p.Version++
+	rev := &PostRevision{
+		PostID: p.ID, UserID: editorID, Number: p.Version,
+		PreviousRaw: previousRaw, CurrentRaw: p.Raw,
+		PreviousCooked: previousCooked, CurrentCooked: p.Cooked,
+		EditReason: editReason, CreatedAt: p.UpdatedAt, Modifications: mods,
+	}
+
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	rev.ID = es.NextPostRevisionID
+	es.NextPostRevisionID++
+	es.PostRevisions[rev.ID] = rev
+	es.PostRevisionsByPost[p.ID] = append(es.PostRevisionsByPost[p.ID], rev)
+	return rev
+}
+
+// inGracePeriod reports whether an edit can be folded into the post's
+// current version: the same user made that version within
+// editing_grace_period seconds and the raw changed by no more than
+// editing_grace_period_max_diff characters (the _high_trust variant for
+// staff and trust level 2+). Caller must hold es.Store.mu.
+func (es *ExtStore) inGracePeriod(p *model.Post, editorID int, before, after string) bool {
+	lastEditorID, lastVersionAt := p.UserID, p.CreatedAt
+	if p.Version > 1 {
+		es.mu.RLock()
+		revs := es.PostRevisionsByPost[p.ID]
+		var latest *PostRevision
+		if len(revs) > 0 {
+			latest = revs[len(revs)-1]
+		}
+		es.mu.RUnlock()
+		if latest == nil || latest.Number != p.Version {
+			return false
+		}
+		lastEditorID, lastVersionAt = latest.UserID, latest.CreatedAt
+	}
+	if lastEditorID != editorID {
+		return false
+	}
+	grace := time.Duration(es.siteSettingInt("editing_grace_period")) * time.Second
+	if time.Since(lastVersionAt) > grace {
+		return false
+	}
+	maxDiff := es.siteSettingInt("editing_grace_period_max_diff")
+	if u := es.Users[editorID]; u != nil && (u.Admin || u.Moderator || u.TrustLevel > 1) {
+		maxDiff = es.siteSettingInt("editing_grace_period_max_diff_high_trust")
+	}
+	return changedChars(before, after) <= maxDiff
+}
+
+// foldIntoCurrentVersion merges a grace-period edit into the revision that
+// produced the post's current version, keeping that revision's original
+// "previous" values. Caller must hold es.Store.mu.
+func (es *ExtStore) foldIntoCurrentVersion(p *model.Post, mods map[string]interface{}) *PostRevision {
+	if p.Version == 1 {
+		return nil
+	}
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	revs := es.PostRevisionsByPost[p.ID]
+	rev := revs[len(revs)-1]
+	rev.CurrentRaw, rev.CurrentCooked = p.Raw, p.Cooked
+	merged := make(map[string]interface{}, len(rev.Modifications)+len(mods))
+	for k, v := range rev.Modifications {
+		merged[k] = v
+	}
+	for k, v := range mods {
+		change := v.([]interface{})
+		if prev, ok := merged[k].([]interface{}); ok {
+			change = []interface{}{prev[0], change[1]}
+		}
+		if reflect.DeepEqual(change[0], change[1]) {
+			delete(merged, k)
+			continue
+		}
+		merged[k] = change
+	}
+	rev.Modifications = merged
+	return rev
+}
+
+// changedChars approximates the size of an edit as the length of the
+// longer side once the common prefix and suffix are removed.
+func changedChars(before, after string) int {
+	a, b := []rune(before), []rune(after)
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		a, b = a[1:], b[1:]
+	}
+	for len(a) > 0 && len(b) > 0 && a[len(a)-1] == b[len(b)-1] {
+		a, b = a[:len(a)-1], b[:len(b)-1]
+	}
+	return max(len(a), len(b))
+}
+
+// PostRevisionByNumber returns a copy of the revision that produced version
+// number of a post.
+func (es *ExtStore) PostRevisionByNumber(postID, number int) (*PostRevision, error) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+	for _, r := range es.PostRevisionsByPost[postID] {
+		if r.Number == number {
+			cp := *r
+			return &cp, nil
+		}
+	}
+	return nil, fmt.Errorf("revision not found")
+}
+
+// SetPostRevisionHidden hides a revision from non-staff users, or shows it again.
+func (es *ExtStore) SetPostRevisionHidden(postID, number int, hidden bool) error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	for _, r := range es.PostRevisionsByPost[postID] {
+		if r.Number == number {
+			r.Hidden = hidden
+			return nil
+		}
+	}
+	return fmt.Errorf("revision not found")
+}
+
+// DeletePostRevisions permanently removes a post's edit history.
+func (es *ExtStore) DeletePostRevisions(postID int) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	for _, r := range es.PostRevisionsByPost[postID] {
+		delete(es.PostRevisions, r.ID)
+	}
+	delete(es.PostRevisionsByPost, postID)
+}
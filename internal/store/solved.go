@@ -0,0 +1,177 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lightcap/dtu-discourse/internal/cook"
+	"github.com/lightcap/dtu-discourse/internal/model"
+)
+
+// ErrCannotAcceptAnswer is returned when a user may not accept or unaccept
+// a post as its topic's solution.
+var ErrCannotAcceptAnswer = errors.New("you are not permitted to accept this answer")
+
+// solvedEnabled reports whether solutions can be accepted in t: either
+// everywhere via allow_solved_on_all_topics, or in categories with the
+// enable_accepted_answers custom field. Private messages never qualify.
+// Caller must hold s.mu.
+func (s *Store) solvedEnabled(t *model.Topic) bool {
+	if t.Archetype == "private_message" {
+		return false
+	}
+	if s.siteSettingBool("allow_solved_on_all_topics") {
+		return true
+	}
+	c := s.Categories[t.CategoryID]
+	return c != nil && customFieldBool(c, "enable_accepted_answers")
+}
+
+// customFieldBool reads a boolean category custom field, which clients
+// send either as a JSON bool or as the string "true".
+func customFieldBool(c *model.Category, name string) bool {
+	switch v := c.CustomFields[name].(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// canAcceptAnswer applies discourse-solved's guardian: staff, users at
+// accept_all_solutions_trust_level and, when accept_solutions_topic_author
+// is on, the topic's author may pick any reply as the solution.
+// Caller must hold s.mu.
+func (s *Store) canAcceptAnswer(t *model.Topic, p *model.Post, u *model.User) bool {
+	if u == nil || p.PostNumber == 1 || !s.solvedEnabled(t) {
+		return false
+	}
+	if u.Admin || u.Moderator {
+		return true
+	}
+	if level := s.siteSettingInt("accept_all_solutions_trust_level"); level > 0 && u.TrustLevel >= level {
+		return true
+	}
+	if first := s.postByNumber(t.ID, 1); first != nil && first.UserID == u.ID {
+		return s.siteSettingBool("accept_solutions_topic_author")
+	}
+	return false
+}
+
+// AcceptAnswer marks a post as its topic's solution on behalf of userID,
+// replacing any previously accepted answer.
+func (s *Store) AcceptAnswer(postID, userID int) (*model.AcceptedAnswer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, t, err := s.solvedTarget(postID)
+	if err != nil {
+		return nil, err
+	}
+	u := s.Users[userID]
+	if !s.canAcceptAnswer(t, p, u) {
+		return nil, ErrCannotAcceptAnswer
+	}
+	for _, other := range s.PostsByTopic[t.ID] {
+		if other.AcceptedAnswer && other.ID != p.ID {
+			s.gamifySolution(other, userID, true)
+		}
+		other.AcceptedAnswer = other.ID == p.ID
+		other.TopicAcceptedAnswer = true
+	}
+	t.HasAcceptedAnswer = true
+	t.AcceptedAnswer = &model.AcceptedAnswer{
+		PostNumber: p.PostNumber, Username: p.Username, Name: p.Name,
+		Excerpt:          cook.Excerpt(p.Cooked, 200),
+		AccepterUsername: u.Username, AccepterName: u.Name,
+	}
+	s.solvedWebHook("accepted_solution", p)
+	s.gamifySolution(p, userID, false)
+	cp := *t.AcceptedAnswer
+	return &cp, nil
+}
+
+// UnacceptAnswer clears a post's accepted-answer state.
+func (s *Store) UnacceptAnswer(postID, userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, t, err := s.solvedTarget(postID)
+	if err != nil {
+		return err
+	}
+	if !s.canAcceptAnswer(t, p, s.Users[userID]) {
+		return ErrCannotAcceptAnswer
+	}
+	if !p.AcceptedAnswer {
+		return fmt.Errorf("post is not the accepted answer")
+	}
+	for _, other := range s.PostsByTopic[t.ID] {
+		other.AcceptedAnswer = false
+		other.TopicAcceptedAnswer = false
+	}
+	t.HasAcceptedAnswer = false
+	t.AcceptedAnswer = nil
+	s.solvedWebHook("unaccepted_solution", p)
+	s.gamifySolution(p, userID, true)
+	return nil
+}
+
+// ApplySolved fills in p's can_accept_answer and can_unaccept_answer for
+// viewerID.
+func (s *Store) ApplySolved(p *model.Post, viewerID int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p.CanAcceptAnswer, p.CanUnacceptAnswer = false, false
+	t := s.Topics[p.TopicID]
+	if t == nil || !s.canAcceptAnswer(t, p, s.Users[viewerID]) {
+		return
+	}
+	p.CanAcceptAnswer = !p.AcceptedAnswer
+	p.CanUnacceptAnswer = p.AcceptedAnswer
+}
+
+// solvedTarget resolves a post and its topic.
+// Caller must hold s.mu.
+func (s *Store) solvedTarget(postID int) (*model.Post, *model.Topic, error) {
+	p, ok := s.Posts[postID]
+	if !ok {
+		return nil, nil, fmt.Errorf("post not found")
+	}
+	t, ok := s.Topics[p.TopicID]
+	if !ok {
+		return nil, nil, fmt.Errorf("topic not found")
+	}
+	return p, t, nil
+}
+
+// splitSolvedFilter pulls a status:solved or status:unsolved filter out
+// of a search term, returning the remaining term and the filter value.
+func splitSolvedFilter(term string) (string, string) {
+	var rest []string
+	status := ""
+	for _, f := range strings.Fields(term) {
+		switch strings.ToLower(f) {
+		case "status:solved":
+			status = "solved"
+		case "status:unsolved":
+			status = "unsolved"
+		default:
+			rest = append(rest, f)
+		}
+	}
+	return strings.Join(rest, " "), status
+}
+
+// matchesSolvedFilter reports whether t passes a status:solved or
+// status:unsolved filter. Unsolved only matches topics that can be solved.
+// Caller must hold s.mu.
+func (s *Store) matchesSolvedFilter(t *model.Topic, status string) bool {
+	switch status {
+	case "solved":
+		return t.HasAcceptedAnswer
+	case "unsolved":
+		return !t.HasAcceptedAnswer && s.solvedEnabled(t)
+	}
+	return true
+}
@@ -6,12 +6,19 @@ package store
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/lightcap/dtu-discourse/internal/mailer"
+	"github.com/lightcap/dtu-discourse/internal/messagebus"
 	"github.com/lightcap/dtu-discourse/internal/model"
+	"github.com/lightcap/dtu-discourse/internal/webhook"
 )
 
 type Store struct {
@@ -50,9 +57,15 @@ type Store struct {
 
 	Notifications map[int][]*model.Notification // user_id -> notifications
 	NextNotifID   int
+	SeenNotificationIDs map[int]int // user_id -> newest notification id the user has seen
+
+	TopicAllowedUsers       map[int][]int       // topic_id -> user_ids allowed in a private message
+	TopicNotificationLevels map[int]map[int]int // topic_id -> user_id -> level
+	CategoryNotificationLevels map[int]map[int]int // category_id -> user_id -> level
 
 	Invites       map[int]*model.Invite
 	NextInviteID  int
+	InviteInviters map[int]int // invite_id -> user_id of the inviter
 
 	Uploads       map[int]*model.Upload
 	NextUploadID  int
@@ -68,6 +81,36 @@ type Store struct {
 	SSOSecret      string
 	SSOCallbackURL string
 	SSONonces      map[string]time.Time
+
+	// Bus carries the real-time updates clients poll /message-bus for.
+	Bus *messagebus.Bus
+	Presence map[string]presenceChannel // presence channel name -> who is present
+
+	// Outbox keeps every email the forum sends, rendered from EmailTemplates.
+	Outbox         *mailer.Outbox
+	EmailTemplates *mailer.Templates
+	EmailTokens    map[string]*EmailToken // token -> email token
+	ReplyKeys      map[string]*PostReplyKey // reply key -> the post and user a notification email was about
+
+	// Hooks delivers events to the admin web hooks. ExtStore keeps it
+	// told about them.
+	Hooks *webhook.Emitter
+
+	// Gamification, when set, is sent the points-worthy things users do.
+	// gamificationIDs counts the events sent about each thing.
+	Gamification    *webhook.Dispatcher
+	gamificationIDs map[string]int
+	// WebhooksSync holds each API response back until the webhooks it set
+	// off have been delivered.
+	WebhooksSync bool
+
+	// IncomingEmails are the emails received through handle_mail, oldest first.
+	IncomingEmails      []*IncomingEmail
+	NextIncomingEmailID int
+
+	// RateLimitsDisabled turns off every request and action rate limit.
+	RateLimitsDisabled bool
+	limiter            *rateLimiter
 }
 
 func New() *Store {
@@ -89,12 +132,28 @@ func New() *Store {
 		Badges:         make(map[int]*model.Badge),
 		UserBadges:     make(map[int][]*model.UserBadge),
 		Notifications:  make(map[int][]*model.Notification),
+		SeenNotificationIDs: make(map[int]int),
+		TopicAllowedUsers:       make(map[int][]int),
+		TopicNotificationLevels: make(map[int]map[int]int),
+		CategoryNotificationLevels: make(map[int]map[int]int),
 		Invites:        make(map[int]*model.Invite),
+		InviteInviters: make(map[int]int),
 		Uploads:        make(map[int]*model.Upload),
 		SiteSettings:   make(map[string]*model.SiteSetting),
 		PostActions:    make(map[int]*model.PostAction),
+		Bus:            messagebus.New(),
+		Presence:       make(map[string]presenceChannel),
+		Outbox:         mailer.NewOutbox("http://localhost:4200"),
+		EmailTemplates: mailer.NewTemplates(),
+		EmailTokens:    make(map[string]*EmailToken),
+		ReplyKeys:      make(map[string]*PostReplyKey),
+		Hooks:          webhook.NewEmitter("http://localhost:4200"),
+		gamificationIDs: make(map[string]int),
+		NextIncomingEmailID: 1,
+		NextInviteID:        1,
 		APIKeys:        make(map[string]string),
 		SSONonces:      make(map[string]time.Time),
+		limiter:        newRateLimiter(),
 	}
 	s.seed()
 	return s
@@ -118,20 +177,20 @@ func (s *Store) seed() {
 		ID: 1, Username: "admin", Name: "Admin User",
 		Email: "admin@example.com", AvatarTemplate: "/letter_avatar_proxy/v4/letter/a/e9a140/{size}.png",
 		Active: true, Admin: true, Moderator: true, TrustLevel: 4,
-		CreatedAt: now.Add(-30 * 24 * time.Hour), Approved: true,
+		CreatedAt: now.Add(-30 * 24 * time.Hour), LastSeenAt: now.Add(-24 * time.Hour), Approved: true,
 	}
 	user1 := &model.User{
 		ID: 2, Username: "alice", Name: "Alice Wonderland",
 		Email: "alice@example.com", AvatarTemplate: "/letter_avatar_proxy/v4/letter/a/d0a95e/{size}.png",
 		Active: true, Admin: false, Moderator: false, TrustLevel: 2,
-		CreatedAt: now.Add(-20 * 24 * time.Hour), Approved: true,
+		CreatedAt: now.Add(-20 * 24 * time.Hour), LastSeenAt: now.Add(-2 * 24 * time.Hour), Approved: true,
 		ExternalID: "ext-alice",
 	}
 	user2 := &model.User{
 		ID: 3, Username: "bob", Name: "Bob Builder",
 		Email: "bob@example.com", AvatarTemplate: "/letter_avatar_proxy/v4/letter/b/b4e14e/{size}.png",
 		Active: true, Admin: false, Moderator: false, TrustLevel: 1,
-		CreatedAt: now.Add(-10 * 24 * time.Hour), Approved: true,
+		CreatedAt: now.Add(-10 * 24 * time.Hour), LastSeenAt: now.Add(-3 * 24 * time.Hour), Approved: true,
 		ExternalID: "ext-bob",
 	}
 	for _, u := range []*model.User{systemUser, admin, user1, user2} {
@@ -157,6 +216,7 @@ func (s *Store) seed() {
 		Description: "Get help here", DescriptionText: "Get help here",
 		TopicCount: 1, PostCount: 1, Position: 1, TopicURL: "/t/about-the-support-category/2",
 		CanEdit: true, NumFeaturedTopics: 3, DefaultView: "latest",
+		CustomFields: map[string]interface{}{"enable_accepted_answers": "true"},
 		CreatedAt: now.Add(-30 * 24 * time.Hour), UpdatedAt: now,
 	}
 	cat3 := &model.Category{
@@ -220,8 +280,9 @@ func (s *Store) seed() {
 		Raw: "Welcome to Discourse! This is your first topic.", Cooked: "<p>Welcome to Discourse! This is your first topic.</p>",
 		PostNumber: 1, PostType: 1, TopicID: 1, TopicSlug: "welcome-to-discourse",
 		DisplayUsername: "Admin User", Version: 1, UserID: 1, TrustLevel: 4,
-		CanEdit: true, CanDelete: true, CanWiki: true,
+		ReplyCount: 1, CanEdit: true, CanDelete: true, CanWiki: true,
 	}
+	replyToFirst := 1
 	post2 := &model.Post{
 		ID: 2, Username: "alice", Name: "Alice Wonderland",
 		AvatarTemplate: user1.AvatarTemplate,
@@ -229,6 +290,8 @@ func (s *Store) seed() {
 		Raw: "Thanks for the warm welcome!", Cooked: "<p>Thanks for the warm welcome!</p>",
 		PostNumber: 2, PostType: 1, TopicID: 1, TopicSlug: "welcome-to-discourse",
 		DisplayUsername: "Alice Wonderland", Version: 1, UserID: 2, TrustLevel: 2,
+		ReplyToPostNumber: &replyToFirst,
+		ReplyToUser: &model.ReplyToUser{Username: admin.Username, Name: admin.Name, AvatarTemplate: admin.AvatarTemplate},
 		ReplyCount: 0, CanEdit: true, CanDelete: true, CanWiki: true,
 	}
 	post3 := &model.Post{
@@ -250,11 +313,18 @@ func (s *Store) seed() {
 		CanEdit: true, CanDelete: true, CanWiki: true,
 	}
 	for _, p := range []*model.Post{post1, post2, post3, post4} {
+		s.refreshActionsSummary(p)
 		s.Posts[p.ID] = p
 		s.PostsByTopic[p.TopicID] = append(s.PostsByTopic[p.TopicID], p)
 	}
 	s.NextPostID = 5
 
+	// Topic creators watch their topics; repliers track them.
+	s.TopicNotificationLevels[1] = map[int]int{1: NotificationLevelWatching, 2: NotificationLevelTracking}
+	s.TopicNotificationLevels[2] = map[int]int{1: NotificationLevelWatching}
+	s.TopicNotificationLevels[3] = map[int]int{3: NotificationLevelWatching}
+	s.NextNotifID = 1
+
 	// --- Groups ---
 	staffGroup := &model.Group{
 		ID: 1, Name: "staff", DisplayName: "Staff", Automatic: true,
@@ -281,17 +351,8 @@ func (s *Store) seed() {
 	}
 
 	// --- Badges ---
-	s.Badges[1] = &model.Badge{
-		ID: 1, Name: "Basic", Description: "Granted when you complete the basic tutorial",
-		GrantCount: 2, AllowTitle: false, MultipleGrant: false, Icon: "certificate",
-		Listable: true, Enabled: true, BadgeGroupingID: 1, System: true, BadgeTypeID: 3,
-	}
-	s.Badges[2] = &model.Badge{
-		ID: 2, Name: "Member", Description: "Granted when you reach trust level 2",
-		GrantCount: 1, AllowTitle: false, MultipleGrant: false, Icon: "certificate",
-		Listable: true, Enabled: true, BadgeGroupingID: 1, System: true, BadgeTypeID: 3,
-	}
-	s.NextBadgeID = 3
+	s.NextUserBadgeID = 1
+	s.seedBadges()
 
 	// --- Site Settings ---
 	defaults := map[string]interface{}{
@@ -302,9 +363,62 @@ func (s *Store) seed() {
 		"min_topic_title_length": 5,
 		"max_topic_title_length": 255,
 		"min_post_length":    10,
+		"min_first_post_length": 10,
 		"max_post_length":    32000,
+		"min_personal_message_title_length": 2,
+		"min_personal_message_post_length":  10,
+		"title_min_entropy":                 10,
+		"allow_uppercase_posts":             false,
+		"unique_posts_mins":                 5,
+		"max_mentions_per_post":             10,
+		"newuser_max_mentions_per_post":     2,
+		"newuser_max_links":                 2,
+		"newuser_max_embedded_media":        1,
+		"watched_words_regular_expressions": false,
+		"approve_post_count":                0,
+		"approve_unless_trust_level":        0,
+		"approve_new_topics_unless_trust_level": 0,
 		"tagging_enabled":    true,
 		"max_tags_per_topic": 5,
+		"editing_grace_period":                    300,
+		"editing_grace_period_max_diff":           100,
+		"editing_grace_period_max_diff_high_trust": 400,
+		"post_undo_action_window_mins":            10,
+		"score_to_hide_post":                      8,
+		"allow_solved_on_all_topics":              false,
+		"accept_solutions_topic_author":           true,
+		"accept_all_solutions_trust_level":        4,
+		"discourse_reactions_reaction_for_like":   "heart",
+		"discourse_reactions_enabled_reactions":   "laughing|open_mouth|cry|angry|thumbsup|hugs",
+		"rate_limit_create_topic":                 15,
+		"rate_limit_create_post":                  5,
+		"rate_limit_new_user_create_topic":        120,
+		"rate_limit_new_user_create_post":         30,
+		"max_topics_per_day":                      20,
+		"max_personal_messages_per_day":           20,
+		"max_topics_in_first_day":                 3,
+		"max_replies_in_first_day":                10,
+		"max_likes_per_day":                       50,
+		"tl2_additional_likes_per_day_multiplier": 1.5,
+		"tl3_additional_likes_per_day_multiplier": 2,
+		"tl4_additional_likes_per_day_multiplier": 3,
+		"max_flags_per_day":                       20,
+		"max_edits_per_day":                       30,
+		"max_reqs_per_ip_per_minute":              0,
+		"max_reqs_per_ip_per_10_seconds":          0,
+		"max_admin_api_reqs_per_minute":           0,
+		"notification_consolidation_threshold":    3,
+		"likes_notification_consolidation_window_mins": 120,
+		"notification_email":                      "noreply@example.com",
+		"email_prefix":                            "",
+		"disable_emails":                          "no",
+		"email_token_valid_hours":                 48,
+		"min_password_length":                     10,
+		"digest_topics":                           20,
+		"reply_by_email_enabled":                  false,
+		"reply_by_email_address":                  "",
+		"email_in":                                false,
+		"email_in_min_trust":                      2,
 	}
 	for k, v := range defaults {
 		s.SiteSettings[k] = &model.SiteSetting{Setting: k, Value: v, Default: v}
@@ -331,9 +445,25 @@ func (s *Store) GetUserByExternalID(extID string) *model.User {
 	return s.UsersByExtID[extID]
 }
 
-func (s *Store) CreateUser(name, username, email, password string) (*model.User, error) {
+// CreateUser registers a user. Unless created active, the account waits
+// for the user to follow the activation link emailed to them.
+func (s *Store) CreateUser(name, username, email, password string, active bool) (*model.User, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	u, err := s.createUser(name, username, email, active)
+	if err != nil {
+		return nil, err
+	}
+	s.userWebHook("user_created", u)
+	s.gamifyUserCreated(u)
+	if !active {
+		s.emailSignup(u)
+	}
+	return u, nil
+}
+
+// Caller must hold s.mu.
+func (s *Store) createUser(name, username, email string, active bool) (*model.User, error) {
 	lower := strings.ToLower(username)
 	if _, exists := s.UsersByName[lower]; exists {
 		return nil, fmt.Errorf("username already taken")
@@ -343,7 +473,7 @@ func (s *Store) CreateUser(name, username, email, password string) (*model.User,
 	}
 	u := &model.User{
 		ID: s.NextUserID, Username: username, Name: name,
-		Email: email, Active: true, TrustLevel: 0, Approved: true,
+		Email: email, Active: active, TrustLevel: 0, Approved: true,
 		AvatarTemplate: fmt.Sprintf("/letter_avatar_proxy/v4/letter/%s/b4e14e/{size}.png", string(lower[0])),
 		CreatedAt: time.Now().UTC(),
 	}
@@ -369,6 +499,11 @@ func (s *Store) UpdateUser(id int, updates map[string]interface{}) (*model.User,
 	}
 	if v, ok := updates["trust_level"].(float64); ok {
 		u.TrustLevel = int(v)
+		s.badgesOnTrustLevel(u)
+	}
+	if v, ok := updates["bio_raw"].(string); ok {
+		u.BioRaw = v
+		s.badgesOnProfile(u)
 	}
 	if v, ok := updates["active"].(bool); ok {
 		u.Active = v
@@ -379,9 +514,16 @@ func (s *Store) UpdateUser(id int, updates map[string]interface{}) (*model.User,
 	if v, ok := updates["moderator"].(bool); ok {
 		u.Moderator = v
 	}
-	if v, ok := updates["suspended"].(bool); ok {
+	if v, ok := updates["suspended"].(bool); ok && v != u.Suspended {
 		u.Suspended = v
+		if v {
+			s.userWebHook("user_suspended", u)
+		} else {
+			s.userWebHook("user_unsuspended", u)
+		}
+		return u, nil
 	}
+	s.userWebHook("user_updated", u)
 	return u, nil
 }
 
@@ -392,6 +534,7 @@ func (s *Store) DeleteUser(id int) error {
 	if !ok {
 		return fmt.Errorf("user not found")
 	}
+	s.userWebHook("user_destroyed", u)
 	delete(s.Users, id)
 	delete(s.UsersByName, strings.ToLower(u.Username))
 	delete(s.UsersByEmail, u.Email)
@@ -492,6 +635,7 @@ func (s *Store) CreateCategory(name, slug, color, textColor string) (*model.Cate
 	s.Categories[c.ID] = c
 	s.CategoriesBySlug[slug] = c
 	s.NextCategoryID++
+	s.categoryWebHook("category_created", c)
 	return c, nil
 }
 
@@ -520,7 +664,29 @@ func (s *Store) UpdateCategory(id int, updates map[string]interface{}) (*model.C
 		c.Description = v
 		c.DescriptionText = v
 	}
+	if v, ok := updates["permissions"].(map[string]interface{}); ok {
+		c.GroupPermissions = parseGroupPermissions(v)
+		c.ReadRestricted = readRestricted(c)
+	}
+	if v, ok := updates["email_in"].(string); ok {
+		c.EmailIn = v
+	}
+	switch v := updates["email_in_allow_strangers"].(type) {
+	case bool:
+		c.EmailInAllowStrangers = v
+	case string:
+		c.EmailInAllowStrangers = v == "true"
+	}
+	if v, ok := updates["custom_fields"].(map[string]interface{}); ok {
+		if c.CustomFields == nil {
+			c.CustomFields = map[string]interface{}{}
+		}
+		for k, val := range v {
+			c.CustomFields[k] = val
+		}
+	}
 	c.UpdatedAt = time.Now().UTC()
+	s.categoryWebHook("category_updated", c)
 	return c, nil
 }
 
@@ -531,6 +697,7 @@ func (s *Store) DeleteCategory(id int) error {
 	if !ok {
 		return fmt.Errorf("category not found")
 	}
+	s.categoryWebHook("category_destroyed", c)
 	delete(s.Categories, id)
 	delete(s.CategoriesBySlug, c.Slug)
 	return nil
@@ -670,10 +837,18 @@ func (s *Store) GetTopicByExternalID(extID string) *model.Topic {
 func (s *Store) CreateTopic(title, raw string, categoryID, userID int, tags []string, archetype string) (*model.Topic, *model.Post, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	return s.createTopic(title, raw, categoryID, userID, tags, archetype)
+}
+
+// createTopic is CreateTopic for callers already holding s.mu.
+func (s *Store) createTopic(title, raw string, categoryID, userID int, tags []string, archetype string) (*model.Topic, *model.Post, error) {
 	u := s.Users[userID]
 	if u == nil {
 		return nil, nil, fmt.Errorf("user not found")
 	}
+	if err := s.validateNewTopic(u, title, raw, categoryID, archetype); err != nil {
+		return nil, nil, err
+	}
 	now := time.Now().UTC()
 	slug := strings.ToLower(strings.ReplaceAll(title, " ", "-"))
 	if archetype == "" {
@@ -699,11 +874,12 @@ func (s *Store) CreateTopic(title, raw string, categoryID, userID int, tags []st
 		ID: s.NextPostID, Username: u.Username, Name: u.Name,
 		AvatarTemplate: u.AvatarTemplate,
 		CreatedAt: now, UpdatedAt: now, Raw: raw,
-		Cooked: "<p>" + raw + "</p>",
+		Cooked: s.cook(raw),
 		PostNumber: 1, PostType: 1, TopicID: t.ID, TopicSlug: slug,
 		DisplayUsername: u.Name, Version: 1, UserID: userID,
 		TrustLevel: u.TrustLevel, CanEdit: true, CanDelete: true, CanWiki: true,
 	}
+	s.refreshActionsSummary(p)
 	s.Posts[p.ID] = p
 	s.PostsByTopic[t.ID] = append(s.PostsByTopic[t.ID], p)
 	s.NextPostID++
@@ -723,6 +899,14 @@ func (s *Store) UpdateTopic(id int, updates map[string]interface{}) (*model.Topi
 	if !ok {
 		return nil, fmt.Errorf("topic not found")
 	}
+	s.applyTopicUpdates(t, updates)
+	s.topicWebHook("topic_edited", t)
+	return t, nil
+}
+
+// applyTopicUpdates copies the editable fields present in updates onto t.
+// Caller must hold s.mu.
+func (s *Store) applyTopicUpdates(t *model.Topic, updates map[string]interface{}) {
 	if v, ok := updates["title"].(string); ok {
 		t.Title = v
 		t.FancyTitle = v
@@ -733,7 +917,19 @@ func (s *Store) UpdateTopic(id int, updates map[string]interface{}) (*model.Topi
 	if v, ok := updates["visible"].(bool); ok {
 		t.Visible = v
 	}
-	return t, nil
+	switch v := updates["tags"].(type) {
+	case []string:
+		t.Tags = v
+	case []interface{}:
+		tags := make([]string, 0, len(v))
+		for _, tag := range v {
+			if name, ok := tag.(string); ok && name != "" {
+				tags = append(tags, name)
+			}
+		}
+		t.Tags = tags
+	}
+	s.ensureTags(t.Tags)
 }
 
 func (s *Store) DeleteTopic(id int) error {
@@ -747,9 +943,14 @@ func (s *Store) DeleteTopic(id int) error {
 		cat.TopicCount--
 		cat.PostCount -= len(s.PostsByTopic[id])
 	}
+	if first := s.postByNumber(id, 1); first != nil {
+		s.gamifyTopicDeleted(t, first.UserID)
+	}
 	for _, p := range s.PostsByTopic[id] {
 		delete(s.Posts, p.ID)
 	}
+	s.publishTopicDeleted(t)
+	s.topicWebHook("topic_destroyed", t)
 	delete(s.PostsByTopic, id)
 	delete(s.Topics, id)
 	return nil
@@ -774,6 +975,7 @@ func (s *Store) UpdateTopicStatus(id int, status string, enabled bool) (*model.T
 	case "pinned_globally":
 		t.PinnedGlobally = enabled
 	}
+	s.topicWebHook("topic_edited", t)
 	return t, nil
 }
 
@@ -822,6 +1024,11 @@ func (s *Store) GetTopicPosts(topicID int, postIDs []int) []model.Post {
 func (s *Store) CreatePost(topicID int, raw string, userID int, replyTo *int) (*model.Post, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	return s.createPost(topicID, raw, userID, replyTo)
+}
+
+// createPost is CreatePost for callers already holding s.mu.
+func (s *Store) createPost(topicID int, raw string, userID int, replyTo *int) (*model.Post, error) {
 	t, ok := s.Topics[topicID]
 	if !ok {
 		return nil, fmt.Errorf("topic not found")
@@ -830,10 +1037,20 @@ func (s *Store) CreatePost(topicID int, raw string, userID int, replyTo *int) (*
 	if u == nil {
 		return nil, fmt.Errorf("user not found")
 	}
+	if err := s.validateNewPost(u, t, raw); err != nil {
+		return nil, err
+	}
 	now := time.Now().UTC()
+	// A reply to a post that doesn't exist is treated as a plain reply
+	// to the topic.
+	var parent *model.Post
+	if replyTo != nil {
+		if parent = s.postByNumber(topicID, *replyTo); parent == nil {
+			replyTo = nil
+		}
+	}
 	t.PostsCount++
 	t.HighestPostNumber++
-	t.ReplyCount++
 	t.LastPostedAt = now
 	t.BumpedAt = now
 	t.LastPosterUsername = u.Username
@@ -853,13 +1070,21 @@ func (s *Store) CreatePost(topicID int, raw string, userID int, replyTo *int) (*
 		ID: s.NextPostID, Username: u.Username, Name: u.Name,
 		AvatarTemplate: u.AvatarTemplate,
 		CreatedAt: now, UpdatedAt: now, Raw: raw,
-		Cooked: "<p>" + raw + "</p>",
+		Cooked: s.cook(raw),
 		PostNumber: t.HighestPostNumber, PostType: 1, TopicID: topicID,
 		TopicSlug: t.Slug, DisplayUsername: u.Name, Version: 1,
 		UserID: userID, TrustLevel: u.TrustLevel,
 		ReplyToPostNumber: replyTo,
 		CanEdit: true, CanDelete: true, CanWiki: true,
 	}
+	if parent != nil {
+		parent.ReplyCount++
+		t.ReplyCount++
+		if pu := s.Users[parent.UserID]; pu != nil {
+			p.ReplyToUser = &model.ReplyToUser{Username: pu.Username, Name: pu.Name, AvatarTemplate: pu.AvatarTemplate}
+		}
+	}
+	s.refreshActionsSummary(p)
 	s.Posts[p.ID] = p
 	s.PostsByTopic[topicID] = append(s.PostsByTopic[topicID], p)
 	s.NextPostID++
@@ -878,13 +1103,19 @@ func (s *Store) UpdatePost(id int, raw string) (*model.Post, error) {
 	if !ok {
 		return nil, fmt.Errorf("post not found")
 	}
-	p.Raw = raw
-	p.Cooked = "<p>" + raw + "</p>"
+	s.editPost(p, raw)
 	p.Version++
-	p.UpdatedAt = time.Now().UTC()
 	return p, nil
 }
 
+// editPost replaces a post's raw and re-cooks it. Versioning is left to
+// the caller. Caller must hold s.mu.
+func (s *Store) editPost(p *model.Post, raw string) {
+	p.Raw = raw
+	p.Cooked = s.cook(raw)
+	p.UpdatedAt = time.Now().UTC()
+}
+
 func (s *Store) DeletePost(id int) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -897,6 +1128,12 @@ func (s *Store) DeletePost(id int) error {
 		if cat, catOk := s.Categories[t.CategoryID]; catOk {
 			cat.PostCount--
 		}
+		if p.ReplyToPostNumber != nil {
+			if parent := s.postByNumber(p.TopicID, *p.ReplyToPostNumber); parent != nil {
+				parent.ReplyCount--
+				t.ReplyCount--
+			}
+		}
 	}
 	posts := s.PostsByTopic[p.TopicID]
 	for i, tp := range posts {
@@ -905,6 +1142,20 @@ func (s *Store) DeletePost(id int) error {
 			break
 		}
 	}
+	for paID, pa := range s.PostActions {
+		if pa.PostID != id {
+			continue
+		}
+		if pa.PostActionTypeID == 2 { // like
+			if t, ok := s.Topics[p.TopicID]; ok {
+				t.LikeCount--
+			}
+		}
+		delete(s.PostActions, paID)
+	}
+	s.publishPostChange(p, "deleted", p.UserID)
+	s.postWebHook("post_destroyed", p)
+	s.gamifyPostDeleted(p)
 	delete(s.Posts, id)
 	return nil
 }
@@ -961,10 +1212,14 @@ func (s *Store) CreateGroup(name string, attrs map[string]interface{}) (*model.G
 	if v, ok := attrs["full_name"].(string); ok {
 		g.FullName = v
 	}
+	if v, ok := attrs["mentionable_level"].(float64); ok {
+		g.MentionableLevel = int(v)
+	}
 	s.Groups[g.ID] = g
 	s.GroupsByName[name] = g
 	s.GroupMembers[g.ID] = []int{}
 	s.NextGroupID++
+	s.groupWebHook("group_created", g)
 	return g, nil
 }
 
@@ -983,7 +1238,11 @@ func (s *Store) UpdateGroup(id int, updates map[string]interface{}) (*model.Grou
 	if v, ok := updates["full_name"].(string); ok {
 		g.FullName = v
 	}
+	if v, ok := updates["mentionable_level"].(float64); ok {
+		g.MentionableLevel = int(v)
+	}
 	g.UpdatedAt = time.Now().UTC()
+	s.groupWebHook("group_updated", g)
 	return g, nil
 }
 
@@ -994,6 +1253,7 @@ func (s *Store) DeleteGroup(id int) error {
 	if !ok {
 		return fmt.Errorf("group not found")
 	}
+	s.groupWebHook("group_destroyed", g)
 	delete(s.Groups, id)
 	delete(s.GroupsByName, g.Name)
 	delete(s.GroupMembers, id)
@@ -1108,15 +1368,22 @@ func (s *Store) GetGroupMembers(groupID int) ([]model.BasicUser, []model.BasicUs
 func (s *Store) Search(term string) model.SearchResult {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
+	term, status := splitSolvedFilter(term)
 	lower := strings.ToLower(term)
 	var posts []model.Post
 	var topics []model.Topic
 	for _, p := range s.Posts {
+		if t := s.Topics[p.TopicID]; status != "" && (t == nil || !s.matchesSolvedFilter(t, status)) {
+			continue
+		}
 		if strings.Contains(strings.ToLower(p.Raw), lower) || strings.Contains(strings.ToLower(p.Cooked), lower) {
 			posts = append(posts, *p)
 		}
 	}
 	for _, t := range s.Topics {
+		if !s.matchesSolvedFilter(t, status) {
+			continue
+		}
 		if strings.Contains(strings.ToLower(t.Title), lower) {
 			topics = append(topics, *t)
 		}
@@ -1142,6 +1409,68 @@ func (s *Store) ListTags() []model.Tag {
 	return result
 }
 
+// CreateTag adds an unused tag.
+func (s *Store) CreateTag(name string) (*model.Tag, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return nil, fmt.Errorf("tag name is required")
+	}
+	if _, exists := s.Tags[name]; exists {
+		return nil, fmt.Errorf("tag already exists")
+	}
+	s.NextTagID++
+	tag := &model.Tag{ID: s.NextTagID, TagName: name, Name: name}
+	s.Tags[name] = tag
+	s.tagWebHook("tag_created", tag)
+	cp := *tag
+	return &cp, nil
+}
+
+// RenameTag renames a tag, retagging its topics.
+func (s *Store) RenameTag(name, newName string) (*model.Tag, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tag, ok := s.Tags[name]
+	if !ok {
+		return nil, fmt.Errorf("tag not found")
+	}
+	newName = strings.ToLower(strings.TrimSpace(newName))
+	if newName != "" && newName != name {
+		if _, exists := s.Tags[newName]; exists {
+			return nil, fmt.Errorf("tag already exists")
+		}
+		delete(s.Tags, name)
+		tag.TagName, tag.Name = newName, newName
+		s.Tags[newName] = tag
+		for _, t := range s.Topics {
+			if i := slices.Index(t.Tags, name); i >= 0 {
+				t.Tags[i] = newName
+			}
+		}
+	}
+	s.tagWebHook("tag_updated", tag)
+	cp := *tag
+	return &cp, nil
+}
+
+// DeleteTag removes a tag from the site and its topics.
+func (s *Store) DeleteTag(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tag, ok := s.Tags[name]
+	if !ok {
+		return fmt.Errorf("tag not found")
+	}
+	for _, t := range s.Topics {
+		t.Tags = slices.DeleteFunc(t.Tags, func(n string) bool { return n == name })
+	}
+	s.tagWebHook("tag_destroyed", tag)
+	delete(s.Tags, name)
+	return nil
+}
+
 // ---------- Badge Operations ----------
 
 func (s *Store) ListBadges() []model.Badge {
@@ -1179,6 +1508,17 @@ func (s *Store) UpdateBadge(id int, updates map[string]interface{}) (*model.Badg
 	if v, ok := updates["description"].(string); ok {
 		b.Description = v
 	}
+	for key, field := range map[string]*bool{
+		"enabled": &b.Enabled, "multiple_grant": &b.MultipleGrant,
+		"allow_title": &b.AllowTitle, "listable": &b.Listable,
+	} {
+		switch v := updates[key].(type) {
+		case bool:
+			*field = v
+		case string:
+			*field = v == "true"
+		}
+	}
 	return b, nil
 }
 
@@ -1192,22 +1532,6 @@ func (s *Store) DeleteBadge(id int) error {
 	return nil
 }
 
-func (s *Store) GrantUserBadge(userID, badgeID int) (*model.UserBadge, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if _, ok := s.Badges[badgeID]; !ok {
-		return nil, fmt.Errorf("badge not found")
-	}
-	ub := &model.UserBadge{
-		ID: s.NextUserBadgeID, GrantedAt: time.Now().UTC(),
-		BadgeID: badgeID, UserID: userID, GrantedByID: 1,
-	}
-	s.UserBadges[userID] = append(s.UserBadges[userID], ub)
-	s.Badges[badgeID].GrantCount++
-	s.NextUserBadgeID++
-	return ub, nil
-}
-
 func (s *Store) GetUserBadges(username string) ([]model.Badge, []model.UserBadge) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -1231,36 +1555,79 @@ func (s *Store) GetUserBadges(username string) ([]model.Badge, []model.UserBadge
 	return badges, userBadges
 }
 
-// ---------- Notification Operations ----------
+// ---------- Invite Operations ----------
 
-func (s *Store) GetNotifications(userID int) []model.Notification {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	notifs := s.Notifications[userID]
-	result := make([]model.Notification, 0, len(notifs))
-	for _, n := range notifs {
-		result = append(result, *n)
-	}
-	return result
+// InviteParams describes an invite to the forum, or to a topic.
+type InviteParams struct {
+	InviterID int
+	Email     string
+	GroupIDs  []int
+	TopicID   *int
+	// SkipEmail creates the invite without emailing it.
+	SkipEmail bool
 }
 
-// ---------- Invite Operations ----------
-
-func (s *Store) CreateInvite(email string, groupIDs []int, topicID *int) (*model.Invite, error) {
+// CreateInvite creates an invite, emailing it when it is for an address.
+func (s *Store) CreateInvite(params InviteParams) (*model.Invite, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	now := time.Now().UTC()
 	inv := &model.Invite{
-		ID: s.NextInviteID, Email: email,
+		ID: s.NextInviteID, Email: params.Email,
 		Link: fmt.Sprintf("/invites/%d", s.NextInviteID),
 		MaxRedemptionsAllowed: 1, CreatedAt: now, UpdatedAt: now,
 		ExpiresAt: now.Add(7 * 24 * time.Hour),
 	}
 	s.Invites[inv.ID] = inv
+	s.InviteInviters[inv.ID] = params.InviterID
 	s.NextInviteID++
+	if params.Email != "" && !params.SkipEmail {
+		var t *model.Topic
+		if params.TopicID != nil {
+			t = s.Topics[*params.TopicID]
+		}
+		s.emailInvite(inv, s.Users[params.InviterID], t)
+	}
 	return inv, nil
 }
 
+// ErrInviteInvalid is returned for redeeming an invite that doesn't
+// exist, has expired or has been used up.
+var ErrInviteInvalid = errors.New("Invite is invalid or expired")
+
+// RedeemInvite signs up a user through invite id. An invite for an
+// address can only be redeemed with that address.
+func (s *Store) RedeemInvite(id int, name, username, email string) (*model.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inv := s.Invites[id]
+	if inv == nil || time.Now().After(inv.ExpiresAt) || inv.RedemptionCount >= inv.MaxRedemptionsAllowed {
+		return nil, ErrInviteInvalid
+	}
+	if inv.Email != "" {
+		if email != "" && !strings.EqualFold(email, inv.Email) {
+			return nil, ErrInviteInvalid
+		}
+		email = inv.Email
+	}
+	if username == "" || email == "" {
+		return nil, fmt.Errorf("username and email are required")
+	}
+	u, err := s.createUser(name, username, email, true)
+	if err != nil {
+		return nil, err
+	}
+	inv.RedemptionCount++
+	inv.UpdatedAt = time.Now().UTC()
+	s.userWebHook("user_created", u)
+	s.gamifyUserCreated(u)
+	s.gamify(webhook.GamificationPayload{
+		DiscourseUserID: s.InviteInviters[id], Action: "invite_redeemed",
+		DiscourseResourceID: id, CounterpartyDiscourseUserID: counterparty(u.ID),
+	}, id, u.ID)
+	return u, nil
+}
+
 // ---------- Upload Operations ----------
 
 func (s *Store) CreateUpload(filename, ext string, filesize int) *model.Upload {
@@ -1291,6 +1658,80 @@ func (s *Store) GetSiteSettings() []model.SiteSetting {
 	return result
 }
 
+// siteSettingInt reads a numeric setting, which may have been stored as an
+// int by the seed or as a float64 or string by the admin API.
+// Caller must hold s.mu.
+func (s *Store) siteSettingInt(name string) int {
+	ss, ok := s.SiteSettings[name]
+	if !ok {
+		return 0
+	}
+	switch v := ss.Value.(type) {
+	case int:
+		return v
+	case float64:
+		return int(v)
+	case string:
+		n, _ := strconv.Atoi(v)
+		return n
+	}
+	return 0
+}
+
+// siteSettingFloat reads a numeric setting that may be fractional.
+// Caller must hold s.mu.
+func (s *Store) siteSettingFloat(name string) float64 {
+	ss, ok := s.SiteSettings[name]
+	if !ok {
+		return 0
+	}
+	switch v := ss.Value.(type) {
+	case int:
+		return float64(v)
+	case float64:
+		return v
+	case string:
+		f, _ := strconv.ParseFloat(v, 64)
+		return f
+	}
+	return 0
+}
+
+// siteSettingBool reads a boolean site setting, accepting "true" as well.
+// Caller must hold s.mu.
+func (s *Store) siteSettingBool(name string) bool {
+	if ss, ok := s.SiteSettings[name]; ok {
+		switch v := ss.Value.(type) {
+		case bool:
+			return v
+		case string:
+			return v == "true"
+		}
+	}
+	return false
+}
+
+// siteSettingString reads a string site setting.
+// Caller must hold s.mu.
+func (s *Store) siteSettingString(name string) string {
+	if ss, ok := s.SiteSettings[name]; ok {
+		if v, ok := ss.Value.(string); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// GetSiteSetting returns the current value of a setting, or nil if unset.
+func (s *Store) GetSiteSetting(name string) interface{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if ss, ok := s.SiteSettings[name]; ok {
+		return ss.Value
+	}
+	return nil
+}
+
 func (s *Store) UpdateSiteSetting(name string, value interface{}) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -1303,45 +1744,186 @@ func (s *Store) UpdateSiteSetting(name string, value interface{}) {
 
 // ---------- Post Action Operations ----------
 
-func (s *Store) CreatePostAction(postID, actionTypeID int) (*model.PostAction, error) {
+var (
+	// ErrAlreadyActed is returned when a user repeats an action on a post.
+	ErrAlreadyActed = errors.New("you already performed this action")
+	// ErrUndoWindowPassed is returned when an action is too old to undo.
+	ErrUndoWindowPassed = errors.New("you can no longer undo this action")
+)
+
+// CreatePostAction records userID acting on a post. A user may perform
+// each action type on a post only once.
+func (s *Store) CreatePostAction(postID, userID, actionTypeID int) (*model.PostAction, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if _, ok := s.Posts[postID]; !ok {
+	return s.createPostAction(postID, userID, actionTypeID)
+}
+
+// createPostAction is CreatePostAction for callers already holding s.mu.
+func (s *Store) createPostAction(postID, userID, actionTypeID int) (*model.PostAction, error) {
+	p, ok := s.Posts[postID]
+	if !ok {
 		return nil, fmt.Errorf("post not found")
 	}
+	if s.findPostAction(postID, userID, actionTypeID) != nil {
+		return nil, ErrAlreadyActed
+	}
+	var limits []actionLimit
+	if u := s.Users[userID]; u != nil {
+		limits = s.postActionLimits(u, actionTypeID)
+		if err := s.checkLimits(u, limits); err != nil {
+			return nil, err
+		}
+		defer s.recordLimits(u, limits)
+	}
 	pa := &model.PostAction{
-		ID: s.NextPostActionID, PostID: postID, PostActionTypeID: actionTypeID,
+		ID: s.NextPostActionID, PostID: postID, UserID: userID,
+		PostActionTypeID: actionTypeID, CreatedAt: time.Now().UTC(),
 	}
 	s.PostActions[pa.ID] = pa
 	s.NextPostActionID++
 
 	if actionTypeID == 2 { // like
-		s.Posts[postID].Score++
-		if t, ok := s.Topics[s.Posts[postID].TopicID]; ok {
+		p.Score++
+		if t, ok := s.Topics[p.TopicID]; ok {
 			t.LikeCount++
 		}
+		if u := s.Users[userID]; u != nil {
+			s.likeWebHook(p, u)
+			s.gamifyReaction(p, userID, false)
+			s.alertLiked(p, u)
+		}
 	}
+	s.refreshActionsSummary(p)
+	s.badgesOnPostAction(p, userID, actionTypeID)
 	return pa, nil
 }
 
-func (s *Store) DeletePostAction(id int) error {
+// DeletePostAction undoes userID's action on a post, which is only allowed
+// within post_undo_action_window_mins of performing it.
+func (s *Store) DeletePostAction(postID, userID, actionTypeID int) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if _, ok := s.PostActions[id]; !ok {
+	return s.deletePostAction(postID, userID, actionTypeID)
+}
+
+// deletePostAction is DeletePostAction for callers already holding s.mu.
+func (s *Store) deletePostAction(postID, userID, actionTypeID int) error {
+	pa := s.findPostAction(postID, userID, actionTypeID)
+	if pa == nil {
 		return fmt.Errorf("post action not found")
 	}
-	delete(s.PostActions, id)
+	window := time.Duration(s.siteSettingInt("post_undo_action_window_mins")) * time.Minute
+	if time.Since(pa.CreatedAt) > window {
+		return ErrUndoWindowPassed
+	}
+	delete(s.PostActions, pa.ID)
+
+	p := s.Posts[postID]
+	if p == nil {
+		return nil
+	}
+	if actionTypeID == 2 { // like
+		p.Score--
+		if t, ok := s.Topics[p.TopicID]; ok {
+			t.LikeCount--
+		}
+		if u := s.Users[userID]; u != nil {
+			s.unalertLiked(p, u)
+		}
+		s.gamifyReaction(p, userID, true)
+	}
+	s.refreshActionsSummary(p)
+	return nil
+}
+
+// PostActionUsers lists the users who performed an action on a post,
+// oldest first.
+func (s *Store) PostActionUsers(postID, actionTypeID int) []model.BasicUser {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var actions []*model.PostAction
+	for _, pa := range s.PostActions {
+		if pa.PostID == postID && pa.PostActionTypeID == actionTypeID {
+			actions = append(actions, pa)
+		}
+	}
+	sort.Slice(actions, func(i, j int) bool { return actions[i].ID < actions[j].ID })
+	users := make([]model.BasicUser, 0, len(actions))
+	for _, pa := range actions {
+		if u := s.Users[pa.UserID]; u != nil {
+			users = append(users, model.BasicUser{
+				ID: u.ID, Username: u.Username, Name: u.Name, AvatarTemplate: u.AvatarTemplate,
+			})
+		}
+	}
+	return users
+}
+
+// ActionsSummaryFor returns a post's actions_summary as seen by userID,
+// marking the actions they have taken and can still undo.
+func (s *Store) ActionsSummaryFor(postID, userID int) []model.ActionSummary {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p := s.Posts[postID]
+	if p == nil {
+		return nil
+	}
+	window := time.Duration(s.siteSettingInt("post_undo_action_window_mins")) * time.Minute
+	out := make([]model.ActionSummary, 0, len(p.ActionsSummary)+1)
+	for _, as := range p.ActionsSummary {
+		if pa := s.findPostAction(postID, userID, as.ID); pa != nil {
+			as.Acted = true
+			as.CanUndo = time.Since(pa.CreatedAt) <= window
+			as.CanAct = false
+		}
+		out = append(out, as)
+	}
+	return out
+}
+
+// findPostAction returns userID's action of the given type on a post.
+// Caller must hold s.mu.
+func (s *Store) findPostAction(postID, userID, actionTypeID int) *model.PostAction {
+	for _, pa := range s.PostActions {
+		if pa.PostID == postID && pa.UserID == userID && pa.PostActionTypeID == actionTypeID {
+			return pa
+		}
+	}
 	return nil
 }
 
+// refreshActionsSummary recounts the actions taken on p. The like entry is
+// always present so clients can offer the like button.
+// Caller must hold s.mu.
+func (s *Store) refreshActionsSummary(p *model.Post) {
+	counts := map[int]int{2: 0}
+	for _, pa := range s.PostActions {
+		if pa.PostID == p.ID {
+			counts[pa.PostActionTypeID]++
+		}
+	}
+	summary := make([]model.ActionSummary, 0, len(counts))
+	for id, n := range counts {
+		summary = append(summary, model.ActionSummary{ID: id, Count: n, CanAct: true})
+	}
+	sort.Slice(summary, func(i, j int) bool { return summary[i].ID < summary[j].ID })
+	p.ActionsSummary = summary
+}
+
 // ---------- Private Message Operations ----------
 
 func (s *Store) GetPrivateMessages(username string) []model.Topic {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	var result []model.Topic
+	u := s.UsersByName[strings.ToLower(username)]
 	for _, t := range s.Topics {
 		if t.Archetype == "private_message" {
+			if u != nil && slices.Contains(s.TopicAllowedUsers[t.ID], u.ID) {
+				result = append(result, *t)
+				continue
+			}
 			posts := s.PostsByTopic[t.ID]
 			for _, p := range posts {
 				if p.Username == username {
@@ -1379,6 +1961,7 @@ func (s *Store) SyncSSO(externalID, email, username, name string) (*model.User,
 		u.Email = email
 		u.Username = username
 		u.Name = name
+		s.userWebHook("user_updated", u)
 		return u, nil
 	}
 
@@ -1394,6 +1977,8 @@ func (s *Store) SyncSSO(externalID, email, username, name string) (*model.User,
 	s.UsersByEmail[email] = u
 	s.UsersByExtID[externalID] = u
 	s.NextUserID++
+	s.userWebHook("user_created", u)
+	s.gamifyUserCreated(u)
 	return u, nil
 }
 
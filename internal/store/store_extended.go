@@ -1,7 +1,10 @@
 package store
 
 import (
+	"errors"
 	"fmt"
+	"slices"
+	"sort"
 	"sync"
 	"time"
 )
@@ -72,6 +75,9 @@ type Webhook struct {
 	VerifyCert     bool      `json:"verify_certificate"`
 	Active         bool      `json:"active"`
 	EventTypes     []string  `json:"event_types"`
+	CategoryIDs    []int     `json:"category_ids"`
+	TagNames       []string  `json:"tag_names"`
+	GroupIDs       []int     `json:"group_ids"`
 	CreatedAt      time.Time `json:"created_at"`
 	UpdatedAt      time.Time `json:"updated_at"`
 }
@@ -79,16 +85,34 @@ type Webhook struct {
 type Reviewable struct {
 	ID             int       `json:"id"`
 	Type           string    `json:"type"`
-	Status         int       `json:"status"` // 0=pending, 1=approved, 2=rejected
+	Status         int       `json:"status"` // 0=pending, 1=approved, 2=rejected, 3=ignored
 	CreatedByID    int       `json:"created_by_id"`
 	TargetID       int       `json:"target_id,omitempty"`
 	TargetType     string    `json:"target_type,omitempty"`
+	TopicID        int       `json:"topic_id,omitempty"`
 	CategoryID     int       `json:"category_id,omitempty"`
 	Score          float64   `json:"score"`
+	Version        int       `json:"version"`
+	Scores         []ReviewableScore `json:"reviewable_scores"`
+	TargetCreatedByID int    `json:"target_created_by_id,omitempty"`
+	Payload        map[string]interface{} `json:"payload,omitempty"` // queued posts: what to create on approval
 	CreatedAt      time.Time `json:"created_at"`
 	UpdatedAt      time.Time `json:"updated_at"`
 }
 
+// ReviewableScore is one user's flag contributing to a Reviewable.
+type ReviewableScore struct {
+	ID                   int        `json:"id"`
+	UserID               int        `json:"user_id"`
+	ReviewableScoreType  int        `json:"reviewable_score_type"` // the flag's post action type
+	Score                float64    `json:"score"`
+	Status               int        `json:"status"` // 0=pending, 1=agreed, 2=disagreed, 3=ignored
+	Reason               string     `json:"reason,omitempty"`
+	ReviewedByID         *int       `json:"reviewed_by_id,omitempty"`
+	ReviewedAt           *time.Time `json:"reviewed_at,omitempty"`
+	CreatedAt            time.Time  `json:"created_at"`
+}
+
 type Theme struct {
 	ID             int       `json:"id"`
 	Name           string    `json:"name"`
@@ -299,8 +323,10 @@ type PostRevision struct {
 	CurrentRaw    string                 `json:"current_raw"`
 	PreviousCooked string               `json:"previous_cooked,omitempty"`
 	CurrentCooked string                 `json:"current_cooked"`
+	EditReason    string                 `json:"edit_reason,omitempty"`
+	Hidden        bool                   `json:"hidden"`
 	CreatedAt     time.Time              `json:"created_at"`
-	Modifications map[string]interface{} `json:"body_changes,omitempty"`
+	Modifications map[string]interface{} `json:"modifications,omitempty"` // field -> [previous, current]
 }
 
 type UserStatus struct {
@@ -325,6 +351,7 @@ type ExtStore struct {
 	mu sync.RWMutex
 
 	Polls             map[int]*Poll
+	pollVotes         map[pollKey]map[int][]string // user_id -> chosen option ids
 	APIKeyRecords     map[int]*APIKeyRecord
 	EmailLogs         map[int]*EmailLog
 	UserActions       map[int]*UserAction
@@ -352,6 +379,7 @@ type ExtStore struct {
 	PostRevisions     map[int]*PostRevision
 	PostRevisionsByPost map[int][]*PostRevision // post_id -> revisions
 	UserStatuses      map[int]*UserStatus // user_id -> current status
+	ReactionUsers     map[int]*ReactionUser
 
 	// ID counters
 	NextPollID           int
@@ -380,6 +408,7 @@ type ExtStore struct {
 	NextAdminFlagID      int
 	NextPostRevisionID   int
 	NextUserStatusID     int
+	NextReactionUserID   int
 }
 
 // NewExtStore creates a fully initialised ExtStore wrapping the given Store.
@@ -388,6 +417,7 @@ func NewExtStore(s *Store) *ExtStore {
 	es := &ExtStore{
 		Store:               s,
 		Polls:               make(map[int]*Poll),
+		pollVotes:           make(map[pollKey]map[int][]string),
 		APIKeyRecords:       make(map[int]*APIKeyRecord),
 		EmailLogs:           make(map[int]*EmailLog),
 		UserActions:         make(map[int]*UserAction),
@@ -415,6 +445,7 @@ func NewExtStore(s *Store) *ExtStore {
 		PostRevisions:       make(map[int]*PostRevision),
 		PostRevisionsByPost: make(map[int][]*PostRevision),
 		UserStatuses:        make(map[int]*UserStatus),
+		ReactionUsers:       make(map[int]*ReactionUser),
 
 		NextPollID:           1,
 		NextAPIKeyRecordID:   1,
@@ -442,6 +473,7 @@ func NewExtStore(s *Store) *ExtStore {
 		NextAdminFlagID:      1,
 		NextPostRevisionID:   1,
 		NextUserStatusID:     1,
+		NextReactionUserID:   1,
 	}
 	es.seedExtended()
 	return es
@@ -643,6 +675,75 @@ func (es *ExtStore) DeletePoll(id int) error {
 	return nil
 }
 
+// pollKey names a poll by its post and name, as the poll routes do.
+type pollKey struct {
+	postID int
+	name   string
+}
+
+// VotePoll records userID's vote for options in a post's poll, replacing
+// any earlier vote, and returns how many users have voted. The counts of
+// a poll created through CreatePoll follow the votes.
+func (es *ExtStore) VotePoll(postID int, name string, userID int, options []string) (int, error) {
+	es.Store.mu.Lock()
+	defer es.Store.mu.Unlock()
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if _, ok := es.Posts[postID]; !ok {
+		return 0, fmt.Errorf("post not found")
+	}
+	if len(options) == 0 {
+		return 0, fmt.Errorf("you must select at least one option")
+	}
+	key := pollKey{postID, name}
+	if es.pollVotes[key] == nil {
+		es.pollVotes[key] = make(map[int][]string)
+	}
+	_, voted := es.pollVotes[key][userID]
+	es.pollVotes[key][userID] = options
+	es.countPollVotes(key)
+	if !voted {
+		es.gamifyPollVote(postID, name, userID, false)
+	}
+	return len(es.pollVotes[key]), nil
+}
+
+// RemovePollVote takes back userID's vote in a post's poll.
+func (es *ExtStore) RemovePollVote(postID int, name string, userID int) (int, error) {
+	es.Store.mu.Lock()
+	defer es.Store.mu.Unlock()
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	key := pollKey{postID, name}
+	if _, ok := es.pollVotes[key][userID]; !ok {
+		return 0, fmt.Errorf("you have not voted in this poll")
+	}
+	delete(es.pollVotes[key], userID)
+	es.countPollVotes(key)
+	es.gamifyPollVote(postID, name, userID, true)
+	return len(es.pollVotes[key]), nil
+}
+
+// countPollVotes updates the counts of the Poll key names, if any.
+// Caller must hold es.mu.
+func (es *ExtStore) countPollVotes(key pollKey) {
+	for _, p := range es.Polls {
+		if p.PostID != key.postID || p.Name != key.name {
+			continue
+		}
+		p.Voters = len(es.pollVotes[key])
+		for i := range p.Options {
+			p.Options[i].Votes = 0
+			for _, chosen := range es.pollVotes[key] {
+				if slices.Contains(chosen, p.Options[i].ID) {
+					p.Options[i].Votes++
+				}
+			}
+		}
+		p.UpdatedAt = time.Now().UTC()
+	}
+}
+
 // ---------------------------------------------------------------------------
 // APIKeyRecord CRUD
 // ---------------------------------------------------------------------------
@@ -811,7 +912,8 @@ func (es *ExtStore) GetWebhook(id int) (*Webhook, error) {
 	if !ok {
 		return nil, fmt.Errorf("webhook not found")
 	}
-	return w, nil
+	cp := *w
+	return &cp, nil
 }
 
 func (es *ExtStore) ListWebhooks() []Webhook {
@@ -821,23 +923,34 @@ func (es *ExtStore) ListWebhooks() []Webhook {
 	for _, w := range es.Webhooks {
 		out = append(out, *w)
 	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
 	return out
 }
 
-func (es *ExtStore) CreateWebhook(payloadURL string, eventTypes []string) (*Webhook, error) {
+// CreateWebhook adds an active JSON web hook to payload_url, with the
+// attributes UpdateWebhook takes.
+func (es *ExtStore) CreateWebhook(attrs map[string]interface{}) (*Webhook, error) {
 	es.mu.Lock()
 	defer es.mu.Unlock()
 	now := time.Now().UTC()
 	w := &Webhook{
-		ID: es.NextWebhookID, PayloadURL: payloadURL, ContentType: 1,
-		WildcardWeb: false, VerifyCert: true, Active: true,
-		EventTypes: eventTypes, CreatedAt: now, UpdatedAt: now,
+		ID: es.NextWebhookID, ContentType: 1,
+		VerifyCert: true, Active: true, CreatedAt: now, UpdatedAt: now,
+	}
+	applyWebhookUpdates(w, attrs)
+	if !validPayloadURL(w.PayloadURL) {
+		return nil, ErrInvalidPayloadURL
 	}
 	es.Webhooks[w.ID] = w
 	es.NextWebhookID++
-	return w, nil
+	es.syncWebHooks()
+	cp := *w
+	return &cp, nil
 }
 
+// UpdateWebhook changes a web hook's payload_url, content_type, secret,
+// wildcard_web_hook, verify_certificate, active, event_types (names),
+// category_ids, tag_names and group_ids.
 func (es *ExtStore) UpdateWebhook(id int, updates map[string]interface{}) (*Webhook, error) {
 	es.mu.Lock()
 	defer es.mu.Unlock()
@@ -845,14 +958,16 @@ func (es *ExtStore) UpdateWebhook(id int, updates map[string]interface{}) (*Webh
 	if !ok {
 		return nil, fmt.Errorf("webhook not found")
 	}
-	if v, ok := updates["payload_url"].(string); ok {
-		w.PayloadURL = v
-	}
-	if v, ok := updates["active"].(bool); ok {
-		w.Active = v
+	updated := *w
+	applyWebhookUpdates(&updated, updates)
+	if !validPayloadURL(updated.PayloadURL) {
+		return nil, ErrInvalidPayloadURL
 	}
-	w.UpdatedAt = time.Now().UTC()
-	return w, nil
+	updated.UpdatedAt = time.Now().UTC()
+	*w = updated
+	es.syncWebHooks()
+	cp := *w
+	return &cp, nil
 }
 
 func (es *ExtStore) DeleteWebhook(id int) error {
@@ -862,6 +977,7 @@ func (es *ExtStore) DeleteWebhook(id int) error {
 		return fmt.Errorf("webhook not found")
 	}
 	delete(es.Webhooks, id)
+	es.syncWebHooks()
 	return nil
 }
 
@@ -1290,9 +1406,19 @@ func (es *ExtStore) ListBookmarks(userID int) []Bookmark {
 	return out
 }
 
+// ErrAlreadyBookmarked is returned for bookmarking something twice.
+var ErrAlreadyBookmarked = errors.New("You have already bookmarked this")
+
 func (es *ExtStore) CreateBookmark(userID, bookmarkableID int, bookmarkableType string) (*Bookmark, error) {
+	es.Store.mu.Lock()
+	defer es.Store.mu.Unlock()
 	es.mu.Lock()
 	defer es.mu.Unlock()
+	for _, b := range es.Bookmarks {
+		if b.UserID == userID && b.BookmarkableID == bookmarkableID && b.BookmarkableType == bookmarkableType {
+			return nil, ErrAlreadyBookmarked
+		}
+	}
 	now := time.Now().UTC()
 	b := &Bookmark{
 		ID: es.NextBookmarkID, UserID: userID,
@@ -1301,6 +1427,7 @@ func (es *ExtStore) CreateBookmark(userID, bookmarkableID int, bookmarkableType
 	}
 	es.Bookmarks[b.ID] = b
 	es.NextBookmarkID++
+	es.gamifyBookmark(b, false)
 	return b, nil
 }
 
@@ -1322,12 +1449,16 @@ func (es *ExtStore) UpdateBookmark(id int, updates map[string]interface{}) (*Boo
 }
 
 func (es *ExtStore) DeleteBookmark(id int) error {
+	es.Store.mu.Lock()
+	defer es.Store.mu.Unlock()
 	es.mu.Lock()
 	defer es.mu.Unlock()
-	if _, ok := es.Bookmarks[id]; !ok {
+	b, ok := es.Bookmarks[id]
+	if !ok {
 		return fmt.Errorf("bookmark not found")
 	}
 	delete(es.Bookmarks, id)
+	es.gamifyBookmark(b, true)
 	return nil
 }
 
@@ -1355,19 +1486,6 @@ func (es *ExtStore) ListWatchedWords() []WatchedWord {
 	return out
 }
 
-func (es *ExtStore) CreateWatchedWord(word string, action int) (*WatchedWord, error) {
-	es.mu.Lock()
-	defer es.mu.Unlock()
-	now := time.Now().UTC()
-	w := &WatchedWord{
-		ID: es.NextWatchedWordID, Word: word, Action: action,
-		CreatedAt: now, UpdatedAt: now,
-	}
-	es.WatchedWords[w.ID] = w
-	es.NextWatchedWordID++
-	return w, nil
-}
-
 func (es *ExtStore) UpdateWatchedWord(id int, updates map[string]interface{}) (*WatchedWord, error) {
 	es.mu.Lock()
 	defer es.mu.Unlock()
@@ -2097,7 +2215,7 @@ func (es *ExtStore) CreatePostRevision(postID, userID int, previousRaw, currentR
 	es.mu.Lock()
 	defer es.mu.Unlock()
 	existing := es.PostRevisionsByPost[postID]
-	number := len(existing) + 1
+	number := len(existing) + 2 // revision 1 is the original post
 	r := &PostRevision{
 		ID: es.NextPostRevisionID, PostID: postID, UserID: userID,
 		Number: number, PreviousRaw: previousRaw, CurrentRaw: currentRaw,
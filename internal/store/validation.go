@@ -0,0 +1,279 @@
+package store
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lightcap/dtu-discourse/internal/model"
+)
+
+// ValidationError carries the full messages for a post or topic Discourse
+// would refuse to save, in the order Discourse reports them.
+type ValidationError struct {
+	Messages []string
+}
+
+func (e *ValidationError) Error() string {
+	return strings.Join(e.Messages, "; ")
+}
+
+// Category permission types, as in Discourse's CategoryGroup.
+const (
+	PermissionFull       = 1
+	PermissionCreatePost = 2
+	PermissionReadOnly   = 3
+)
+
+var (
+	reMentionTag = regexp.MustCompile(`<(?:a|span)\b[^>]*class="mention"[^>]*>@([\w.-]+)<`)
+	reAnchorTag  = regexp.MustCompile(`<a\b[^>]*>`)
+	reImgTag     = regexp.MustCompile(`<img\b[^>]*>`)
+	reLongWord   = regexp.MustCompile(`\S{31,}`) // longer than TextSentinel's max_word_length
+	reAnyLetter  = regexp.MustCompile(`\pL`)
+)
+
+// validateNewTopic checks a new topic's title, category and first post.
+// Caller must hold s.mu.
+func (s *Store) validateNewTopic(u *model.User, title, raw string, categoryID int, archetype string) error {
+	pm := archetype == "private_message"
+	var msgs []string
+	msgs = append(msgs, s.titleErrors(title, pm)...)
+	if !pm && !isStaff(u) {
+		if c := s.Categories[categoryID]; c != nil && s.categoryPermission(c, u) != PermissionFull {
+			msgs = append(msgs, "You are not permitted to create topics in this category.")
+		}
+	}
+	msgs = append(msgs, s.rawErrors(u, raw, true, pm)...)
+	if len(msgs) > 0 {
+		return &ValidationError{Messages: msgs}
+	}
+	return nil
+}
+
+// validateNewPost checks a reply before it is added to t.
+// Caller must hold s.mu.
+func (s *Store) validateNewPost(u *model.User, t *model.Topic, raw string) error {
+	if msgs := s.rawErrors(u, raw, false, t.Archetype == "private_message"); len(msgs) > 0 {
+		return &ValidationError{Messages: msgs}
+	}
+	return nil
+}
+
+// titleErrors applies the title length settings and TextSentinel's
+// heuristics for titles that don't read like a sentence.
+// Caller must hold s.mu.
+func (s *Store) titleErrors(title string, pm bool) []string {
+	title = strings.TrimSpace(title)
+	min := s.siteSettingInt("min_topic_title_length")
+	if pm {
+		min = s.siteSettingInt("min_personal_message_title_length")
+	}
+	n := utf8.RuneCountInString(title)
+	if n < min {
+		return []string{fmt.Sprintf("Title is too short (minimum is %d characters)", min)}
+	}
+	if max := s.siteSettingInt("max_topic_title_length"); max > 0 && n > max {
+		return []string{fmt.Sprintf("Title is too long (maximum is %d characters)", max)}
+	}
+	// As in TextSentinel.title_sentinel, the entropy bar never exceeds
+	// what the minimum title length allows.
+	entropy := s.siteSettingInt("title_min_entropy")
+	if min := s.siteSettingInt("min_topic_title_length"); min <= entropy {
+		entropy = min - 1
+	}
+	if !s.seemsSentence(title, entropy) {
+		return []string{"Title seems unclear, is it a complete sentence?"}
+	}
+	return nil
+}
+
+// seemsSentence mirrors TextSentinel: enough distinct characters, at least
+// one letter, no absurdly long words and, unless allow_uppercase_posts is
+// on, not shouted in capitals.
+// Caller must hold s.mu.
+func (s *Store) seemsSentence(text string, minEntropy int) bool {
+	if textEntropy(text) < minEntropy {
+		return false
+	}
+	if !reAnyLetter.MatchString(text) || reLongWord.MatchString(text) {
+		return false
+	}
+	if !s.siteSettingBool("allow_uppercase_posts") && strings.ToUpper(text) == text && strings.ToLower(text) != text {
+		return false
+	}
+	return true
+}
+
+// textEntropy counts the distinct characters in text.
+func textEntropy(text string) int {
+	seen := map[rune]bool{}
+	for _, r := range text {
+		seen[r] = true
+	}
+	return len(seen)
+}
+
+// rawErrors applies the body validators: length, duplicates, mentions and
+// the new-user link and media limits.
+// Caller must hold s.mu.
+func (s *Store) rawErrors(u *model.User, raw string, firstPost, pm bool) []string {
+	stripped := strings.TrimSpace(raw)
+	n := utf8.RuneCountInString(stripped)
+	min := s.siteSettingInt("min_post_length")
+	switch {
+	case pm:
+		min = s.siteSettingInt("min_personal_message_post_length")
+	case firstPost:
+		min = s.siteSettingInt("min_first_post_length")
+	}
+	if n < min {
+		return []string{fmt.Sprintf("Body is too short (minimum is %d characters)", min)}
+	}
+	if max := s.siteSettingInt("max_post_length"); max > 0 && n > max {
+		return []string{fmt.Sprintf("Body is too long (maximum is %d characters)", max)}
+	}
+	if isStaff(u) {
+		return nil
+	}
+
+	var msgs []string
+	if s.recentlyPosted(u.ID, stripped) {
+		msgs = append(msgs, "Body is too similar to what you recently posted")
+	}
+	cooked := s.cook(raw)
+	newUser := u.TrustLevel == 0
+	mentions := distinctMentions(cooked)
+	if newUser {
+		if max := s.siteSettingInt("newuser_max_mentions_per_post"); mentions > max {
+			msgs = append(msgs, fmt.Sprintf("Sorry, new users can only mention %d users in a post.", max))
+		}
+	} else if max := s.siteSettingInt("max_mentions_per_post"); mentions > max {
+		msgs = append(msgs, fmt.Sprintf("Sorry, you can only mention %d users in a post.", max))
+	}
+	if newUser {
+		if max := s.siteSettingInt("newuser_max_links"); countLinks(cooked) > max {
+			if max == 1 {
+				msgs = append(msgs, "Sorry, new users can only put one link in a post.")
+			} else {
+				msgs = append(msgs, fmt.Sprintf("Sorry, new users can only put %d links in a post.", max))
+			}
+		}
+		if max := s.siteSettingInt("newuser_max_embedded_media"); countMedia(cooked) > max {
+			if max == 1 {
+				msgs = append(msgs, "Sorry, new users can only put one embedded media item in a post.")
+			} else {
+				msgs = append(msgs, fmt.Sprintf("Sorry, new users can only put %d embedded media items in a post.", max))
+			}
+		}
+	}
+	return msgs
+}
+
+// recentlyPosted reports whether userID posted the same body within
+// unique_posts_mins.
+// Caller must hold s.mu.
+func (s *Store) recentlyPosted(userID int, stripped string) bool {
+	window := time.Duration(s.siteSettingInt("unique_posts_mins")) * time.Minute
+	if window <= 0 {
+		return false
+	}
+	for _, p := range s.Posts {
+		if p.UserID == userID && time.Since(p.CreatedAt) < window && strings.TrimSpace(p.Raw) == stripped {
+			return true
+		}
+	}
+	return false
+}
+
+// categoryPermission returns u's best permission type in c. A category
+// without group permissions is open to everyone.
+// Caller must hold s.mu.
+func (s *Store) categoryPermission(c *model.Category, u *model.User) int {
+	if len(c.GroupPermissions) == 0 {
+		return PermissionFull
+	}
+	best := 0
+	for _, gp := range c.GroupPermissions {
+		if gp.GroupName != "everyone" && !s.inGroup(gp.GroupName, u.ID) {
+			continue
+		}
+		if best == 0 || gp.PermissionType < best {
+			best = gp.PermissionType
+		}
+	}
+	return best
+}
+
+// inGroup reports whether userID belongs to the named group.
+// Caller must hold s.mu.
+func (s *Store) inGroup(name string, userID int) bool {
+	for _, g := range s.Groups {
+		if g.Name != name {
+			continue
+		}
+		for _, id := range s.GroupMembers[g.ID] {
+			if id == userID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isStaff(u *model.User) bool {
+	return u.Admin || u.Moderator
+}
+
+func distinctMentions(cooked string) int {
+	seen := map[string]bool{}
+	for _, m := range reMentionTag.FindAllStringSubmatch(cooked, -1) {
+		seen[strings.ToLower(m[1])] = true
+	}
+	return len(seen)
+}
+
+// countLinks counts anchors other than mentions and hashtags.
+func countLinks(cooked string) int {
+	n := 0
+	for _, a := range reAnchorTag.FindAllString(cooked, -1) {
+		if !strings.Contains(a, `class="mention"`) && !strings.Contains(a, `class="hashtag`) {
+			n++
+		}
+	}
+	return n
+}
+
+// countMedia counts images other than emoji.
+func countMedia(cooked string) int {
+	n := 0
+	for _, img := range reImgTag.FindAllString(cooked, -1) {
+		if !strings.Contains(img, `class="emoji"`) {
+			n++
+		}
+	}
+	return n
+}
+
+// parseGroupPermissions reads Discourse's permissions parameter, a map of
+// group name to permission type.
+func parseGroupPermissions(v map[string]interface{}) []model.GroupPermission {
+	out := make([]model.GroupPermission, 0, len(v))
+	for name, raw := range v {
+		pt := 0
+		switch t := raw.(type) {
+		case float64:
+			pt = int(t)
+		case string:
+			fmt.Sscanf(t, "%d", &pt)
+		}
+		if pt >= PermissionFull && pt <= PermissionReadOnly {
+			out = append(out, model.GroupPermission{GroupName: name, PermissionType: pt})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].GroupName < out[j].GroupName })
+	return out
+}
@@ -0,0 +1,343 @@
+package store
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/lightcap/dtu-discourse/internal/model"
+)
+
+// Watched word actions, indexed as in WatchedWord.Action.
+const (
+	WatchedBlock = iota
+	WatchedCensor
+	WatchedRequireApproval
+	WatchedFlag
+	WatchedReplace
+	WatchedTag
+	WatchedSilence
+	WatchedLink
+)
+
+// WatchedWordActions names each action; the index is the action's id.
+var WatchedWordActions = []string{"block", "censor", "require_approval", "flag", "replace", "tag", "silence", "link"}
+
+// WatchedWordActionID resolves an action name such as "censor".
+func WatchedWordActionID(name string) (int, bool) {
+	for i, a := range WatchedWordActions {
+		if a == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// watchedMatcher is a compiled watched word. Unless the site uses regular
+// expressions, a match must not touch a word character on either side.
+type watchedMatcher struct {
+	word    *WatchedWord
+	re      *regexp.Regexp
+	bounded bool
+}
+
+// watchedMatchers compiles the words for one action, oldest first.
+// Words that don't compile as regular expressions are skipped.
+// Caller must hold es.Store.mu and es.mu.
+func (es *ExtStore) watchedMatchers(action int) []watchedMatcher {
+	regexMode := es.siteSettingBool("watched_words_regular_expressions")
+	var out []watchedMatcher
+	for _, w := range es.WatchedWords {
+		if w.Action != action || w.Word == "" {
+			continue
+		}
+		pattern := w.Word
+		if !regexMode {
+			parts := strings.Split(w.Word, "*")
+			for i, p := range parts {
+				parts[i] = regexp.QuoteMeta(p)
+			}
+			pattern = strings.Join(parts, `\S*`)
+		}
+		if !w.CaseSensitive {
+			pattern = "(?i)" + pattern
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			continue
+		}
+		out = append(out, watchedMatcher{word: w, re: re, bounded: !regexMode})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].word.ID < out[j].word.ID })
+	return out
+}
+
+// find returns the spans of text matched by m.
+func (m watchedMatcher) find(text string) [][]int {
+	var out [][]int
+	for _, loc := range m.re.FindAllStringIndex(text, -1) {
+		if loc[0] == loc[1] {
+			continue
+		}
+		if m.bounded {
+			before, _ := utf8.DecodeLastRuneInString(text[:loc[0]])
+			after, _ := utf8.DecodeRuneInString(text[loc[1]:])
+			if isWordRune(before) || isWordRune(after) {
+				continue
+			}
+		}
+		out = append(out, loc)
+	}
+	return out
+}
+
+// replace rewrites every match of m in text with fn(match).
+func (m watchedMatcher) replace(text string, fn func(string) string) string {
+	spans := m.find(text)
+	if len(spans) == 0 {
+		return text
+	}
+	var b strings.Builder
+	last := 0
+	for _, loc := range spans {
+		b.WriteString(text[last:loc[0]])
+		b.WriteString(fn(text[loc[0]:loc[1]]))
+		last = loc[1]
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
+
+func isWordRune(r rune) bool {
+	return r != utf8.RuneError && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_')
+}
+
+// watchedMatches returns the distinct text in text matched by words of
+// the given action, in the order the words were added.
+// Caller must hold es.Store.mu and es.mu.
+func (es *ExtStore) watchedMatches(action int, text string) []string {
+	var out []string
+	seen := map[string]bool{}
+	for _, m := range es.watchedMatchers(action) {
+		for _, loc := range m.find(text) {
+			if s := text[loc[0]:loc[1]]; !seen[strings.ToLower(s)] {
+				seen[strings.ToLower(s)] = true
+				out = append(out, s)
+			}
+		}
+	}
+	return out
+}
+
+// blockedError turns blocked matches into the validation error Discourse
+// shows, or nil when nothing was blocked.
+func blockedError(words []string) error {
+	switch len(words) {
+	case 0:
+		return nil
+	case 1:
+		return &ValidationError{Messages: []string{"Your post contains a word that's not allowed: " + words[0]}}
+	}
+	return &ValidationError{Messages: []string{"Your post contains multiple words that aren't allowed: " + strings.Join(words, ", ")}}
+}
+
+// checkBlocked rejects text containing blocked words.
+// Caller must hold es.Store.mu; es.mu is taken here.
+func (es *ExtStore) checkBlocked(text string) error {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+	return blockedError(es.watchedMatches(WatchedBlock, text))
+}
+
+// BlockedWords returns the blocked words found in text, for validating
+// usernames and other short strings outside posts.
+func (es *ExtStore) BlockedWords(text string) []string {
+	es.Store.mu.RLock()
+	defer es.Store.mu.RUnlock()
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+	return es.watchedMatches(WatchedBlock, text)
+}
+
+var reHTMLTag = regexp.MustCompile(`<[^>]*>`)
+
+// filterCooked applies replace, censor and link words to the text of
+// cooked HTML, leaving markup alone and never nesting links.
+// Caller must hold es.Store.mu and es.mu.
+func (es *ExtStore) filterCooked(cooked string) string {
+	replace := es.watchedMatchers(WatchedReplace)
+	censor := es.watchedMatchers(WatchedCensor)
+	link := es.watchedMatchers(WatchedLink)
+	if len(replace)+len(censor)+len(link) == 0 {
+		return cooked
+	}
+	filter := func(text string, inLink bool) string {
+		for _, m := range replace {
+			repl := html.EscapeString(replacementOf(m.word))
+			text = m.replace(text, func(string) string { return repl })
+		}
+		for _, m := range censor {
+			text = m.replace(text, censorText)
+		}
+		if !inLink {
+			for _, m := range link {
+				href := html.EscapeString(replacementOf(m.word))
+				text = m.replace(text, func(s string) string {
+					return `<a href="` + href + `" rel="noopener nofollow ugc">` + s + `</a>`
+				})
+			}
+		}
+		return text
+	}
+
+	var b strings.Builder
+	anchors, last := 0, 0
+	for _, loc := range reHTMLTag.FindAllStringIndex(cooked, -1) {
+		b.WriteString(filter(cooked[last:loc[0]], anchors > 0))
+		tag := cooked[loc[0]:loc[1]]
+		switch {
+		case strings.HasPrefix(tag, "<a ") || tag == "<a>":
+			anchors++
+		case tag == "</a>" && anchors > 0:
+			anchors--
+		}
+		b.WriteString(tag)
+		last = loc[1]
+	}
+	b.WriteString(filter(cooked[last:], anchors > 0))
+	return b.String()
+}
+
+// censorTitle applies censor words to a title's display form.
+// Caller must hold es.Store.mu and es.mu.
+func (es *ExtStore) censorTitle(t *model.Topic) {
+	t.FancyTitle = t.Title
+	for _, m := range es.watchedMatchers(WatchedCensor) {
+		t.FancyTitle = m.replace(t.FancyTitle, censorText)
+	}
+}
+
+// filterPost re-applies the cooked-text words to p, and to its topic's
+// title when p is the first post.
+// Caller must hold es.Store.mu; es.mu is taken here.
+func (es *ExtStore) filterPost(p *model.Post) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+	p.Cooked = es.filterCooked(p.Cooked)
+	if t := es.Topics[p.TopicID]; t != nil && p.PostNumber == 1 {
+		es.censorTitle(t)
+	}
+}
+
+func censorText(s string) string {
+	return strings.Repeat("■", utf8.RuneCountInString(s))
+}
+
+func replacementOf(w *WatchedWord) string {
+	if w.Replacement == nil {
+		return ""
+	}
+	return *w.Replacement
+}
+
+// CreateWatchedWord adds a watched word, or updates the existing entry
+// for the same word, as Discourse's create_or_update_word does.
+func (es *ExtStore) CreateWatchedWord(word string, action int, replacement string, caseSensitive bool) (*WatchedWord, error) {
+	word, err := validWatchedWord(word, action, replacement)
+	if err != nil {
+		return nil, err
+	}
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	cp := *es.putWatchedWord(word, action, replacement, caseSensitive)
+	return &cp, nil
+}
+
+// WatchedWordRow is one row of an uploaded watched word list.
+type WatchedWordRow struct {
+	Word          string
+	Replacement   string
+	CaseSensitive bool
+}
+
+// ImportWatchedWords adds or updates every row with the given action, or,
+// if any row is invalid, none of them; the error names the first bad row,
+// counting from 1.
+func (es *ExtStore) ImportWatchedWords(action int, rows []WatchedWordRow) error {
+	words := make([]string, len(rows))
+	for i, row := range rows {
+		word, err := validWatchedWord(row.Word, action, row.Replacement)
+		if err != nil {
+			return fmt.Errorf("Row %d: %v", i+1, err)
+		}
+		words[i] = word
+	}
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	for i, row := range rows {
+		es.putWatchedWord(words[i], action, row.Replacement, row.CaseSensitive)
+	}
+	return nil
+}
+
+// validWatchedWord checks a watched word before it is added, returning it
+// trimmed.
+func validWatchedWord(word string, action int, replacement string) (string, error) {
+	word = strings.TrimSpace(word)
+	if word == "" {
+		return "", fmt.Errorf("Word can't be blank")
+	}
+	if action < 0 || action >= len(WatchedWordActions) {
+		return "", fmt.Errorf("Action is invalid")
+	}
+	switch action {
+	case WatchedReplace, WatchedTag, WatchedLink:
+		if strings.TrimSpace(replacement) == "" {
+			return "", fmt.Errorf("Replacement can't be blank")
+		}
+	}
+	return word, nil
+}
+
+// putWatchedWord adds a valid watched word or updates the entry for it.
+// Caller must hold es.mu.
+func (es *ExtStore) putWatchedWord(word string, action int, replacement string, caseSensitive bool) *WatchedWord {
+	var w *WatchedWord
+	for _, existing := range es.WatchedWords {
+		if strings.EqualFold(existing.Word, word) {
+			w = existing
+			break
+		}
+	}
+	now := time.Now().UTC()
+	if w == nil {
+		w = &WatchedWord{ID: es.NextWatchedWordID, CreatedAt: now}
+		es.WatchedWords[w.ID] = w
+		es.NextWatchedWordID++
+	}
+	w.Word, w.Action, w.CaseSensitive, w.UpdatedAt = word, action, caseSensitive, now
+	w.Replacement = nil
+	if replacement != "" {
+		w.Replacement = &replacement
+	}
+	return w
+}
+
+// ClearWatchedWords removes every word with the given action.
+func (es *ExtStore) ClearWatchedWords(action int) int {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	n := 0
+	for id, w := range es.WatchedWords {
+		if w.Action == action {
+			delete(es.WatchedWords, id)
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,282 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/lightcap/dtu-discourse/internal/model"
+	"github.com/lightcap/dtu-discourse/internal/webhook"
+)
+
+// Like the message bus, s.Hooks is emitted to while s.mu is held, so web
+// hooks are told about changes in the order they were made. The emitter
+// takes no store locks. ExtStore hands it a copy of the admin web hooks
+// whenever they change.
+
+// emitWebHook tells the web hooks that want it about event name,
+// serializing payload only when some hook subscribes.
+// Caller must hold s.mu.
+func (s *Store) emitWebHook(name string, payload func() interface{}, ev webhook.Event) {
+	if !s.Hooks.Wants(name) {
+		return
+	}
+	data, err := json.Marshal(payload())
+	if err != nil {
+		log.Printf("[webhook] %s: %v", name, err)
+		return
+	}
+	ev.Name, ev.Payload = name, data
+	s.Hooks.Emit(ev)
+}
+
+// FlushWebhooks waits until the gamification events and admin web hook
+// events queued so far have been delivered, or ctx is done.
+func (s *Store) FlushWebhooks(ctx context.Context) error {
+	if err := s.Gamification.Flush(ctx); err != nil {
+		return err
+	}
+	return s.Hooks.Flush(ctx)
+}
+
+// WebhookMark is how far the gamification and web hook queues had got at
+// some point, so the events queued after it can be told apart.
+type WebhookMark struct {
+	gamification, hooks int
+}
+
+// MarkWebhooks notes how far the webhook queues have got.
+func (s *Store) MarkWebhooks() WebhookMark {
+	return WebhookMark{gamification: s.Gamification.NextID(), hooks: s.Hooks.NextID()}
+}
+
+// FlushWebhooksSince waits until the events queued since mark have been
+// delivered, or ctx is done.
+func (s *Store) FlushWebhooksSince(ctx context.Context, mark WebhookMark) error {
+	now := s.MarkWebhooks()
+	if err := s.Gamification.Wait(ctx, mark.gamification, now.gamification); err != nil {
+		return err
+	}
+	return s.Hooks.Wait(ctx, mark.hooks, now.hooks)
+}
+
+// userGroupIDs lists the groups userID belongs to.
+// Caller must hold s.mu.
+func (s *Store) userGroupIDs(userID int) []int {
+	var ids []int
+	for groupID, members := range s.GroupMembers {
+		for _, id := range members {
+			if id == userID {
+				ids = append(ids, groupID)
+				break
+			}
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// basicUser is u as a BasicUserSerializer, or nil.
+func basicUser(u *model.User) *model.BasicUser {
+	if u == nil {
+		return nil
+	}
+	return &model.BasicUser{ID: u.ID, Username: u.Username, Name: u.Name, AvatarTemplate: u.AvatarTemplate}
+}
+
+// topicHookPayload is a topic as WebHookTopicViewSerializer sends it.
+type topicHookPayload struct {
+	model.Topic
+	CreatedBy  *model.BasicUser `json:"created_by"`
+	LastPoster *model.BasicUser `json:"last_poster"`
+}
+
+// postHookPayload is a post as WebHookPostSerializer sends it.
+type postHookPayload struct {
+	model.Post
+	TopicPostsCount         int    `json:"topic_posts_count"`
+	TopicFilteredPostsCount int    `json:"topic_filtered_posts_count"`
+	TopicArchetype          string `json:"topic_archetype"`
+	CategorySlug            string `json:"category_slug"`
+}
+
+// topicWebHook emits a topic event about t.
+// Caller must hold s.mu.
+func (s *Store) topicWebHook(name string, t *model.Topic) {
+	var authorID int
+	if first := s.postByNumber(t.ID, 1); first != nil {
+		authorID = first.UserID
+	}
+	s.emitWebHook(name, func() interface{} {
+		payload := topicHookPayload{Topic: *t, CreatedBy: basicUser(s.Users[authorID])}
+		payload.PostStream, payload.Details = nil, nil
+		payload.LastPoster = basicUser(s.UsersByName[strings.ToLower(t.LastPosterUsername)])
+		return payload
+	}, webhook.Event{CategoryID: t.CategoryID, Tags: t.Tags, GroupIDs: s.userGroupIDs(authorID)})
+}
+
+// postPayload is p as web hooks are sent it.
+// Caller must hold s.mu.
+func (s *Store) postPayload(p *model.Post) postHookPayload {
+	payload := postHookPayload{Post: *p}
+	if t := s.Topics[p.TopicID]; t != nil {
+		payload.TopicTitle, payload.CategoryID = t.Title, t.CategoryID
+		payload.TopicPostsCount, payload.TopicFilteredPostsCount = t.PostsCount, t.PostsCount
+		payload.TopicArchetype = t.Archetype
+		if c := s.Categories[t.CategoryID]; c != nil {
+			payload.CategorySlug = c.Slug
+		}
+	}
+	return payload
+}
+
+// postEvent is the filter data of an event about p.
+// Caller must hold s.mu.
+func (s *Store) postEvent(p *model.Post, userID int) webhook.Event {
+	ev := webhook.Event{GroupIDs: s.userGroupIDs(userID)}
+	if t := s.Topics[p.TopicID]; t != nil {
+		ev.CategoryID, ev.Tags = t.CategoryID, t.Tags
+	}
+	return ev
+}
+
+// postWebHook emits a post event about p.
+// Caller must hold s.mu.
+func (s *Store) postWebHook(name string, p *model.Post) {
+	s.emitWebHook(name, func() interface{} { return s.postPayload(p) }, s.postEvent(p, p.UserID))
+}
+
+// likeWebHook emits post_liked for liker liking p.
+// Caller must hold s.mu.
+func (s *Store) likeWebHook(p *model.Post, liker *model.User) {
+	s.emitWebHook("post_liked", func() interface{} {
+		return map[string]interface{}{"post": s.postPayload(p), "user": basicUser(liker)}
+	}, s.postEvent(p, liker.ID))
+}
+
+// solvedWebHook emits accepted_solution or unaccepted_solution about p.
+// Caller must hold s.mu.
+func (s *Store) solvedWebHook(name string, p *model.Post) {
+	s.emitWebHook(name, func() interface{} { return s.postPayload(p) }, s.postEvent(p, p.UserID))
+}
+
+// userWebHook emits a user event about u.
+// Caller must hold s.mu.
+func (s *Store) userWebHook(name string, u *model.User) {
+	groupIDs := s.userGroupIDs(u.ID)
+	s.emitWebHook(name, func() interface{} {
+		cp := *u
+		cp.GroupIDs = groupIDs
+		return cp
+	}, webhook.Event{GroupIDs: groupIDs})
+}
+
+// groupWebHook emits a group event about g.
+// Caller must hold s.mu.
+func (s *Store) groupWebHook(name string, g *model.Group) {
+	s.emitWebHook(name, func() interface{} { return *g }, webhook.Event{GroupIDs: []int{g.ID}})
+}
+
+// categoryWebHook emits a category event about c.
+// Caller must hold s.mu.
+func (s *Store) categoryWebHook(name string, c *model.Category) {
+	s.emitWebHook(name, func() interface{} { return *c }, webhook.Event{CategoryID: c.ID})
+}
+
+// tagWebHook emits a tag event about tag.
+// Caller must hold s.mu.
+func (s *Store) tagWebHook(name string, tag *model.Tag) {
+	s.emitWebHook(name, func() interface{} { return *tag }, webhook.Event{Tags: []string{tag.TagName}})
+}
+
+// notificationWebHook emits notification_created about n.
+// Caller must hold s.mu.
+func (s *Store) notificationWebHook(n *model.Notification) {
+	s.emitWebHook("notification_created", func() interface{} { return *n }, webhook.Event{GroupIDs: s.userGroupIDs(n.UserID)})
+}
+
+// reviewableWebHook emits a reviewable event about r.
+// Caller must hold s.mu.
+func (s *Store) reviewableWebHook(name string, r *Reviewable) {
+	s.emitWebHook(name, func() interface{} { return *r }, webhook.Event{CategoryID: r.CategoryID})
+}
+
+// ensureTags creates the tags in names that don't exist yet, as tagging
+// a topic does in Discourse.
+// Caller must hold s.mu.
+func (s *Store) ensureTags(names []string) {
+	for _, name := range names {
+		if name == "" || s.Tags[name] != nil {
+			continue
+		}
+		s.NextTagID++
+		tag := &model.Tag{ID: s.NextTagID, TagName: name, Name: name, Count: 1}
+		s.Tags[name] = tag
+		s.tagWebHook("tag_created", tag)
+	}
+}
+
+// ErrInvalidPayloadURL is returned for a web hook without an http or
+// https payload URL.
+var ErrInvalidPayloadURL = errors.New("Payload URL is invalid")
+
+// applyWebhookUpdates copies the attributes present in updates onto w.
+func applyWebhookUpdates(w *Webhook, updates map[string]interface{}) {
+	if v, ok := updates["payload_url"].(string); ok {
+		w.PayloadURL = strings.TrimSpace(v)
+	}
+	if v, ok := updates["content_type"].(int); ok && (v == webhook.ContentTypeJSON || v == webhook.ContentTypeURLEncoded) {
+		w.ContentType = v
+	}
+	if v, ok := updates["secret"].(string); ok {
+		w.Secret = v
+	}
+	if v, ok := updates["wildcard_web_hook"].(bool); ok {
+		w.WildcardWeb = v
+	}
+	if v, ok := updates["verify_certificate"].(bool); ok {
+		w.VerifyCert = v
+	}
+	if v, ok := updates["active"].(bool); ok {
+		w.Active = v
+	}
+	if v, ok := updates["event_types"].([]string); ok {
+		w.EventTypes = v
+	}
+	if v, ok := updates["category_ids"].([]int); ok {
+		w.CategoryIDs = v
+	}
+	if v, ok := updates["tag_names"].([]string); ok {
+		w.TagNames = v
+	}
+	if v, ok := updates["group_ids"].([]int); ok {
+		w.GroupIDs = v
+	}
+}
+
+func validPayloadURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// syncWebHooks hands the emitter a copy of the admin web hooks.
+// Caller must hold es.mu.
+func (es *ExtStore) syncWebHooks() {
+	hooks := make([]webhook.Hook, 0, len(es.Webhooks))
+	for _, w := range es.Webhooks {
+		hooks = append(hooks, webhook.Hook{
+			ID: w.ID, PayloadURL: w.PayloadURL, ContentType: w.ContentType, Secret: w.Secret,
+			Wildcard: w.WildcardWeb, VerifyCertificate: w.VerifyCert, Active: w.Active,
+			EventTypes:  append([]string{}, w.EventTypes...),
+			CategoryIDs: append([]int{}, w.CategoryIDs...),
+			TagNames:    append([]string{}, w.TagNames...),
+			GroupIDs:    append([]int{}, w.GroupIDs...),
+		})
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].ID < hooks[j].ID })
+	es.Hooks.SetHooks(hooks)
+}
@@ -0,0 +1,196 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+)
+
+// EventType is an event admin web hooks can subscribe to, as in
+// Discourse's web_hook_event_types. Group is the kind of object the event
+// is about; it is sent as X-Discourse-Event-Type and keys the payload.
+type EventType struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Group string `json:"group"`
+}
+
+// EventTypes lists the event types the DTU emits, numbered as Discourse
+// numbers them.
+var EventTypes = []EventType{
+	{101, "topic_created", "topic"},
+	{102, "topic_revised", "topic"},
+	{103, "topic_edited", "topic"},
+	{104, "topic_destroyed", "topic"},
+	{105, "topic_recovered", "topic"},
+	{201, "post_created", "post"},
+	{202, "post_edited", "post"},
+	{203, "post_destroyed", "post"},
+	{204, "post_recovered", "post"},
+	{303, "user_confirmed_email", "user"},
+	{304, "user_created", "user"},
+	{306, "user_updated", "user"},
+	{307, "user_destroyed", "user"},
+	{308, "user_suspended", "user"},
+	{309, "user_unsuspended", "user"},
+	{401, "group_created", "group"},
+	{402, "group_updated", "group"},
+	{403, "group_destroyed", "group"},
+	{501, "category_created", "category"},
+	{502, "category_updated", "category"},
+	{503, "category_destroyed", "category"},
+	{601, "tag_created", "tag"},
+	{602, "tag_updated", "tag"},
+	{603, "tag_destroyed", "tag"},
+	{901, "reviewable_created", "reviewable"},
+	{902, "reviewable_updated", "reviewable"},
+	{1001, "notification_created", "notification"},
+	{1101, "accepted_solution", "solved"},
+	{1102, "unaccepted_solution", "solved"},
+	{1401, "post_liked", "like"},
+}
+
+// pingEvent is what a web hook is sent to check it works.
+var pingEvent = EventType{Name: "ping", Group: "ping"}
+
+// EventTypeByID returns the event type numbered id.
+func EventTypeByID(id int) (EventType, bool) {
+	for _, et := range EventTypes {
+		if et.ID == id {
+			return et, true
+		}
+	}
+	return EventType{}, false
+}
+
+// EventTypeNamed returns the event type called name.
+func EventTypeNamed(name string) (EventType, bool) {
+	for _, et := range EventTypes {
+		if et.Name == name {
+			return et, true
+		}
+	}
+	return EventType{}, false
+}
+
+// Content types a web hook can post its payload as.
+const (
+	ContentTypeJSON       = 1
+	ContentTypeURLEncoded = 2
+)
+
+// Hook is an admin web hook as the Emitter sees it.
+type Hook struct {
+	ID                int
+	PayloadURL        string
+	ContentType       int
+	Secret            string
+	Wildcard          bool
+	VerifyCertificate bool
+	Active            bool
+	// EventTypes are the names of the events the hook subscribes to,
+	// unless it is a wildcard hook.
+	EventTypes []string
+	// CategoryIDs, TagNames and GroupIDs, when set, limit the hook to
+	// events about those categories, tags and groups' members.
+	CategoryIDs []int
+	TagNames    []string
+	GroupIDs    []int
+}
+
+// Event is something that happened on the forum that web hooks may be
+// told about.
+type Event struct {
+	// Name is the event type's name, e.g. topic_created.
+	Name string
+	// Payload is the object the event is about, serialized as JSON.
+	Payload []byte
+	// CategoryID, Tags and GroupIDs are matched against the hooks'
+	// filters. An event without them only goes to hooks without the
+	// filter.
+	CategoryID int
+	Tags       []string
+	GroupIDs   []int
+}
+
+// subscribes reports whether h is told about events called name.
+func (h Hook) subscribes(name string) bool {
+	return h.Active && (h.Wildcard || slices.Contains(h.EventTypes, name))
+}
+
+// wants reports whether h is told about ev, as EmitWebHookEvent decides.
+func (h Hook) wants(ev Event) bool {
+	if !h.subscribes(ev.Name) {
+		return false
+	}
+	if len(h.CategoryIDs) > 0 && !slices.Contains(h.CategoryIDs, ev.CategoryID) {
+		return false
+	}
+	if len(h.TagNames) > 0 && !slices.ContainsFunc(ev.Tags, func(t string) bool { return slices.Contains(h.TagNames, t) }) {
+		return false
+	}
+	if len(h.GroupIDs) > 0 && !slices.ContainsFunc(ev.GroupIDs, func(g int) bool { return slices.Contains(h.GroupIDs, g) }) {
+		return false
+	}
+	return true
+}
+
+// Delivery is one event on its way to one hook.
+type Delivery struct {
+	// ID is the web hook event id, sent as X-Discourse-Event-Id.
+	ID                int
+	HookID            int
+	URL               string
+	ContentType       int
+	Secret            string
+	VerifyCertificate bool
+	Event             string
+	EventType         string
+	// Body is the JSON body: the payload keyed by the event type.
+	Body []byte
+	// Retry counts the failed deliveries of the event before this one.
+	Retry int
+}
+
+// Signature is the X-Discourse-Event-Signature of body signed with
+// secret.
+func Signature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// encoded is d's body as sent and its content type. A url-encoded hook
+// gets the JSON as the payload field.
+func (d Delivery) encoded() ([]byte, string) {
+	if d.ContentType == ContentTypeURLEncoded {
+		return []byte(url.Values{"payload": {string(d.Body)}}.Encode()), "application/x-www-form-urlencoded"
+	}
+	return d.Body, "application/json"
+}
+
+// Request builds the POST Discourse makes for d. The signature covers the
+// body as sent.
+func (d Delivery) Request(instance string) (*http.Request, error) {
+	body, contentType := d.encoded()
+	req, err := http.NewRequest("POST", d.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "*/*")
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "Discourse/3.2.0")
+	req.Header.Set("X-Discourse-Instance", instance)
+	req.Header.Set("X-Discourse-Event-Id", strconv.Itoa(d.ID))
+	req.Header.Set("X-Discourse-Event-Type", d.EventType)
+	req.Header.Set("X-Discourse-Event", d.Event)
+	if d.Secret != "" {
+		req.Header.Set("X-Discourse-Event-Signature", Signature(d.Secret, body))
+	}
+	return req, nil
+}
@@ -2,9 +2,14 @@ package webhook
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -15,53 +20,429 @@ type GamificationPayload struct {
 	DiscourseResourceID         interface{} `json:"discourseResourceId"`
 	CounterpartyDiscourseUserID *int        `json:"counterpartyDiscourseUserId,omitempty"`
 	OccurredAt                  string      `json:"occurredAt,omitempty"`
+	// EventID identifies the event, so a receiver can ignore repeats.
+	EventID string `json:"eventId,omitempty"`
+	// ReversesEventID, on an event that undoes another, is that event's
+	// EventID.
+	ReversesEventID string `json:"reversesEventId,omitempty"`
 }
 
-// Dispatcher sends webhook payloads to a configured URL.
+// Dispatcher defaults: how many payloads may wait, how many are posted at
+// once, and how failed posts are retried.
+const (
+	DefaultQueueSize      = 1000
+	DefaultWorkers        = 4
+	DefaultDispatchTries  = 5
+	DefaultDispatchDelay  = 500 * time.Millisecond
+	maxDispatchDelay      = 30 * time.Second
+	maxDeadLetters        = 1000
+	maxDispatched         = 1000
+	dispatchClientTimeout = 5 * time.Second
+)
+
+// DeadLetter is a payload the Dispatcher gave up on.
+type DeadLetter struct {
+	URL      string              `json:"url"`
+	Payload  GamificationPayload `json:"payload"`
+	Attempts int                 `json:"attempts"`
+	Error    string              `json:"error"`
+	FailedAt time.Time           `json:"failed_at"`
+}
+
+// States of a Dispatched payload.
+const (
+	DispatchQueued       = "queued"
+	DispatchRetrying     = "retrying"
+	DispatchDelivered    = "delivered"
+	DispatchDeadLettered = "dead_lettered"
+)
+
+// Dispatched is a payload on its way to one URL, and how that went.
+type Dispatched struct {
+	ID       int                 `json:"id"`
+	URL      string              `json:"url"`
+	Payload  GamificationPayload `json:"payload"`
+	State    string              `json:"state"`
+	Attempts int                 `json:"attempts"`
+	// Status is the last response's status code, or 0 if there was none.
+	Status     int        `json:"status,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	QueuedAt   time.Time  `json:"queued_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// Dispatcher sends gamification payloads to one or more URLs. Each URL
+// gets every payload, and a user's payloads reach it in the order they
+// were dispatched: a failing one is retried with exponential backoff
+// before the next is sent, and is dead-lettered once it runs out of
+// tries. At most QueueSize payloads wait at once; more are dead-lettered.
 type Dispatcher struct {
-	URL    string
+	URLs   []string
 	Secret string
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	lanes     map[lane][]*dispatchJob
+	queued    map[int]*dispatchJob
+	ready     []lane
+	waiting   map[lane]*time.Timer
+	pending   int
+	idle      chan struct{}
+	dead      []DeadLetter
+	sent      []*Dispatched
+	nextID    int
+	started   bool
+	closed    bool
+	queueSize int
+	workers   int
+	tries     int
+	delay     time.Duration
+
 	client *http.Client
 }
 
-// New creates a Dispatcher. If url is empty, Dispatch is a no-op.
+// lane is one user's payloads on their way to one URL.
+type lane struct {
+	url    string
+	userID int
+}
+
+type dispatchJob struct {
+	payload  GamificationPayload
+	body     []byte
+	attempts int
+	record   *Dispatched
+	done     chan struct{}
+}
+
+// New creates a Dispatcher posting to url, which may list several URLs
+// separated by commas. If url is empty, Dispatch is a no-op.
 func New(url, secret string) *Dispatcher {
-	return &Dispatcher{
-		URL:    url,
-		Secret: secret,
-		client: &http.Client{Timeout: 5 * time.Second},
+	d := &Dispatcher{
+		Secret:    secret,
+		lanes:     make(map[lane][]*dispatchJob),
+		queued:    make(map[int]*dispatchJob),
+		waiting:   make(map[lane]*time.Timer),
+		queueSize: DefaultQueueSize,
+		workers:   DefaultWorkers,
+		tries:     DefaultDispatchTries,
+		delay:     DefaultDispatchDelay,
+		nextID:    1,
+		client:    &http.Client{Timeout: dispatchClientTimeout},
 	}
+	d.cond = sync.NewCond(&d.mu)
+	for _, u := range strings.Split(url, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			d.URLs = append(d.URLs, u)
+		}
+	}
+	return d
 }
 
-// Dispatch sends the payload in a fire-and-forget goroutine.
+// SetRetryPolicy sets how many times a payload is tried before it is
+// dead-lettered and the wait before the first retry. Each later wait
+// doubles, up to 30s.
+func (d *Dispatcher) SetRetryPolicy(tries int, delay time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.tries, d.delay = tries, delay
+}
+
+// SetQueueSize sets how many payloads may wait to be delivered.
+func (d *Dispatcher) SetQueueSize(n int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.queueSize = n
+}
+
+// Dispatch queues the payload for every URL.
 func (d *Dispatcher) Dispatch(payload GamificationPayload) {
-	if d == nil || d.URL == "" {
+	if d == nil || len(d.URLs) == 0 {
 		return
 	}
 	if payload.OccurredAt == "" {
 		payload.OccurredAt = time.Now().UTC().Format(time.RFC3339)
 	}
-	go func() {
-		body, err := json.Marshal(payload)
-		if err != nil {
-			log.Printf("[webhook] marshal error: %v", err)
-			return
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("[webhook] marshal error: %v", err)
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		log.Printf("[webhook] %s dropped: dispatcher is shut down", payload.Action)
+		return
+	}
+	if !d.started {
+		d.started = true
+		for i := 0; i < d.workers; i++ {
+			go d.work()
+		}
+	}
+	for _, url := range d.URLs {
+		job := &dispatchJob{payload: payload, body: body, record: d.track(url, payload)}
+		if d.pending >= d.queueSize {
+			d.deadLetter(url, job, "queue full")
+			continue
+		}
+		l := lane{url, payload.DiscourseUserID}
+		job.done = make(chan struct{})
+		d.queued[job.record.ID] = job
+		d.lanes[l] = append(d.lanes[l], job)
+		if d.pending == 0 {
+			d.idle = make(chan struct{})
+		}
+		d.pending++
+		if len(d.lanes[l]) == 1 {
+			d.ready = append(d.ready, l)
+			d.cond.Signal()
+		}
+	}
+}
+
+func (d *Dispatcher) work() {
+	d.mu.Lock()
+	for {
+		for len(d.ready) == 0 {
+			d.cond.Wait()
+		}
+		l := d.ready[0]
+		d.ready = d.ready[1:]
+		job := d.lanes[l][0]
+		d.mu.Unlock()
+		status, err := d.post(l.url, job)
+		d.mu.Lock()
+		job.attempts++
+		job.record.Attempts, job.record.Status = job.attempts, status
+		if err == nil {
+			job.record.State, job.record.Error = DispatchDelivered, ""
+			job.record.FinishedAt = now()
+			d.finish(l)
+			continue
 		}
-		req, err := http.NewRequest("POST", d.URL, bytes.NewReader(body))
-		if err != nil {
-			log.Printf("[webhook] request error: %v", err)
-			return
+		var permanent permanentError
+		if errors.As(err, &permanent) || job.attempts >= d.tries {
+			d.deadLetter(l.url, job, err.Error())
+			d.finish(l)
+			continue
+		}
+		wait := d.delay << (job.attempts - 1)
+		if wait > maxDispatchDelay || wait <= 0 {
+			wait = maxDispatchDelay
+		}
+		if d.closed {
+			wait = 0
+		}
+		job.record.State, job.record.Error = DispatchRetrying, err.Error()
+		log.Printf("[webhook] %s to %s failed (%v), retrying in %s", job.payload.Action, l.url, err, wait)
+		d.waiting[l] = time.AfterFunc(wait, func() { d.wake(l) })
+	}
+}
+
+// wake makes l ready again after a retry's wait.
+func (d *Dispatcher) wake(l lane) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.waiting[l]; !ok {
+		return
+	}
+	delete(d.waiting, l)
+	d.ready = append(d.ready, l)
+	d.cond.Signal()
+}
+
+// finish drops the job at the head of l and moves on to the next.
+// Caller must hold d.mu.
+func (d *Dispatcher) finish(l lane) {
+	job := d.lanes[l][0]
+	close(job.done)
+	delete(d.queued, job.record.ID)
+	d.lanes[l] = d.lanes[l][1:]
+	if len(d.lanes[l]) == 0 {
+		delete(d.lanes, l)
+	} else {
+		d.ready = append(d.ready, l)
+		d.cond.Signal()
+	}
+	d.pending--
+	if d.pending == 0 {
+		close(d.idle)
+	}
+}
+
+// deadLetter records that job won't be delivered to url.
+// Caller must hold d.mu.
+func (d *Dispatcher) deadLetter(url string, job *dispatchJob, reason string) {
+	log.Printf("[webhook] %s to %s dead-lettered after %d attempts: %s", job.payload.Action, url, job.attempts, reason)
+	job.record.State, job.record.Error = DispatchDeadLettered, reason
+	job.record.FinishedAt = now()
+	d.dead = append(d.dead, DeadLetter{
+		URL: url, Payload: job.payload, Attempts: job.attempts, Error: reason, FailedAt: time.Now().UTC(),
+	})
+	if len(d.dead) > maxDeadLetters {
+		d.dead = d.dead[len(d.dead)-maxDeadLetters:]
+	}
+}
+
+// track starts recording payload's delivery to url.
+// Caller must hold d.mu.
+func (d *Dispatcher) track(url string, payload GamificationPayload) *Dispatched {
+	rec := &Dispatched{ID: d.nextID, URL: url, Payload: payload, State: DispatchQueued, QueuedAt: time.Now().UTC()}
+	d.nextID++
+	d.sent = append(d.sent, rec)
+	if len(d.sent) > maxDispatched {
+		d.sent = d.sent[len(d.sent)-maxDispatched:]
+	}
+	return rec
+}
+
+// Deliveries returns the latest payloads dispatched to each URL, oldest
+// first, with how their delivery went.
+func (d *Dispatcher) Deliveries() []Dispatched {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := make([]Dispatched, len(d.sent))
+	for i, rec := range d.sent {
+		out[i] = *rec
+	}
+	return out
+}
+
+// DeadLetters returns the payloads that could not be delivered, oldest
+// first.
+func (d *Dispatcher) DeadLetters() []DeadLetter {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]DeadLetter{}, d.dead...)
+}
+
+// Flush waits until every queued payload has been delivered or
+// dead-lettered, or ctx is done.
+func (d *Dispatcher) Flush(ctx context.Context) error {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	if d.pending == 0 {
+		d.mu.Unlock()
+		return nil
+	}
+	idle := d.idle
+	d.mu.Unlock()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// NextID is the id the next payload dispatched to a URL will get, so a
+// caller can later wait for just the payloads dispatched in between.
+func (d *Dispatcher) NextID() int {
+	if d == nil {
+		return 0
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.nextID
+}
+
+// Wait waits until the payloads with ids from from up to but not
+// including to have been delivered or dead-lettered, or ctx is done.
+func (d *Dispatcher) Wait(ctx context.Context, from, to int) error {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	var done []chan struct{}
+	for id := from; id < to; id++ {
+		if job := d.queued[id]; job != nil {
+			done = append(done, job.done)
 		}
-		req.Header.Set("Content-Type", "application/json")
-		if d.Secret != "" {
-			req.Header.Set("x-webhook-secret", d.Secret)
+	}
+	d.mu.Unlock()
+	return waitAll(ctx, done)
+}
+
+// waitAll waits until every channel in done is closed, or ctx is done.
+func waitAll(ctx context.Context, done []chan struct{}) error {
+	for _, ch := range done {
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
 		}
-		resp, err := d.client.Do(req)
-		if err != nil {
-			log.Printf("[webhook] dispatch error: %v", err)
-			return
+	}
+	return nil
+}
+
+// Close stops the Dispatcher taking payloads and flushes the queue,
+// retrying failures without waiting. It returns ctx's error if payloads
+// were still undelivered when ctx ended.
+func (d *Dispatcher) Close(ctx context.Context) error {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	d.closed = true
+	for l, t := range d.waiting {
+		if t.Stop() {
+			delete(d.waiting, l)
+			d.ready = append(d.ready, l)
+			d.cond.Signal()
 		}
-		resp.Body.Close()
-		log.Printf("[webhook] %s dispatched to %s — %d", payload.Action, d.URL, resp.StatusCode)
-	}()
+	}
+	d.mu.Unlock()
+	if err := d.Flush(ctx); err != nil {
+		d.mu.Lock()
+		log.Printf("[webhook] shut down with %d payloads undelivered", d.pending)
+		d.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// permanentError is a failure retrying won't change.
+type permanentError struct{ msg string }
+
+func (e permanentError) Error() string { return e.msg }
+
+func now() *time.Time {
+	t := time.Now().UTC()
+	return &t
+}
+
+// post sends job to url once, returning the response's status code. A
+// 4xx other than 408 or 429 is permanent.
+func (d *Dispatcher) post(url string, job *dispatchJob) (int, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(job.body))
+	if err != nil {
+		return 0, permanentError{err.Error()}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if d.Secret != "" {
+		req.Header.Set("x-webhook-secret", d.Secret)
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	log.Printf("[webhook] %s dispatched to %s — %d", job.payload.Action, url, resp.StatusCode)
+	switch code := resp.StatusCode; {
+	case code >= 200 && code < 300:
+		return code, nil
+	case code >= 400 && code < 500 && code != http.StatusRequestTimeout && code != http.StatusTooManyRequests:
+		return code, permanentError{fmt.Sprintf("status %d", code)}
+	default:
+		return code, fmt.Errorf("status %d", code)
+	}
 }
@@ -0,0 +1,477 @@
+package webhook
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Delivery statuses of a web hook, as its last_delivery_status.
+const (
+	StatusInactive   = 1
+	StatusFailed     = 2
+	StatusSuccessful = 3
+	StatusDisabled   = 4
+)
+
+// Default retry policy: like Discourse, a failed event is tried again up
+// to four times, each wait five times longer than the last.
+const (
+	DefaultRetries = 4
+	DefaultBackoff = time.Second
+)
+
+// maxResponseBody caps how much of a response an Attempt keeps, and
+// maxAttempts how many events are kept for each hook.
+const (
+	maxResponseBody = 64 << 10
+	maxAttempts     = 1000
+)
+
+// Attempt is a web hook event: one delivery to one hook and what came
+// back, as Discourse records it in web_hook_events.
+type Attempt struct {
+	ID     int
+	HookID int
+	Event  string
+	// RequestURL, Headers and Payload are the request as sent. Headers
+	// and ResponseHeaders are JSON objects.
+	RequestURL string
+	Headers    string
+	Payload    string
+	// Status is the response's status code, -1 if there was none, or 0
+	// while the attempt is pending.
+	Status          int
+	ResponseHeaders string
+	ResponseBody    string
+	// Duration is how long the request took, in milliseconds.
+	Duration     int
+	CreatedAt    time.Time
+	Redelivering bool
+
+	delivery Delivery
+}
+
+// Succeeded reports whether a got a 2xx response.
+func (a Attempt) Succeeded() bool {
+	return a.Status >= 200 && a.Status < 300
+}
+
+// Emitter delivers events to the admin web hooks that want them. Each
+// hook has its own goroutine, which posts its events in order holding no
+// lock, so a slow receiver only holds up its own hook. Every delivery is
+// kept as an Attempt; failed ones are retried with backoff.
+type Emitter struct {
+	// Instance is the forum's URL, sent as X-Discourse-Instance.
+	Instance string
+
+	mu       sync.Mutex
+	hooks    []Hook
+	pending  map[int][]Delivery
+	attempts map[int]*Attempt
+	byHook   map[int][]int
+	queued   map[int]chan struct{}
+	nextID   int
+	running  map[int]bool
+	busy     int
+	idle     chan struct{}
+	retries  int
+	backoff  time.Duration
+
+	client   *http.Client
+	insecure *http.Client
+}
+
+// NewEmitter creates an Emitter for the forum at instance with no hooks.
+func NewEmitter(instance string) *Emitter {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	return &Emitter{
+		Instance: instance,
+		attempts: make(map[int]*Attempt),
+		byHook:   make(map[int][]int),
+		pending:  make(map[int][]Delivery),
+		running:  make(map[int]bool),
+		queued:   make(map[int]chan struct{}),
+		nextID:   1,
+		retries:  DefaultRetries,
+		backoff:  DefaultBackoff,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		insecure: &http.Client{Timeout: 10 * time.Second, Transport: transport},
+	}
+}
+
+// SetRetryPolicy sets how many times a failed event is retried and the
+// wait before the first retry. Each later wait is five times longer.
+func (e *Emitter) SetRetryPolicy(retries int, backoff time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.retries, e.backoff = retries, backoff
+}
+
+// SetHooks replaces the hooks events are matched against and forgets the
+// events of hooks that are gone.
+func (e *Emitter) SetHooks(hooks []Hook) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.hooks = hooks
+	for hookID, ids := range e.byHook {
+		if _, ok := e.hook(hookID); ok {
+			continue
+		}
+		for _, id := range ids {
+			delete(e.attempts, id)
+		}
+		delete(e.byHook, hookID)
+	}
+}
+
+// hook returns the hook numbered id.
+// Caller must hold e.mu.
+func (e *Emitter) hook(id int) (Hook, bool) {
+	for _, h := range e.hooks {
+		if h.ID == id {
+			return h, true
+		}
+	}
+	return Hook{}, false
+}
+
+// Wants reports whether any hook subscribes to events called name, so
+// callers can skip building payloads nobody will be sent.
+func (e *Emitter) Wants(name string) bool {
+	if e == nil {
+		return false
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, h := range e.hooks {
+		if h.subscribes(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Emit queues ev for every hook that wants it.
+func (e *Emitter) Emit(ev Event) {
+	if e == nil {
+		return
+	}
+	et, ok := EventTypeNamed(ev.Name)
+	if !ok {
+		log.Printf("[webhook] unknown event %s", ev.Name)
+		return
+	}
+	body := []byte(fmt.Sprintf(`{%q:%s}`, et.Group, ev.Payload))
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, h := range e.hooks {
+		if h.wants(ev) {
+			e.enqueue(h, et, body)
+		}
+	}
+}
+
+// Ping sends hook id a ping event, whatever it subscribes to. It reports
+// false if there is no such hook.
+func (e *Emitter) Ping(id int) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	h, ok := e.hook(id)
+	if !ok {
+		return false
+	}
+	e.enqueue(h, pingEvent, []byte(`{"ping":"OK"}`))
+	return true
+}
+
+// enqueue records a new event of type et for h and queues it.
+// Caller must hold e.mu.
+func (e *Emitter) enqueue(h Hook, et EventType, body []byte) {
+	e.queue(Delivery{
+		HookID: h.ID, URL: h.PayloadURL, ContentType: h.ContentType,
+		Secret: h.Secret, VerifyCertificate: h.VerifyCertificate,
+		Event: et.Name, EventType: et.Group, Body: body,
+	})
+}
+
+// queue gives d a new event id, records it and hands it to its hook's
+// goroutine. Only
+// the latest maxAttempts events of each hook are kept.
+// Caller must hold e.mu.
+func (e *Emitter) queue(d Delivery) {
+	d.ID = e.nextID
+	e.nextID++
+	payload, _ := d.encoded()
+	e.attempts[d.ID] = &Attempt{
+		ID: d.ID, HookID: d.HookID, Event: d.Event, RequestURL: d.URL,
+		Payload: string(payload), CreatedAt: time.Now().UTC(), delivery: d,
+	}
+	ids := append(e.byHook[d.HookID], d.ID)
+	if len(ids) > maxAttempts {
+		for _, id := range ids[:len(ids)-maxAttempts] {
+			delete(e.attempts, id)
+		}
+		ids = append([]int(nil), ids[len(ids)-maxAttempts:]...)
+	}
+	e.byHook[d.HookID] = ids
+	e.queued[d.ID] = make(chan struct{})
+	e.push(d)
+}
+
+// push queues d behind its hook's other events, starting the hook's
+// goroutine if it isn't running.
+// Caller must hold e.mu.
+func (e *Emitter) push(d Delivery) {
+	e.pending[d.HookID] = append(e.pending[d.HookID], d)
+	if e.busy == 0 {
+		e.idle = make(chan struct{})
+	}
+	e.busy++
+	if !e.running[d.HookID] {
+		e.running[d.HookID] = true
+		go e.deliver(d.HookID)
+	}
+}
+
+// Redeliver sends hook hookID's event id again, keeping its id, and
+// records the new result over the old one.
+func (e *Emitter) Redeliver(hookID, id int) (Attempt, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	a := e.attempts[id]
+	if a == nil || a.HookID != hookID {
+		return Attempt{}, false
+	}
+	a.Redelivering = true
+	e.push(a.delivery)
+	return *a, true
+}
+
+// Attempts returns hook hookID's events, newest first.
+func (e *Emitter) Attempts(hookID int) []Attempt {
+	if e == nil {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ids := e.byHook[hookID]
+	out := make([]Attempt, 0, len(ids))
+	for i := len(ids) - 1; i >= 0; i-- {
+		out = append(out, *e.attempts[ids[i]])
+	}
+	return out
+}
+
+// LastStatus is hook hookID's last_delivery_status: how its most recent
+// finished event went, or StatusInactive if none has.
+func (e *Emitter) LastStatus(hookID int) int {
+	if e == nil {
+		return StatusInactive
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var last *Attempt
+	ids := e.byHook[hookID]
+	for i := len(ids) - 1; i >= 0 && last == nil; i-- {
+		if a := e.attempts[ids[i]]; a.Status != 0 {
+			last = a
+		}
+	}
+	switch {
+	case last == nil:
+		return StatusInactive
+	case last.Succeeded():
+		return StatusSuccessful
+	default:
+		return StatusFailed
+	}
+}
+
+// deliver sends hook hookID's queued events one at a time, returning
+// once there are none left.
+func (e *Emitter) deliver(hookID int) {
+	for {
+		e.mu.Lock()
+		queue := e.pending[hookID]
+		if len(queue) == 0 {
+			delete(e.pending, hookID)
+			delete(e.running, hookID)
+			e.mu.Unlock()
+			return
+		}
+		d := queue[0]
+		e.pending[hookID] = queue[1:]
+		instance := e.Instance
+		e.mu.Unlock()
+		e.record(d, e.send(d, instance))
+	}
+}
+
+// record stores the outcome of sending d. A failed delivery is retried
+// while it has retries left; a redelivery is not.
+func (e *Emitter) record(d Delivery, result Attempt) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	defer e.done()
+	if ch, ok := e.queued[d.ID]; ok {
+		close(ch)
+		delete(e.queued, d.ID)
+	}
+	a := e.attempts[d.ID]
+	if a == nil {
+		return
+	}
+	redelivered := a.Redelivering
+	a.Headers, a.Status, a.Duration = result.Headers, result.Status, result.Duration
+	a.ResponseHeaders, a.ResponseBody = result.ResponseHeaders, result.ResponseBody
+	a.Redelivering = false
+	if a.Succeeded() || redelivered || d.Retry >= e.retries {
+		return
+	}
+	wait := e.backoff
+	for i := 0; i < d.Retry; i++ {
+		wait *= 5
+	}
+	time.AfterFunc(wait, func() { e.retry(d) })
+}
+
+// done notes that a pushed delivery has been sent.
+// Caller must hold e.mu.
+func (e *Emitter) done() {
+	e.busy--
+	if e.busy == 0 {
+		close(e.idle)
+	}
+}
+
+// Flush waits until every queued event has been sent, or ctx is done.
+// Retries that are waiting out their backoff are not waited for.
+func (e *Emitter) Flush(ctx context.Context) error {
+	if e == nil {
+		return nil
+	}
+	e.mu.Lock()
+	if e.busy == 0 {
+		e.mu.Unlock()
+		return nil
+	}
+	idle := e.idle
+	e.mu.Unlock()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// NextID is the id the next event will get, so a caller can later wait
+// for just the events queued in between.
+func (e *Emitter) NextID() int {
+	if e == nil {
+		return 0
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.nextID
+}
+
+// Wait waits until the events with ids from from up to but not including
+// to have been sent once, or ctx is done. Like Flush, it doesn't wait for
+// their retries.
+func (e *Emitter) Wait(ctx context.Context, from, to int) error {
+	if e == nil {
+		return nil
+	}
+	e.mu.Lock()
+	var done []chan struct{}
+	for id := from; id < to; id++ {
+		if ch, ok := e.queued[id]; ok {
+			done = append(done, ch)
+		}
+	}
+	e.mu.Unlock()
+	return waitAll(ctx, done)
+}
+
+// Deliveries returns every hook's events, oldest first.
+func (e *Emitter) Deliveries() []Attempt {
+	if e == nil {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	out := make([]Attempt, 0, len(e.attempts))
+	for _, a := range e.attempts {
+		out = append(out, *a)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// retry queues d again as a new event, unless its hook has gone.
+func (e *Emitter) retry(d Delivery) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if h, ok := e.hook(d.HookID); !ok || !h.Active {
+		return
+	}
+	d.Retry++
+	e.queue(d)
+}
+
+// send posts d and returns what happened, logging the outcome.
+func (e *Emitter) send(d Delivery, instance string) Attempt {
+	var result Attempt
+	req, err := d.Request(instance)
+	if err != nil {
+		log.Printf("[webhook] %s for web hook %d: %v", d.Event, d.HookID, err)
+		result.Status, result.ResponseBody = -1, err.Error()
+		return result
+	}
+	result.Headers = headerJSON(req.Header)
+	client := e.client
+	if !d.VerifyCertificate {
+		client = e.insecure
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Duration = int(time.Since(start).Milliseconds())
+		log.Printf("[webhook] %s for web hook %d: %v", d.Event, d.HookID, err)
+		result.Status, result.ResponseBody = -1, err.Error()
+		return result
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseBody))
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	result.Duration = int(time.Since(start).Milliseconds())
+	result.Status, result.ResponseBody = resp.StatusCode, string(body)
+	result.ResponseHeaders = headerJSON(resp.Header)
+	log.Printf("[webhook] %s delivered to %s — %d", d.Event, d.URL, resp.StatusCode)
+	return result
+}
+
+// headerJSON is h as a JSON object, one value per header.
+func headerJSON(h http.Header) string {
+	flat := make(map[string]string, len(h))
+	for name, values := range h {
+		if len(values) > 0 {
+			flat[http.CanonicalHeaderKey(name)] = values[0]
+		}
+	}
+	data, _ := json.Marshal(flat)
+	return string(data)
+}